@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/Masterminds/semver/v3 v3.1.1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/aws/aws-sdk-go-v2 v1.16.2
 	github.com/aws/aws-sdk-go-v2/config v1.15.3
 	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.11.5
@@ -14,5 +15,6 @@ require (
 	github.com/ije/gox v0.6.1
 	github.com/ije/postdb v0.7.1
 	github.com/ije/rex v1.8.1
+	github.com/klauspost/compress v1.15.9
 	github.com/mssola/user_agent v0.5.3
 )
@@ -108,24 +108,22 @@ function verifyExports(names) {
 }
 
 exports.parseCjsExports = async input => {
-  const { buildDir, importPath, nodeEnv = 'production' } = input
+  const { buildDir, importPath, nodeEnv = 'production', requireMode = false } = input
   const entry = await resolve(buildDir, importPath)
   const exports = []
 
   /* workaround for edge cases that can't be parsed by cjsLexer correctly */
-  for (const name of requireModeAllowList) {
-    if (importPath === name || importPath.startsWith(name + '/')) {
-      process.env.NODE_ENV = nodeEnv
-      const mod = require(entry)
-      if (isObject(mod) || typeof mod === 'function') {
-        for (const key of Object.keys(mod)) {
-          if (typeof key === 'string' && key !== '') {
-            exports.push(key)
-          }
+  if (requireMode || requireModeAllowList.some(name => importPath === name || importPath.startsWith(name + '/'))) {
+    process.env.NODE_ENV = nodeEnv
+    const mod = require(entry)
+    if (isObject(mod) || typeof mod === 'function') {
+      for (const key of Object.keys(mod)) {
+        if (typeof key === 'string' && key !== '') {
+          exports.push(key)
         }
       }
-      return verifyExports(exports)
     }
+    return verifyExports(exports)
   }
 
   if (entry.endsWith('.json')) {
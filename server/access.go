@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// PackageAccess is loaded from the `[etc-dir]/access.json`, the rules are the package names or
+// the globs like `@internal/*` and `lodash.*`:
+//
+//	{
+//	  "allow": ["react", "react-dom", "@internal/*"],
+//	  "deny": ["@internal/secret"]
+//	}
+//
+// The denylist takes precedence over the allowlist, all packages are allowed if the allowlist is empty.
+type PackageAccess struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// the access rules of the packages, nil means all packages can be built
+var pkgAccess *PackageAccess
+
+func loadPackageAccess(filename string) (access *PackageAccess, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var a PackageAccess
+	err = json.Unmarshal(data, &a)
+	if err != nil {
+		return
+	}
+	for _, rule := range append(append([]string{}, a.Allow...), a.Deny...) {
+		if _, err = path.Match(rule, ""); err != nil {
+			err = fmt.Errorf("invalid access rule '%s': %v", rule, err)
+			return
+		}
+	}
+	access = &a
+	return
+}
+
+// Check checks the package name against the rules, returns the reason if the package is not allowed.
+func (access *PackageAccess) Check(name string) (ok bool, reason string) {
+	if access == nil {
+		return true, ""
+	}
+	if rule, matched := matchAccessRules(access.Deny, name); matched {
+		return false, fmt.Sprintf("package '%s' is denied by the rule '%s'", name, rule)
+	}
+	if len(access.Allow) > 0 {
+		if _, matched := matchAccessRules(access.Allow, name); !matched {
+			return false, fmt.Sprintf("package '%s' is not in the allowlist", name)
+		}
+	}
+	return true, ""
+}
+
+// the message prefix of the denied dependency errors of the resolver, see `toBuildError`
+const accessDeniedErrorPrefix = "Access denied: "
+
+// checkDependencyAccess checks the package of the bare import specifier against the rules, the
+// denied dependencies fail the build even if they are bundled.
+func checkDependencyAccess(specifier string) error {
+	if isLocalImport(specifier) || isRemoteImport(specifier) || builtInNodeModules[specifierPkgName(specifier)] {
+		return nil
+	}
+	if ok, reason := pkgAccess.Check(strings.ToLower(specifierPkgName(specifier))); !ok {
+		return errors.New(accessDeniedErrorPrefix + reason)
+	}
+	return nil
+}
+
+// pkgNameOf returns the package name of the path like `/@scope/name@1.0.0/submodule`
+func pkgNameOf(pathname string) string {
+	name, _, _ := splitPkgPath(strings.TrimSpace(pathname))
+	return strings.ToLower(name)
+}
+
+// matchAccessRules returns the first rule that matches the package name, `*` doesn't match the `/`
+// so the `*` rule doesn't match the scoped packages.
+func matchAccessRules(rules []string, name string) (rule string, matched bool) {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule, name); ok {
+			return rule, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestPackageAccess(t *testing.T) {
+	check := func(access *PackageAccess, cases map[string]bool) {
+		for name, expected := range cases {
+			if ok, reason := access.Check(name); ok != expected {
+				t.Fatalf("the package '%s' should be allowed=%v by %+v: %s", name, expected, access, reason)
+			}
+		}
+	}
+
+	// no rules
+	check(nil, map[string]bool{"react": true, "@internal/foo": true})
+
+	// allow-only
+	check(&PackageAccess{Allow: []string{"react", "react-dom", "@internal/*", "lodash.*"}}, map[string]bool{
+		"react":         true,
+		"react-dom":     true,
+		"@internal/foo": true,
+		"lodash.merge":  true,
+		"lodash":        false,
+		"preact":        false,
+		"@other/foo":    false,
+	})
+
+	// deny-only
+	check(&PackageAccess{Deny: []string{"evil", "@bad/*"}}, map[string]bool{
+		"react":    true,
+		"evil":     false,
+		"evil-ext": true,
+		"@bad/foo": false,
+		"@good/ok": true,
+	})
+
+	// the denylist takes precedence over the allowlist
+	check(&PackageAccess{Allow: []string{"@internal/*", "react"}, Deny: []string{"@internal/secret", "react"}}, map[string]bool{
+		"@internal/foo":    true,
+		"@internal/secret": false,
+		"react":            false,
+		"vue":              false,
+	})
+
+	// `*` doesn't match the scoped packages
+	check(&PackageAccess{Allow: []string{"*"}}, map[string]bool{"react": true, "@internal/foo": false})
+
+	_, reason := (&PackageAccess{Deny: []string{"@bad/*"}}).Check("@bad/foo")
+	if reason != "package '@bad/foo' is denied by the rule '@bad/*'" {
+		t.Fatalf("invalid reason: %s", reason)
+	}
+
+	for pathname, name := range map[string]string{
+		"/react@18.2.0":                 "react",
+		"/React/jsx-runtime":            "react",
+		"/@internal/foo@1.0.0/lib/x.js": "@internal/foo",
+		"/react-dom@18.2.0/es2022/x.js": "react-dom",
+	} {
+		if n := pkgNameOf(pathname); n != name {
+			t.Fatalf("the package name of '%s' should be '%s', got '%s'", pathname, name, n)
+		}
+	}
+}
+
+func TestLoadPackageAccess(t *testing.T) {
+	dir := t.TempDir()
+	access, err := loadPackageAccess(path.Join(dir, "access.json"))
+	if err != nil || access != nil {
+		t.Fatalf("the missing access.json should allow all packages: %v", err)
+	}
+
+	filename := path.Join(dir, "access.json")
+	ioutil.WriteFile(filename, []byte(`{"allow":["@internal/*"],"deny":["@internal/secret"]}`), 0644)
+	access, err = loadPackageAccess(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(access.Allow) != 1 || len(access.Deny) != 1 {
+		t.Fatalf("invalid access: %+v", access)
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"deny":["[bad"]}`), 0644)
+	if _, err = loadPackageAccess(filename); err == nil {
+		t.Fatal("the bad glob should be refused")
+	}
+}
+
+func TestDependencyAccess(t *testing.T) {
+	var err error
+	defer func(l *logx.Logger) { log = l }(log)
+	log = &logx.Logger{}
+	defer func(e EmbedFS) { embedFS = e }(embedFS)
+	embedFS = testEmbedFS{}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(f storage.FS) { fs = f }(fs)
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(a *PackageAccess) { pkgAccess = a }(pkgAccess)
+	pkgAccess = &PackageAccess{Deny: []string{"evil", "@bad/*"}}
+
+	// the denied dependency fails the bundle build
+	wd := t.TempDir()
+	writeFixture(t, wd, "app", map[string]string{
+		"package.json": `{"name":"app","version":"1.0.0","module":"index.js","types":"index.d.ts","dependencies":{"ok":"^1.0.0"}}`,
+		"index.d.ts":   `export declare const x: any;`,
+		"index.js":     `import ok from "ok"; export const x = ok;`,
+	})
+	writeFixture(t, wd, "ok", map[string]string{
+		"package.json": `{"name":"ok","version":"1.0.0","module":"index.js","dependencies":{"@bad/lib":"^1.0.0"}}`,
+		"index.js":     `import bad from "@bad/lib"; export default bad;`,
+	})
+	writeFixture(t, wd, "@bad/lib", map[string]string{
+		"package.json": `{"name":"@bad/lib","version":"1.0.0","module":"index.js"}`,
+		"index.js":     `export default "__BAD__"`,
+	})
+	task := &BuildTask{
+		wd:           wd,
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "app", Version: "1.0.0"},
+		Target:       "es2022",
+		BundleMode:   true,
+		External:     newStringSet(),
+		noStore:      true,
+	}
+	_, err = task.build(newStringSet())
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) || buildErr.Code != ErrPackageDenied || !strings.Contains(buildErr.Message, "@bad/lib") {
+		t.Fatalf("the denied dependency should fail the build: %v %s", err, task.output)
+	}
+
+	// the denied targets of the alias and the deps are refused
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+	for _, url := range []string{
+		"/foo@1.0.0?alias=react:evil",
+		"/foo@1.0.0?alias=react:@bad/react/compat",
+		"/foo@1.0.0?deps=evil@1.0.0",
+	} {
+		res, err := http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 403 {
+			t.Fatalf("%s: the denied target should be refused, got %d", url, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/ije/rex"
+)
+
+// isAdmin checks the admin token of the request that is passed by the
+// `Authorization: Bearer TOKEN` header, always returns false if the `-admin-token` is not set.
+func isAdmin(ctx *rex.Context) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(ctx.R.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// the slots of the builds that bypass the build cache by the `?cache=no-store|reload` query, the
+// builds are not in the build queue.
+var forcedBuildSlots = make(chan struct{}, 2)
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// A BuildAnalysis is the composition of a build for the `?analyze` query
+type BuildAnalysis struct {
+	Bytes        int                  `json:"bytes"`        // the size of the js output
+	Modules      []AnalysisModule     `json:"modules"`      // the input modules sorted by the size in output
+	Dependencies []AnalysisDependency `json:"dependencies"` // the rollups of the modules by package
+}
+
+type AnalysisModule struct {
+	Path  string `json:"path"`
+	Bytes int    `json:"bytes"`
+}
+
+type AnalysisDependency struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Bytes   int    `json:"bytes"`
+	Modules int    `json:"modules"`
+}
+
+// the metafile of esbuild, only the fields used by the analysis and the graph
+type esbuildMetafile struct {
+	Inputs map[string]struct {
+		Bytes   int `json:"bytes"`
+		Imports []struct {
+			Path string `json:"path"`
+		} `json:"imports"`
+	} `json:"inputs"`
+	Outputs map[string]struct {
+		Bytes  int `json:"bytes"`
+		Inputs map[string]struct {
+			BytesInOutput int `json:"bytesInOutput"`
+		} `json:"inputs"`
+	} `json:"outputs"`
+}
+
+// analyzeMetafile returns the analysis of the js output in the metafile, the module paths are
+// relative to the `node_modules` of the build dir like `react/index.js`.
+func analyzeMetafile(metafile string, wd string) (analysis *BuildAnalysis, err error) {
+	var meta esbuildMetafile
+	err = json.Unmarshal([]byte(metafile), &meta)
+	if err != nil {
+		return
+	}
+
+	analysis = &BuildAnalysis{Modules: []AnalysisModule{}, Dependencies: []AnalysisDependency{}}
+	deps := map[string]*AnalysisDependency{}
+	for name, output := range meta.Outputs {
+		if !strings.HasSuffix(name, ".js") {
+			continue
+		}
+		analysis.Bytes += output.Bytes
+		for input, v := range output.Inputs {
+			if v.BytesInOutput == 0 {
+				continue
+			}
+			modulePath, pkgName := analysisModulePath(input)
+			analysis.Modules = append(analysis.Modules, AnalysisModule{modulePath, v.BytesInOutput})
+			if pkgName == "" {
+				continue
+			}
+			dep, ok := deps[pkgName]
+			if !ok {
+				dep = &AnalysisDependency{Name: pkgName}
+				var p NpmPackage
+				if utils.ParseJSONFile(path.Join(wd, "node_modules", pkgName, "package.json"), &p) == nil {
+					dep.Version = p.Version
+				}
+				deps[pkgName] = dep
+			}
+			dep.Bytes += v.BytesInOutput
+			dep.Modules++
+		}
+	}
+
+	sort.Slice(analysis.Modules, func(i, j int) bool {
+		a, b := analysis.Modules[i], analysis.Modules[j]
+		return a.Bytes > b.Bytes || (a.Bytes == b.Bytes && a.Path < b.Path)
+	})
+	for _, dep := range deps {
+		analysis.Dependencies = append(analysis.Dependencies, *dep)
+	}
+	sort.Slice(analysis.Dependencies, func(i, j int) bool {
+		a, b := analysis.Dependencies[i], analysis.Dependencies[j]
+		return a.Bytes > b.Bytes || (a.Bytes == b.Bytes && a.Name < b.Name)
+	})
+	return
+}
+
+// analysisModulePath returns the module path and the package name of the metafile input like
+// `../../tmp/esm-build-xxx/node_modules/@babel/runtime/helpers/esm/extends.js`, the namespace of the
+// plugins(like `esm.sh-cjs:`) and the suffix(like `?cjs`) are stripped.
+func analysisModulePath(input string) (modulePath string, pkgName string) {
+	if i := strings.Index(input, ":"); i > 0 && !strings.HasPrefix(input, "/") {
+		input = input[i+1:]
+	}
+	if i := strings.IndexByte(input, '?'); i > 0 {
+		input = input[:i]
+	}
+	i := strings.LastIndex(input, "node_modules/")
+	if i < 0 {
+		return input, ""
+	}
+	modulePath = input[i+len("node_modules/"):]
+	a := strings.Split(modulePath, "/")
+	pkgName = a[0]
+	if strings.HasPrefix(pkgName, "@") && len(a) > 1 {
+		pkgName = a[0] + "/" + a[1]
+	}
+	return
+}
+
+// metafileGraph returns the import graph of the js output in the metafile as the Graphviz DOT format,
+// the nodes are the modules labeled with the bytes in output, the edges are the imports between them.
+func metafileGraph(metafile string) (dot []byte, err error) {
+	var meta esbuildMetafile
+	err = json.Unmarshal([]byte(metafile), &meta)
+	if err != nil {
+		return
+	}
+
+	bytesInOutput := map[string]int{}
+	for name, output := range meta.Outputs {
+		if !strings.HasSuffix(name, ".js") {
+			continue
+		}
+		for input, v := range output.Inputs {
+			if v.BytesInOutput > 0 {
+				bytesInOutput[input] += v.BytesInOutput
+			}
+		}
+	}
+	inputs := make([]string, 0, len(bytesInOutput))
+	for input := range bytesInOutput {
+		inputs = append(inputs, input)
+	}
+	sort.Strings(inputs)
+
+	buf := bytes.NewBufferString("digraph {\n\tnode [shape=box];\n")
+	for _, input := range inputs {
+		modulePath, _ := analysisModulePath(input)
+		fmt.Fprintf(buf, "\t%s [label=%s];\n", dotQuote(modulePath), dotQuote(fmt.Sprintf("%s\n%d B", modulePath, bytesInOutput[input])))
+	}
+	for _, input := range inputs {
+		from, _ := analysisModulePath(input)
+		edges := newStringSet()
+		for _, imp := range meta.Inputs[input].Imports {
+			if _, ok := bytesInOutput[imp.Path]; ok {
+				to, _ := analysisModulePath(imp.Path)
+				edges.Add(to)
+			}
+		}
+		imports := edges.Values()
+		sort.Strings(imports)
+		for _, to := range imports {
+			fmt.Fprintf(buf, "\t%s -> %s;\n", dotQuote(from), dotQuote(to))
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// dotQuote returns the double-quoted string of the DOT format
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// storeBuildAnalysis stores the analysis next to the build like `react.analyze.json`
+func storeBuildAnalysis(id string, analysis *BuildAnalysis) error {
+	return fs.WriteData(path.Join("builds", strings.TrimSuffix(id, ".js")+".analyze.json"), utils.MustEncodeJSON(analysis))
+}
+
+// storeBuildGraph stores the import graph next to the build like `react.graph.dot`
+func storeBuildGraph(id string, dot []byte) error {
+	return fs.WriteData(path.Join("builds", strings.TrimSuffix(id, ".js")+".graph.dot"), dot)
+}
+
+// readBuildAnalysis reads the stored analysis of the build, the `ok` is false if the build has no analysis
+func readBuildAnalysis(id string) (data []byte, ok bool, err error) {
+	return readBuildSidecar(id, ".analyze.json")
+}
+
+// readBuildGraph reads the stored import graph of the build, the `ok` is false if the build has no graph
+func readBuildGraph(id string) (data []byte, ok bool, err error) {
+	return readBuildSidecar(id, ".graph.dot")
+}
+
+// readBuildSidecar reads the file stored next to the build with the extname
+func readBuildSidecar(id string, ext string) (data []byte, ok bool, err error) {
+	savePath := path.Join("builds", strings.TrimSuffix(id, ".js")+ext)
+	exists, size, _, err := fs.Exists(savePath)
+	if err != nil || !exists {
+		return
+	}
+	r, err := fs.ReadFile(savePath, size)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	data, err = ioutil.ReadAll(r)
+	ok = err == nil
+	return
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+	logx "github.com/ije/gox/log"
+)
+
+func TestAnalyzeMetafile(t *testing.T) {
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","module":"index.js"}`,
+		"index.js":     `import { bar } from "@scope/bar"; import baz from "baz"; export default () => bar + baz;`,
+	})
+	writeFixture(t, wd, "@scope/bar", map[string]string{
+		"package.json": `{"name":"@scope/bar","version":"2.0.0","module":"index.js"}`,
+		"index.js":     `export { bar } from "./lib/bar.js";`,
+		"lib/bar.js":   `export const bar = "` + strings.Repeat("bar", 100) + `";`,
+	})
+	writeFixture(t, wd, "baz", map[string]string{
+		"package.json": `{"name":"baz","version":"3.0.0","main":"index.js"}`,
+		"index.js":     `module.exports = "baz";`,
+	})
+
+	result := api.Build(api.BuildOptions{
+		EntryPoints: []string{path.Join(wd, "node_modules/foo/index.js")},
+		Outdir:      "/esbuild",
+		Bundle:      true,
+		Format:      api.FormatESModule,
+		Write:       false,
+		Metafile:    true,
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors[0].Text)
+	}
+	analysis, err := analyzeMetafile(result.Metafile, wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if analysis.Bytes != len(result.OutputFiles[0].Contents) {
+		t.Fatalf("the bytes should be the size of the output, got %d", analysis.Bytes)
+	}
+	if len(analysis.Modules) != 3 || analysis.Modules[0].Path != "@scope/bar/lib/bar.js" {
+		t.Fatalf("unexpected modules %v", analysis.Modules)
+	}
+	for i := 1; i < len(analysis.Modules); i++ {
+		if analysis.Modules[i].Bytes > analysis.Modules[i-1].Bytes {
+			t.Fatalf("the modules should be sorted by size descending: %v", analysis.Modules)
+		}
+	}
+	if len(analysis.Dependencies) != 3 {
+		t.Fatalf("unexpected dependencies %v", analysis.Dependencies)
+	}
+	for _, dep := range analysis.Dependencies {
+		expected := map[string]string{"foo": "1.0.0", "@scope/bar": "2.0.0", "baz": "3.0.0"}[dep.Name]
+		if dep.Version != expected || dep.Modules != 1 || dep.Bytes == 0 {
+			t.Fatalf("unexpected dependency %v", dep)
+		}
+	}
+}
+
+func TestAnalysisModulePath(t *testing.T) {
+	for input, expected := range map[string][2]string{
+		"../../tmp/esm-build-1/node_modules/react/index.js":                    {"react/index.js", "react"},
+		"../../tmp/esm-build-1/node_modules/@babel/runtime/helpers/extends.js": {"@babel/runtime/helpers/extends.js", "@babel/runtime"},
+		"esm.sh-cjs:/tmp/esm-build-1/node_modules/foo/index.mjs?cjs":           {"foo/index.mjs", "foo"},
+		"/tmp/esm-build-1/node_modules/foo/node_modules/bar/index.js":          {"bar/index.js", "bar"},
+		"<stdin>": {"<stdin>", ""},
+	} {
+		modulePath, pkgName := analysisModulePath(input)
+		if modulePath != expected[0] || pkgName != expected[1] {
+			t.Fatalf("analysisModulePath(%s) should be (%s, %s), got (%s, %s)", input, expected[0], expected[1], modulePath, pkgName)
+		}
+	}
+}
+
+func TestStoreBuildAnalysis(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := "v87/foo@1.0.0/es2022/foo.js"
+	if _, ok, err := readBuildAnalysis(id); ok || err != nil {
+		t.Fatalf("the analysis should not exist, got %v %v", ok, err)
+	}
+	err = storeBuildAnalysis(id, &BuildAnalysis{Bytes: 10, Modules: []AnalysisModule{{"foo/index.js", 10}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok, err := readBuildAnalysis(id)
+	if err != nil || !ok {
+		t.Fatalf("the analysis should be stored, got %v %v", ok, err)
+	}
+	var analysis BuildAnalysis
+	if json.Unmarshal(data, &analysis) != nil || analysis.Bytes != 10 || analysis.Modules[0].Path != "foo/index.js" {
+		t.Fatalf("unexpected analysis %s", data)
+	}
+	if exists, _, _, _ := fs.Exists("builds/v87/foo@1.0.0/es2022/foo.analyze.json"); !exists {
+		t.Fatal("the analysis should be stored next to the build")
+	}
+}
+
+func TestMetafileGraph(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","module":"index.js"}`,
+		"index.js":     `import { bar } from "./bar.js"; import { baz } from "baz"; export default bar + baz;`,
+		"bar.js":       `import { baz } from "baz"; export const bar = "bar" + baz;`,
+	})
+	writeFixture(t, wd, "baz", map[string]string{
+		"package.json": `{"name":"baz","version":"1.0.0","module":"index.js"}`,
+		"index.js":     `export const baz = "baz";`,
+	})
+
+	result := api.Build(api.BuildOptions{
+		EntryPoints: []string{path.Join(wd, "node_modules/foo/index.js")},
+		Outdir:      "/esbuild",
+		Bundle:      true,
+		Format:      api.FormatESModule,
+		Write:       false,
+		Metafile:    true,
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors[0].Text)
+	}
+	dot, err := metafileGraph(result.Metafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph := string(dot)
+	if !strings.HasPrefix(graph, "digraph {\n") || !strings.HasSuffix(graph, "}\n") {
+		t.Fatalf("invalid graph: %s", graph)
+	}
+	for _, s := range []string{
+		`"foo/index.js" [label="foo/index.js\n`,
+		`"baz/index.js" [label="baz/index.js\n`,
+		`"foo/index.js" -> "foo/bar.js";`,
+		`"foo/index.js" -> "baz/index.js";`,
+		`"foo/bar.js" -> "baz/index.js";`,
+	} {
+		if !strings.Contains(graph, s) {
+			t.Fatalf("'%s' not found in the graph: %s", s, graph)
+		}
+	}
+	if strings.Count(graph, " -> ") != 3 || strings.Count(graph, "[label=") != 3 {
+		t.Fatalf("unexpected nodes or edges in the graph: %s", graph)
+	}
+
+	// the graph is stored next to the build
+	id := "v87/foo@1.0.0/es2022/foo.js"
+	if _, ok, _ := readBuildGraph(id); ok {
+		t.Fatal("the graph should not exist")
+	}
+	if err = storeBuildGraph(id, dot); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok, err := readBuildGraph(id); err != nil || !ok || string(data) != graph {
+		t.Fatalf("the graph should be stored, got %v %v", ok, err)
+	}
+	if exists, _, _, _ := fs.Exists("builds/v87/foo@1.0.0/es2022/foo.graph.dot"); !exists {
+		t.Fatal("the graph should be stored next to the build")
+	}
+
+	if dotQuote(`a"b\c`) != `"a\"b\\c"` {
+		t.Fatalf("invalid quoted string: %s", dotQuote(`a"b\c`))
+	}
+}
+
+func TestBuildMetafile(t *testing.T) {
+	var err error
+	defer func(l *logx.Logger) { log = l }(log)
+	log = &logx.Logger{}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(f storage.FS) { fs = f }(fs)
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "meta", map[string]string{
+		"package.json": `{"name":"meta","version":"1.0.0","module":"index.js","types":"index.d.ts"}`,
+		"index.d.ts":   `export declare const foo: string;`,
+		"index.js":     `export { foo } from "./foo.js";`,
+		"foo.js":       `export const foo = "foo";`,
+	})
+
+	build := func(metafile bool) string {
+		task := &BuildTask{
+			wd:           wd,
+			BuildVersion: VERSION,
+			Pkg:          Pkg{Name: "meta", Version: "1.0.0"},
+			Target:       "es2022",
+			External:     newStringSet(),
+			noCache:      true,
+			metafile:     metafile,
+		}
+		if _, err := task.build(newStringSet()); err != nil {
+			t.Fatal(err)
+		}
+		return task.ID()
+	}
+
+	// the metafile outputs are generated for the `?analyze` and `?output=graph` rebuilds only
+	id := build(false)
+	for _, read := range []func(id string) ([]byte, bool, error){readBuildAnalysis, readBuildGraph} {
+		if _, ok, err := read(id); ok || err != nil {
+			t.Fatalf("the build should not have the metafile outputs, got %v %v", ok, err)
+		}
+	}
+	id = build(true)
+	for _, read := range []func(id string) ([]byte, bool, error){readBuildAnalysis, readBuildGraph} {
+		if _, ok, err := read(id); !ok || err != nil {
+			t.Fatalf("the metafile outputs should be stored, got %v %v", ok, err)
+		}
+	}
+}
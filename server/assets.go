@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/gox/utils"
+)
+
+// the asset references like `new URL("./asset.png", import.meta.url)`
+var regexpImportMetaAsset = regexp.MustCompile(`new\s+URL\(\s*(['"])(\.{1,2}/[^'"\n]+)['"]\s*,\s*import\.meta\.url\s*\)`)
+
+// the modes of the `?assets` query: `rewrite`(default) rewrites the asset references to the raw file
+// URLs, `strip` replaces them with an empty data URL, and `keep` keeps them as they are.
+var assetsModes = map[string]bool{
+	"rewrite": true,
+	"strip":   true,
+	"keep":    true,
+}
+
+// the asset types that are served by the raw passthrough
+var rawAssetExts = map[string]bool{
+	".json":    true,
+	".css":     true,
+	".pcss":    true,
+	".postcss": true,
+	".less":    true,
+	".sass":    true,
+	".scss":    true,
+	".stylus":  true,
+	".styl":    true,
+	".wasm":    true,
+	".xml":     true,
+	".yaml":    true,
+	".md":      true,
+	".svg":     true,
+	".png":     true,
+	".jpg":     true,
+	".webp":    true,
+	".gif":     true,
+	".eot":     true,
+	".ttf":     true,
+	".otf":     true,
+	".woff":    true,
+	".woff2":   true,
+}
+
+// assetsPlugin rewrites the `import.meta.url` asset references of the package files,
+// the unsupported asset types are kept and added to the warnings.
+func (task *BuildTask) assetsPlugin(warnings *stringSet) api.Plugin {
+	return api.Plugin{
+		Name: "esm.sh-assets",
+		Setup: func(build api.PluginBuild) {
+			build.OnLoad(
+				api.OnLoadOptions{Filter: `\.(js|mjs|jsx)$`},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					data, err := ioutil.ReadFile(args.Path)
+					if err != nil || !strings.Contains(string(data), "import.meta.url") {
+						return api.OnLoadResult{}, nil
+					}
+					code := task.rewriteAssetURLs(string(data), args.Path, warnings)
+					loader := api.LoaderJS
+					if strings.HasSuffix(args.Path, ".jsx") {
+						loader = api.LoaderJSX
+					}
+					resolveDir := path.Dir(args.Path)
+					return api.OnLoadResult{Contents: &code, Loader: loader, ResolveDir: resolveDir}, nil
+				},
+			)
+		},
+	}
+}
+
+// rewriteAssetURLs rewrites the asset references of the importer(an absolute path in the `node_modules`)
+func (task *BuildTask) rewriteAssetURLs(code string, importer string, warnings *stringSet) string {
+	return regexpImportMetaAsset.ReplaceAllStringFunc(code, func(ref string) string {
+		m := regexpImportMetaAsset.FindStringSubmatch(ref)
+		assetPath := path.Join(path.Dir(importer), m[2])
+		if !fileExists(assetPath) {
+			warnings.Add(fmt.Sprintf("asset '%s' not found", m[2]))
+			return ref
+		}
+		if !rawAssetExts[path.Ext(assetPath)] {
+			warnings.Add(fmt.Sprintf("unsupported asset type '%s'", m[2]))
+			return ref
+		}
+		if task.Assets == "strip" {
+			return `new URL("data:,")`
+		}
+		pkg, ok := findAssetPackage(path.Join(task.wd, "node_modules"), assetPath)
+		if !ok {
+			warnings.Add(fmt.Sprintf("asset '%s' is out of the packages", m[2]))
+			return ref
+		}
+		if err := storeRawAsset(pkg, assetPath); err != nil {
+			log.Warnf("store asset %s: %v", pkg, err)
+		}
+		return fmt.Sprintf(`new URL("%s%s/%s?raw")`, task.CdnOrigin, basePath, pkg)
+	})
+}
+
+// findAssetPackage returns the package of the asset file with the subpath, like `foo@1.0.0/assets/logo.png`
+func findAssetPackage(nodeModulesDir string, assetPath string) (pkg Pkg, ok bool) {
+	if !strings.HasPrefix(assetPath, nodeModulesDir+"/") {
+		return
+	}
+	for dir := path.Dir(assetPath); strings.HasPrefix(dir, nodeModulesDir+"/"); dir = path.Dir(dir) {
+		var p NpmPackage
+		if utils.ParseJSONFile(path.Join(dir, "package.json"), &p) == nil && p.Name != "" && p.Version != "" {
+			if strings.HasSuffix(dir, "/node_modules/"+p.Name) {
+				return Pkg{Name: p.Name, Version: p.Version, Submodule: strings.TrimPrefix(assetPath, dir+"/")}, true
+			}
+		}
+	}
+	return
+}
+
+// storeRawAsset stores the asset file in the `raw` storage, so it's available without fetching from unpkg.com
+func storeRawAsset(pkg Pkg, assetPath string) error {
+	savePath := path.Join("raw", pkg.String())
+	exists, _, _, err := fs.Exists(savePath)
+	if err != nil || exists {
+		return err
+	}
+	f, err := os.Open(assetPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fs.WriteFile(savePath, f)
+	return err
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestRewriteAssetURLs(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json":       `{"name":"foo","version":"1.0.0","module":"index.mjs"}`,
+		"index.mjs":          `export const logo = new URL("./assets/logo.png", import.meta.url); export const wasm = new URL('./lib/foo.wasm', import.meta.url); export const bin = new URL("./assets/data.bin", import.meta.url);`,
+		"assets/logo.png":    "PNG",
+		"assets/data.bin":    "BIN",
+		"lib/foo.wasm":       "WASM",
+		"lib/nested/util.js": `export const logo = new URL("../../assets/logo.png", import.meta.url);`,
+	})
+	importer := path.Join(wd, "node_modules/foo/index.mjs")
+	task := &BuildTask{wd: wd, CdnOrigin: "https://esm.sh"}
+
+	warnings := newStringSet()
+	code := task.rewriteAssetURLs(`export const logo = new URL("./assets/logo.png", import.meta.url); export const wasm = new URL('./lib/foo.wasm', import.meta.url); export const bin = new URL("./assets/data.bin", import.meta.url);`, importer, warnings)
+	for _, s := range []string{
+		`new URL("https://esm.sh/foo@1.0.0/assets/logo.png?raw")`,
+		`new URL("https://esm.sh/foo@1.0.0/lib/foo.wasm?raw")`,
+		`new URL("./assets/data.bin", import.meta.url)`,
+	} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("'%s' not found in the rewritten code: %s", s, code)
+		}
+	}
+	if warnings.Size() != 1 || !strings.Contains(warnings.Values()[0], "assets/data.bin") {
+		t.Fatalf("unexpected warnings %v", warnings.Values())
+	}
+	for _, name := range []string{"raw/foo@1.0.0/assets/logo.png", "raw/foo@1.0.0/lib/foo.wasm"} {
+		if exists, _, _, _ := fs.Exists(name); !exists {
+			t.Fatalf("the asset '%s' should be stored", name)
+		}
+	}
+
+	code = task.rewriteAssetURLs(`new URL("../../assets/logo.png", import.meta.url)`, path.Join(wd, "node_modules/foo/lib/nested/util.js"), newStringSet())
+	if code != `new URL("https://esm.sh/foo@1.0.0/assets/logo.png?raw")` {
+		t.Fatalf("unexpected code of the nested importer: %s", code)
+	}
+
+	warnings = newStringSet()
+	code = task.rewriteAssetURLs(`new URL("./assets/missing.png", import.meta.url)`, importer, warnings)
+	if code != `new URL("./assets/missing.png", import.meta.url)` || warnings.Size() != 1 {
+		t.Fatalf("the missing asset should be kept with a warning, got %s %v", code, warnings.Values())
+	}
+
+	task.Assets = "strip"
+	code = task.rewriteAssetURLs(`new URL("./assets/logo.png", import.meta.url)`, importer, newStringSet())
+	if code != `new URL("data:,")` {
+		t.Fatalf("the asset reference should be stripped, got %s", code)
+	}
+}
+
+func TestAssetsPlugin(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json":    `{"name":"foo","version":"1.0.0","module":"index.mjs"}`,
+		"index.mjs":       `export const logo = new URL("./assets/logo.svg", import.meta.url);`,
+		"assets/logo.svg": "<svg></svg>",
+	})
+	task := &BuildTask{wd: wd, CdnOrigin: "https://esm.sh", External: newStringSet()}
+	warnings := newStringSet()
+	result := api.Build(api.BuildOptions{
+		EntryPoints: []string{path.Join(wd, "node_modules/foo/index.mjs")},
+		Bundle:      true,
+		Format:      api.FormatESModule,
+		Target:      api.ESNext,
+		Write:       false,
+		Plugins:     []api.Plugin{task.assetsPlugin(warnings)},
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors[0].Text)
+	}
+	code := string(result.OutputFiles[0].Contents)
+	if !strings.Contains(code, `new URL("https://esm.sh/foo@1.0.0/assets/logo.svg?raw")`) {
+		t.Fatalf("the asset reference should be rewritten: %s", code)
+	}
+}
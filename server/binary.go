@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// the loader policies of the `.node` native addons and the unknown binary imports: `empty` stubs
+// the binary with an empty module, `file` serves the binary by the raw passthrough and imports its
+// URL, and `error` fails the build with the `NATIVE_ADDON` error.
+var binaryLoaderModes = map[string]bool{
+	"empty": true,
+	"file":  true,
+	"error": true,
+}
+
+// the default loader policy of the binary imports, set by the `-binary-loader` flag
+var binaryLoader = "error"
+
+// the binary files that can't be bundled, the `.node` native addons and the shared libraries
+var binaryExts = map[string]bool{
+	".node":  true,
+	".so":    true,
+	".dylib": true,
+	".dll":   true,
+	".exe":   true,
+	".bin":   true,
+}
+
+// the message prefix of the binary import errors, see `toBuildError`
+const binaryImportErrorPrefix = "Could not bundle the binary file "
+
+// getBinaryLoader returns the loader policy of the binary imports of the task
+func (task *BuildTask) getBinaryLoader() string {
+	if task.Binary != "" {
+		return task.Binary
+	}
+	return binaryLoader
+}
+
+// binaryPlugin loads the binary imports of the package with the loader policy of the task,
+// the binary in the `empty` mode and the `file` mode is added to the warnings.
+func (task *BuildTask) binaryPlugin(warnings *stringSet) api.Plugin {
+	exts := make([]string, 0, len(binaryExts))
+	for ext := range binaryExts {
+		exts = append(exts, ext[1:])
+	}
+	return api.Plugin{
+		Name: "esm.sh-binary",
+		Setup: func(build api.PluginBuild) {
+			build.OnLoad(
+				api.OnLoadOptions{Filter: fmt.Sprintf(`\.(%s)$`, strings.Join(exts, "|"))},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					name := strings.TrimPrefix(args.Path, path.Join(task.wd, "node_modules")+"/")
+					switch task.getBinaryLoader() {
+					case "empty":
+						warnings.Add(fmt.Sprintf("binary '%s' is stubbed", name))
+						code := "module.exports = {};"
+						return api.OnLoadResult{Contents: &code, Loader: api.LoaderJS}, nil
+					case "file":
+						pkg, ok := findAssetPackage(path.Join(task.wd, "node_modules"), args.Path)
+						if !ok {
+							return api.OnLoadResult{}, fmt.Errorf("%s'%s': out of the packages", binaryImportErrorPrefix, name)
+						}
+						if err := storeRawAsset(pkg, args.Path); err != nil {
+							return api.OnLoadResult{}, err
+						}
+						warnings.Add(fmt.Sprintf("binary '%s' is served as a file", name))
+						url := fmt.Sprintf("%s%s/%s?raw", task.CdnOrigin, basePath, pkg)
+						return api.OnLoadResult{Contents: &url, Loader: api.LoaderText}, nil
+					default:
+						return api.OnLoadResult{}, fmt.Errorf(
+							"%s'%s', add the `?binary=empty` or `?binary=file` query if it's not needed at runtime",
+							binaryImportErrorPrefix,
+							name,
+						)
+					}
+				},
+			)
+		},
+	}
+}
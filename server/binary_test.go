@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestBinaryPlugin(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json":     `{"name":"foo","version":"1.0.0","main":"index.js"}`,
+		"index.js":         `let addon; try { addon = require("./build/addon.node") } catch (e) {} module.exports = { native: !!addon, lib: require("./lib/foo.so") }`,
+		"build/addon.node": "\x7fELF",
+		"lib/foo.so":       "\x7fELF",
+	})
+	build := func(binary string) (code string, warnings *stringSet, errors []api.Message) {
+		task := &BuildTask{wd: wd, CdnOrigin: "https://esm.sh", Binary: binary}
+		warnings = newStringSet()
+		result := api.Build(api.BuildOptions{
+			EntryPoints: []string{path.Join(wd, "node_modules/foo/index.js")},
+			Bundle:      true,
+			Format:      api.FormatESModule,
+			Target:      api.ESNext,
+			Write:       false,
+			Plugins:     []api.Plugin{task.binaryPlugin(warnings)},
+		})
+		if len(result.OutputFiles) > 0 {
+			code = string(result.OutputFiles[0].Contents)
+		}
+		return code, warnings, result.Errors
+	}
+
+	// the `empty` policy stubs the binaries
+	code, warnings, errors := build("empty")
+	if len(errors) > 0 {
+		t.Fatal(errors[0].Text)
+	}
+	if strings.Contains(code, "ELF") || warnings.Size() != 2 {
+		t.Fatalf("the binaries should be stubbed: %s %v", code, warnings.Values())
+	}
+
+	// the `file` policy serves the binaries by the raw passthrough
+	code, _, errors = build("file")
+	if len(errors) > 0 {
+		t.Fatal(errors[0].Text)
+	}
+	for _, url := range []string{"https://esm.sh/foo@1.0.0/build/addon.node?raw", "https://esm.sh/foo@1.0.0/lib/foo.so?raw"} {
+		if !strings.Contains(code, url) {
+			t.Fatalf("the binary url '%s' not found in the code: %s", url, code)
+		}
+	}
+	for _, name := range []string{"raw/foo@1.0.0/build/addon.node", "raw/foo@1.0.0/lib/foo.so"} {
+		if exists, _, _, _ := fs.Exists(name); !exists {
+			t.Fatalf("the binary '%s' should be stored", name)
+		}
+	}
+
+	// the `error` policy fails the build with the `NATIVE_ADDON` error, it's the default
+	for _, binary := range []string{"error", ""} {
+		_, _, errors = build(binary)
+		if len(errors) == 0 {
+			t.Fatalf("[%s] the build should fail", binary)
+		}
+		buildErr := toBuildError(errors[0].Text)
+		if buildErr == nil || buildErr.Code != ErrNativeAddon || !strings.Contains(buildErr.Message, "addon.node") {
+			t.Fatalf("[%s] invalid build error: %s", binary, errors[0].Text)
+		}
+	}
+
+	defer func() { binaryLoader = "error" }()
+	binaryLoader = "empty"
+	if _, _, errors = build(""); len(errors) > 0 {
+		t.Fatalf("the binaries should be stubbed by the default policy: %s", errors[0].Text)
+	}
+}
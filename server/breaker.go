@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// the error of the registry calls while the circuit is open
+var errRegistryUnavailable = errors.New("npm registry is unavailable, please try again later")
+
+// the circuit breaker of the npm registry calls, replaced by the `-registry-breaker-*` flags
+var registryBreaker = newCircuitBreaker(20, time.Minute, 30*time.Second)
+
+// the states of the circuit breaker
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// A CircuitBreaker opens the circuit after the threshold of failures within the window, the calls
+// fail fast while the circuit is open. After the cooldown, a single probe call is allowed to test
+// the recovery (half-open): the circuit is closed if it succeeds, or opened again if it fails.
+type CircuitBreaker struct {
+	lock      sync.Mutex
+	threshold int // 0 disables the breaker
+	window    time.Duration
+	cooldown  time.Duration
+	state     string
+	failures  []time.Time
+	openedAt  time.Time
+	probing   bool
+	opened    int64
+}
+
+func newCircuitBreaker(threshold int, window time.Duration, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+// Allow reports whether the call can be sent
+func (b *CircuitBreaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Record records the result of the allowed call
+func (b *CircuitBreaker) Record(ok bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if ok {
+			b.state = breakerClosed
+			b.failures = nil
+		} else {
+			b.open(now)
+		}
+		return
+	}
+	if ok || b.state == breakerOpen {
+		return
+	}
+
+	// drop the failures out of the window
+	i := 0
+	for i < len(b.failures) && now.Sub(b.failures[i]) > b.window {
+		i++
+	}
+	b.failures = append(b.failures[i:], now)
+	if len(b.failures) >= b.threshold {
+		b.open(now)
+	}
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.failures = nil
+	b.opened++
+	log.Warnf("circuit breaker opened for %v", b.cooldown)
+}
+
+// RetryAfter returns the remaining cooldown of the open circuit, at least one second
+func (b *CircuitBreaker) RetryAfter() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == breakerClosed {
+		return 0
+	}
+	d := b.cooldown - time.Since(b.openedAt)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// JSON returns the state of the breaker for the `/status.json`
+func (b *CircuitBreaker) JSON() map[string]interface{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	m := map[string]interface{}{
+		"state":    b.state,
+		"failures": len(b.failures),
+		"opened":   b.opened,
+	}
+	if b.threshold <= 0 {
+		m["state"] = "disabled"
+	}
+	if !b.openedAt.IsZero() {
+		m["openedAt"] = b.openedAt.UTC().Format(time.RFC3339)
+	}
+	return m
+}
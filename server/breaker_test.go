@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, time.Minute, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatal("the closed circuit should allow the calls")
+		}
+		b.Record(false)
+	}
+	b.Record(true)
+	if b.JSON()["state"] != breakerClosed {
+		t.Fatal("the circuit should be closed under the threshold")
+	}
+	b.Record(false)
+	if b.JSON()["state"] != breakerOpen || b.Allow() {
+		t.Fatal("the circuit should be opened at the threshold")
+	}
+	if d := b.RetryAfter(); d <= 0 || d > 50*time.Millisecond+time.Second {
+		t.Fatalf("unexpected retry-after %v", d)
+	}
+
+	// a single probe after the cooldown
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("the probe should be allowed after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("only one probe should be allowed in the half-open state")
+	}
+	b.Record(false)
+	if b.JSON()["state"] != breakerOpen || b.Allow() {
+		t.Fatal("the failed probe should open the circuit again")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("the probe should be allowed after the cooldown")
+	}
+	b.Record(true)
+	if b.JSON()["state"] != breakerClosed || !b.Allow() || b.RetryAfter() != 0 {
+		t.Fatal("the successful probe should close the circuit")
+	}
+	if b.JSON()["opened"] != int64(2) {
+		t.Fatalf("the circuit should be opened twice, got %v", b.JSON()["opened"])
+	}
+
+	// the failures out of the window are dropped
+	b = newCircuitBreaker(2, 20*time.Millisecond, time.Minute)
+	b.Record(false)
+	time.Sleep(30 * time.Millisecond)
+	b.Record(false)
+	if b.JSON()["state"] != breakerClosed {
+		t.Fatal("the failures out of the window should be dropped")
+	}
+
+	b = newCircuitBreaker(0, time.Minute, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.Record(false)
+	}
+	if !b.Allow() || b.JSON()["state"] != "disabled" {
+		t.Fatal("the disabled breaker should allow all the calls")
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -20,6 +22,14 @@ import (
 	"github.com/ije/gox/utils"
 )
 
+// the `?legal-comments` modes, the default is `eof` that keeps the license banners at the end of file
+var legalCommentsModes = map[string]api.LegalComments{
+	"":         api.LegalCommentsEndOfFile,
+	"inline":   api.LegalCommentsInline,
+	"external": api.LegalCommentsExternal,
+	"none":     api.LegalCommentsNone,
+}
+
 type BuildTask struct {
 	CdnOrigin         string
 	BuildVersion      int
@@ -34,56 +44,74 @@ type BuildTask struct {
 	KeepNames         bool
 	IgnoreAnnotations bool
 	Sourcemap         bool
+	Namespace         bool // spread the named exports of the cjs module onto the namespace
+	DepsPolicy        string
+	DepsGraph         string // the hash of the graph pins with the `graph` deps policy
+	Minify            string
+	LegalComments     string // `inline`, `external` or `none`, empty means the default `eof`
+	Optional          string // the behavior of the optional dependencies: `stub`, `external` or `error`
+	Pure              string // the hash of the `?pure` names
+	EntryField        string // the CDN-oriented entry field of package.json, `unpkg` or `jsdelivr`
+	Assets            string // the mode of the `import.meta.url` asset references, empty means `rewrite`
+	CSSBundleAssets   string // the mode of the `url()` assets of the package CSS, empty keeps the loaders as they are
+	NodeEnv           string // the `process.env.NODE_ENV` define, empty means the default of the dev mode
+	Binary            string // the loader policy of the binary imports, empty means the `-binary-loader` default
+	PeerDeps          string // the mode of the peer dependencies, `bundle` or empty that means `external`
+	StripDirectives   bool   // strip the `"use client"`/`"use server"` directives instead of preserving them
+	DtsBundle         bool   // roll the transformed types into one `.d.ts`, for the `types` target only
 
 	// state
-	id    string
-	wd    string
-	stage string
+	id        string
+	wd        string
+	stage     string
+	noCache   bool              // ignore the previous build
+	noStore   bool              // don't store the build, the output is kept in `output`
+	output    []byte            // the output of the `noStore` build
+	graphPins map[string]string // loaded from the db by `DepsGraph`
+	registry  string            // picked by the `X-Esm-Registry` request header
+	pureNames []string          // loaded from the db by `Pure`
+	split     *SplitTask        // the split build that runs in the build queue, see `newSplitBuildTask`
+	metafile  bool              // generate the metafile for the `?analyze` and `?output=graph` queries
 }
 
-func (task *BuildTask) ID() string {
-	if task.id != "" {
-		return task.id
+func (task *BuildTask) getPureNames() []string {
+	if task.pureNames == nil {
+		names, err := loadPure(task.Pure)
+		if err != nil {
+			log.Warnf("load pure names(%s) of %s: %v", task.Pure, task.Pkg, err)
+			names = []string{}
+		}
+		task.pureNames = names
 	}
+	return task.pureNames
+}
 
-	pkg := task.Pkg
-	name := path.Base(pkg.Name)
-
-	if pkg.Submodule != "" {
-		name = pkg.Submodule
-	}
-	name = strings.TrimSuffix(name, ".js")
-	if task.NoRequire {
-		name += ".nr"
-	}
-	if task.KeepNames {
-		name += ".kn"
-	}
-	if task.IgnoreAnnotations {
-		name += ".ia"
+// npmRegistry returns the registry to install the packages of the task
+func (task *BuildTask) npmRegistry() string {
+	if task.registry != "" {
+		return task.registry
 	}
-	if task.Sourcemap {
-		name += ".sm"
-	}
-	if task.DevMode {
-		name += ".development"
-	}
-	if task.BundleMode {
-		name += ".bundle"
+	return node.npmRegistry
+}
+
+func (task *BuildTask) getGraphPins() map[string]string {
+	if task.graphPins == nil {
+		pins, _, err := loadGraphPins(task.DepsGraph)
+		if err != nil {
+			log.Warnf("load graph pins(%s) of %s: %v", task.DepsGraph, task.Pkg, err)
+			pins = map[string]string{}
+		}
+		task.graphPins = pins
 	}
+	return task.graphPins
+}
 
-	task.id = fmt.Sprintf(
-		"v%d/%s@%s/%s%s/%s.js",
-		task.BuildVersion,
-		pkg.Name,
-		pkg.Version,
-		encodeResolveArgsPrefix(task.Alias, task.Deps, task.External),
-		task.Target,
-		name,
-	)
-	if task.Target == "types" {
-		task.id = strings.TrimSuffix(task.id, ".js")
+// ID returns the build id of the task, see `computeBuildID`
+func (task *BuildTask) ID() string {
+	if task.id != "" {
+		return task.id
 	}
+	task.id = computeBuildID(task.Pkg, task)
 	return task.id
 }
 
@@ -93,6 +121,9 @@ func (task *BuildTask) getImportPath(pkg Pkg, prefix string) string {
 		name = pkg.Submodule
 	}
 	name = strings.TrimSuffix(name, ".js")
+	if nodeEnv := normalizeNodeEnv(task.NodeEnv, task.DevMode); nodeEnv != "" {
+		name += ".ne-" + nodeEnv
+	}
 	if task.DevMode {
 		name += ".development"
 	}
@@ -110,9 +141,23 @@ func (task *BuildTask) getImportPath(pkg Pkg, prefix string) string {
 }
 
 func (task *BuildTask) Build() (esm *ModuleMeta, err error) {
-	prev, err := findModule(task.ID())
-	if err == nil {
-		return prev, nil
+	// the split build takes a slot of the build queue, its manifest is stored in the db
+	if task.split != nil {
+		_, err = task.split.Build()
+		return
+	}
+
+	// the types bundle is rolled from the transformed types, the package is not installed
+	if task.DtsBundle {
+		err = task.bundleDTS()
+		return
+	}
+
+	if !task.noCache {
+		prev, err := findModule(task.ID())
+		if err == nil {
+			return prev, nil
+		}
 	}
 
 	if task.wd == "" {
@@ -129,8 +174,17 @@ func (task *BuildTask) Build() (esm *ModuleMeta, err error) {
 	}()
 
 	task.stage = "install"
+	// resolve the `workspace:` versions leaked by the monorepo-published packages
+	var peerDeps []string
+	if info, e := fetchPackageInfoFrom(task.registry, task.Pkg.Name, task.Pkg.Version); e == nil {
+		err = writeYarnResolutions(task.wd, info)
+		if err != nil {
+			return
+		}
+		peerDeps = task.peerDepsToInstall(info)
+	}
 	for i := 0; i < 3; i++ {
-		err = yarnAdd(task.wd, fmt.Sprintf("%s@%s", task.Pkg.Name, task.Pkg.Version))
+		err = yarnAddFrom(task.npmRegistry(), task.wd, fmt.Sprintf("%s@%s", task.Pkg.Name, task.Pkg.Version))
 		if err == nil && !fileExists(path.Join(task.wd, "node_modules", task.Pkg.Name, "package.json")) {
 			defer yarnCacheClean(task.wd, task.Pkg.Name)
 			err = fmt.Errorf("yarnAdd(%s): package.json not found", task.Pkg)
@@ -145,6 +199,12 @@ func (task *BuildTask) Build() (esm *ModuleMeta, err error) {
 	if err != nil {
 		return
 	}
+	// the unresolved peer dependencies are still imported from the CDN URLs
+	if len(peerDeps) > 0 {
+		if e := yarnAddFrom(task.npmRegistry(), task.wd, peerDeps...); e != nil {
+			log.Warnf("install peer dependencies of %s: %v", task.Pkg, e)
+		}
+	}
 
 	return task.build(newStringSet())
 }
@@ -157,7 +217,7 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 
 	var npm *NpmPackage
 	task.stage = "init"
-	esm, npm, err = initModule(task.wd, task.Pkg, task.Target, task.DevMode)
+	esm, npm, err = initModule(task.wd, task.Pkg, task.Target, task.DevMode, task.getNodeEnv(), task.EntryField)
 	if err != nil {
 		return
 	}
@@ -175,6 +235,14 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 		dts := npm.Name + "@" + npm.Version + "/" + npm.Types
 		task.stage = "transform-dts"
 		task.transformDTS(dts)
+		task.checkDTS(esm, npm)
+		// store a stub module for the types-only package
+		if !task.noStore {
+			err = task.storeBuild([]buildFile{{task.ID(), []byte("export default null;\n"), false}}, "")
+			if err != nil {
+				return
+			}
+		}
 		task.storeToDB(esm)
 		return
 	}
@@ -188,17 +256,27 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 
 	var entryPoint string
 	var input *api.StdinOptions
+	// the file of the cjs entry, that may be labeled as an ES module by mistake
+	var cjsEntry string
 
 	if npm.Module == "" {
+		cjsEntry = path.Join(task.wd, "node_modules", npm.Name, npm.Main)
 		buf := bytes.NewBuffer(nil)
 		importPath := task.Pkg.ImportPath()
-		fmt.Fprintf(buf, `import $default from "%s";`, importPath)
-		fmt.Fprintf(buf, `import * as $module from "%s";`, importPath)
-		if len(esm.Exports) > 0 {
-			fmt.Fprintf(buf, `export const { %s } = $module;`, strings.Join(esm.Exports, ","))
+		if task.EntryField != "" && esm.Entry != "" {
+			importPath = path.Join(task.Pkg.Name, esm.Entry)
+		}
+		if task.Namespace {
+			buf.WriteString(cjsNamespaceBarrel(importPath, task.namespaceExports(esm)))
+		} else {
+			fmt.Fprintf(buf, `import $default from "%s";`, importPath)
+			fmt.Fprintf(buf, `import * as $module from "%s";`, importPath)
+			if len(esm.Exports) > 0 {
+				fmt.Fprintf(buf, `export const { %s } = $module;`, strings.Join(esm.Exports, ","))
+			}
+			fmt.Fprintf(buf, "const { default: $def, ...$rest } = $module;")
+			fmt.Fprintf(buf, "export default $default ?? $def ?? $rest;")
 		}
-		fmt.Fprintf(buf, "const { default: $def, ...$rest } = $module;")
-		fmt.Fprintf(buf, "export default $default ?? $def ?? $rest;")
 		input = &api.StdinOptions{
 			Contents:   buf.String(),
 			ResolveDir: task.wd,
@@ -208,10 +286,7 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 		entryPoint = path.Join(task.wd, "node_modules", npm.Name, npm.Module)
 	}
 
-	nodeEnv := "production"
-	if task.DevMode {
-		nodeEnv = "development"
-	}
+	nodeEnv := task.getNodeEnv()
 	define := map[string]string{
 		"__filename":                  fmt.Sprintf(`"%s%s/%s"`, task.CdnOrigin, basePath, task.ID()),
 		"__dirname":                   fmt.Sprintf(`"%s%s/%s"`, task.CdnOrigin, basePath, path.Dir(task.ID())),
@@ -231,6 +306,8 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 	}
 	externalDeps := newStringSet()
 	extraExternal := newStringSet()
+	externalPeers := newStringSet()
+	assetWarnings := newStringSet()
 	esmResolverPlugin := api.Plugin{
 		Name: "esm.sh-resolver",
 		Setup: func(build api.PluginBuild) {
@@ -260,18 +337,34 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 						}
 					}
 
+					// the access rules apply to the dependencies too, the bundled ones included
+					if specifierPkgName(specifier) != npm.Name {
+						if err := checkDependencyAccess(specifier); err != nil {
+							return api.OnResolveResult{}, err
+						}
+					}
+
+					// don't resolve the optional dependencies with the `?optional` query
+					if task.Optional != "" && npm.isOptionalDependency(specifier) {
+						externalDeps.Add(specifier)
+						return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL:" + specifier, External: true}, nil
+					}
+
+					// the peer dependencies are provided by the host, they are imported from the CDN URLs
+					// to avoid the duplicate copies, unless the `?peer-deps=bundle` query is set
+					if npm.isPeerDependency(specifier) {
+						if task.PeerDeps == "bundle" && !extraExternal.Has(specifier) {
+							return api.OnResolveResult{}, nil
+						}
+						externalPeers.Add(specifierPkgName(specifier))
+						externalDeps.Add(specifier)
+						return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL:" + specifier, External: true}, nil
+					}
+
 					// bundles all dependencies in `bundle` mode, apart from peer dependencies
 					if task.BundleMode && !extraExternal.Has(specifier) {
-						a := strings.Split(specifier, "/")
-						pkgName := a[0]
-						if len(a) > 1 && specifier[0] == '@' {
-							pkgName = a[1]
-						}
-						if !builtInNodeModules[pkgName] {
-							_, ok := npm.PeerDependencies[pkgName]
-							if !ok {
-								return api.OnResolveResult{}, nil
-							}
+						if !builtInNodeModules[specifierPkgName(specifier)] {
+							return api.OnResolveResult{}, nil
 						}
 					}
 
@@ -365,6 +458,7 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 	}
 
 esbuild:
+	minifySyntax, minifyWhitespace, minifyIdentifiers := task.minify()
 	options := api.BuildOptions{
 		Outdir:            "/esbuild",
 		Write:             false,
@@ -372,12 +466,14 @@ esbuild:
 		Target:            targets[task.Target],
 		Format:            api.FormatESModule,
 		Platform:          api.PlatformBrowser,
-		MinifyWhitespace:  !task.DevMode,
-		MinifyIdentifiers: !task.DevMode,
-		MinifySyntax:      !task.DevMode,
+		MinifyWhitespace:  minifyWhitespace,
+		MinifyIdentifiers: minifyIdentifiers,
+		MinifySyntax:      minifySyntax,
+		LegalComments:     legalCommentsModes[task.LegalComments],
 		KeepNames:         task.KeepNames,         // prevent class/function names erasing
 		IgnoreAnnotations: task.IgnoreAnnotations, // some libs maybe use wrong side-effect annotations
-		Plugins:           []api.Plugin{esmResolverPlugin},
+		Metafile:          task.metafile,          // for the `?analyze` and `?output=graph` queries
+		Plugins:           []api.Plugin{esmResolverPlugin, task.syntaxPlugin(cjsEntry, assetWarnings)},
 		Loader: map[string]api.Loader{
 			".wasm":  api.LoaderDataURL,
 			".svg":   api.LoaderDataURL,
@@ -397,6 +493,19 @@ esbuild:
 	if (task.Sourcemap) {
 		options.Sourcemap = 1
 	}
+	if task.Pure != "" {
+		options.Pure = task.getPureNames()
+	}
+	if task.Assets != "keep" {
+		options.Plugins = append(options.Plugins, task.assetsPlugin(assetWarnings))
+	}
+	options.Plugins = append(options.Plugins, task.binaryPlugin(assetWarnings))
+	if task.CSSBundleAssets != "" {
+		for ext := range cssAssetExts {
+			options.Loader[ext] = api.LoaderDataURL
+		}
+		options.Plugins = append([]api.Plugin{task.cssAssetsPlugin(assetWarnings)}, options.Plugins...)
+	}
 	if entryPoint != "" {
 		options.EntryPoints = []string{entryPoint}
 	} else {
@@ -409,7 +518,7 @@ esbuild:
 		if strings.HasPrefix(msg, "Could not resolve \"") {
 			// but current package/module can not mark as external
 			if strings.Contains(msg, fmt.Sprintf("Could not resolve \"%s\"", task.Pkg.ImportPath())) {
-				err = fmt.Errorf("Could not resolve \"%s\"", task.Pkg.ImportPath())
+				err = &BuildError{ErrNoEntry, fmt.Sprintf("Could not resolve \"%s\"", task.Pkg.ImportPath())}
 				return
 			}
 			log.Warnf("esbuild(%s): %s", task.ID(), msg)
@@ -427,7 +536,11 @@ esbuild:
 			}
 			goto esbuild
 		}
-		err = errors.New("esbuild: " + msg)
+		if buildErr := toBuildError(msg); buildErr != nil {
+			err = buildErr
+		} else {
+			err = errors.New("esbuild: " + msg)
+		}
 		return
 	}
 
@@ -436,7 +549,35 @@ esbuild:
 			log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
 		}
 	}
+	if assetWarnings.Size() > 0 {
+		warnings := assetWarnings.Values()
+		sort.Strings(warnings)
+		esm.AssetWarning = strings.Join(warnings, "; ")
+	}
+	if externalPeers.Size() > 0 {
+		esm.PeerDeps = externalPeers.Values()
+		sort.Strings(esm.PeerDeps)
+	}
+
+	// don't store the pathological bundles
+	err = task.checkOutputSize(result.OutputFiles)
+	if err != nil {
+		return
+	}
+
+	// the RSC directives of the entry are preserved at the top of the build
+	var directives []string
+	if !task.StripDirectives {
+		entry := entryPoint
+		if entry == "" {
+			entry = cjsEntry
+		}
+		if filename, ok := resolveModuleFile(entry); ok {
+			directives = readDirectives(filename)
+		}
+	}
 
+	var files []buildFile
 	for _, file := range result.OutputFiles {
 		outputContent := file.Contents
 		if strings.HasSuffix(file.Path, ".js") {
@@ -444,12 +585,16 @@ esbuild:
 				"/* esm.sh - esbuild bundle(%s) %s %s */\n",
 				task.Pkg.String(),
 				strings.ToLower(task.Target),
-				nodeEnv,
+				task.getNodeEnv(),
 			))
 			eol := "\n"
 			if !task.DevMode {
 				eol = ""
 			}
+			for _, directive := range directives {
+				fmt.Fprintf(buf, `"%s";%s`, directive, eol)
+			}
+			outputContent = stripStrayDirectives(outputContent)
 
 			// replace external imports/requires
 			for _, name := range externalDeps.Values() {
@@ -458,6 +603,11 @@ esbuild:
 				if isRemoteImport(name) || task.External.Has(name) {
 					importPath = name
 				}
+				// optional dependencies with the `?optional` query
+				optional := task.Optional != "" && npm.isOptionalDependency(name)
+				if importPath == "" && optional {
+					importPath = task.optionalImportPath(name, importedNames(outputContent, name))
+				}
 				// is sub-module
 				if importPath == "" && strings.HasPrefix(name, task.Pkg.Name+"/") {
 					submodule := strings.TrimPrefix(name, task.Pkg.Name+"/")
@@ -476,6 +626,8 @@ esbuild:
 						Deps:         task.Deps,
 						Target:       task.Target,
 						DevMode:      task.DevMode,
+						NodeEnv:      task.NodeEnv,
+						registry:     task.registry,
 					}
 					subTask.build(tracing)
 					if err != nil {
@@ -507,7 +659,7 @@ esbuild:
 					} else {
 						polyfill, ok := polyfilledBuiltInNodeModules[name]
 						if ok {
-							p, submodule, _, e := getPackageInfo(task.wd, polyfill, "latest")
+							p, submodule, _, e := getPackageInfoFrom(task.registry, task.wd, polyfill, "latest")
 							if e != nil {
 								err = e
 								return
@@ -566,8 +718,11 @@ esbuild:
 					} else if v, ok := npm.PeerDependencies[name]; ok {
 						version = v
 					}
-					p, submodule, _, e := getPackageInfo(task.wd, name, version)
+					p, submodule, _, e := getPackageInfoFrom(task.registry, task.wd, name, version)
 					if e != nil {
+						if v, ok := npm.protocolDeps[name]; ok && e != errRegistryUnavailable {
+							e = &BuildError{ErrDepUnresolvable, fmt.Sprintf("Could not resolve \"%s@%s\" (Imported by \"%s\"): no published version: %v", name, v, task.Pkg.Name, e)}
+						}
 						err = e
 						return
 					}
@@ -577,6 +732,14 @@ esbuild:
 						Version:   p.Version,
 						Submodule: submodule,
 					}
+					// use the version pinned by the dependency graph of the root package
+					var useGraph bool
+					if task.DepsPolicy == "graph" {
+						if v, ok := task.getGraphPins()[p.Name]; ok {
+							pkg.Version = v
+							useGraph = true
+						}
+					}
 					t := &BuildTask{
 						CdnOrigin:    task.CdnOrigin,
 						BuildVersion: task.BuildVersion,
@@ -586,19 +749,36 @@ esbuild:
 						Deps:         task.Deps,
 						Target:       task.Target,
 						DevMode:      task.DevMode,
+						NodeEnv:      task.NodeEnv,
+						// the cjs dependency imported by `import * as` gets the namespace barrel
+						Namespace: p.Module == "" && isNamespaceImported(outputContent, name),
+					}
+					t.registry = task.registry
+					if useGraph {
+						t.DepsPolicy = "graph"
+						t.DepsGraph = task.DepsGraph
 					}
+					// the build defaults of the dependency, the options are in the id of the dependency build
+					buildDefaults.ApplyTask(t)
 
 					_, _err := findModule(t.ID())
 					if _err == storage.ErrNotFound {
 						buildQueue.Add(t, "")
 					}
 
-					importPath = task.getImportPath(pkg, encodeResolveArgsPrefix(task.Alias, task.Deps, task.External))
+					// keep the declared version range with the `range` deps policy
+					if task.DepsPolicy == "range" && version != "latest" && version != p.Version {
+						pkg.Version = url.PathEscape(version)
+					}
+					// the import path is the id of the dependency build, so the options of the
+					// dependency task like the namespace barrel are in the path
+					importPath = fmt.Sprintf("%s/%s", basePath, computeBuildID(pkg, t))
 				}
 				if importPath == "" {
-					err = fmt.Errorf("Could not resolve \"%s\" (Imported by \"%s\")", name, task.Pkg.Name)
+					err = &BuildError{ErrDepUnresolvable, fmt.Sprintf("Could not resolve \"%s\" (Imported by \"%s\")", name, task.Pkg.Name)}
 					return
 				}
+				importPath = task.importURL(importPath)
 				buffer := bytes.NewBuffer(nil)
 				identifier := identify(name)
 				slice := bytes.Split(outputContent, []byte(fmt.Sprintf("\"__ESM_SH_EXTERNAL:%s\"", name)))
@@ -608,11 +788,15 @@ esbuild:
 					if cjsContext {
 						p = bytes.TrimPrefix(p, []byte{')'})
 						var marked bool
-						if _, ok := builtInNodeModules[name]; !ok {
-							pkg, _, err := parsePkg(name)
+						if optional && task.Optional != "external" {
+							cjsImports.Add("optional")
+							marked = true
+						}
+						if _, ok := builtInNodeModules[name]; !ok && !marked {
+							pkg, _, err := parsePkgFrom(task.registry, name)
 							if err == nil && !fileExists(path.Join(task.wd, "node_modules", pkg.Name, "package.json")) {
 								for i := 0; i < 3; i++ {
-									err = yarnAdd(task.wd, fmt.Sprintf("%s@%s", pkg.Name, pkg.Version))
+									err = yarnAddFrom(task.npmRegistry(), task.wd, fmt.Sprintf("%s@%s", pkg.Name, pkg.Version))
 									if err == nil && !fileExists(path.Join(task.wd, "node_modules", pkg.Name, "package.json")) {
 										defer yarnCacheClean(task.wd, pkg.Name)
 										err = fmt.Errorf("yarnAdd(%s): package.json not found", pkg)
@@ -626,7 +810,7 @@ esbuild:
 								}
 							}
 							if err == nil {
-								dep, depNpm, err := initModule(task.wd, *pkg, task.Target, task.DevMode)
+								dep, depNpm, err := initModule(task.wd, *pkg, task.Target, task.DevMode, task.getNodeEnv(), "")
 								if err == nil {
 									if bytes.HasPrefix(p, []byte{'.'}) {
 										// right shift to strip the object `key`
@@ -690,7 +874,9 @@ esbuild:
 					}
 					buffer.Write(p)
 					if i < len(slice)-1 {
-						if cjsContext {
+						if cjsContext && optional && task.Optional == "error" {
+							buffer.WriteString(fmt.Sprintf("__%s$()", identifier))
+						} else if cjsContext {
 							buffer.WriteString(fmt.Sprintf("__%s$", identifier))
 						} else {
 							buffer.WriteString(fmt.Sprintf("\"%s\"", importPath))
@@ -713,6 +899,8 @@ esbuild:
 								fmt.Fprintf(buf, `import __%s$$ from "%s";`, identifier, importPath)
 								fmt.Fprintf(buf, `import * as __%s$$$ from "%s";`, identifier, importPath)
 								fmt.Fprintf(buf, `const __%s$ = Object.assign({ default: __%s$$ }, __%s$$$);%s`, identifier, identifier, identifier, eol)
+							case "optional":
+								fmt.Fprintf(buf, "%s%s", optionalRequireStub(identifier, name, task.Pkg.Name, task.Optional), eol)
 							case "__esModule":
 								fmt.Fprintf(buf, `import * as __%s$$ from "%s";const __%s$ = Object.assign({ __esModule: true }, __%s$$);%s`, identifier, importPath, identifier, identifier, eol)
 							default:
@@ -734,14 +922,14 @@ esbuild:
 					if task.Target == "deno" {
 						fmt.Fprintf(buf, `import __Process$ from "https://deno.land/std@%s/node/process.ts";%s`, denoStdVersion, eol)
 					} else {
-						fmt.Fprintf(buf, `import __Process$ from "%s/v%d/node_process.js";%s`, basePath, task.BuildVersion, eol)
+						fmt.Fprintf(buf, `import __Process$ from "%s";%s`, task.importURL(fmt.Sprintf("%s/v%d/node_process.js", basePath, task.BuildVersion)), eol)
 					}
 				}
 				if bytes.Contains(outputContent, []byte("__Buffer$")) {
 					if task.Target == "deno" {
 						fmt.Fprintf(buf, `import  { Buffer as __Buffer$ } from "https://deno.land/std@%s/node/buffer.ts";%s`, denoStdVersion, eol)
 					} else {
-						fmt.Fprintf(buf, `import { Buffer as __Buffer$ } from "%s/v%d/node_buffer.js";%s`, basePath, task.BuildVersion, eol)
+						fmt.Fprintf(buf, `import { Buffer as __Buffer$ } from "%s";%s`, task.importURL(fmt.Sprintf("%s/v%d/node_buffer.js", basePath, task.BuildVersion)), eol)
 					}
 				}
 				if bytes.Contains(outputContent, []byte("__global$")) {
@@ -768,25 +956,85 @@ esbuild:
 				return
 			}
 
-			err = fs.WriteData(path.Join("builds", task.ID()), buf.Bytes())
-			if err != nil {
-				return
-			}
-		} else if strings.HasSuffix(file.Path, ".css") {
-			err = fs.WriteData(path.Join("builds", strings.TrimSuffix(task.ID(), ".js")+".css"), outputContent)
-			if err != nil {
-				return
+			if task.noStore {
+				task.output = buf.Bytes()
+				continue
 			}
+			files = append(files, buildFile{task.ID(), buf.Bytes(), true})
+		} else if strings.HasSuffix(file.Path, ".LEGAL.txt") && !task.noStore {
+			files = append(files, buildFile{strings.TrimSuffix(task.ID(), ".js") + ".LEGAL.txt", outputContent, false})
+		} else if strings.HasSuffix(file.Path, ".css") && !task.noStore {
+			files = append(files, buildFile{strings.TrimSuffix(task.ID(), ".js") + ".css", outputContent, true})
 			esm.PackageCSS = true
 		}
 	}
 
+	if !task.noStore {
+		metafile := ""
+		if task.metafile {
+			metafile = result.Metafile
+		}
+		err = task.storeBuild(files, metafile)
+		if err != nil {
+			return
+		}
+	}
+
 	task.checkDTS(esm, npm)
 	task.storeToDB(esm)
 	return
 }
 
+// A buildFile is an output file of the build stored in the `builds` storage
+type buildFile struct {
+	name        string
+	data        []byte
+	precompress bool
+}
+
+// storeBuild stores the output files of the build, the compressed variants and the analysis of the
+// metafile. The concurrent stores of the same build id share one call, so the sidecars of a build
+// are never written by two builds at the same time.
+func (task *BuildTask) storeBuild(files []buildFile, metafile string) error {
+	return sidecarFlight.Do(path.Join("builds", task.ID()), func() error {
+		for _, file := range files {
+			savePath := path.Join("builds", file.name)
+			err := fs.WriteData(savePath, file.data)
+			if err != nil {
+				return err
+			}
+			// the rebuild overwrites the stored build, the stale variants are rewritten before it's served
+			if file.precompress && task.noCache {
+				precompressVariants(fs, savePath, file.data, precompressEncodings)
+			} else if file.precompress {
+				queuePrecompress(savePath, file.data, precompressEncodings)
+			}
+		}
+		// the analysis and the import graph are stored alongside the build
+		if metafile != "" {
+			analysis, err := analyzeMetafile(metafile, task.wd)
+			if err == nil {
+				err = storeBuildAnalysis(task.ID(), analysis)
+			}
+			if err != nil {
+				log.Warnf("analyze build %s: %v", task.ID(), err)
+			}
+			dot, err := metafileGraph(metafile)
+			if err == nil {
+				err = storeBuildGraph(task.ID(), dot)
+			}
+			if err != nil {
+				log.Warnf("graph build %s: %v", task.ID(), err)
+			}
+		}
+		return nil
+	})
+}
+
 func (task *BuildTask) storeToDB(esm *ModuleMeta) {
+	if task.noStore {
+		return
+	}
 	dbErr := db.Put(
 		task.ID(),
 		"build",
@@ -805,8 +1053,10 @@ func (task *BuildTask) checkDTS(esm *ModuleMeta, npm *NpmPackage) {
 	ResolveArgsPrefix := encodeResolveArgsPrefix(task.Alias, task.Deps, task.External)
 
 	var dts string
+	var dtsVersions []DtsVersion
 	if npm.Types != "" {
 		dts = toTypesPath(task.wd, npm, "", ResolveArgsPrefix, submodule)
+		dtsVersions = toDtsVersions(task.wd, npm, dts, fmt.Sprintf("%s@%s/%s", npm.Name, npm.Version, ResolveArgsPrefix))
 	} else if !strings.HasPrefix(name, "@types/") {
 		versions := []string{"latest"}
 		versionParts := strings.Split(task.Pkg.Version, ".")
@@ -824,21 +1074,35 @@ func (task *BuildTask) checkDTS(esm *ModuleMeta, npm *NpmPackage) {
 			versions = append([]string{pkg.Version}, versions...)
 		}
 		for _, version := range versions {
-			p, _, _, err := getPackageInfo(task.wd, typesPkgName, version)
+			p, _, _, err := getPackageInfoFrom(task.registry, task.wd, typesPkgName, version)
 			if err == nil {
 				dts = toTypesPath(task.wd, &p, version, ResolveArgsPrefix, submodule)
+				dtsVersions = toDtsVersions(task.wd, &p, dts, fmt.Sprintf("%s@%s/%s", p.Name, version, ResolveArgsPrefix))
 				break
 			}
 		}
 	}
 	if dts != "" {
 		esm.Dts = fmt.Sprintf("/v%d/%s", task.BuildVersion, dts)
+		esm.DtsVersions = nil
+		for _, v := range dtsVersions {
+			if v.Dts != "" {
+				v.Dts = fmt.Sprintf("/v%d/%s", task.BuildVersion, v.Dts)
+			}
+			esm.DtsVersions = append(esm.DtsVersions, v)
+		}
 	}
 }
 
 func (task *BuildTask) transformDTS(dts string) {
 	start := time.Now()
-	n, err := task.CopyDTS(dts, task.BuildVersion)
+	// the concurrent requests of the same types share one transform
+	var n int
+	key := fmt.Sprintf("types/v%d/%s%s", task.BuildVersion, encodeResolveArgsPrefix(task.Alias, task.Deps, task.External), dts)
+	err := sidecarFlight.Do(key, func() (err error) {
+		n, err = task.CopyDTS(dts, task.BuildVersion)
+		return
+	})
 	if err != nil && os.IsExist(err) {
 		log.Errorf("copyDTS(%s): %v", dts, err)
 		return
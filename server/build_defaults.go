@@ -0,0 +1,338 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the build queries that can be set by the build defaults
+var buildDefaultKeys = map[string]bool{
+	"alias":              true,
+	"assets":             true,
+	"binary":             true,
+	"bundle":             true,
+	"css-bundle-assets":  true,
+	"deps":               true,
+	"deps-policy":        true,
+	"dev":                true,
+	"entry-field":        true,
+	"external":           true,
+	"ignore-annotations": true,
+	"keep-names":         true,
+	"legal-comments":     true,
+	"minify":             true,
+	"minify-identifiers": true,
+	"minify-syntax":      true,
+	"minify-whitespace":  true,
+	"namespace":          true,
+	"no-check":           true,
+	"no-dts":             true,
+	"no-require":         true,
+	"node-env":           true,
+	"optional":           true,
+	"peer-deps":          true,
+	"pure":               true,
+	"sourcemap":          true,
+	"strip-directives":   true,
+	"target":             true,
+}
+
+// A BuildDefault sets the default build queries of the packages matched the version range, the
+// boolean queries like `?keep-names` are the flags.
+type BuildDefault struct {
+	Name       string
+	Range      string
+	constraint *semver.Constraints
+	Options    map[string]string
+	Flags      map[string]bool
+}
+
+// BuildDefaults is loaded from the `[etc-dir]/build-defaults.json`, keyed by `name@versionRange`,
+// the entries are kept in the order of the file:
+//
+//	{
+//	  "foo@^2.0.0": { "alias": "react:preact/compat", "keep-names": true }
+//	}
+type BuildDefaults []*BuildDefault
+
+var buildDefaults BuildDefaults
+
+func loadBuildDefaults(filename string) (defaults BuildDefaults, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return parseBuildDefaults(data)
+}
+
+// parseBuildDefaults parses the build defaults in the order of the keys of the JSON object
+func parseBuildDefaults(data []byte) (defaults BuildDefaults, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, e := dec.Token(); e != nil || tok != json.Delim('{') {
+		err = fmt.Errorf("invalid build defaults: not an object")
+		return
+	}
+	keys := []string{}
+	m := map[string]map[string]json.RawMessage{}
+	for dec.More() {
+		var tok json.Token
+		tok, err = dec.Token()
+		if err != nil {
+			return
+		}
+		key := tok.(string)
+		var queries map[string]json.RawMessage
+		err = dec.Decode(&queries)
+		if err != nil {
+			err = fmt.Errorf("invalid build default '%s': %v", key, err)
+			return
+		}
+		if _, ok := m[key]; !ok {
+			keys = append(keys, key)
+		}
+		m[key] = queries
+	}
+	for _, key := range keys {
+		name, versionRange := key, "*"
+		if i := strings.LastIndexByte(key, '@'); i > 0 {
+			name, versionRange = key[:i], key[i+1:]
+		}
+		var c *semver.Constraints
+		c, err = semver.NewConstraint(versionRange)
+		if err != nil {
+			err = fmt.Errorf("invalid build default '%s': %v", key, err)
+			return
+		}
+		d := &BuildDefault{
+			Name:       name,
+			Range:      versionRange,
+			constraint: c,
+			Options:    map[string]string{},
+			Flags:      map[string]bool{},
+		}
+		for query, raw := range m[key] {
+			if !buildDefaultKeys[query] {
+				err = fmt.Errorf("invalid build default '%s': query '%s' can't be set", key, query)
+				return
+			}
+			var value string
+			if string(raw) == "true" {
+				d.Flags[query] = true
+			} else if json.Unmarshal(raw, &value) == nil {
+				d.Options[query] = value
+			} else {
+				err = fmt.Errorf("invalid build default '%s': the value of '%s' must be a string or `true`", key, query)
+				return
+			}
+		}
+		defaults = append(defaults, d)
+	}
+	return
+}
+
+// match returns the defaults that match the package in the order of the file
+func (defaults BuildDefaults) match(pkg Pkg) (matched []*BuildDefault) {
+	if len(defaults) == 0 {
+		return
+	}
+	v, err := semver.NewVersion(pkg.Version)
+	if err != nil {
+		return
+	}
+	for _, d := range defaults {
+		if d.Name == pkg.Name && d.constraint.Check(v) {
+			matched = append(matched, d)
+		}
+	}
+	return
+}
+
+// Apply sets the default build queries of the matched defaults to the request, the queries of the
+// request take precedence and the `false` value of the request turns off the default flag. The
+// first matched default in the order of the file wins. It returns the keys of the matched defaults.
+func (defaults BuildDefaults) Apply(r *http.Request, pkg Pkg) (applied []string) {
+	if r.Form == nil {
+		r.ParseForm()
+	}
+	matched := defaults.match(pkg)
+	if len(matched) == 0 {
+		return
+	}
+	requested := map[string]bool{}
+	for query := range r.Form {
+		requested[query] = true
+	}
+	for _, d := range matched {
+		for query := range d.Flags {
+			if requested[query] {
+				if r.Form.Get(query) == "false" {
+					delete(r.Form, query)
+				}
+				continue
+			}
+			if _, ok := r.Form[query]; !ok {
+				r.Form.Set(query, "")
+			}
+		}
+		for query, value := range d.Options {
+			if _, ok := r.Form[query]; !ok && !requested[query] {
+				r.Form.Set(query, value)
+			}
+		}
+		applied = append(applied, fmt.Sprintf("%s@%s", d.Name, d.Range))
+	}
+	return
+}
+
+// ApplyTask sets the default build options of the matched defaults to the task of a dependency, the
+// options inherited from the importer (`alias`, `deps`, `external`, `target`, `dev`, `node-env` and
+// `deps-policy`) are kept. The first matched default in the order of the file wins. It returns the
+// keys of the matched defaults.
+func (defaults BuildDefaults) ApplyTask(task *BuildTask) (applied []string) {
+	matched := defaults.match(task.Pkg)
+	if len(matched) == 0 {
+		return
+	}
+	set := map[string]bool{}
+	for _, d := range matched {
+		for query := range d.Flags {
+			if !set[query] && task.setDefaultFlag(query) {
+				set[query] = true
+			}
+		}
+		for query, value := range d.Options {
+			if set[query] {
+				continue
+			}
+			if err := task.setDefaultOption(query, value); err != nil {
+				log.Warnf("build default %s@%s of %s: %v", d.Name, d.Range, task.Pkg, err)
+				continue
+			}
+			set[query] = true
+		}
+		applied = append(applied, fmt.Sprintf("%s@%s", d.Name, d.Range))
+	}
+	task.Minify = normalizeMinify(task.Minify, task.DevMode)
+	task.id = ""
+	return
+}
+
+// setDefaultFlag sets the flag query of the build defaults to the task, it returns false if the
+// flag is inherited from the importer.
+func (task *BuildTask) setDefaultFlag(query string) bool {
+	switch query {
+	case "bundle":
+		task.BundleMode = true
+	case "keep-names":
+		task.KeepNames = true
+	case "ignore-annotations":
+		task.IgnoreAnnotations = true
+	case "no-require":
+		task.NoRequire = true
+	case "namespace":
+		task.Namespace = true
+	case "sourcemap":
+		task.Sourcemap = true
+	case "strip-directives":
+		task.StripDirectives = true
+	case "minify":
+		task.Minify = minifyAll
+	case "minify-syntax":
+		task.Minify += "s"
+	case "minify-whitespace":
+		task.Minify += "w"
+	case "minify-identifiers":
+		task.Minify += "i"
+	default:
+		return false
+	}
+	return true
+}
+
+// setDefaultOption sets the option query of the build defaults to the task, the inherited options
+// are ignored.
+func (task *BuildTask) setDefaultOption(query string, value string) (err error) {
+	invalid := func() error {
+		return fmt.Errorf("invalid %s query: %s", query, value)
+	}
+	switch query {
+	case "legal-comments":
+		if _, ok := legalCommentsModes[value]; !ok && value != "eof" {
+			return invalid()
+		}
+		if value == "eof" {
+			value = ""
+		}
+		task.LegalComments = value
+	case "optional":
+		if value != "" && !optionalModes[value] {
+			return invalid()
+		}
+		task.Optional = value
+	case "entry-field":
+		if value != "" && !entryFields[value] {
+			return invalid()
+		}
+		task.EntryField = value
+	case "assets":
+		if value != "" && !assetsModes[value] {
+			return invalid()
+		}
+		if value == "rewrite" {
+			value = ""
+		}
+		task.Assets = value
+	case "css-bundle-assets":
+		if value != "" && !cssBundleAssetsModes[value] {
+			return invalid()
+		}
+		task.CSSBundleAssets = value
+	case "binary":
+		if value != "" && !binaryLoaderModes[value] {
+			return invalid()
+		}
+		task.Binary = value
+	case "peer-deps":
+		if value != "" && !peerDepsModes[value] {
+			return invalid()
+		}
+		if value == "external" {
+			value = ""
+		}
+		task.PeerDeps = value
+	case "pure":
+		var names []string
+		names, err = parsePureQuery(value)
+		if err != nil {
+			return
+		}
+		task.Pure, err = storePure(names)
+		if err != nil {
+			return
+		}
+		task.pureNames = names
+	}
+	return
+}
+
+// effectiveBuildQuery returns the encoded build queries of the request that the build defaults can set
+func effectiveBuildQuery(r *http.Request) string {
+	q := url.Values{}
+	for query, values := range r.Form {
+		if buildDefaultKeys[query] {
+			q[query] = values
+		}
+	}
+	return q.Encode()
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuildDefaults(t *testing.T) {
+	defaults, err := parseBuildDefaults([]byte(`{
+		"foo@^2.0.0": { "alias": "react:preact/compat", "keep-names": true, "target": "es2020" },
+		"foo@>=2.1.0": { "target": "es2022", "no-require": true },
+		"@scope/bar": { "bundle": true }
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apply := func(url string, pkg Pkg) (string, []string) {
+		r := httptest.NewRequest("GET", url, nil)
+		applied := defaults.Apply(r, pkg)
+		return effectiveBuildQuery(r), applied
+	}
+
+	// the defaults are applied to the matched packages
+	query, applied := apply("/foo@2.0.0", Pkg{Name: "foo", Version: "2.0.0"})
+	if query != "alias=react%3Apreact%2Fcompat&keep-names=&target=es2020" || strings.Join(applied, ",") != "foo@^2.0.0" {
+		t.Fatalf("invalid build defaults: %s %v", query, applied)
+	}
+	query, applied = apply("/@scope/bar@1.0.0", Pkg{Name: "@scope/bar", Version: "1.0.0"})
+	if query != "bundle=" || strings.Join(applied, ",") != "@scope/bar@*" {
+		t.Fatalf("invalid build defaults: %s %v", query, applied)
+	}
+
+	// the first matched default in the order of the file wins
+	query, applied = apply("/foo@2.1.0", Pkg{Name: "foo", Version: "2.1.0"})
+	if query != "alias=react%3Apreact%2Fcompat&keep-names=&no-require=&target=es2020" || strings.Join(applied, ",") != "foo@^2.0.0,foo@>=2.1.0" {
+		t.Fatalf("invalid build defaults: %s %v", query, applied)
+	}
+	reversed, err := parseBuildDefaults([]byte(`{"foo@>=2.1.0": {"target": "es2022"}, "foo@^2.0.0": {"target": "es2020"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/foo@2.1.0", nil)
+	if applied := reversed.Apply(r, Pkg{Name: "foo", Version: "2.1.0"}); r.Form.Get("target") != "es2022" || strings.Join(applied, ",") != "foo@>=2.1.0,foo@^2.0.0" {
+		t.Fatalf("the first default in the file should win, got %s %v", r.Form.Get("target"), applied)
+	}
+
+	// the queries of the request take precedence, and `false` turns off the default flag
+	query, _ = apply("/foo@2.0.0?target=es2017&alias=react:react&keep-names=false&dev", Pkg{Name: "foo", Version: "2.0.0"})
+	if query != "alias=react%3Areact&dev=&target=es2017" {
+		t.Fatalf("the queries of the request should take precedence: %s", query)
+	}
+
+	// the unmatched packages are not changed
+	for _, pkg := range []Pkg{{Name: "foo", Version: "1.0.0"}, {Name: "foobar", Version: "2.0.0"}} {
+		query, applied = apply("/"+pkg.String()+"?keep-names=false", pkg)
+		if query != "keep-names=false" || len(applied) != 0 {
+			t.Fatalf("the defaults should not be applied to %s: %s %v", pkg, query, applied)
+		}
+	}
+
+	for _, data := range []string{
+		`{"foo": {"output": "css"}}`,
+		`{"foo": {"target": 2020}}`,
+		`{"foo@abc": {"bundle": true}}`,
+		`["foo"]`,
+	} {
+		if _, err := parseBuildDefaults([]byte(data)); err == nil {
+			t.Fatalf("the build defaults %s should be invalid", data)
+		}
+	}
+}
+
+func TestBuildDefaultsOfDependency(t *testing.T) {
+	defaults, err := parseBuildDefaults([]byte(`{
+		"dep@^1.0.0": { "keep-names": true, "minify-syntax": true, "legal-comments": "none", "target": "es2015", "alias": "a:b" },
+		"dep@1.2.0": { "legal-comments": "inline", "optional": "bad" }
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "dep", Version: "1.2.0"}, Target: "es2022", External: newStringSet()}
+	id := task.ID()
+	applied := defaults.ApplyTask(task)
+	if strings.Join(applied, ",") != "dep@^1.0.0,dep@1.2.0" {
+		t.Fatalf("unexpected applied defaults %v", applied)
+	}
+	// the options inherited from the importer are kept
+	if !task.KeepNames || task.Minify != "s" || task.LegalComments != "none" || task.Target != "es2022" || task.Alias != nil || task.Optional != "" {
+		t.Fatalf("unexpected task options %+v", task)
+	}
+	// the options are in the id of the dependency build
+	if task.ID() == id || !strings.Contains(task.ID(), ".kn") {
+		t.Fatalf("the applied options should be in the build id, got %s", task.ID())
+	}
+
+	task = &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "dep", Version: "2.0.0"}, Target: "es2022", External: newStringSet()}
+	if applied := defaults.ApplyTask(task); len(applied) != 0 || task.ID() != (&BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "dep", Version: "2.0.0"}, Target: "es2022", External: newStringSet()}).ID() {
+		t.Fatalf("the unmatched dependency should not be changed, got %v %s", applied, task.ID())
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+// reason codes of the build errors that are cached in the db
+const (
+	ErrNativeAddon     = "NATIVE_ADDON"
+	ErrNoEntry         = "NO_ENTRY"
+	ErrDepUnresolvable = "DEP_UNRESOLVABLE"
+	ErrTimeout         = "TIMEOUT"
+	ErrOutputTooLarge  = "OUTPUT_TOO_LARGE"
+	ErrEngineMismatch  = "ENGINE_MISMATCH"
+	ErrPackageDenied   = "PACKAGE_DENIED"
+)
+
+// A BuildError is a known build error with reason code, repeat requests of the
+// failed build get the cached error until the `-build-error-ttl` expires.
+type BuildError struct {
+	Code    string
+	Message string
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// toBuildError returns the BuildError of the esbuild error, or nil if the error is unknown.
+func toBuildError(msg string) *BuildError {
+	if strings.HasPrefix(msg, "No loader is configured for \".node\" files") {
+		return &BuildError{ErrNativeAddon, msg}
+	}
+	if strings.HasPrefix(msg, binaryImportErrorPrefix) {
+		return &BuildError{ErrNativeAddon, msg}
+	}
+	if strings.HasPrefix(msg, accessDeniedErrorPrefix) {
+		return &BuildError{ErrPackageDenied, strings.TrimPrefix(msg, accessDeniedErrorPrefix)}
+	}
+	return nil
+}
+
+func buildErrorID(id string) string {
+	return "fail:" + id
+}
+
+// findBuildError returns the cached build error of the build id,
+// the expired error is removed from the db.
+func findBuildError(id string) (buildErr *BuildError, err error) {
+	if buildErrorTTL <= 0 {
+		err = storage.ErrNotFound
+		return
+	}
+	store, modtime, err := db.Get(buildErrorID(id))
+	if err != nil {
+		return
+	}
+	if time.Since(modtime) > buildErrorTTL || store["code"] == "" {
+		db.Delete(buildErrorID(id))
+		err = storage.ErrNotFound
+		return
+	}
+	buildErr = &BuildError{store["code"], store["message"]}
+	return
+}
+
+func storeBuildError(id string, err error) {
+	var buildErr *BuildError
+	if buildErrorTTL <= 0 || !errors.As(err, &buildErr) {
+		return
+	}
+	dbErr := db.Put(
+		buildErrorID(id),
+		"fail",
+		storage.Store{
+			"code":    buildErr.Code,
+			"message": buildErr.Message,
+		},
+	)
+	if dbErr != nil {
+		log.Errorf("db: %v", dbErr)
+	}
+}
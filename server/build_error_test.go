@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+func TestBuildErrorCache(t *testing.T) {
+	defer func(d storage.DB) { db = d }(db)
+	var err error
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	buildErrorTTL = time.Hour
+
+	id := "v87/foo@1.0.0/es2022/foo.js"
+	storeBuildError(id, errors.New("network error"))
+	_, err = findBuildError(id)
+	if err != storage.ErrNotFound {
+		t.Fatal("unknown errors should not be cached")
+	}
+
+	storeBuildError(id, &BuildError{ErrNativeAddon, "No loader is configured for \".node\" files: build/foo.node"})
+	buildErr, err := findBuildError(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildErr.Code != ErrNativeAddon {
+		t.Fatalf("invalid error code: %s", buildErr.Code)
+	}
+
+	buildErrorTTL = time.Nanosecond
+	_, err = findBuildError(id)
+	if err != storage.ErrNotFound {
+		t.Fatal("the expired error should be removed")
+	}
+	buildErrorTTL = time.Hour
+	_, err = findBuildError(id)
+	if err != storage.ErrNotFound {
+		t.Fatal("the expired error should be removed")
+	}
+}
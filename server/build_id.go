@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// computeBuildID returns the build id of the package with the build options, like
+// `v87/react@18.2.0/X-ZGVw/es2022/react.development.js`, the id is the cache key of the build.
+// Every build-significant option is encoded in the id, the boolean options are the suffixes like
+// `.nr` and the string options are the suffixes with value like `.min-sw`, in a fixed order that
+// the bare build URLs are parsed in reverse. The alias, deps and external are sorted in the `X-`
+// args prefix so the order of the queries doesn't matter, and the options are normalized, e.g.
+// `?minify` is the default production build. The registry other than the default one is in the
+// `.rg-` hash. The `CdnOrigin`, the state of the task and the cosmetic queries like `?download`,
+// `?pin` and `?output` are not build-significant.
+func computeBuildID(pkg Pkg, options *BuildTask) string {
+	name := path.Base(pkg.Name)
+	if pkg.Submodule != "" {
+		name = pkg.Submodule
+	}
+	name = strings.TrimSuffix(name, ".js")
+	if options.NoRequire {
+		name += ".nr"
+	}
+	if options.KeepNames {
+		name += ".kn"
+	}
+	if options.IgnoreAnnotations {
+		name += ".ia"
+	}
+	if options.Sourcemap {
+		name += ".sm"
+	}
+	if options.Namespace {
+		name += ".ns"
+	}
+	if options.DepsPolicy == "range" {
+		name += ".dr"
+	} else if options.DepsPolicy == "graph" {
+		name += ".dg-" + options.DepsGraph
+	}
+	if minify := normalizeMinify(options.Minify, options.DevMode); minify != "" {
+		name += ".min-" + minify
+	}
+	if options.LegalComments != "" {
+		name += ".lc-" + options.LegalComments
+	}
+	if options.Optional != "" {
+		name += ".op-" + options.Optional
+	}
+	if options.Pure != "" {
+		name += ".pr-" + options.Pure
+	}
+	if overrides := pkgOverrides.Hash(pkg); overrides != "" {
+		name += ".ov-" + overrides
+	}
+	if registry := registryHash(options.registry); registry != "" {
+		name += ".rg-" + registry
+	}
+	if options.EntryField != "" {
+		name += ".ef-" + options.EntryField
+	}
+	if options.Assets != "" && options.Assets != "rewrite" {
+		name += ".as-" + options.Assets
+	}
+	if options.CSSBundleAssets != "" {
+		name += ".ca-" + options.CSSBundleAssets
+	}
+	if nodeEnv := normalizeNodeEnv(options.NodeEnv, options.DevMode); nodeEnv != "" {
+		name += ".ne-" + nodeEnv
+	}
+	if options.Binary != "" {
+		name += ".bi-" + options.Binary
+	}
+	if options.PeerDeps == "bundle" {
+		name += ".pd-bundle"
+	}
+	if options.StripDirectives {
+		name += ".sd"
+	}
+	if options.DtsBundle {
+		name += ".dtsb"
+	}
+	if options.DevMode {
+		name += ".development"
+	}
+	if options.BundleMode {
+		name += ".bundle"
+	}
+
+	external := options.External
+	if external == nil {
+		external = newStringSet()
+	}
+	id := fmt.Sprintf(
+		"v%d/%s@%s/%s%s/%s.js",
+		options.BuildVersion,
+		pkg.Name,
+		pkg.Version,
+		encodeResolveArgsPrefix(options.Alias, options.Deps, external),
+		options.Target,
+		name,
+	)
+	if options.Target == "types" {
+		id = strings.TrimSuffix(id, ".js")
+	}
+	return id
+}
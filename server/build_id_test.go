@@ -0,0 +1,314 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func newTestBuildOptions() *BuildTask {
+	return &BuildTask{
+		BuildVersion: 87,
+		Target:       "es2022",
+		External:     newStringSet(),
+	}
+}
+
+func TestComputeBuildID(t *testing.T) {
+	react := Pkg{Name: "react", Version: "18.2.0"}
+	for expected, options := range map[string]*BuildTask{
+		"v87/react@18.2.0/es2022/react.js":                     newTestBuildOptions(),
+		"v87/react@18.2.0/es2022/react.development.js":         {BuildVersion: 87, Target: "es2022", DevMode: true},
+		"v87/react@18.2.0/es2022/react.nr.sm.min-sw.bundle.js": {BuildVersion: 87, Target: "es2022", NoRequire: true, Sourcemap: true, Minify: "ws", BundleMode: true},
+		"v87/react@18.2.0/types/react":                         {BuildVersion: 87, Target: "types"},
+	} {
+		if id := computeBuildID(react, options); id != expected {
+			t.Fatalf("computeBuildID should be '%s', got '%s'", expected, id)
+		}
+	}
+
+	id := computeBuildID(Pkg{Name: "@emotion/react", Version: "11.0.0", Submodule: "jsx-runtime.js"}, newTestBuildOptions())
+	if id != "v87/@emotion/react@11.0.0/es2022/jsx-runtime.js" {
+		t.Fatalf("unexpected id of the submodule: %s", id)
+	}
+
+	// the id is cached by the task
+	task := newTestBuildOptions()
+	task.Pkg = react
+	if task.ID() != computeBuildID(react, task) || task.ID() != task.id {
+		t.Fatal("the task id should be the computed build id")
+	}
+}
+
+func TestComputeBuildIDStability(t *testing.T) {
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	options := func() *BuildTask {
+		o := newTestBuildOptions()
+		o.Alias = map[string]string{"react": "preact/compat", "react-dom": "preact/compat"}
+		o.Deps = PkgSlice{{Name: "preact", Version: "10.0.0"}, {Name: "bar", Version: "2.0.0"}}
+		o.External.Add("lodash")
+		o.External.Add("axios")
+		o.Minify = "s"
+		o.Pure = "abc123"
+		return o
+	}
+	id := computeBuildID(pkg, options())
+	for i := 0; i < 100; i++ {
+		if computeBuildID(pkg, options()) != id {
+			t.Fatal("the build id should be stable")
+		}
+	}
+
+	// the order of the alias, deps and external doesn't matter
+	o := options()
+	o.Deps = PkgSlice{{Name: "bar", Version: "2.0.0"}, {Name: "preact", Version: "10.0.0"}}
+	o.External = newStringSet()
+	o.External.Add("axios")
+	o.External.Add("lodash")
+	o.Alias = map[string]string{"react-dom": "preact/compat", "react": "preact/compat"}
+	if computeBuildID(pkg, o) != id {
+		t.Fatal("the build id should not depend on the order of the options")
+	}
+
+	// the non-significant fields are excluded
+	o = options()
+	o.CdnOrigin = "https://cdn.example.com"
+	o.wd = "/tmp/esm-build"
+	o.stage = "build"
+	o.noCache = true
+	o.noStore = true
+	o.pureNames = []string{"foo"}
+	if computeBuildID(pkg, o) != id {
+		t.Fatal("the build id should not depend on the non-significant fields")
+	}
+
+	// the nil external is the same as the empty one
+	o = newTestBuildOptions()
+	o.External = nil
+	if computeBuildID(pkg, o) != computeBuildID(pkg, newTestBuildOptions()) {
+		t.Fatal("the nil external should be the same as the empty one")
+	}
+}
+
+func TestComputeBuildIDNormalization(t *testing.T) {
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	base := computeBuildID(pkg, newTestBuildOptions())
+	for name, mutate := range map[string]func(o *BuildTask){
+		"minify all":         func(o *BuildTask) { o.Minify = minifyAll },
+		"assets rewrite":     func(o *BuildTask) { o.Assets = "rewrite" },
+		"exact deps policy":  func(o *BuildTask) { o.DepsPolicy = "exact" },
+		"graph without pins": func(o *BuildTask) { o.DepsGraph = "abc" },
+		"production env":     func(o *BuildTask) { o.NodeEnv = "production" },
+	} {
+		o := newTestBuildOptions()
+		mutate(o)
+		if id := computeBuildID(pkg, o); id != base {
+			t.Fatalf("the %s should be the default build, got '%s'", name, id)
+		}
+	}
+
+	a := newTestBuildOptions()
+	a.Minify = "iws"
+	b := newTestBuildOptions()
+	b.Minify = "swi"
+	b.DevMode = true
+	a.DevMode = true
+	if computeBuildID(pkg, a) != computeBuildID(pkg, b) {
+		t.Fatal("the order of the minify options should not matter")
+	}
+}
+
+func TestComputeBuildIDDistinctness(t *testing.T) {
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	mutators := map[string]func(o *BuildTask){
+		"version":            func(o *BuildTask) { o.BuildVersion = 86 },
+		"target":             func(o *BuildTask) { o.Target = "es2020" },
+		"deno":               func(o *BuildTask) { o.Target = "deno" },
+		"alias":              func(o *BuildTask) { o.Alias = map[string]string{"react": "preact/compat"} },
+		"deps":               func(o *BuildTask) { o.Deps = PkgSlice{{Name: "react", Version: "18.2.0"}} },
+		"external":           func(o *BuildTask) { o.External.Add("react") },
+		"dev":                func(o *BuildTask) { o.DevMode = true },
+		"bundle":             func(o *BuildTask) { o.BundleMode = true },
+		"no-require":         func(o *BuildTask) { o.NoRequire = true },
+		"keep-names":         func(o *BuildTask) { o.KeepNames = true },
+		"ignore-annotations": func(o *BuildTask) { o.IgnoreAnnotations = true },
+		"sourcemap":          func(o *BuildTask) { o.Sourcemap = true },
+		"namespace":          func(o *BuildTask) { o.Namespace = true },
+		"deps-range":         func(o *BuildTask) { o.DepsPolicy = "range" },
+		"deps-graph":         func(o *BuildTask) { o.DepsPolicy = "graph"; o.DepsGraph = "abc" },
+		"deps-graph-2":       func(o *BuildTask) { o.DepsPolicy = "graph"; o.DepsGraph = "def" },
+		"minify-syntax":      func(o *BuildTask) { o.Minify = "s" },
+		"minify-sw":          func(o *BuildTask) { o.Minify = "sw" },
+		"legal-comments":     func(o *BuildTask) { o.LegalComments = "none" },
+		"legal-inline":       func(o *BuildTask) { o.LegalComments = "inline" },
+		"optional":           func(o *BuildTask) { o.Optional = "stub" },
+		"pure":               func(o *BuildTask) { o.Pure = "abc" },
+		"entry-field":        func(o *BuildTask) { o.EntryField = "unpkg" },
+		"assets":             func(o *BuildTask) { o.Assets = "strip" },
+		"assets-keep":        func(o *BuildTask) { o.Assets = "keep" },
+		"css-assets":         func(o *BuildTask) { o.CSSBundleAssets = "url" },
+		"css-assets-2":       func(o *BuildTask) { o.CSSBundleAssets = "inline" },
+		"node-env":           func(o *BuildTask) { o.NodeEnv = "test" },
+		"node-env-dev":       func(o *BuildTask) { o.NodeEnv = "development" },
+		"binary":             func(o *BuildTask) { o.Binary = "empty" },
+		"binary-file":        func(o *BuildTask) { o.Binary = "file" },
+		"peer-deps":          func(o *BuildTask) { o.PeerDeps = "bundle" },
+		"strip-directives":   func(o *BuildTask) { o.StripDirectives = true },
+		"types":              func(o *BuildTask) { o.Target = "types" },
+		"dts-bundle":         func(o *BuildTask) { o.Target = "types"; o.DtsBundle = true },
+	}
+
+	ids := map[string]string{computeBuildID(pkg, newTestBuildOptions()): "default"}
+	for name, mutate := range mutators {
+		o := newTestBuildOptions()
+		mutate(o)
+		id := computeBuildID(pkg, o)
+		if prev, ok := ids[id]; ok {
+			t.Fatalf("the build id of '%s' collides with '%s': %s", name, prev, id)
+		}
+		ids[id] = name
+	}
+
+	// every combination of the boolean options is distinct
+	flags := []func(o *BuildTask){
+		func(o *BuildTask) { o.DevMode = true },
+		func(o *BuildTask) { o.BundleMode = true },
+		func(o *BuildTask) { o.NoRequire = true },
+		func(o *BuildTask) { o.KeepNames = true },
+		func(o *BuildTask) { o.IgnoreAnnotations = true },
+		func(o *BuildTask) { o.Sourcemap = true },
+		func(o *BuildTask) { o.Namespace = true },
+		func(o *BuildTask) { o.StripDirectives = true },
+	}
+	combinations := map[string]int{}
+	for mask := 0; mask < 1<<len(flags); mask++ {
+		o := newTestBuildOptions()
+		for i, set := range flags {
+			if mask&(1<<i) != 0 {
+				set(o)
+			}
+		}
+		id := computeBuildID(pkg, o)
+		if prev, ok := combinations[id]; ok {
+			t.Fatalf("the build id of the flags %b collides with %b: %s", mask, prev, id)
+		}
+		combinations[id] = mask
+	}
+
+	// the args of different kinds don't collide
+	a := newTestBuildOptions()
+	a.External.Add("react")
+	b := newTestBuildOptions()
+	b.Alias = map[string]string{"react": ""}
+	c := newTestBuildOptions()
+	c.Deps = PkgSlice{{Name: "react"}}
+	if computeBuildID(pkg, a) == computeBuildID(pkg, b) || computeBuildID(pkg, a) == computeBuildID(pkg, c) || computeBuildID(pkg, b) == computeBuildID(pkg, c) {
+		t.Fatal("the alias, deps and external should not collide")
+	}
+}
+
+func TestComputeBuildIDWithOverrides(t *testing.T) {
+	defer func(o PackageOverrides) { pkgOverrides = o }(pkgOverrides)
+	parse := func(data string) PackageOverrides {
+		var m map[string]map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			t.Fatal(err)
+		}
+		overrides, err := parsePackageOverrides(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return overrides
+	}
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	base := computeBuildID(pkg, newTestBuildOptions())
+
+	pkgOverrides = parse(`{"foo@<2.0.0": {"module": "esm/index.js"}, "bar": {"main": null}}`)
+	id := computeBuildID(pkg, newTestBuildOptions())
+	if id == base || !strings.HasPrefix(id, "v87/foo@1.0.0/es2022/foo.ov-") {
+		t.Fatalf("the matched overrides should be in the build id, got %s", id)
+	}
+	// the formatting of the file doesn't matter
+	pkgOverrides = parse(`{ "foo@<2.0.0": { "module":  "esm/index.js" } }`)
+	if computeBuildID(pkg, newTestBuildOptions()) != id {
+		t.Fatal("the build id should not depend on the formatting of the overrides")
+	}
+	// the changed override gets a new build id
+	pkgOverrides = parse(`{"foo@<2.0.0": {"module": "esm/index.mjs"}}`)
+	if changed := computeBuildID(pkg, newTestBuildOptions()); changed == id || changed == base {
+		t.Fatalf("the changed overrides should change the build id, got %s", changed)
+	}
+	// the unmatched packages are not changed
+	if computeBuildID(Pkg{Name: "foo", Version: "2.0.0"}, newTestBuildOptions()) != "v87/foo@2.0.0/es2022/foo.js" {
+		t.Fatal("the build id of the unmatched package should not be changed")
+	}
+}
+
+func TestBareBuildURLHashes(t *testing.T) {
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS) {
+		log, embedFS, db, fs = l, e, d, f
+	}(log, embedFS, db, fs)
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	defer func(o PackageOverrides) { pkgOverrides = o }(pkgOverrides)
+	var err error
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryLimiter = newRateLimiter(0, time.Minute)
+	var m map[string]map[string]json.RawMessage
+	err = json.Unmarshal([]byte(`{"foo@1.0.0": {"module": "esm/index.js"}}`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgOverrides, err = parsePackageOverrides(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022"}
+	id := task.ID()
+	err = fs.WriteData(path.Join("builds", id), []byte("export default 1;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ov := ".ov-" + pkgOverrides.Hash(task.Pkg)
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+	for url, status := range map[string]int{
+		"/" + id: 200,
+		// the hash of the overrides that don't match the current overrides
+		"/" + strings.Replace(id, ov, ".ov-0123456789", 1): 404,
+		"/" + strings.Replace(id, ov, ".ov-garbage", 1):    404,
+		// the malformed hash of the pure names
+		"/" + strings.Replace(id, ov, ".pr-garbage"+ov, 1): 400,
+	} {
+		res, err := http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s: expected %d, got %d", url, status, res.StatusCode)
+		}
+	}
+}
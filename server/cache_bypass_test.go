@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestCacheBypass(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/foo":
+			fmt.Fprint(w, `{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0","module":"index.js","types":"index.d.ts"}}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer registry.Close()
+
+	// the fake yarn installs the fresh source of the package
+	bin := t.TempDir()
+	err := os.WriteFile(path.Join(bin, "yarn"), []byte(`#!/bin/sh
+mkdir -p node_modules/foo
+echo '{"name":"foo","version":"1.0.0","module":"index.js","types":"index.d.ts"}' > node_modules/foo/package.json
+echo 'export default "__FRESH__";' > node_modules/foo/index.js
+echo 'declare const foo: string; export default foo;' > node_modules/foo/index.d.ts
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS, c storage.Cache, n *Node) {
+		log, embedFS, db, fs, cache, node = l, e, d, f, c, n
+	}(log, embedFS, db, fs, cache, node)
+	defer waitPrecompress()
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	defer func(token string) { adminToken = token }(adminToken)
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node = &Node{npmRegistry: registry.URL + "/"}
+	registryLimiter = newRateLimiter(0, time.Minute)
+	adminToken = "secret"
+
+	// the cached build and its stale variant
+	task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022"}
+	savePath := path.Join("builds", task.ID())
+	for name, data := range map[string]string{savePath: "export default \"__CACHED__\";\n", savePath + ".gz": "stale"} {
+		err = fs.WriteData(name, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Put(task.ID(), "build", storage.Store{"meta": "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFile := func(name string) string {
+		_, size, _, err := fs.Exists(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := fs.ReadFile(name, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+	get := func(query string, token string) (int, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/foo@1.0.0?target=es2022&%s", server.URL, query), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(data)
+	}
+
+	// the bypass is for the admins only
+	for _, token := range []string{"", "wrong"} {
+		for _, mode := range []string{"no-store", "reload"} {
+			if status, _ := get("cache="+mode, token); status != 403 {
+				t.Fatalf("the bypass without the admin token should be forbidden, got %d", status)
+			}
+		}
+	}
+
+	// `no-store` builds fresh and leaves the cached build untouched
+	status, code := get("cache=no-store", "secret")
+	if status != 200 || !strings.Contains(code, "__FRESH__") {
+		t.Fatalf("the fresh build should be returned, got %d: %s", status, code)
+	}
+	if data := readFile(savePath); !strings.Contains(data, "__CACHED__") {
+		t.Fatalf("the cached build should not be changed: %s", data)
+	}
+
+	// `reload` overwrites the cached build and rewrites the variants before it's served
+	if status, _ = get("cache=reload", "secret"); status != 200 {
+		t.Fatalf("the reload should succeed, got %d", status)
+	}
+	if data := readFile(savePath); !strings.Contains(data, "__FRESH__") {
+		t.Fatalf("the cached build should be overwritten: %s", data)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader([]byte(readFile(savePath + ".gz"))))
+	if err != nil {
+		t.Fatalf("the stale variant should be rewritten: %v", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil || !strings.Contains(string(data), "__FRESH__") {
+		t.Fatalf("the variant should be the fresh build: %s %v", data, err)
+	}
+}
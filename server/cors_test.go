@@ -0,0 +1,37 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCorsExposedHeaders(t *testing.T) {
+	exposed := map[string]bool{}
+	for _, header := range corsExposedHeaders {
+		exposed[header] = true
+	}
+
+	// every `X-Esm-*` response header is readable by the cross-origin clients
+	regSetHeader := regexp.MustCompile(`(?:SetHeader|\.Set)\("(X-Esm-[\w-]+)"`)
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range regSetHeader.FindAllStringSubmatch(string(data), -1) {
+			if !exposed[m[1]] {
+				t.Fatalf("the header %s of %s is not exposed to the cross-origin clients", m[1], file)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// the modes of the `?css-bundle-assets` query: `inline` inlines all the fonts and images referenced by
+// the `url()` of the package CSS as data URLs, `url` rewrites the larger ones to the raw file URLs.
+var cssBundleAssetsModes = map[string]bool{
+	"inline": true,
+	"url":    true,
+}
+
+// the assets of the `url()` in the `url` mode are inlined if they are not larger than the
+// limit, set by the `-css-inline-limit` flag
+var cssInlineLimit int64 = 8 * 1024
+
+// the fonts and images that can be referenced by the package CSS, all of them are served by the raw passthrough
+var cssAssetExts = map[string]bool{
+	".svg":   true,
+	".png":   true,
+	".jpg":   true,
+	".gif":   true,
+	".webp":  true,
+	".eot":   true,
+	".ttf":   true,
+	".otf":   true,
+	".woff":  true,
+	".woff2": true,
+}
+
+// cssAssetsPlugin resolves the `url()` assets of the package CSS, it runs before the resolver plugin
+// to keep the assets out of the externals. In the `url` mode, the assets larger than the inline limit
+// are rewritten to the raw file URLs, others are inlined by the data URL loader.
+func (task *BuildTask) cssAssetsPlugin(warnings *stringSet) api.Plugin {
+	return api.Plugin{
+		Name: "esm.sh-css-assets",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(
+				api.OnResolveOptions{Filter: `\.(svg|png|jpg|gif|webp|eot|ttf|otf|woff2?)([?#].*)?$`},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if args.Kind != api.ResolveCSSURLToken || strings.HasPrefix(args.Path, "data:") || strings.Contains(args.Path, "://") {
+						return api.OnResolveResult{}, nil
+					}
+					// keep the suffix like `?#iefix` of the font URLs
+					assetPath, suffix := args.Path, ""
+					if i := strings.IndexAny(assetPath, "?#"); i >= 0 {
+						assetPath, suffix = assetPath[:i], assetPath[i:]
+					}
+					filename := assetPath
+					if !strings.HasPrefix(filename, "/") {
+						filename = path.Join(args.ResolveDir, assetPath)
+					}
+					fi, err := os.Stat(filename)
+					if err != nil || fi.IsDir() {
+						warnings.Add(fmt.Sprintf("css asset '%s' not found", args.Path))
+						return api.OnResolveResult{}, nil
+					}
+					if task.CSSBundleAssets == "inline" || fi.Size() <= cssInlineLimit {
+						return api.OnResolveResult{Path: filename}, nil
+					}
+					pkg, ok := findAssetPackage(path.Join(task.wd, "node_modules"), filename)
+					if !ok {
+						return api.OnResolveResult{Path: filename}, nil
+					}
+					if err := storeRawAsset(pkg, filename); err != nil {
+						log.Warnf("store css asset %s: %v", pkg, err)
+					}
+					url := fmt.Sprintf("%s%s/%s?raw", task.CdnOrigin, basePath, pkg)
+					if strings.HasPrefix(suffix, "?") {
+						suffix = strings.TrimPrefix(suffix, "?")
+						if suffix != "" && suffix[0] != '#' {
+							suffix = "&" + suffix
+						}
+					}
+					return api.OnResolveResult{Path: url + suffix, External: true}, nil
+				},
+			)
+		},
+	}
+}
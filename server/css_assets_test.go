@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestCSSAssetsPlugin(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(v int64) { cssInlineLimit = v }(cssInlineLimit)
+	cssInlineLimit = 1024
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json":    `{"name":"foo","version":"1.0.0","module":"index.js"}`,
+		"index.js":        `import "./style.css"; export default "foo";`,
+		"style.css":       `@font-face { font-family: Foo; src: url("./fonts/foo.eot?#iefix") format("embedded-opentype"), url(./fonts/foo.woff2) format("woff2"); } .logo { background: url(./img/logo.png); }`,
+		"fonts/foo.eot":   strings.Repeat("e", 2048),
+		"fonts/foo.woff2": strings.Repeat("w", 2048),
+		"img/logo.png":    "PNG",
+	})
+
+	build := func(mode string) string {
+		task := &BuildTask{wd: wd, CdnOrigin: "https://esm.sh", CSSBundleAssets: mode, External: newStringSet()}
+		loader := map[string]api.Loader{}
+		for ext := range cssAssetExts {
+			loader[ext] = api.LoaderDataURL
+		}
+		result := api.Build(api.BuildOptions{
+			EntryPoints: []string{path.Join(wd, "node_modules/foo/index.js")},
+			Outdir:      "/esbuild",
+			Bundle:      true,
+			Format:      api.FormatESModule,
+			Write:       false,
+			Loader:      loader,
+			Plugins:     []api.Plugin{task.cssAssetsPlugin(newStringSet())},
+		})
+		if len(result.Errors) > 0 {
+			t.Fatal(result.Errors[0].Text)
+		}
+		for _, file := range result.OutputFiles {
+			if strings.HasSuffix(file.Path, ".css") {
+				return string(file.Contents)
+			}
+		}
+		t.Fatal("no css output")
+		return ""
+	}
+
+	css := build("url")
+	for _, s := range []string{
+		`url(https://esm.sh/foo@1.0.0/fonts/foo.eot?raw#iefix)`,
+		`url(https://esm.sh/foo@1.0.0/fonts/foo.woff2?raw)`,
+		`url(data:image/png;base64,`,
+	} {
+		if !strings.Contains(css, s) {
+			t.Fatalf("'%s' not found in the css: %s", s, css)
+		}
+	}
+	for _, name := range []string{"raw/foo@1.0.0/fonts/foo.eot", "raw/foo@1.0.0/fonts/foo.woff2"} {
+		if exists, _, _, _ := fs.Exists(name); !exists {
+			t.Fatalf("the css asset '%s' should be stored", name)
+		}
+	}
+	if exists, _, _, _ := fs.Exists("raw/foo@1.0.0/img/logo.png"); exists {
+		t.Fatal("the inlined css asset should not be stored")
+	}
+
+	css = build("inline")
+	if strings.Contains(css, "https://esm.sh/") || strings.Count(css, "url(data:") != 3 {
+		t.Fatalf("all the css assets should be inlined: %s", css)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the limits of walking the dependency graph, set by the `-deps-graph-max-depth` and the
+// `-deps-graph-max-nodes` flags, 0 means no limit
+var (
+	depsGraphMaxDepth int
+	depsGraphMaxNodes int
+)
+
+// A DepsGraph is the resolved dependency graph of a package
+type DepsGraph struct {
+	Root      Pkg                  `json:"root"`
+	Nodes     map[string]*DepsNode `json:"nodes"`
+	Truncated bool                 `json:"truncated,omitempty"` // the walking exceeded the limits, the graph is partial
+}
+
+// A DepsNode is a package with exact version in the dependency graph
+type DepsNode struct {
+	Pkg      Pkg               `json:"pkg"`
+	Deps     []string          `json:"deps,omitempty"`
+	Requires map[string]string `json:"requires,omitempty"` // the declared version ranges of the deps
+}
+
+// resolveDepsGraph walks the dependency tree(`dependencies` and `peerDependencies`) of the
+// root package, the `fetch` function resolves the package info by a version or semver range.
+// The walking stops at the `maxDepth`(the root is 0) and the `maxNodes` packages, the graph is
+// marked as truncated if any package is left out, 0 means no limit.
+func resolveDepsGraph(root Pkg, maxDepth int, maxNodes int, fetch func(name string, version string) (NpmPackage, error)) (graph *DepsGraph, err error) {
+	graph = &DepsGraph{
+		Root:  Pkg{Name: root.Name, Version: root.Version},
+		Nodes: map[string]*DepsNode{},
+	}
+	type queueItem struct {
+		pkg   Pkg
+		depth int
+	}
+	queue := []queueItem{{graph.Root, 0}}
+	// the packages in the graph or in the queue
+	seen := map[string]bool{graph.Root.String(): true}
+	for len(queue) > 0 {
+		pkg, depth := queue[0].pkg, queue[0].depth
+		queue = queue[1:]
+		key := pkg.String()
+		if _, ok := graph.Nodes[key]; ok {
+			continue
+		}
+
+		var info NpmPackage
+		info, err = fetch(pkg.Name, pkg.Version)
+		if err != nil {
+			return
+		}
+
+		deps := map[string]string{}
+		for name, version := range info.PeerDependencies {
+			deps[name] = version
+		}
+		for name, version := range info.Dependencies {
+			deps[name] = version
+		}
+		node := &DepsNode{Pkg: Pkg{Name: info.Name, Version: info.Version}, Requires: deps}
+		graph.Nodes[key] = node
+
+		names := make([]string, 0, len(deps))
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		// the deps of the deepest packages are not resolved
+		if maxDepth > 0 && depth >= maxDepth && len(names) > 0 {
+			graph.Truncated = true
+			continue
+		}
+		for _, name := range names {
+			if maxNodes > 0 && len(seen) >= maxNodes {
+				graph.Truncated = true
+				break
+			}
+			var dep NpmPackage
+			dep, err = fetch(name, deps[name])
+			if err != nil {
+				return
+			}
+			p := Pkg{Name: dep.Name, Version: dep.Version}
+			node.Deps = append(node.Deps, p.String())
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				queue = append(queue, queueItem{p, depth + 1})
+			}
+		}
+	}
+	return
+}
+
+// Pkgs returns all packages of the graph sorted by name and version.
+func (g *DepsGraph) Pkgs() PkgSlice {
+	pkgs := make(PkgSlice, 0, len(g.Nodes))
+	for _, node := range g.Nodes {
+		pkgs = append(pkgs, node.Pkg)
+	}
+	sort.Sort(pkgs)
+	return pkgs
+}
+
+// Pins collapses the graph to single versions: a package is pinned to the highest resolved version
+// that satisfies all declared ranges in the graph, the packages can't be collapsed are not pinned.
+func (g *DepsGraph) Pins() map[string]string {
+	versions := map[string][]*semver.Version{}
+	ranges := map[string][]*semver.Constraints{}
+	for _, node := range g.Nodes {
+		v, err := semver.NewVersion(node.Pkg.Version)
+		if err == nil {
+			versions[node.Pkg.Name] = append(versions[node.Pkg.Name], v)
+		}
+		for name, r := range node.Requires {
+			// ignore dist tags like `latest`
+			c, err := semver.NewConstraint(r)
+			if err == nil {
+				ranges[name] = append(ranges[name], c)
+			}
+		}
+	}
+	pins := map[string]string{}
+	for name, vs := range versions {
+		sort.Sort(sort.Reverse(semver.Collection(vs)))
+	Check:
+		for _, v := range vs {
+			for _, c := range ranges[name] {
+				if !c.Check(v) {
+					continue Check
+				}
+			}
+			pins[name] = v.Original()
+			break
+		}
+	}
+	return pins
+}
+
+// hashPins returns a short hash of the pinned versions for the build id
+func hashPins(pins map[string]string) string {
+	names := make([]string, 0, len(pins))
+	for name := range pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha1.New()
+	for _, name := range names {
+		h.Write([]byte(name + "@" + pins[name] + "\n"))
+	}
+	return strings.ToLower(hex.EncodeToString(h.Sum(nil))[:10])
+}
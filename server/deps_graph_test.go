@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDepsGraphPins(t *testing.T) {
+	registry := map[string]NpmPackage{
+		"app@1.0.0": {Name: "app", Version: "1.0.0", Dependencies: map[string]string{"a": "^1.0.0", "b": "^1.0.0", "c": "^1.0.0"}},
+		"a@1.0.0":   {Name: "a", Version: "1.0.0", Dependencies: map[string]string{"c": "~1.1.0"}},
+		"b@1.0.0":   {Name: "b", Version: "1.0.0", Dependencies: map[string]string{"d": "^2.0.0"}},
+		"c@1.2.0":   {Name: "c", Version: "1.2.0"},
+		"c@1.1.0":   {Name: "c", Version: "1.1.0"},
+		"d@2.0.0":   {Name: "d", Version: "2.0.0", Dependencies: map[string]string{"e": "^1.0.0"}},
+		"e@1.0.0":   {Name: "e", Version: "1.0.0"},
+	}
+	resolved := map[string]string{
+		"app@1.0.0": "app@1.0.0",
+		"a@^1.0.0":  "a@1.0.0",
+		"b@^1.0.0":  "b@1.0.0",
+		"c@^1.0.0":  "c@1.2.0",
+		"c@~1.1.0":  "c@1.1.0",
+		"d@^2.0.0":  "d@2.0.0",
+		"e@^1.0.0":  "e@1.0.0",
+	}
+	fetch := func(name string, version string) (info NpmPackage, err error) {
+		if info, ok := registry[name+"@"+version]; ok {
+			return info, nil
+		}
+		key, ok := resolved[name+"@"+version]
+		if !ok {
+			err = fmt.Errorf("npm: version '%s' of '%s' not found", version, name)
+			return
+		}
+		return registry[key], nil
+	}
+
+	graph, err := resolveDepsGraph(Pkg{Name: "app", Version: "1.0.0"}, 0, 0, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 7 {
+		t.Fatalf("invalid nodes: %v", graph.Pkgs())
+	}
+
+	pins := graph.Pins()
+	// `c@1.2.0` doesn't satisfy `~1.1.0` required by `a`, collapse to `c@1.1.0`
+	for name, version := range map[string]string{"app": "1.0.0", "a": "1.0.0", "b": "1.0.0", "c": "1.1.0", "d": "2.0.0", "e": "1.0.0"} {
+		if pins[name] != version {
+			t.Fatalf("invalid pin of %s: %s, expected %s", name, pins[name], version)
+		}
+	}
+	if hashPins(pins) != hashPins(graph.Pins()) {
+		t.Fatal("the pins hash should be stable")
+	}
+}
+
+func TestDepsGraphLimits(t *testing.T) {
+	// a synthetic graph: the chain `pkg-0 -> pkg-1 -> ... -> pkg-99`, and `wide` depends on 100 packages
+	fetch := func(name string, version string) (info NpmPackage, err error) {
+		info = NpmPackage{Name: name, Version: "1.0.0", Dependencies: map[string]string{}}
+		var i int
+		if _, e := fmt.Sscanf(name, "pkg-%d", &i); e == nil && i < 99 {
+			info.Dependencies[fmt.Sprintf("pkg-%d", i+1)] = "^1.0.0"
+		}
+		if name == "wide" {
+			for i := 0; i < 100; i++ {
+				info.Dependencies[fmt.Sprintf("leaf-%02d", i)] = "^1.0.0"
+			}
+		}
+		return
+	}
+
+	// no limits
+	graph, err := resolveDepsGraph(Pkg{Name: "pkg-0", Version: "1.0.0"}, 0, 0, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 100 || graph.Truncated {
+		t.Fatalf("the whole graph should be resolved, got %d nodes", len(graph.Nodes))
+	}
+
+	// the deep graph is truncated at the max depth
+	graph, err = resolveDepsGraph(Pkg{Name: "pkg-0", Version: "1.0.0"}, 10, 0, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 11 || !graph.Truncated {
+		t.Fatalf("the graph should be truncated at the depth 10, got %d nodes", len(graph.Nodes))
+	}
+	if node := graph.Nodes["pkg-10@1.0.0"]; node == nil || len(node.Deps) != 0 {
+		t.Fatalf("the deps of the deepest package should not be resolved: %v", node)
+	}
+
+	// the wide graph is truncated at the max nodes
+	var fetched int
+	graph, err = resolveDepsGraph(Pkg{Name: "wide", Version: "1.0.0"}, 0, 20, func(name string, version string) (NpmPackage, error) {
+		fetched++
+		return fetch(name, version)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 20 || !graph.Truncated {
+		t.Fatalf("the graph should be truncated at 20 nodes, got %d nodes", len(graph.Nodes))
+	}
+	if fetched > 40 {
+		t.Fatalf("the walking should stop fetching at the limit, fetched %d times", fetched)
+	}
+
+	// the graph within the limits is not truncated
+	graph, err = resolveDepsGraph(Pkg{Name: "pkg-90", Version: "1.0.0"}, 10, 10, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 10 || graph.Truncated {
+		t.Fatalf("the graph within the limits should not be truncated, got %d nodes", len(graph.Nodes))
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestDepsPolicyBuild(t *testing.T) {
+	defer func(l *logx.Logger, d storage.DB, f storage.FS, q *BuildQueue) {
+		log, db, fs, buildQueue = l, d, f, q
+	}(log, db, fs, buildQueue)
+	var err error
+	log = &logx.Logger{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the queue without slots keeps the dependency builds waiting
+	buildQueue = newBuildQueue(0)
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "app", map[string]string{
+		"package.json": `{"name":"app","version":"1.0.0","module":"index.js","types":"index.d.ts","dependencies":{"dep":"^1.0.0"}}`,
+		"index.d.ts":   `export default string;`,
+		"index.js":     `import dep from "dep"; export default dep;`,
+	})
+	writeFixture(t, wd, "dep", map[string]string{
+		"package.json": `{"name":"dep","version":"1.2.0","module":"index.js"}`,
+		"index.js":     `export default "dep";`,
+	})
+
+	build := func(depsPolicy string) string {
+		task := &BuildTask{
+			wd:           wd,
+			BuildVersion: VERSION,
+			Pkg:          Pkg{Name: "app", Version: "1.0.0"},
+			Target:       "es2022",
+			DepsPolicy:   depsPolicy,
+			External:     newStringSet(),
+			noStore:      true,
+		}
+		_, err := task.build(newStringSet())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(task.output)
+	}
+
+	// the `exact` policy pins the resolved version
+	if code := build("exact"); !strings.Contains(code, fmt.Sprintf("/v%d/dep@1.2.0/es2022/dep.js", VERSION)) {
+		t.Fatalf("the dependency should be pinned: %s", code)
+	}
+	// the `range` policy keeps the declared range
+	if code := build("range"); !strings.Contains(code, fmt.Sprintf("/v%d/dep@%%5E1.0.0/es2022/dep.js", VERSION)) || strings.Contains(code, "dep@1.2.0") {
+		t.Fatalf("the dependency should keep the declared range: %s", code)
+	}
+}
+
+func TestDepsPolicyQuery(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/dep":
+			fmt.Fprint(w, `{"dist-tags":{"latest":"1.2.0"},"versions":{"1.0.0":{"name":"dep","version":"1.0.0"},"1.2.0":{"name":"dep","version":"1.2.0"}}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer registry.Close()
+
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS, c storage.Cache, n *Node, q *BuildQueue) {
+		log, embedFS, db, fs, cache, node, buildQueue = l, e, d, f, c, n, q
+	}(log, embedFS, db, fs, cache, node, buildQueue)
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	defer func(p string) { defaultDepsPolicy = p }(defaultDepsPolicy)
+	var err error
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node = &Node{npmRegistry: registry.URL + "/"}
+	registryLimiter = newRateLimiter(0, time.Minute)
+	buildQueue = newBuildQueue(0)
+	defaultDepsPolicy = "range"
+
+	// the stored builds of the `exact` and `range` policies and the dependency
+	ids := map[string]string{}
+	for _, task := range []*BuildTask{
+		{BuildVersion: VERSION, Pkg: Pkg{Name: "app", Version: "1.0.0"}, Target: "es2022", DepsPolicy: "exact"},
+		{BuildVersion: VERSION, Pkg: Pkg{Name: "app", Version: "1.0.0"}, Target: "es2022", DepsPolicy: "range"},
+		{BuildVersion: VERSION, Pkg: Pkg{Name: "dep", Version: "1.2.0"}, Target: "es2022"},
+	} {
+		if task.DepsPolicy != "" {
+			ids[task.DepsPolicy] = task.ID()
+		}
+		err = fs.WriteData(path.Join("builds", task.ID()), []byte("export default 1;\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Put(task.ID(), "build", storage.Store{"meta": "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	get := func(url string) (*http.Response, string) {
+		res, err := http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(data)
+	}
+
+	// the server default applies without the query, and the `?deps-policy` query overrides it
+	for url, policy := range map[string]string{
+		"/app@1.0.0?target=es2022":                   "range",
+		"/app@1.0.0?target=es2022&deps-policy=exact": "exact",
+	} {
+		res, code := get(url)
+		if res.StatusCode != 200 || !strings.Contains(code, "/"+ids[policy]) {
+			t.Fatalf("%s should import the build of the '%s' policy %s, got %d: %s", url, policy, ids[policy], res.StatusCode, code)
+		}
+	}
+
+	// the range is not cached as immutable since it resolves to the new releases
+	res, _ := get(fmt.Sprintf("/v%d/dep@%%5E1.0.0/es2022/dep.js", VERSION))
+	if res.StatusCode != 200 || strings.Contains(res.Header.Get("Cache-Control"), "immutable") {
+		t.Fatalf("the range should not be immutable, got %d %s", res.StatusCode, res.Header.Get("Cache-Control"))
+	}
+	res, _ = get(fmt.Sprintf("/v%d/dep@1.2.0/es2022/dep.js", VERSION))
+	if res.StatusCode != 200 || res.Header.Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("the exact version should be immutable, got %d %s", res.StatusCode, res.Header.Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io/ioutil"
+	"regexp"
+)
+
+// the React Server Components directives that are preserved at the top of the build
+var rscDirectives = map[string]bool{
+	"use client": true,
+	"use server": true,
+}
+
+// the copies of the RSC directives that esbuild keeps as the plain statements of the bundled
+// modules, they don't work in the middle of the bundle.
+var regStrayDirective = regexp.MustCompile(`(?m)^["']use (client|server)["'];?[ \t]*$`)
+
+// parseDirectives returns the RSC directives of the directive prologue of the code, the prologue
+// is the string literal statements before any other statement, the comments and the hashbang are
+// skipped.
+func parseDirectives(code []byte) (directives []string) {
+	i := 0
+	if len(code) > 1 && code[0] == '#' && code[1] == '!' {
+		for i < len(code) && code[i] != '\n' {
+			i++
+		}
+	}
+	// skipSpaces skips the spaces and the comments, and returns whether there is a newline
+	skipSpaces := func() bool {
+		sawNewline := false
+		for i < len(code) {
+			switch c := code[i]; {
+			case c == '\n':
+				sawNewline = true
+				i++
+			case c == ' ' || c == '\t' || c == '\r':
+				i++
+			case c == '/' && i+1 < len(code) && code[i+1] == '/':
+				for i < len(code) && code[i] != '\n' {
+					i++
+				}
+			case c == '/' && i+1 < len(code) && code[i+1] == '*':
+				i += 2
+				for i+1 < len(code) && !(code[i] == '*' && code[i+1] == '/') {
+					if code[i] == '\n' {
+						sawNewline = true
+					}
+					i++
+				}
+				i += 2
+			default:
+				return sawNewline
+			}
+		}
+		return sawNewline
+	}
+	for {
+		skipSpaces()
+		if i >= len(code) || (code[i] != '"' && code[i] != '\'') {
+			return
+		}
+		quote := code[i]
+		start := i + 1
+		escaped := false
+		for i++; i < len(code) && code[i] != quote && code[i] != '\n'; i++ {
+			if code[i] == '\\' {
+				escaped = true
+				i++
+			}
+		}
+		if i >= len(code) || code[i] != quote {
+			return
+		}
+		value := string(code[start:i])
+		i++
+		// the directive statement ends with `;`, a newline or the end of the code,
+		// otherwise the string is a part of an expression like `"use client".length`
+		if newline := skipSpaces(); i < len(code) && code[i] == ';' {
+			i++
+		} else if !newline && i < len(code) {
+			return
+		}
+		// the directives with the escapes are not the directives
+		if !escaped && rscDirectives[value] {
+			directives = append(directives, value)
+		}
+	}
+}
+
+// readDirectives returns the RSC directives of the file, it returns nil if the file can't be read.
+func readDirectives(filename string) []string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	return parseDirectives(data)
+}
+
+// stripStrayDirectives blanks the copies of the RSC directives in the bundle, the lines are
+// kept so the source map still matches.
+func stripStrayDirectives(code []byte) []byte {
+	return regStrayDirective.ReplaceAll(code, nil)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+)
+
+func TestParseDirectives(t *testing.T) {
+	for code, expected := range map[string]string{
+		`"use client"; export const a = 1`:                 "use client",
+		"'use client'\nexport const a = 1":                 "use client",
+		"#!/usr/bin/env node\n// comment\n\"use server\";": "use server",
+		"/* license */\n\"use strict\";\n'use client';":    "use client",
+		`"use client";"use server";`:                       "use client,use server",
+		`"use client"`:                                     "use client",
+		`export const a = 1; "use client";`:                "",
+		`"use client".length`:                              "",
+		`"use\u0020client";`:                               "",
+		`import "use client";`:                             "",
+		`"use something";`:                                 "",
+	} {
+		if directives := strings.Join(parseDirectives([]byte(code)), ","); directives != expected {
+			t.Fatalf("invalid directives of `%s`: expected '%s', got '%s'", code, expected, directives)
+		}
+	}
+}
+
+func TestDirectivesBuild(t *testing.T) {
+	defer func(l *logx.Logger, d storage.DB, f storage.FS) {
+		log, db, fs = l, d, f
+	}(log, db, fs)
+	var err error
+	log = &logx.Logger{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "rsc-ui", map[string]string{
+		"package.json": `{"name":"rsc-ui","version":"1.0.0","module":"index.js","types":"index.d.ts"}`,
+		"index.d.ts":   `export declare const Button: () => any;`,
+		"index.js":     "/* rsc-ui */\n\"use client\";\nimport { Button } from \"./button.js\";\nexport { Button };\n",
+		"button.js":    "'use client'\nexport function Button() { return \"__BUTTON__\" }\n",
+		"actions.js":   "\"use server\";\nexport async function save() { return \"__SAVE__\" }\n",
+		"plain.js":     "import { Button } from \"./button.js\";\nexport const Plain = Button;\n",
+	})
+
+	build := func(pkg Pkg, devMode bool, strip bool) string {
+		task := &BuildTask{
+			wd:              wd,
+			BuildVersion:    VERSION,
+			Pkg:             pkg,
+			Target:          "es2022",
+			DevMode:         devMode,
+			StripDirectives: strip,
+			External:        newStringSet(),
+			noStore:         true,
+		}
+		_, err := task.build(newStringSet())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// skip the header comment
+		code := string(task.output)
+		return code[strings.Index(code, "*/\n")+3:]
+	}
+
+	for _, c := range []struct {
+		pkg       Pkg
+		directive string
+	}{
+		{Pkg{Name: "rsc-ui", Version: "1.0.0"}, `"use client";`},
+		{Pkg{Name: "rsc-ui", Version: "1.0.0", Submodule: "actions"}, `"use server";`},
+		{Pkg{Name: "rsc-ui", Version: "1.0.0", Submodule: "button"}, `"use client";`},
+	} {
+		for _, devMode := range []bool{true, false} {
+			// the directive of the entry is preserved at the top of the build, and the copies of
+			// the bundled modules are removed
+			code := build(c.pkg, devMode, false)
+			if !strings.HasPrefix(code, c.directive) {
+				t.Fatalf("[%s dev=%v] the directive should be at the top: %s", c.pkg, devMode, code)
+			}
+			if n := strings.Count(code, "use client") + strings.Count(code, "use server"); n != 1 {
+				t.Fatalf("[%s dev=%v] the directive should be preserved once: %s", c.pkg, devMode, code)
+			}
+
+			// the `?strip-directives` query strips the directives
+			code = build(c.pkg, devMode, true)
+			if strings.Contains(code, "use client") || strings.Contains(code, "use server") {
+				t.Fatalf("[%s dev=%v] the directives should be stripped: %s", c.pkg, devMode, code)
+			}
+		}
+	}
+
+	// the entry without the directive doesn't get one from the modules it imports
+	code := build(Pkg{Name: "rsc-ui", Version: "1.0.0", Submodule: "plain"}, true, false)
+	if strings.Contains(code, "use client") {
+		t.Fatalf("the entry without the directive should not get one: %s", code)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// toDownloadFilename returns a safe filename of a build id for the `Content-Disposition` header,
+// e.g. `v87/@babel/core@7.18.0/es2022/core.js` -> `babel__core@7.18.0.js`
+func toDownloadFilename(id string) string {
+	a := strings.Split(strings.TrimPrefix(id, "/"), "/")
+	if len(a) > 0 && (a[0] == "builds" || a[0] == "types") {
+		a = a[1:]
+	}
+	if len(a) > 0 && regBuildVersionPath.MatchString("/"+a[0]+"/") {
+		a = a[1:]
+	}
+	if len(a) == 0 {
+		return "index.js"
+	}
+	versionedName := a[0]
+	a = a[1:]
+	name, _ := splitVersionedName(versionedName)
+	if strings.HasPrefix(versionedName, "@") && len(a) > 0 {
+		name, _ = splitVersionedName(a[0])
+		versionedName = versionedName[1:] + "__" + a[0]
+		a = a[1:]
+	}
+	// strip the resolve args prefix and the build target
+	if len(a) > 0 && strings.HasPrefix(a[0], "X-") {
+		a = a[1:]
+	}
+	if len(a) > 1 {
+		if _, ok := targets[a[0]]; ok || a[0] == "types" {
+			a = a[1:]
+		}
+	}
+
+	ext := ".js"
+	file := strings.Join(a, "/")
+	switch {
+	case strings.HasSuffix(file, ".d.ts"):
+		ext = ".d.ts"
+	case file != "":
+		if e := path.Ext(file); e != "" {
+			ext = e
+		}
+	}
+	file = strings.TrimSuffix(file, ext)
+	filename := versionedName
+	if file != "" && file != name {
+		filename += "_" + file
+	}
+	return sanitizeFilename(filename) + ext
+}
+
+func splitVersionedName(versionedName string) (name string, version string) {
+	i := strings.LastIndexByte(versionedName, '@')
+	if i <= 0 {
+		return versionedName, ""
+	}
+	return versionedName[:i], versionedName[i+1:]
+}
+
+// sanitizeFilename replaces the unsafe characters with `_`
+func sanitizeFilename(name string) string {
+	p := []byte(name)
+	for i, c := range p {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_' || c == '@') {
+			p[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(p), ".")
+}
+
+func setContentDisposition(header http.Header, id string) {
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, toDownloadFilename(id)))
+}
+
+// serveDownload serves the content without compression, the range requests work with the original bytes
+func serveDownload(id string, modtime time.Time, content io.ReadSeeker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := content.(io.Closer); ok {
+			defer c.Close()
+		}
+		setContentDisposition(w.Header(), id)
+		http.ServeContent(w, r, path.Base(id), modtime, content)
+	})
+}
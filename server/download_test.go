@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestToDownloadFilename(t *testing.T) {
+	for id, filename := range map[string]string{
+		"v87/react@18.2.0/es2022/react.js":               "react@18.2.0.js",
+		"/react@18.2.0/es2022/react.development.js":      "react@18.2.0_react.development.js",
+		"v87/@babel/core@7.18.0/es2022/core.js":          "babel__core@7.18.0.js",
+		"v87/preact@10.8.0/X-ZS9yZWFjdA/es2022/hooks.js": "preact@10.8.0_hooks.js",
+		"v87/react-dom@18.2.0/es2022/server.css":         "react-dom@18.2.0_server.css",
+		"types/v87/@types/react@18.0.15/index.d.ts":      "types__react@18.0.15_index.d.ts",
+		"v87/foo@1.0.0/es2022/\"bar\";evil.js":           "foo@1.0.0__bar__evil.js",
+		"v87/foo@1.0.0/es2022/lib/a b.js":                "foo@1.0.0_lib_a_b.js",
+	} {
+		if v := toDownloadFilename(id); v != filename {
+			t.Fatalf("invalid download filename of '%s': %s, expected %s", id, v, filename)
+		}
+	}
+}
+
+func TestDownloadPackageURL(t *testing.T) {
+	var err error
+	defer func(l *logx.Logger) { log = l }(log)
+	log = &logx.Logger{}
+	defer func(e EmbedFS) { embedFS = e }(embedFS)
+	embedFS = testEmbedFS{}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(f storage.FS) { fs = f }(fs)
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := fmt.Sprintf("v%d/foo@1.0.0/es2022/foo.js", VERSION)
+	if err = fs.WriteData("builds/"+id, []byte("export const foo = 1;\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put(id, "build", storage.Store{"meta": `{}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(url string) (*http.Response, string) {
+		res, err := client.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res, string(data)
+	}
+
+	// the package URL redirects to the download of the build
+	res, _ := get("/foo@1.0.0?target=es2022&download")
+	if location := res.Header.Get("Location"); res.StatusCode != 307 || !strings.HasSuffix(location, "/"+id+"?download") {
+		t.Fatalf("the download should be redirected to the build URL, got %d %s", res.StatusCode, location)
+	}
+	res, body := get("/" + id + "?download")
+	if res.StatusCode != 200 || body != "export const foo = 1;\n" || res.Header.Get("Content-Disposition") != `attachment; filename="foo@1.0.0.js"` {
+		t.Fatalf("the build should be downloaded, got %d %s %v", res.StatusCode, body, res.Header)
+	}
+}
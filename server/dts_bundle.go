@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// the error code of the types that can't be rolled into one `.d.ts`
+const ErrDtsBundleUnsupported = "DTS_BUNDLE_UNSUPPORTED"
+
+// the marker of the local imports of the types files that are inlined into the bundle
+const dtsBundleMarker = "__ESM_SH_DTS_BUNDLE:"
+
+var (
+	// `import { A, type B } from "./a"`, `export { A } from "./a"` and `export * from "./a"`, the
+	// imported names are declared in the bundle
+	regDtsBundleFromStmt = regexp.MustCompile(`(?m)(^|;)[ \t]*(import|export)\s+(type\s+)?(\{[^}]*\}|\*)\s*from\s*["']` + dtsBundleMarker + `([^"']+)["'][ \t]*;?`)
+	// the renaming imports/exports like `import { A as B } from "./a"` and `export { default } from "./a"`
+	regDtsBundleRenaming = regexp.MustCompile(`[\s{,](as|default)\b`)
+	// `import "./a"` and `/// <reference path="./a.d.ts" />`
+	regDtsBundlePlainStmt = regexp.MustCompile(`(?m)^[ \t]*(import\s*|/// <reference path=)["']` + dtsBundleMarker + `[^"']+["'][^\n]*$`)
+	// `import("./a").A` of the type references
+	regDtsBundleImportCall = regexp.MustCompile(`import\(\s*["']` + dtsBundleMarker + `[^"']+["']\s*\)\.`)
+	regDtsBundleMarker     = regexp.MustCompile(dtsBundleMarker + `([^"']+)`)
+	// the top-level declarations that can't be declared twice in the bundle
+	regDtsBundleDeclaration   = regexp.MustCompile(`(?m)^(?:export\s+)?(?:declare\s+)?(?:const|let|var|class|type|enum)\s+([A-Za-z_$][\w$]*)`)
+	regDtsBundleExportDefault = regexp.MustCompile(`(?m)^export\s+default\b`)
+	// the exported top-level declarations like `export declare function f(): void`
+	regDtsBundleExportDecl = regexp.MustCompile(`(?m)^export[ \t]+(declare[ \t]+)?((?:abstract[ \t]+)?(const|let|var|class|type|enum|interface|function|namespace)[ \t]+([A-Za-z_$][\w$]*))`)
+	// the local export lists like `export { A, B };`
+	regDtsBundleExportList = regexp.MustCompile(`(?m)^[ \t]*export[ \t]+(type[ \t]+)?\{([^}]*)\}[ \t]*;?[ \t]*$`)
+)
+
+// A dtsRoller rolls the types files into one bundle
+type dtsRoller struct {
+	buf           *bytes.Buffer
+	rolled        *stringSet
+	files         []*dtsRolledFile  // the rolled files in the order of the bundle
+	declared      map[string]string // the top-level names declared by the rolled files
+	exportDefault string            // the rolled file that has the `export default`
+}
+
+// A dtsRolledFile is a types file that is inlined into the bundle
+type dtsRolledFile struct {
+	savePath string
+	name     string
+	code     []byte
+	// the re-exports of the local files, `*` means `export * from`
+	reexports map[string][]string
+	// the names that are exported by the bundle, nil means all the names(of the entry or `export *`)
+	public  map[string]bool
+	reached bool
+}
+
+// dtsBundlePath returns the save path of the types bundle of the types file, the bundles are
+// cached separately from the types.
+func dtsBundlePath(typesPath string) string {
+	return "types-bundle" + strings.TrimPrefix(typesPath, "types")
+}
+
+// bundleDTS rolls the transformed types of the task into one `.d.ts`, the types must be transformed before.
+func (task *BuildTask) bundleDTS() (err error) {
+	savePath, exists, _, _, err := findTypesFile(task.Pkg, task.BuildVersion, encodeResolveArgsPrefix(task.Alias, task.Deps, task.External))
+	if err != nil {
+		return
+	}
+	if !exists {
+		return fmt.Errorf("types of %s not found", task.Pkg)
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "/* esm.sh - dts bundle of %s */\n", strings.TrimPrefix(savePath, "types/"))
+	roller := &dtsRoller{buf: buf, rolled: newStringSet(), declared: map[string]string{}}
+	err = roller.roll(savePath)
+	if err != nil {
+		return
+	}
+	roller.write()
+	return fs.WriteData(dtsBundlePath(savePath), buf.Bytes())
+}
+
+// roll adds the stored types file to the bundle after the local types files it imports, every
+// file is rolled once. The local imports are removed since the names are declared in the same
+// bundle, the imports that can't be flattened, like `import * as ns from "./a"`, and the names
+// declared by more than one file are refused. The imports of other packages are the CDN URLs that
+// are kept as they are.
+func (roller *dtsRoller) roll(savePath string) (err error) {
+	if roller.rolled.Has(savePath) {
+		return
+	}
+	roller.rolled.Add(savePath)
+	name := strings.TrimPrefix(savePath, "types/")
+
+	exists, size, _, err := fs.Exists(savePath)
+	if err != nil {
+		return
+	}
+	if !exists {
+		return &BuildError{ErrDtsBundleUnsupported, fmt.Sprintf("the types file '%s' not found", name)}
+	}
+	r, err := fs.ReadFile(savePath, size)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return
+	}
+
+	deps := []string{}
+	code := bytes.NewBuffer(nil)
+	err = walkDts(bytes.NewReader(data), code, func(importPath string, kind string, position int) string {
+		if (kind == "import" || kind == "reference path") && (strings.HasPrefix(importPath, "./") || strings.HasPrefix(importPath, "../")) {
+			dep := path.Join(path.Dir(savePath), importPath)
+			deps = append(deps, dep)
+			return dtsBundleMarker + dep
+		}
+		return importPath
+	})
+	if err != nil {
+		return
+	}
+
+	for _, dep := range deps {
+		err = roller.roll(dep)
+		if err != nil {
+			return
+		}
+	}
+
+	file := &dtsRolledFile{savePath: savePath, name: name, reexports: map[string][]string{}}
+	flattened := regDtsBundleFromStmt.ReplaceAllFunc(code.Bytes(), func(stmt []byte) []byte {
+		// keep the renaming imports/exports, they are refused below
+		if regDtsBundleRenaming.Match(stmt) {
+			return stmt
+		}
+		m := regDtsBundleFromStmt.FindSubmatch(stmt)
+		if string(m[2]) == "export" {
+			dep := string(m[5])
+			if string(m[4]) == "*" {
+				file.reexports[dep] = append(file.reexports[dep], "*")
+			} else {
+				file.reexports[dep] = append(file.reexports[dep], splitDtsNames(m[4])...)
+			}
+		}
+		// keep the end of the previous statement on the same line
+		if stmt[0] == ';' {
+			return []byte{';'}
+		}
+		return nil
+	})
+	flattened = regDtsBundlePlainStmt.ReplaceAll(flattened, nil)
+	flattened = regDtsBundleImportCall.ReplaceAll(flattened, nil)
+	if m := regDtsBundleMarker.FindSubmatch(flattened); m != nil {
+		return &BuildError{ErrDtsBundleUnsupported, fmt.Sprintf(
+			"the import of '%s' in '%s' can't be flattened",
+			strings.TrimPrefix(string(m[1]), "types/"),
+			name,
+		)}
+	}
+	for _, m := range regDtsBundleDeclaration.FindAllSubmatch(flattened, -1) {
+		if file, ok := roller.declared[string(m[1])]; ok && file != name {
+			return &BuildError{ErrDtsBundleUnsupported, fmt.Sprintf("'%s' is declared by both '%s' and '%s'", m[1], file, name)}
+		}
+		roller.declared[string(m[1])] = name
+	}
+	if regDtsBundleExportDefault.Match(flattened) {
+		if roller.exportDefault != "" {
+			return &BuildError{ErrDtsBundleUnsupported, fmt.Sprintf("both '%s' and '%s' have the default export", roller.exportDefault, name)}
+		}
+		roller.exportDefault = name
+	}
+
+	file.code = flattened
+	roller.files = append(roller.files, file)
+	return
+}
+
+// write writes the rolled files to the bundle, only the names of the entry and the names re-exported
+// by the exported files are exported, the `export` of the names that are only imported by the
+// other files is removed.
+func (roller *dtsRoller) write() {
+	files := map[string]*dtsRolledFile{}
+	for _, file := range roller.files {
+		files[file.savePath] = file
+	}
+	// the entry is the last rolled file
+	entry := roller.files[len(roller.files)-1]
+	entry.reached = true
+	for changed := true; changed; {
+		changed = false
+		for _, file := range roller.files {
+			if !file.reached {
+				continue
+			}
+			for dep, names := range file.reexports {
+				if files[dep] != nil && files[dep].addPublic(names, file.public) {
+					changed = true
+				}
+			}
+		}
+	}
+	for _, file := range roller.files {
+		code := file.code
+		if file.public != nil || !file.reached {
+			code = file.stripExports()
+		}
+		fmt.Fprintf(roller.buf, "\n// %s\n", file.name)
+		roller.buf.Write(bytes.TrimSpace(code))
+		roller.buf.WriteByte('\n')
+	}
+}
+
+// addPublic adds the re-exported names to the public names of the file, the `*` re-exports the
+// public names of the exporter. It returns whether the public names are changed.
+func (file *dtsRolledFile) addPublic(names []string, exporter map[string]bool) (changed bool) {
+	// all the names are public already
+	if file.reached && file.public == nil {
+		return false
+	}
+	if !file.reached {
+		file.reached = true
+		file.public = map[string]bool{}
+		changed = true
+	}
+	add := func(name string) {
+		if !file.public[name] {
+			file.public[name] = true
+			changed = true
+		}
+	}
+	for _, name := range names {
+		if name == "*" {
+			if exporter == nil {
+				file.public = nil
+				return true
+			}
+			for name := range exporter {
+				add(name)
+			}
+		} else if exporter == nil || exporter[name] {
+			add(name)
+		}
+	}
+	return
+}
+
+// stripExports removes the `export` of the declarations that are not public, the removed ones get
+// the `declare` modifier that is required by the top-level declarations of the types file.
+func (file *dtsRolledFile) stripExports() []byte {
+	code := regDtsBundleExportDecl.ReplaceAllFunc(file.code, func(decl []byte) []byte {
+		m := regDtsBundleExportDecl.FindSubmatch(decl)
+		if file.public[string(m[4])] {
+			return decl
+		}
+		if kind := string(m[3]); len(m[1]) == 0 && kind != "type" && kind != "interface" {
+			return append([]byte("declare "), m[2]...)
+		}
+		return append(m[1], m[2]...)
+	})
+	return regDtsBundleExportList.ReplaceAllFunc(code, func(stmt []byte) []byte {
+		m := regDtsBundleExportList.FindSubmatch(stmt)
+		items := []string{}
+		for _, item := range strings.Split(string(m[2]), ",") {
+			names := strings.Fields(item)
+			if len(names) > 0 && file.public[names[len(names)-1]] {
+				items = append(items, strings.TrimSpace(item))
+			}
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		return []byte(fmt.Sprintf("export %s{ %s };", m[1], strings.Join(items, ", ")))
+	})
+}
+
+// splitDtsNames returns the names of the import/export list like `{ A, type B }`
+func splitDtsNames(list []byte) (names []string) {
+	for _, item := range strings.Split(strings.Trim(string(list), "{}"), ",") {
+		fields := strings.Fields(item)
+		if len(fields) > 0 {
+			names = append(names, fields[len(fields)-1])
+		}
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+)
+
+func TestBundleDTS(t *testing.T) {
+	defer func(l *logx.Logger, f storage.FS) {
+		log, fs = l, f
+	}(log, fs)
+	var err error
+	log = &logx.Logger{}
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json":     `{"name":"foo","version":"1.0.0","types":"index.d.ts"}`,
+		"index.d.ts":       "import { Options } from \"./options\";\nimport type {\n  Theme,\n} from \"./theme\";\nexport * from \"./utils\";\nexport { Theme } from \"./theme\";\nexport declare function create(options: Options): Theme;\n",
+		"options.d.ts":     "export interface Options {\n  theme?: import(\"./theme\").Theme;\n}\nexport declare const defaults: Options;\nexport function merge(a: Options, b: Options): Options;\n",
+		"theme.d.ts":       "export interface Theme {\n  color: string;\n}\n",
+		"utils/index.d.ts": "/// <reference path=\"../globals.d.ts\" />\nexport declare const version: string;\n",
+		"globals.d.ts":     "declare var __FOO__: string;\n",
+		"ns.d.ts":          "import * as theme from \"./theme\";\nexport declare const t: theme.Theme;\n",
+		"dup.d.ts":         "import { version } from \"./utils\";\nexport declare const version: string;\n",
+	})
+
+	bundle := func(submodule string) (string, error) {
+		task := &BuildTask{
+			wd:           wd,
+			BuildVersion: VERSION,
+			Pkg:          Pkg{Name: "foo", Version: "1.0.0", Submodule: submodule},
+			External:     newStringSet(),
+			Target:       "types",
+		}
+		if _, err := task.CopyDTS("foo@1.0.0/"+submodule, VERSION); err != nil {
+			t.Fatal(err)
+		}
+		task.DtsBundle = true
+		if _, err := task.Build(); err != nil {
+			return "", err
+		}
+		savePath := dtsBundlePath(fmt.Sprintf("types/v%d/foo@1.0.0/%s", VERSION, submodule))
+		exists, size, _, err := fs.Exists(savePath)
+		if err != nil || !exists {
+			t.Fatalf("the types bundle should be stored: %v", err)
+		}
+		r, err := fs.ReadFile(savePath, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		return string(data), err
+	}
+
+	code, err := bundle("index.d.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"declare var __FOO__: string;", "export declare const version: string;", "export interface Theme {", "theme?: Theme;", "export declare function create(options: Options): Theme;"} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("'%s' not found in the bundle: %s", s, code)
+		}
+	}
+	for _, s := range []string{"from ", "reference path", "import(", dtsBundleMarker} {
+		if strings.Contains(code, s) {
+			t.Fatalf("the local imports should be flattened, '%s' found: %s", s, code)
+		}
+	}
+	// the names that are only imported are not exported by the bundle
+	for _, s := range []string{"export interface Options", "export declare const defaults", "export function merge"} {
+		if strings.Contains(code, s) {
+			t.Fatalf("the import-only name should not be exported, '%s' found: %s", s, code)
+		}
+	}
+	for _, s := range []string{"\ninterface Options {", "\ndeclare const defaults: Options;", "\ndeclare function merge("} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("the import-only name should be declared, '%s' not found: %s", s, code)
+		}
+	}
+
+	// every file is rolled once, after the files it imports
+	if strings.Count(code, "export interface Theme {") != 1 || strings.Index(code, "interface Theme") > strings.Index(code, "function create") {
+		t.Fatalf("invalid order of the rolled files: %s", code)
+	}
+	if strings.Index(code, "__FOO__") > strings.Index(code, "const version") {
+		t.Fatalf("the referenced file should be rolled first: %s", code)
+	}
+
+	// the imports can't be flattened and the names declared twice are refused
+	for _, submodule := range []string{"ns.d.ts", "dup.d.ts"} {
+		_, err = bundle(submodule)
+		var buildErr *BuildError
+		if !errors.As(err, &buildErr) || buildErr.Code != ErrDtsBundleUnsupported {
+			t.Fatalf("the types of '%s' should not be bundled: %v", submodule, err)
+		}
+	}
+}
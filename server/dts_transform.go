@@ -8,10 +8,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ije/gox/utils"
 )
 
+// the number of the transformed dts files, reported in the `/status.json`
+var dtsTransformedFiles int64
+
 func (task *BuildTask) CopyDTS(dts string, buildVersion int) (n int, err error) {
 	resolveArgsPrefix := encodeResolveArgsPrefix(task.Alias, task.Deps, task.External)
 	tracing := newStringSet()
@@ -203,9 +207,9 @@ func (task *BuildTask) copyDTS(dts string, buildVersion int, aliasDepsPrefix str
 				fromPackageJSON bool
 			)
 			for _, version := range versions {
-				info, subpath, fromPackageJSON, err = getPackageInfo(task.wd, importPath, version)
+				info, subpath, fromPackageJSON, err = getPackageInfoFrom(task.registry, task.wd, importPath, version)
 				if err != nil || ((info.Types == "" && info.Typings == "") && !strings.HasPrefix(info.Name, "@types/")) {
-					info, _, fromPackageJSON, err = getPackageInfo(task.wd, toTypesPackageName(importPath), version)
+					info, _, fromPackageJSON, err = getPackageInfoFrom(task.registry, task.wd, toTypesPackageName(importPath), version)
 				}
 				if err == nil {
 					break
@@ -311,6 +315,7 @@ func (task *BuildTask) copyDTS(dts string, buildVersion int, aliasDepsPrefix str
 		buf = bytes.NewBuffer(dtsData)
 	}
 
+	atomic.AddInt64(&dtsTransformedFiles, 1)
 	err = fs.WriteData(savePath, buf.Bytes())
 	if err != nil {
 		return
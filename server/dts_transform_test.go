@@ -7,9 +7,12 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
 )
 
 func TestCopyDTS(t *testing.T) {
@@ -158,3 +161,126 @@ func TestCopyDTS(t *testing.T) {
 		}
 	}
 }
+
+func TestTransformDTSOnce(t *testing.T) {
+	defer func(f storage.FS, c storage.Cache) {
+		fs, cache = f, c
+	}(fs, cache)
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","types":"index.d.ts"}`,
+		"index.d.ts":   "export * from './a';\n" + strings.Repeat("export declare const foo: string;\n", 20000),
+		"a.d.ts":       strings.Repeat("export declare const a: string;\n", 20000),
+	})
+
+	var err error
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", path.Join(wd, "storage")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the module request and the types request of the same build
+	start := atomic.LoadInt64(&dtsTransformedFiles)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task := &BuildTask{
+				BuildVersion: VERSION,
+				Pkg:          Pkg{Name: "foo", Version: "1.0.0"},
+				Deps:         PkgSlice{},
+				External:     newStringSet(),
+				Target:       "types",
+				wd:           wd,
+			}
+			task.transformDTS("foo@1.0.0/index.d.ts")
+			// the types must be completed when the transform returns
+			exists, _, _, err := fs.Exists(fmt.Sprintf("types/v%d/foo@1.0.0/a.d.ts", VERSION))
+			if err != nil || !exists {
+				t.Error("a.d.ts not found")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&dtsTransformedFiles) - start; n != 2 {
+		t.Fatalf("the types should be transformed once, but %d files transformed", n)
+	}
+	for _, name := range []string{"index.d.ts", "a.d.ts"} {
+		exists, _, _, err := fs.Exists(fmt.Sprintf("types/v%d/foo@1.0.0/%s", VERSION, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatalf("%s not found", name)
+		}
+	}
+}
+
+func TestBuildWithTypesOnce(t *testing.T) {
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","types":"index.d.ts"}`,
+		"index.d.ts":   "export * from './a';\n" + strings.Repeat("export declare const foo: string;\n", 20000),
+		"a.d.ts":       strings.Repeat("export declare const a: string;\n", 20000),
+	})
+
+	defer func(l *logx.Logger, d storage.DB, f storage.FS, c storage.Cache) {
+		log, db, fs, cache = l, d, f, c
+	}(log, db, fs, cache)
+	var err error
+	log = &logx.Logger{}
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(wd, "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", path.Join(wd, "storage")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the module and its types are requested at the same time
+	start := atomic.LoadInt64(&dtsTransformedFiles)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		target := "es2022"
+		if i%2 == 1 {
+			target = "types"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task := &BuildTask{
+				BuildVersion: VERSION,
+				Pkg:          Pkg{Name: "foo", Version: "1.0.0"},
+				Deps:         PkgSlice{},
+				External:     newStringSet(),
+				Target:       target,
+				wd:           wd,
+			}
+			if _, err := task.build(newStringSet()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&dtsTransformedFiles) - start; n != 2 {
+		t.Fatalf("the types should be extracted once, but %d files transformed", n)
+	}
+	task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Deps: PkgSlice{}, External: newStringSet(), Target: "es2022"}
+	exists, _, _, err := fs.Exists(path.Join("builds", task.ID()))
+	if err != nil || !exists {
+		t.Fatalf("the build %s not found", task.ID())
+	}
+}
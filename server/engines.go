@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the policy of the packages that the `engines.node` is not satisfied by the node version of the server,
+// set by the `-engines` flag: `warn` returns the mismatch in the `X-Esm-Engine-Warning` header,
+// `error` refuses to build the packages, `ignore` skips the check.
+var enginesPolicy = "warn"
+
+func isValidEnginesPolicy(policy string) bool {
+	return policy == "warn" || policy == "error" || policy == "ignore"
+}
+
+// PackageEngines defines the `engines` field of package.json, the legacy array form is ignored
+type PackageEngines map[string]string
+
+func (e *PackageEngines) UnmarshalJSON(data []byte) error {
+	var m map[string]interface{}
+	if json.Unmarshal(data, &m) != nil {
+		return nil
+	}
+	engines := PackageEngines{}
+	for name, v := range m {
+		if s, ok := v.(string); ok {
+			engines[name] = s
+		}
+	}
+	*e = engines
+	return nil
+}
+
+// checkEngines checks the `engines.node` of the package with the node version, that runs the cjs
+// exports analysis of the package.
+func checkEngines(npm *NpmPackage, nodeVersion string) (warning string, err error) {
+	if enginesPolicy == "ignore" || nodeVersion == "" {
+		return
+	}
+	versionRange := strings.TrimSpace(npm.Engines["node"])
+	if versionRange == "" || versionRange == "*" {
+		return
+	}
+	c, e := semver.NewConstraint(versionRange)
+	if e != nil {
+		return
+	}
+	v, e := semver.NewVersion(nodeVersion)
+	if e != nil || c.Check(v) {
+		return
+	}
+	warning = fmt.Sprintf("%s@%s requires node %s, but the node version of the server is %s", npm.Name, npm.Version, versionRange, nodeVersion)
+	if enginesPolicy == "error" {
+		err = &BuildError{ErrEngineMismatch, warning}
+		warning = ""
+	}
+	return
+}
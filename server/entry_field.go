@@ -0,0 +1,18 @@
+package server
+
+// the CDN-oriented entry fields of package.json that can be preferred by the `?entry-field` query
+var entryFields = map[string]bool{
+	"unpkg":    true,
+	"jsdelivr": true,
+}
+
+// entryField returns the entry of the CDN-oriented field, like `"unpkg": "dist/foo.min.js"`
+func (npm *NpmPackage) entryField(field string) string {
+	switch field {
+	case "unpkg":
+		return npm.Unpkg
+	case "jsdelivr":
+		return npm.Jsdelivr
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the modes of the `-exports-enforcement` flag: `strict` follows node that the subpaths not
+// exported by the `exports` of package.json are not found, `loose` builds the physical files of
+// them with a warning, since many consumers rely on the deep imports that predate `exports`.
+var exportsEnforcementModes = map[string]bool{
+	"strict": true,
+	"loose":  true,
+}
+
+// the reason code of the unexported subpaths in the `strict` mode, it's checked before the build so it's not cached
+const ErrNotExported = "NOT_EXPORTED"
+
+// the enforcement of the `exports`, set by the `-exports-enforcement` flag
+var exportsEnforcement = "loose"
+
+// isExportedSubpath reports whether the subpath is exported by the `exports` of package.json in
+// node's way, the `defined` is false if the package has no `exports` that exports everything.
+func isExportedSubpath(exports interface{}, submodule string) (exported bool, defined bool) {
+	if exports == nil {
+		return true, false
+	}
+	if submodule == "" {
+		return true, true
+	}
+	m, ok := exports.(map[string]interface{})
+	if !ok {
+		// `"exports": "./index.js"` or the fallback array exports the main only
+		return false, true
+	}
+	subpath := "./" + submodule
+	if value, ok := m[subpath]; ok {
+		// the `null` target excludes the subpath
+		return value != nil, true
+	}
+
+	// the most specific pattern(the longest prefix) wins, like `./lib/*` and `./lib/internal/*`
+	var matched string
+	var matchedValue interface{}
+	for key, value := range m {
+		if !strings.HasPrefix(key, "./") {
+			// the conditions sugar like `{"import": "./index.mjs"}` exports the main only
+			continue
+		}
+		var prefix, suffix string
+		if i := strings.IndexByte(key, '*'); i >= 0 {
+			prefix, suffix = key[:i], key[i+1:]
+		} else if strings.HasSuffix(key, "/") {
+			// the deprecated folder mappings like `"./lib/": "./lib/"`
+			prefix = key
+		} else {
+			continue
+		}
+		if len(subpath) >= len(prefix)+len(suffix) && strings.HasPrefix(subpath, prefix) && strings.HasSuffix(subpath, suffix) && len(prefix) > len(matched) {
+			matched = prefix
+			matchedValue = value
+		}
+	}
+	return matched != "" && matchedValue != nil, true
+}
+
+// checkSubpathExport checks the subpath of the request against the `exports` of package.json, the
+// unexported subpath is a NOT_EXPORTED error in the `strict` mode, or a warning in the `loose` mode.
+// The `?deep-import` query allows the deep imports in the `strict` mode.
+func checkSubpathExport(info NpmPackage, submodule string, deepImport bool) (warning string, err error) {
+	exported, defined := isExportedSubpath(info.DefinedExports, submodule)
+	if exported || !defined {
+		return
+	}
+	if exportsEnforcement == "strict" && !deepImport {
+		err = &BuildError{ErrNotExported, fmt.Sprintf("subpath './%s' is not exported by the package.json of '%s@%s'", submodule, info.Name, info.Version)}
+		return
+	}
+	warning = fmt.Sprintf("subpath './%s' is not exported by the package.json of '%s@%s', the deep import is deprecated", submodule, info.Name, info.Version)
+	return
+}
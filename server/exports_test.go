@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIsExportedSubpath(t *testing.T) {
+	var exports interface{}
+	err := json.Unmarshal([]byte(`{
+		".": "./index.js",
+		"./jsx-runtime": {"import": "./jsx-runtime.mjs", "require": "./jsx-runtime.js"},
+		"./locale/*": "./locale/*.js",
+		"./locale/internal/*": null,
+		"./icons/*.svg": "./icons/*.svg",
+		"./legacy/": "./legacy/",
+		"./private": null
+	}`), &exports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for submodule, expected := range map[string]bool{
+		"":                      true,
+		"jsx-runtime":           true,
+		"locale/zh":             true,
+		"locale/zh/cn":          true,
+		"locale/internal/x":     false,
+		"icons/logo.svg":        true,
+		"icons/logo.png":        false,
+		"legacy/utils.js":       true,
+		"private":               false,
+		"lib/utils.js":          false,
+		"jsx-runtime.mjs":       false,
+		"nonexistent/submodule": false,
+	} {
+		exported, defined := isExportedSubpath(exports, submodule)
+		if !defined || exported != expected {
+			t.Fatalf("the subpath '%s' should be exported=%v, got %v", submodule, expected, exported)
+		}
+	}
+
+	// the `exports` exports the main only
+	for _, exports := range []interface{}{"./index.js", []interface{}{"./index.js"}, map[string]interface{}{"import": "./index.mjs"}} {
+		if exported, defined := isExportedSubpath(exports, "lib/utils.js"); exported || !defined {
+			t.Fatalf("only the main of %v should be exported", exports)
+		}
+		if exported, _ := isExportedSubpath(exports, ""); !exported {
+			t.Fatalf("the main of %v should be exported", exports)
+		}
+	}
+
+	// all subpaths are exported without the `exports`
+	if exported, defined := isExportedSubpath(nil, "lib/utils.js"); !exported || defined {
+		t.Fatal("all subpaths should be exported without the exports")
+	}
+}
+
+func TestCheckSubpathExport(t *testing.T) {
+	defer func() { exportsEnforcement = "loose" }()
+
+	info := NpmPackage{
+		Name:           "foo",
+		Version:        "1.0.0",
+		DefinedExports: map[string]interface{}{".": "./index.js", "./utils": "./lib/utils.js"},
+	}
+
+	for _, mode := range []string{"strict", "loose"} {
+		exportsEnforcement = mode
+		// the exported subpath
+		warning, err := checkSubpathExport(info, "utils", false)
+		if err != nil || warning != "" {
+			t.Fatalf("[%s] the exported subpath should pass: %v %s", mode, err, warning)
+		}
+		// the subpath of the package without the `exports`
+		warning, err = checkSubpathExport(NpmPackage{Name: "bar", Version: "1.0.0"}, "lib/utils.js", false)
+		if err != nil || warning != "" {
+			t.Fatalf("[%s] the package without exports should pass: %v %s", mode, err, warning)
+		}
+	}
+
+	// the physically-present-but-unexported subpath and the nonexistent subpath are both unexported,
+	// the physical file is checked by the build in the loose mode
+	for _, submodule := range []string{"lib/utils.js", "nonexistent"} {
+		exportsEnforcement = "strict"
+		_, err := checkSubpathExport(info, submodule, false)
+		var buildErr *BuildError
+		if !errors.As(err, &buildErr) || buildErr.Code != ErrNotExported {
+			t.Fatalf("the unexported subpath '%s' should be refused in the strict mode: %v", submodule, err)
+		}
+		warning, err := checkSubpathExport(info, submodule, true)
+		if err != nil || warning == "" {
+			t.Fatalf("the '?deep-import' should allow the subpath '%s' with a warning: %v", submodule, err)
+		}
+
+		exportsEnforcement = "loose"
+		warning, err = checkSubpathExport(info, submodule, false)
+		if err != nil || warning == "" {
+			t.Fatalf("the unexported subpath '%s' should be warned in the loose mode: %v", submodule, err)
+		}
+	}
+}
+
+func TestCheckSubpathExportWithOverrides(t *testing.T) {
+	defer func() { exportsEnforcement = "loose" }()
+	defer func(o PackageOverrides) { pkgOverrides = o }(pkgOverrides)
+	exportsEnforcement = "strict"
+
+	var m map[string]map[string]json.RawMessage
+	err := json.Unmarshal([]byte(`{"foo@1.0.0": {"exports": {".": "./index.js", "./utils": "./lib/utils.js", "./extra": "./lib/extra.js"}}}`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgOverrides, err = parsePackageOverrides(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the subpath exported by the overrides passes, and the info of the other packages is not changed
+	info := NpmPackage{Name: "foo", Version: "1.0.0", Dependencies: map[string]string{"bar": "^1.0.0"}, DefinedExports: map[string]interface{}{".": "./index.js"}}
+	if _, err := checkSubpathExport(pkgOverrides.ApplyInfo(info), "extra", false); err != nil {
+		t.Fatalf("the subpath exported by the overrides should pass: %v", err)
+	}
+	if overridden := pkgOverrides.ApplyInfo(info); overridden.Dependencies["bar"] != "^1.0.0" {
+		t.Fatalf("the fields not overridden should be kept: %+v", overridden)
+	}
+	other := NpmPackage{Name: "foo", Version: "2.0.0", DefinedExports: map[string]interface{}{".": "./index.js"}}
+	if _, err := checkSubpathExport(pkgOverrides.ApplyInfo(other), "extra", false); err == nil {
+		t.Fatal("the unmatched version should not be overridden")
+	}
+}
+
+func TestInitModuleUnexportedSubpath(t *testing.T) {
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","type":"module","exports":{".":"./index.js","./utils":"./lib/utils.js"}}`,
+		"index.js":     `export default "foo"`,
+		"lib/utils.js": `export const utils = true`,
+		"lib/deep.js":  `export const deep = true`,
+	})
+
+	// the exported subpath is resolved by the `exports`
+	_, npm, err := initModule(wd, Pkg{Name: "foo", Version: "1.0.0", Submodule: "utils"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimPrefix(npm.Module, "./") != "lib/utils.js" {
+		t.Fatalf("invalid entry of the exported subpath: %s", npm.Module)
+	}
+
+	// the physically-present-but-unexported subpath falls back to the physical file(the loose mode)
+	_, npm, err = initModule(wd, Pkg{Name: "foo", Version: "1.0.0", Submodule: "lib/deep.js"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimPrefix(npm.Module, "./") != "lib/deep.js" {
+		t.Fatalf("invalid entry of the unexported subpath: %s", npm.Module)
+	}
+}
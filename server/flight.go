@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A FlightGroup collapses the concurrent calls of the same key, the first caller
+// does the work and the others wait for its result.
+type FlightGroup struct {
+	lock     sync.Mutex
+	calls    map[string]*flightCall
+	executed int64
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// the group of the build sidecars keyed by the storage path, the outputs and the metafile of a build are
+// stored in one call of the build id, the compressed variants in one call of the file and the encodings,
+// the types in one call of the types path.
+var sidecarFlight = newFlightGroup()
+
+func newFlightGroup() *FlightGroup {
+	return &FlightGroup{calls: map[string]*flightCall{}}
+}
+
+// Do calls the fn once for the concurrent calls of the same key.
+func (g *FlightGroup) Do(key string, fn func() error) error {
+	g.lock.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		c.wg.Wait()
+		return c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	atomic.AddInt64(&g.executed, 1)
+	c.err = fn()
+	c.wg.Done()
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	return c.err
+}
+
+// Executed returns the number of the calls that are not collapsed.
+func (g *FlightGroup) Executed() int64 {
+	return atomic.LoadInt64(&g.executed)
+}
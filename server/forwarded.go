@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// the proxies that the `X-Forwarded-Host` and `X-Forwarded-Proto` headers are trusted from, set by the
+// `-trusted-proxies` flag, the headers are ignored if it's empty
+var trustedProxies []*net.IPNet
+
+// the forwarded host is a hostname or an IP with an optional port
+var regexpForwardedHost = regexp.MustCompile(`^(\[[0-9a-fA-F:.]+\]|[a-zA-Z0-9.-]+)(:\d{1,5})?$`)
+
+// parseTrustedProxies parses the IPs and the CIDRs separated by commas, like `10.0.0.1,172.16.0.0/12`
+func parseTrustedProxies(s string) (nets []*net.IPNet, err error) {
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.ContainsRune(p, '/') {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy IP '%s'", p)
+			}
+			if ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+// isTrustedProxy reports whether the peer of the request is a trusted proxy, the peer is the
+// `RemoteAddr` of the connection that can't be forged by the `X-Forwarded-For` header.
+func isTrustedProxy(r *http.Request) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedOrigin returns the origin that the client actually reached from the `X-Forwarded-Host`
+// and `X-Forwarded-Proto` headers of the trusted proxies, the first value is the client-facing one
+// if the proxies are chained.
+func forwardedOrigin(r *http.Request) (string, bool) {
+	if !isTrustedProxy(r) {
+		return "", false
+	}
+	host, _ := utils.SplitByFirstByte(r.Header.Get("X-Forwarded-Host"), ',')
+	host = strings.TrimSpace(host)
+	if host == "" || !regexpForwardedHost.MatchString(host) {
+		return "", false
+	}
+	proto, _ := utils.SplitByFirstByte(r.Header.Get("X-Forwarded-Proto"), ',')
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto != "http" && proto != "https" {
+		proto = "https"
+	}
+	return fmt.Sprintf("%s://%s", proto, host), true
+}
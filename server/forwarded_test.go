@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedOrigin(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.1, 172.16.0.0/12,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		trustedProxies = nil
+		origin = ""
+	}()
+
+	request := func(remoteAddr string, headers map[string]string) string {
+		r := httptest.NewRequest("GET", "http://esm.internal:8080/react", nil)
+		r.RemoteAddr = remoteAddr
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		return getOrigin(r)
+	}
+	forwarded := map[string]string{"X-Forwarded-Host": "cdn.example.com", "X-Forwarded-Proto": "https"}
+
+	// the trusted proxies
+	for _, remoteAddr := range []string{"10.0.0.1:5678", "172.20.1.2:5678", "[::1]:5678"} {
+		if o := request(remoteAddr, forwarded); o != "https://cdn.example.com" {
+			t.Fatalf("the forwarded origin of the trusted proxy %s should be used, got %s", remoteAddr, o)
+		}
+	}
+	if o := request("10.0.0.1:5678", map[string]string{"X-Forwarded-Host": "cdn.example.com:8443, proxy.internal", "X-Forwarded-Proto": "http, https"}); o != "http://cdn.example.com:8443" {
+		t.Fatalf("the client-facing value of the chained proxies should be used, got %s", o)
+	}
+	if o := request("10.0.0.1:5678", map[string]string{"X-Forwarded-Host": "cdn.example.com", "X-Forwarded-Proto": "gopher"}); o != "https://cdn.example.com" {
+		t.Fatalf("the invalid proto should be https, got %s", o)
+	}
+	if o := request("10.0.0.1:5678", map[string]string{"X-Forwarded-Host": "evil.com/path?"}); o != "https://esm.internal:8080" {
+		t.Fatalf("the invalid forwarded host should be ignored, got %s", o)
+	}
+
+	// the untrusted peers, the `X-Forwarded-For` can't forge the peer
+	untrusted := map[string]string{"X-Forwarded-Host": "evil.com", "X-Forwarded-For": "10.0.0.1"}
+	for _, remoteAddr := range []string{"10.0.0.2:5678", "192.168.1.1:5678", "[::2]:5678"} {
+		if o := request(remoteAddr, untrusted); o != "https://esm.internal:8080" {
+			t.Fatalf("the forwarded headers of the untrusted peer %s should be ignored, got %s", remoteAddr, o)
+		}
+	}
+
+	// fall back to the `-origin` flag
+	origin = "https://esm.sh/"
+	if o := request("192.168.1.1:5678", untrusted); o != "https://esm.sh" {
+		t.Fatalf("the configured origin should be used, got %s", o)
+	}
+	if o := request("10.0.0.1:5678", forwarded); o != "https://cdn.example.com" {
+		t.Fatalf("the forwarded origin of the trusted proxy should take precedence, got %s", o)
+	}
+
+	// no trusted proxies
+	trustedProxies = nil
+	if o := request("10.0.0.1:5678", forwarded); o != "https://esm.sh" {
+		t.Fatalf("the forwarded headers should be ignored without the trusted proxies, got %s", o)
+	}
+
+	for _, s := range []string{"10.0.0", "10.0.0.0/33", "example.com"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Fatalf("the trusted proxies '%s' should be invalid", s)
+		}
+	}
+}
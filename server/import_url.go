@@ -0,0 +1,51 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// toImportURL rewrites the server-absolute `importPath` (like `/v87/react@18.2.0/es2022/react.js`)
+// that is imported by the module `importer` with the `-import-base` option:
+//   - "": keep the server-absolute path
+//   - "./": use the path relative to the importer
+//   - "/esm" or "https://cdn.example.com/esm": replace the base path with it
+func toImportURL(base string, importer string, importPath string) string {
+	if base == "" || !strings.HasPrefix(importPath, "/") {
+		return importPath
+	}
+	if base == "." || base == "./" {
+		pathname, query := utils.SplitByFirstByte(importPath, '?')
+		rel := relativePath(importer, pathname)
+		if query != "" {
+			rel += "?" + query
+		}
+		return rel
+	}
+	if basePath != "" {
+		importPath = strings.TrimPrefix(importPath, basePath)
+	}
+	return strings.TrimSuffix(base, "/") + importPath
+}
+
+// relativePath returns the relative path from the `from` module to the `to` module,
+// both of them must be absolute paths.
+func relativePath(from string, to string) string {
+	fromDir := strings.Split(strings.Trim(utils.CleanPath(from), "/"), "/")
+	fromDir = fromDir[:len(fromDir)-1]
+	toParts := strings.Split(strings.TrimPrefix(utils.CleanPath(to), "/"), "/")
+	i := 0
+	for i < len(fromDir) && i < len(toParts)-1 && fromDir[i] == toParts[i] {
+		i++
+	}
+	if i == len(fromDir) {
+		return "./" + strings.Join(toParts[i:], "/")
+	}
+	return strings.Repeat("../", len(fromDir)-i) + strings.Join(toParts[i:], "/")
+}
+
+// importURL rewrites the import path of the task module by the `-import-base` option
+func (task *BuildTask) importURL(importPath string) string {
+	return toImportURL(importBase, basePath+"/"+task.ID(), importPath)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestToImportURL(t *testing.T) {
+	importer := "/v87/swr@1.3.0/es2022/swr.js"
+	importPath := "/v87/react@18.1.0/es2022/react.js"
+
+	// empty base(like a dev server without the `-origin` option)
+	if url := toImportURL("", importer, importPath); url != importPath {
+		t.Fatalf("unexpected import url %s", url)
+	}
+
+	// path-prefixed
+	if url := toImportURL("/esm", importer, importPath); url != "/esm/v87/react@18.1.0/es2022/react.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+	if url := toImportURL("/esm/", importer, importPath); url != "/esm/v87/react@18.1.0/es2022/react.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+
+	// full host
+	if url := toImportURL("https://cdn.example.com/esm", importer, importPath); url != "https://cdn.example.com/esm/v87/react@18.1.0/es2022/react.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+
+	// relative
+	if url := toImportURL("./", importer, importPath); url != "../../react@18.1.0/es2022/react.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+	if url := toImportURL("./", importer, "/v87/swr@1.3.0/es2022/_internal.js"); url != "./_internal.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+	if url := toImportURL("./", "/react", "/v87/react@18.1.0/es2022/react.js"); url != "./v87/react@18.1.0/es2022/react.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+	if url := toImportURL("./", importer, "/error.js?type=resolve&name=foo/bar"); url != "../../../error.js?type=resolve&name=foo/bar" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+
+	// remote imports are not changed
+	deno := "https://deno.land/std@0.140.0/node/process.ts"
+	if url := toImportURL("./", importer, deno); url != deno {
+		t.Fatalf("unexpected import url %s", url)
+	}
+}
+
+func TestToImportURLWithBasePath(t *testing.T) {
+	defer func(v string) { basePath = v }(basePath)
+	basePath = "/cdn"
+
+	importer := "/cdn/v87/swr@1.3.0/es2022/swr.js"
+	importPath := "/cdn/v87/react@18.1.0/es2022/react.js"
+	if url := toImportURL("https://esm.example.com", importer, importPath); url != "https://esm.example.com/v87/react@18.1.0/es2022/react.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+	if url := toImportURL("./", importer, importPath); url != "../../react@18.1.0/es2022/react.js" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+}
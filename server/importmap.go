@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+// An ImportMap maps the bare specifiers to the pinned build URLs
+type ImportMap struct {
+	Imports   map[string]string `json:"imports"`
+	Truncated bool              `json:"truncated,omitempty"` // the dependency graph exceeded the limits, the imports are partial
+}
+
+// resolveGraphPins resolves the dependency graph of the root package and collapses it to single versions,
+// the pins are stored in the db by the hash that is a part of the build id of the `graph` deps policy.
+// The pins of the truncated graph are partial, the packages out of the pins are resolved by their ranges.
+func resolveGraphPins(root Pkg) (hash string, pins map[string]string, truncated bool, err error) {
+	id := fmt.Sprintf("deps-graph:%s", root)
+	data, err := cache.Get(id)
+	if err == nil {
+		hash = string(data)
+		pins, truncated, err = loadGraphPins(hash)
+		if err == nil {
+			return
+		}
+	}
+	if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
+		log.Error("cache:", err)
+	}
+
+	graph, err := resolveDepsGraph(root, depsGraphMaxDepth, depsGraphMaxNodes, fetchPackageInfo)
+	if err != nil {
+		return
+	}
+	if graph.Truncated {
+		log.Warnf("the dependency graph of %s is truncated at %d packages", root, len(graph.Nodes))
+	}
+	pins = graph.Pins()
+	truncated = graph.Truncated
+	hash = hashPins(pins)
+	store := storage.Store{"pins": string(utils.MustEncodeJSON(pins))}
+	if truncated {
+		store["truncated"] = "true"
+	}
+	err = db.Put("graph:"+hash, "graph", store)
+	if err != nil {
+		return
+	}
+	cache.Set(id, []byte(hash), 10*time.Minute)
+	return
+}
+
+func loadGraphPins(hash string) (pins map[string]string, truncated bool, err error) {
+	store, _, err := db.Get("graph:" + hash)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(store["pins"]), &pins)
+	truncated = store["truncated"] == "true"
+	return
+}
+
+// buildImportMap returns the import map of the root package, the URLs are equal to the imports
+// rewritten by the builder with the `graph` deps policy.
+func buildImportMap(root Pkg, target string, isDev bool, origin string) (importMap ImportMap, err error) {
+	hash, pins, truncated, err := resolveGraphPins(root)
+	if err != nil {
+		return
+	}
+	importMap.Truncated = truncated
+	names := make([]string, 0, len(pins))
+	for name := range pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	importMap.Imports = map[string]string{}
+	for _, name := range names {
+		version := pins[name]
+		if name == root.Name {
+			version = root.Version
+		}
+		task := &BuildTask{
+			BuildVersion: VERSION,
+			Pkg:          Pkg{Name: name, Version: version},
+			Target:       target,
+			DevMode:      isDev,
+			DepsPolicy:   "graph",
+			DepsGraph:    hash,
+		}
+		importMap.Imports[name] = fmt.Sprintf("%s%s/%s", origin, basePath, task.ID())
+	}
+	return
+}
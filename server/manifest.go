@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+// ManifestOptions defines the request body of the `/-/manifest` endpoint
+type ManifestOptions struct {
+	Pkg    string `json:"pkg"`
+	Target string `json:"target"`
+	Dev    bool   `json:"dev"`
+}
+
+// the error of the manifest that the dependency graph exceeds the limits
+var errDepsGraphTruncated = errors.New("the dependency graph exceeds the limits")
+
+// buildManifest builds all packages in the dependency graph of the root package,
+// and returns the integrity(SRI) of every build URL. The truncated graph is refused
+// since the partial manifest can't verify the whole graph.
+func buildManifest(root Pkg, target string, isDev bool, origin string, consumerIp string) (manifest map[string]string, err error) {
+	graph, err := resolveDepsGraph(root, depsGraphMaxDepth, depsGraphMaxNodes, fetchPackageInfo)
+	if err != nil {
+		return
+	}
+	if graph.Truncated {
+		err = errDepsGraphTruncated
+		return
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var errs []error
+	manifest = map[string]string{}
+	for _, pkg := range graph.Pkgs() {
+		wg.Add(1)
+		go func(pkg Pkg) {
+			defer wg.Done()
+			task := &BuildTask{
+				CdnOrigin:    origin,
+				BuildVersion: VERSION,
+				Pkg:          pkg,
+				Target:       target,
+				DevMode:      isDev,
+				stage:        "init",
+			}
+			// the build defaults are applied as the builds of the dependencies, so the URLs
+			// of the manifest are the ones the imports are rewritten to
+			buildDefaults.ApplyTask(task)
+			esm, err := findModule(task.ID())
+			if err == storage.ErrNotFound {
+				// build in the build queue to limit the concurrency
+				c := buildQueue.Add(task, consumerIp)
+				select {
+				case output := <-c.C:
+					esm, err = output.meta, output.err
+				case <-time.After(5 * time.Minute):
+					buildQueue.RemoveConsumer(task, c)
+					err = fmt.Errorf("build %s: timeout", pkg)
+				}
+			}
+			if err == nil && !esm.TypesOnly {
+				var integrity string
+				integrity, err = computeIntegrity(path.Join("builds", task.ID()))
+				if err == nil {
+					lock.Lock()
+					manifest[fmt.Sprintf("%s%s/%s", origin, basePath, task.ID())] = integrity
+					lock.Unlock()
+				}
+			}
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+			}
+		}(pkg)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		err = errs[0]
+	}
+	return
+}
+
+// computeIntegrity returns the subresource integrity(sha384) of the stored file
+func computeIntegrity(savePath string) (integrity string, err error) {
+	exists, size, _, err := fs.Exists(savePath)
+	if err != nil {
+		return
+	}
+	if !exists {
+		err = fmt.Errorf("%s not found", savePath)
+		return
+	}
+	r, err := fs.ReadFile(savePath, size)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	h := sha512.New384()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return
+	}
+	integrity = "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return
+}
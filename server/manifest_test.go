@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestManifest(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/app":
+			fmt.Fprint(w, `{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"app","version":"1.0.0","dependencies":{"dep":"^1.0.0"}}}}`)
+		case "/dep":
+			fmt.Fprint(w, `{"dist-tags":{"latest":"1.1.0"},"versions":{"1.0.0":{"name":"dep","version":"1.0.0"},"1.1.0":{"name":"dep","version":"1.1.0"}}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer registry.Close()
+
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS, c storage.Cache, n *Node, q *BuildQueue) {
+		log, embedFS, db, fs, cache, node, buildQueue = l, e, d, f, c, n, q
+	}(log, embedFS, db, fs, cache, node, buildQueue)
+	var err error
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node = &Node{npmRegistry: registry.URL + "/"}
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	registryLimiter = newRateLimiter(0, time.Minute)
+	// the queue without slots never builds, all the packages of the graph are stored already
+	buildQueue = newBuildQueue(0)
+
+	integrities := map[string]string{}
+	for _, pkg := range []Pkg{{Name: "app", Version: "1.0.0"}, {Name: "dep", Version: "1.1.0"}} {
+		task := &BuildTask{BuildVersion: VERSION, Pkg: pkg, Target: "es2022"}
+		data := []byte(fmt.Sprintf("export default %q;\n", pkg.Name))
+		err = fs.WriteData(path.Join("builds", task.ID()), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Put(task.ID(), "build", storage.Store{"meta": "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha512.Sum384(data)
+		integrities[task.ID()] = "sha384-" + base64.StdEncoding.EncodeToString(h[:])
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+	origin := "https://" + strings.TrimPrefix(server.URL, "http://")
+
+	post := func(body string) (*http.Response, map[string]string) {
+		res, err := http.Post(server.URL+"/-/manifest", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var manifest map[string]string
+		if res.StatusCode == 200 {
+			err = json.NewDecoder(res.Body).Decode(&manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res, manifest
+	}
+
+	// the manifest has the integrity of every build of the graph
+	res, manifest := post(`{"pkg":"app@1.0.0","target":"es2022"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	if len(manifest) != len(integrities) {
+		t.Fatalf("unexpected manifest %v", manifest)
+	}
+	for id, integrity := range integrities {
+		if manifest[origin+"/"+id] != integrity {
+			t.Fatalf("invalid integrity of %s: %s, expected %s", id, manifest[origin+"/"+id], integrity)
+		}
+	}
+
+	// the manifest lists the builds of the build defaults, the same URLs the imports are rewritten to
+	defer func(d BuildDefaults) { buildDefaults = d }(buildDefaults)
+	buildDefaults, err = parseBuildDefaults([]byte(`{"dep@^1.0.0": {"keep-names": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "dep", Version: "1.1.0"}, Target: "es2022", KeepNames: true}
+	err = fs.WriteData(path.Join("builds", task.ID()), []byte("export default \"dep\";\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put(task.ID(), "build", storage.Store{"meta": "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, manifest = post(`{"pkg":"app@1.0.0","target":"es2022"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	depURL := origin + "/" + task.ID()
+	if _, ok := manifest[depURL]; !ok {
+		t.Fatalf("%s not found in the manifest %v", depURL, manifest)
+	}
+	wd := t.TempDir()
+	writeFixture(t, wd, "app", map[string]string{
+		"package.json": `{"name":"app","version":"1.0.0","module":"index.js","types":"index.d.ts","dependencies":{"dep":"^1.0.0"}}`,
+		"index.d.ts":   `export default string;`,
+		"index.js":     `import dep from "dep"; export default dep;`,
+	})
+	writeFixture(t, wd, "dep", map[string]string{
+		"package.json": `{"name":"dep","version":"1.1.0","module":"index.js"}`,
+		"index.js":     `export default "dep";`,
+	})
+	app := &BuildTask{wd: wd, BuildVersion: VERSION, Pkg: Pkg{Name: "app", Version: "1.0.0"}, Target: "es2022", External: newStringSet(), noStore: true}
+	_, err = app.build(newStringSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(app.output), "\"/"+task.ID()+"\"") {
+		t.Fatalf("the build should import %s: %s", task.ID(), app.output)
+	}
+
+	// the truncated graph is refused
+	defer func(n int) { depsGraphMaxNodes = n }(depsGraphMaxNodes)
+	depsGraphMaxNodes = 1
+	res, _ = post(`{"pkg":"app@1.0.0","target":"es2022"}`)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("the truncated graph should be refused, got %d", res.StatusCode)
+	}
+}
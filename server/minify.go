@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+)
+
+// the minify options are a combination of `s`(syntax), `w`(whitespace) and `i`(identifiers),
+// empty means the default that minifies all in production and nothing in development.
+const minifyAll = "swi"
+
+// normalizeMinify returns the canonical minify options, the default combination is empty,
+// so `?minify` and the default production build share the same build id.
+func normalizeMinify(minify string, isDev bool) string {
+	var b strings.Builder
+	for _, c := range minifyAll {
+		if strings.ContainsRune(minify, c) {
+			b.WriteRune(c)
+		}
+	}
+	minify = b.String()
+	if !isDev && minify == minifyAll {
+		return ""
+	}
+	return minify
+}
+
+// minify returns the esbuild minify options(syntax, whitespace, identifiers) of the task
+func (task *BuildTask) minify() (syntax bool, whitespace bool, identifiers bool) {
+	if task.Minify == "" {
+		return !task.DevMode, !task.DevMode, !task.DevMode
+	}
+	return strings.ContainsRune(task.Minify, 's'), strings.ContainsRune(task.Minify, 'w'), strings.ContainsRune(task.Minify, 'i')
+}
+
+// minifyHeader returns the effective minify options for the `X-Esm-Minify` header,
+// e.g. `syntax,whitespace`, or `none` if nothing is minified.
+func (task *BuildTask) minifyHeader() string {
+	syntax, whitespace, identifiers := task.minify()
+	a := []string{}
+	if syntax {
+		a = append(a, "syntax")
+	}
+	if whitespace {
+		a = append(a, "whitespace")
+	}
+	if identifiers {
+		a = append(a, "identifiers")
+	}
+	if len(a) == 0 {
+		return "none"
+	}
+	return strings.Join(a, ",")
+}
@@ -24,29 +24,90 @@ type ModuleMeta struct {
 	TypesOnly     bool     `json:"o"`
 	Dts           string   `json:"t"`
 	PackageCSS    bool     `json:"s"`
+	Entry         string   `json:"e,omitempty"` // the effective entry if the package.json is overridden
+	EngineWarning string   `json:"w,omitempty"` // the `engines.node` is not satisfied by the node version
+
+	DtsVersions  []DtsVersion `json:"tv,omitempty"` // the types of the `typesVersions` ranges in order
+	AssetWarning string       `json:"aw,omitempty"` // the `import.meta.url` asset references that are not rewritten
+	PeerDeps     []string     `json:"pd,omitempty"` // the peer dependencies that are imported from the CDN URLs
 }
 
-func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta, npm *NpmPackage, err error) {
+// initModule initializes the module of the package in the wd, the `nodeEnv` is the `process.env.NODE_ENV`
+// of the cjs exports detection, empty means the default of the dev mode.
+func initModule(wd string, pkg Pkg, target string, isDev bool, nodeEnv string, entryField string) (esm *ModuleMeta, npm *NpmPackage, err error) {
 	packageDir := path.Join(wd, "node_modules", pkg.Name)
 	packageFile := path.Join(packageDir, "package.json")
 
+	overrides, err := overridePackageJSON(packageFile)
+	if err != nil {
+		return
+	}
+	if len(overrides) > 0 {
+		log.Infof("override package.json of %s by %s", pkg, strings.Join(overrides, ","))
+	}
+
 	var p NpmPackage
 	err = utils.ParseJSONFile(packageFile, &p)
 	if err != nil {
 		return
 	}
+	p.fixProtocolVersions()
 
 	npm = fixNpmPackage(p, target, isDev)
 	esm = &ModuleMeta{}
 
+	// the cjs exports analysis runs the package in node
+	if node != nil {
+		esm.EngineWarning, err = checkEngines(npm, node.version)
+		if err != nil {
+			return
+		}
+		if esm.EngineWarning != "" {
+			log.Warn(esm.EngineWarning)
+		}
+	}
+
+	// the resolved index entry of a directory-style submodule
+	var dirEntry string
+
+	// prefer the CDN-oriented entry field of the `?entry-field` query, the field is checked as
+	// the module entry and falls back to the cjs main if it's not an ES module(like UMD).
+	var fieldEntry string
+	if pkg.Submodule == "" && entryField != "" {
+		if entry := npm.entryField(entryField); entry != "" && existsEntry(packageDir, entry) {
+			fieldEntry = strings.TrimPrefix(path.Clean(entry), "./")
+			filename, _ := resolveModuleFile(path.Join(packageDir, fieldEntry))
+			if strings.HasSuffix(fieldEntry, ".mjs") || probeModuleSyntax(filename) == moduleTypeESM {
+				npm.Module = fieldEntry
+				npm.Main = ""
+			} else {
+				npm.Module = ""
+				npm.Main = fieldEntry
+			}
+		}
+	}
+
 	defer func() {
 		esm.CJS = npm.Module == ""
 		esm.TypesOnly = npm.Module == "" && npm.Main == "" && npm.Types != ""
+		if dirEntry != "" {
+			esm.Entry = dirEntry
+		} else if fieldEntry != "" {
+			esm.Entry = fieldEntry
+		} else if len(overrides) > 0 {
+			if npm.Module != "" {
+				esm.Entry = npm.Module
+			} else {
+				esm.Entry = npm.Main
+			}
+		}
 	}()
 
-	nodeEnv := "production"
-	if isDev {
-		nodeEnv = "development"
+	if nodeEnv == "" {
+		nodeEnv = "production"
+		if isDev {
+			nodeEnv = "development"
+		}
 	}
 
 	if pkg.Submodule != "" {
@@ -142,11 +203,22 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 					}
 				}
 				if !resolved {
-					if npm.Type == "module" || npm.Module != "" {
+					entry := pkg.Submodule
+					// a directory-style submodule resolves to the index entry of the directory
+					if dirExists(subDir) && !existsFile(subDir, ".js", ".mjs", ".cjs") {
+						index, ok := resolveDirectoryIndex(subDir)
+						if !ok {
+							err = &BuildError{ErrNoEntry, fmt.Sprintf("directory '%s' of '%s' has no index entry", pkg.Submodule, pkg.Name)}
+							return
+						}
+						entry = path.Join(pkg.Submodule, index)
+						dirEntry = entry
+					}
+					if npm.Type == "module" || npm.Module != "" || strings.HasSuffix(entry, ".mjs") {
 						// follow main module type
-						npm.Module = pkg.Submodule
+						npm.Module = entry
 					} else {
-						npm.Main = pkg.Submodule
+						npm.Main = entry
 					}
 					npm.Types = ""
 					if fileExists(path.Join(subDir, "index.d.ts")) {
@@ -173,7 +245,15 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 		}
 	}
 
-	// for pure types packages
+	// for pure types packages like `@types/react` that have no runtime entry
+	if pkg.Submodule == "" && npm.Module == "" {
+		if npm.Main != "" && npm.Types != "" && !existsEntry(packageDir, npm.Main) {
+			npm.Main = ""
+		}
+		if npm.Main == "" && npm.Types == "" && fileExists(path.Join(packageDir, "index.d.ts")) {
+			npm.Types = "index.d.ts"
+		}
+	}
 	if npm.Main == "" && npm.Module == "" && npm.Types != "" {
 		return
 	}
@@ -182,6 +262,16 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 		npm.Module = npm.Main
 	}
 
+	// the ES module syntax in the `main` of a CommonJS package(like `.js` without the `type: module`)
+	if npm.Module == "" && npm.Main != "" {
+		if filename, ok := resolveModuleFile(path.Join(packageDir, npm.Main)); ok {
+			if actual, mismatch := checkModuleSyntax(filename); mismatch && actual == moduleTypeESM {
+				log.Warnf("the main '%s' of '%s' is labeled as CommonJS but uses the ES module syntax", npm.Main, npm.Name)
+				npm.Module = npm.Main
+			}
+		}
+	}
+
 	if npm.Module != "" {
 		modulePath, exportDefault, reason := checkESM(wd, npm.Name, npm.Module)
 		if reason == nil {
@@ -189,7 +279,7 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 			esm.ExportDefault = exportDefault
 		} else if reason.Error() == "not a module" {
 			var ret cjsExportsResult
-			ret, err = parseCJSModuleExports(wd, path.Join(pkg.Name, strings.TrimSuffix(npm.Module, ".js")), nodeEnv)
+			ret, err = parseCJSModuleExports(wd, path.Join(pkg.Name, strings.TrimSuffix(npm.Module, ".js")), nodeEnv, false)
 			if err == nil && ret.Error != "" {
 				err = fmt.Errorf(ret.Error)
 			}
@@ -206,8 +296,12 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 			return
 		}
 	} else if npm.Main != "" {
+		importPath := pkg.ImportPath()
+		if fieldEntry != "" {
+			importPath = path.Join(pkg.Name, fieldEntry)
+		}
 		var ret cjsExportsResult
-		ret, err = parseCJSModuleExports(wd, pkg.ImportPath(), nodeEnv)
+		ret, err = parseCJSModuleExports(wd, importPath, nodeEnv, false)
 		if err == nil && ret.Error != "" {
 			err = fmt.Errorf(ret.Error)
 		}
@@ -287,9 +381,36 @@ func findModule(id string) (esm *ModuleMeta, err error) {
 	return
 }
 
+// resolveDirectoryIndex returns the index entry of the directory, unlike node it tries `index.mjs` and
+// `index.cjs` too since the directory requests are resolved for the ES module builds.
+func resolveDirectoryIndex(dir string) (index string, ok bool) {
+	for _, name := range []string{"index.mjs", "index.js", "index.cjs"} {
+		if fileExists(path.Join(dir, name)) {
+			return name, true
+		}
+	}
+	return
+}
+
+// existsFile checks whether the file with one of the extnames exists
+func existsFile(filename string, extnames ...string) bool {
+	for _, ext := range extnames {
+		if fileExists(filename + ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// existsEntry checks whether the entry file exists in node's way: `entry`, `entry.js` or `entry/index.js`
+func existsEntry(dir string, entry string) bool {
+	filename := path.Join(dir, entry)
+	return fileExists(filename) || fileExists(filename+".js") || fileExists(filename+".cjs") || fileExists(path.Join(filename, "index.js"))
+}
+
 func checkESM(wd string, packageName string, moduleSpecifier string) (resolveName string, exportDefault bool, err error) {
 	pkgDir := path.Join(wd, "node_modules", packageName)
-	if dirExists(path.Join(pkgDir, moduleSpecifier)) {
+	if dirExists(path.Join(pkgDir, moduleSpecifier)) && !fileExists(path.Join(pkgDir, moduleSpecifier+".js")) {
 		f := path.Join(moduleSpecifier, "index.mjs")
 		if !fileExists(path.Join(pkgDir, f)) {
 			f = path.Join(moduleSpecifier, "index.js")
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ije/gox/utils"
+)
+
+// writeFixture writes the files of a fake package into the `node_modules` directory of wd
+func writeFixture(t *testing.T, wd string, pkgName string, files map[string]string) {
+	for name, content := range files {
+		filename := path.Join(wd, "node_modules", pkgName, name)
+		err := os.MkdirAll(path.Dir(filename), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInitTypesOnlyModule(t *testing.T) {
+	wd := t.TempDir()
+
+	// like `@types/react`, `main` is empty
+	writeFixture(t, wd, "@types/foo", map[string]string{
+		"package.json": `{"name":"@types/foo","version":"1.0.0","main":"","types":"index.d.ts"}`,
+		"index.d.ts":   `export declare const foo: string;`,
+	})
+	// no `types` field
+	writeFixture(t, wd, "@types/bar", map[string]string{
+		"package.json": `{"name":"@types/bar","version":"1.0.0"}`,
+		"index.d.ts":   `export declare const bar: string;`,
+	})
+	// `main` points to a missing file
+	writeFixture(t, wd, "@types/baz", map[string]string{
+		"package.json": `{"name":"@types/baz","version":"1.0.0","main":"index.js","typings":"index.d.ts"}`,
+		"index.d.ts":   `export declare const baz: string;`,
+	})
+
+	for _, name := range []string{"@types/foo", "@types/bar", "@types/baz"} {
+		esm, npm, err := initModule(wd, Pkg{Name: name, Version: "1.0.0"}, "es2022", false, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !esm.TypesOnly {
+			t.Fatalf("%s should be types only", name)
+		}
+		if npm.Types != "index.d.ts" {
+			t.Fatalf("invalid types entry of %s: %s", name, npm.Types)
+		}
+	}
+}
+
+func TestInitModuleWithOverrides(t *testing.T) {
+	wd := t.TempDir()
+
+	// the `module` field points to a missing file
+	writeFixture(t, wd, "broken", map[string]string{
+		"package.json":  `{"name":"broken","version":"1.0.0","main":"index.js","module":"esm/missing.js","sideEffects":true}`,
+		"index.js":      `module.exports = { foo: "bar" }`,
+		"esm/index.mjs": `export const foo = "bar"`,
+	})
+
+	var err error
+	pkgOverrides, err = parsePackageOverrides(map[string]map[string]json.RawMessage{
+		"broken@<1.1.0": {
+			"module":      json.RawMessage(`"esm/index.mjs"`),
+			"sideEffects": json.RawMessage(`false`),
+		},
+		"broken@>=2.0.0": {
+			"main": json.RawMessage(`null`),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { pkgOverrides = nil }()
+
+	esm, npm, err := initModule(wd, Pkg{Name: "broken", Version: "1.0.0"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if npm.Module != "esm/index.mjs" || esm.Entry != "esm/index.mjs" {
+		t.Fatalf("invalid module entry: %s", npm.Module)
+	}
+	if npm.Main != "index.js" {
+		t.Fatalf("the main entry should not be overridden: %s", npm.Main)
+	}
+
+	var raw map[string]interface{}
+	err = utils.ParseJSONFile(path.Join(wd, "node_modules", "broken", "package.json"), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw["sideEffects"] != false {
+		t.Fatalf("invalid sideEffects: %v", raw["sideEffects"])
+	}
+
+	_, err = parsePackageOverrides(map[string]map[string]json.RawMessage{
+		"broken@1.0.0": {"dependencies": json.RawMessage(`{}`)},
+	})
+	if err == nil {
+		t.Fatal("the `dependencies` field should not be overridable")
+	}
+}
+
+func TestInitModuleWithDirectory(t *testing.T) {
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json":         `{"name":"foo","version":"1.0.0","type":"module","main":"index.js"}`,
+		"index.js":             `export default "foo"`,
+		"lib/index.mjs":        `export default "lib"`,
+		"lib/locale/index.js":  `export default "locale"`,
+		"lib/sub/package.json": `{"module":"esm/sub.js"}`,
+		"lib/sub/esm/sub.js":   `export default "sub"`,
+		"lib/util.js":          `export default "util"`,
+		"lib/util/index.js":    `export default "util/index"`,
+		"lib/empty/README.md":  `# no index`,
+	})
+
+	for pathname, entry := range map[string]string{
+		"/foo@1.0.0/lib/":        "lib/index.mjs",
+		"/foo@1.0.0/lib/locale/": "lib/locale/index.js",
+		"/foo@1.0.0/lib/sub/":    "lib/sub/esm/sub.js",
+		"/foo@1.0.0/lib/util":    "lib/util",
+	} {
+		pkg, _, err := parsePkg(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, npm, err := initModule(wd, *pkg, "es2022", false, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if npm.Module != entry {
+			t.Fatalf("invalid entry of '%s': %s, expected %s", pathname, npm.Module, entry)
+		}
+	}
+
+	esm, _, err := initModule(wd, Pkg{Name: "foo", Version: "1.0.0", Submodule: "lib/locale"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esm.Entry != "lib/locale/index.js" {
+		t.Fatalf("invalid entry of the directory: %s", esm.Entry)
+	}
+
+	_, _, err = initModule(wd, Pkg{Name: "foo", Version: "1.0.0", Submodule: "lib/empty"}, "es2022", false, "", "")
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) || buildErr.Code != ErrNoEntry {
+		t.Fatalf("the directory without index should be not found: %v", err)
+	}
+}
+
+func TestInitModuleWithEngines(t *testing.T) {
+	defer func(n *Node) { node = n }(node)
+	wd := t.TempDir()
+
+	writeFixture(t, wd, "modern", map[string]string{
+		"package.json": `{"name":"modern","version":"1.0.0","module":"index.mjs","engines":{"node":">=99"}}`,
+		"index.mjs":    `export const foo = "bar"`,
+	})
+	// the legacy array form of `engines`
+	writeFixture(t, wd, "legacy", map[string]string{
+		"package.json": `{"name":"legacy","version":"1.0.0","module":"index.mjs","engines":["node >= 0.4"]}`,
+		"index.mjs":    `export const foo = "bar"`,
+	})
+
+	prevNode := node
+	defer func() {
+		node = prevNode
+		enginesPolicy = "warn"
+	}()
+	node = &Node{version: "16.14.0"}
+
+	esm, _, err := initModule(wd, Pkg{Name: "legacy", Version: "1.0.0"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esm.EngineWarning != "" {
+		t.Fatalf("unexpected engine warning: %s", esm.EngineWarning)
+	}
+
+	enginesPolicy = "warn"
+	esm, _, err = initModule(wd, Pkg{Name: "modern", Version: "1.0.0"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esm.EngineWarning != "modern@1.0.0 requires node >=99, but the node version of the server is 16.14.0" {
+		t.Fatalf("unexpected engine warning: %s", esm.EngineWarning)
+	}
+
+	enginesPolicy = "error"
+	_, _, err = initModule(wd, Pkg{Name: "modern", Version: "1.0.0"}, "es2022", false, "", "")
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) || buildErr.Code != ErrEngineMismatch {
+		t.Fatalf("expected the %s error, got %v", ErrEngineMismatch, err)
+	}
+
+	enginesPolicy = "ignore"
+	esm, _, err = initModule(wd, Pkg{Name: "modern", Version: "1.0.0"}, "es2022", false, "", "")
+	if err != nil || esm.EngineWarning != "" {
+		t.Fatalf("the engines should be ignored, got %v %s", err, esm.EngineWarning)
+	}
+}
+
+func TestInitModuleWithEntryField(t *testing.T) {
+	wd := t.TempDir()
+
+	writeFixture(t, wd, "cdn", map[string]string{
+		"package.json":     `{"name":"cdn","version":"1.0.0","main":"lib/index.js","module":"es/index.js","unpkg":"./dist/cdn.min.mjs","jsdelivr":"dist/missing.js"}`,
+		"lib/index.js":     `exports.foo = "lib"`,
+		"es/index.js":      `export const foo = "es"`,
+		"dist/cdn.min.mjs": `export const foo = "unpkg"`,
+	})
+
+	esm, npm, err := initModule(wd, Pkg{Name: "cdn", Version: "1.0.0"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if npm.Module != "es/index.js" || esm.Entry != "" {
+		t.Fatalf("the module field should be used by default, got '%s'", npm.Module)
+	}
+
+	esm, npm, err = initModule(wd, Pkg{Name: "cdn", Version: "1.0.0"}, "es2022", false, "", "unpkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if npm.Module != "dist/cdn.min.mjs" || esm.Entry != "dist/cdn.min.mjs" || esm.CJS {
+		t.Fatalf("the unpkg field should be preferred, got '%s'", npm.Module)
+	}
+
+	// the missing entry of the field is ignored
+	_, npm, err = initModule(wd, Pkg{Name: "cdn", Version: "1.0.0"}, "es2022", false, "", "jsdelivr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if npm.Module != "es/index.js" {
+		t.Fatalf("the missing jsdelivr entry should be ignored, got '%s'", npm.Module)
+	}
+
+	task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "cdn", Version: "1.0.0"}, Target: "es2022", EntryField: "unpkg", External: newStringSet()}
+	if !strings.HasSuffix(task.ID(), "/es2022/cdn.ef-unpkg.js") {
+		t.Fatalf("unexpected build id %s", task.ID())
+	}
+}
+
+func TestInitModuleWithUMDEntryField(t *testing.T) {
+	wd := t.TempDir()
+
+	writeFixture(t, wd, "umd", map[string]string{
+		"package.json":    `{"name":"umd","version":"1.0.0","module":"es/index.js","unpkg":"dist/umd.min.js"}`,
+		"es/index.js":     `export const foo = "es"`,
+		"dist/umd.min.js": `(function (g, f) { typeof exports === "object" ? f(exports) : f(g.umd = {}) })(this, function (exports) { exports.foo = "umd" })`,
+	})
+
+	// the fake cjs exports service of node
+	importPaths := make(chan string, 1)
+	go func() {
+		task := <-nsChannel
+		importPaths <- task.input["importPath"].(string)
+		task.output <- []byte(`{"exports":["foo"]}`)
+	}()
+
+	esm, npm, err := initModule(wd, Pkg{Name: "umd", Version: "1.0.0"}, "es2022", false, "", "unpkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the UMD entry of the field falls back to the cjs main
+	if npm.Module != "" || npm.Main != "dist/umd.min.js" || esm.Entry != "dist/umd.min.js" || !esm.CJS {
+		t.Fatalf("the UMD entry should be the cjs main, got module '%s', main '%s'", npm.Module, npm.Main)
+	}
+	if importPath := <-importPaths; importPath != "umd/dist/umd.min.js" {
+		t.Fatalf("the cjs exports should be detected from the UMD entry, got '%s'", importPath)
+	}
+	if strings.Join(esm.Exports, ",") != "foo" {
+		t.Fatalf("unexpected exports %v", esm.Exports)
+	}
+}
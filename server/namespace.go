@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// matches the tail of `import * as foo from ` before the import path
+var regexpNamespaceImportTail = regexp.MustCompile(`import\s*\*\s*as\s+[\w$]+\s*from\s*$`)
+
+// isNamespaceImported checks whether the external module is imported by `import * as` in the output
+func isNamespaceImported(content []byte, name string) bool {
+	slice := bytes.Split(content, []byte(fmt.Sprintf("\"__ESM_SH_EXTERNAL:%s\"", name)))
+	for _, p := range slice[:len(slice)-1] {
+		if regexpNamespaceImportTail.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceExports returns the exports detected by the lexer merged with the enumerable keys
+// of the `module.exports` that are got by requiring the module.
+func (task *BuildTask) namespaceExports(esm *ModuleMeta) []string {
+	exports := newStringSet()
+	for _, name := range esm.Exports {
+		exports.Add(name)
+	}
+	ret, err := parseCJSModuleExports(task.wd, task.Pkg.ImportPath(), task.getNodeEnv(), true)
+	if err == nil && ret.Error != "" {
+		err = fmt.Errorf(ret.Error)
+	}
+	if err != nil {
+		log.Warnf("require exports of %s: %v", task.Pkg, err)
+	} else {
+		for _, name := range ret.Exports {
+			exports.Add(name)
+		}
+	}
+	names := exports.Values()
+	sort.Strings(names)
+	return names
+}
+
+// cjsNamespaceBarrel returns the entry of the cjs module that spreads the members of the `module.exports`
+// onto the namespace, the members are read from the `module.exports` rather than the interop namespace
+// of esbuild, that covers the getters and the prototype methods.
+func cjsNamespaceBarrel(importPath string, exports []string) string {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, `import $default from "%s";`, importPath)
+	fmt.Fprintf(buf, `import * as $module from "%s";`, importPath)
+	fmt.Fprintf(buf, "const { default: $def, ...$rest } = $module;")
+	fmt.Fprintf(buf, "const $ns = $default ?? $def ?? $rest;")
+	names := make([]string, 0, len(exports))
+	for _, name := range exports {
+		if name != "default" && name != "__esModule" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(buf, `const $obj = $ns !== null && (typeof $ns === "object" || typeof $ns === "function") ? $ns : $module;`)
+		fmt.Fprintf(buf, "export const { %s } = $obj;", strings.Join(names, ","))
+	}
+	fmt.Fprintf(buf, "export default $ns;")
+	return buf.String()
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+	logx "github.com/ije/gox/log"
+)
+
+func TestCJSNamespaceBarrel(t *testing.T) {
+	wd := t.TempDir()
+	pkgDir := path.Join(wd, "node_modules", "foo")
+	err := os.MkdirAll(pkgDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the members are assigned at runtime, the static interop of esbuild only yields the `default`
+	files := map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","main":"index.js"}`,
+		"index.js":     "module.exports = (function () { return { foo: 1, bar() { return 2 } } })();",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(path.Join(pkgDir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ret := api.Build(api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents:   cjsNamespaceBarrel("foo", []string{"bar", "default", "foo"}),
+			ResolveDir: wd,
+			Sourcefile: "mod.js",
+		},
+		Outdir:   "/out",
+		Bundle:   true,
+		Format:   api.FormatESModule,
+		Metafile: true,
+	})
+	if len(ret.Errors) > 0 {
+		t.Fatal(ret.Errors[0].Text)
+	}
+
+	var meta struct {
+		Outputs map[string]struct {
+			Exports []string `json:"exports"`
+		} `json:"outputs"`
+	}
+	err = json.Unmarshal([]byte(ret.Metafile), &meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, output := range meta.Outputs {
+		exports := output.Exports
+		sort.Strings(exports)
+		if strings.Join(exports, ",") != "bar,default,foo" {
+			t.Fatalf("unexpected namespace members %v", exports)
+		}
+	}
+}
+
+func TestIsNamespaceImported(t *testing.T) {
+	for _, c := range []struct {
+		content  string
+		imported bool
+	}{
+		{`import * as foo from "__ESM_SH_EXTERNAL:foo";`, true},
+		{`import*as a from"__ESM_SH_EXTERNAL:foo";`, true},
+		{`import foo from "__ESM_SH_EXTERNAL:foo";`, false},
+		{`import { bar } from "__ESM_SH_EXTERNAL:foo";import * as b from "__ESM_SH_EXTERNAL:bar";`, false},
+	} {
+		if isNamespaceImported([]byte(c.content), "foo") != c.imported {
+			t.Fatalf("isNamespaceImported(%s) should be %v", c.content, c.imported)
+		}
+	}
+
+	task := &BuildTask{
+		BuildVersion: 87,
+		Pkg:          Pkg{Name: "foo", Version: "1.0.0"},
+		External:     newStringSet(),
+		Target:       "es2022",
+		Namespace:    true,
+	}
+	if task.ID() != "v87/foo@1.0.0/es2022/foo.ns.js" {
+		t.Fatalf("invalid build id: %s", task.ID())
+	}
+}
+
+func TestNamespaceImportPath(t *testing.T) {
+	var err error
+	defer func(l *logx.Logger) { log = l }(log)
+	log = &logx.Logger{}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(f storage.FS) { fs = f }(fs)
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the queue without slots keeps the dependency builds waiting
+	defer func(q *BuildQueue) { buildQueue = q }(buildQueue)
+	buildQueue = newBuildQueue(0)
+
+	wd := t.TempDir()
+	writeFixture(t, wd, "app", map[string]string{
+		"package.json": `{"name":"app","version":"1.0.0","module":"index.js","types":"index.d.ts","dependencies":{"foo":"^1.0.0","bar":"^1.0.0"}}`,
+		"index.d.ts":   `export declare const x: any;`,
+		"index.js":     `import * as foo from "foo"; import bar from "bar"; export const x = [foo.foo, bar];`,
+	})
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","main":"index.js"}`,
+		"index.js":     `module.exports = { foo: 1 }`,
+	})
+	writeFixture(t, wd, "bar", map[string]string{
+		"package.json": `{"name":"bar","version":"1.0.0","main":"index.js"}`,
+		"index.js":     `module.exports = 1`,
+	})
+
+	task := &BuildTask{
+		wd:           wd,
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "app", Version: "1.0.0"},
+		Target:       "es2022",
+		External:     newStringSet(),
+		noStore:      true,
+	}
+	_, err = task.build(newStringSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := string(task.output)
+
+	// the namespace-imported cjs dependency is imported from its namespace build
+	for _, s := range []string{
+		fmt.Sprintf(`"/v%d/foo@1.0.0/es2022/foo.ns.js"`, VERSION),
+		fmt.Sprintf(`"/v%d/bar@1.0.0/es2022/bar.js"`, VERSION),
+	} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("the import url %s not found in the code: %s", s, code)
+		}
+	}
+	if strings.Contains(code, "/foo.js") {
+		t.Fatalf("the plain build of the namespace-imported dependency should not be imported: %s", code)
+	}
+}
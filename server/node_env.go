@@ -0,0 +1,35 @@
+package server
+
+import (
+	"regexp"
+)
+
+// the value of the `?node-env` query is a safe string literal of the `process.env.NODE_ENV` define,
+// no dots since it's a suffix of the build id
+var regexpNodeEnv = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{0,31}$`)
+
+// isValidNodeEnv reports whether the value of the `?node-env` query is valid
+func isValidNodeEnv(nodeEnv string) bool {
+	return regexpNodeEnv.MatchString(nodeEnv)
+}
+
+// normalizeNodeEnv returns the canonical `?node-env` value, the default of the dev mode(`production`
+// or `development`) is empty, so the `?node-env=production` and the default build share the same build id.
+func normalizeNodeEnv(nodeEnv string, isDev bool) string {
+	if (!isDev && nodeEnv == "production") || (isDev && nodeEnv == "development") {
+		return ""
+	}
+	return nodeEnv
+}
+
+// getNodeEnv returns the `process.env.NODE_ENV` of the task, it's independent of the minification
+// and the dev shims that are controlled by the dev mode.
+func (task *BuildTask) getNodeEnv() string {
+	if task.NodeEnv != "" {
+		return task.NodeEnv
+	}
+	if task.DevMode {
+		return "development"
+	}
+	return "production"
+}
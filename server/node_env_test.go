@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestNodeEnv(t *testing.T) {
+	for nodeEnv, valid := range map[string]bool{
+		"production":   true,
+		"test":         true,
+		"e2e_staging":  true,
+		"qa-1":         true,
+		"":             false,
+		"1test":        false,
+		"a.b":          false,
+		`"+alert(1)+"`: false,
+		"process.env":  false,
+	} {
+		if isValidNodeEnv(nodeEnv) != valid {
+			t.Fatalf("the node env '%s' should be valid=%v", nodeEnv, valid)
+		}
+	}
+
+	for _, c := range []struct {
+		nodeEnv  string
+		devMode  bool
+		expected string
+	}{
+		{"", false, "production"},
+		{"", true, "development"},
+		{"test", false, "test"},
+		{"production", true, "production"},
+	} {
+		task := &BuildTask{NodeEnv: c.nodeEnv, DevMode: c.devMode}
+		if env := task.getNodeEnv(); env != c.expected {
+			t.Fatalf("the node env of %+v should be '%s', got '%s'", c, c.expected, env)
+		}
+	}
+
+	// the deps are imported with the same env, the suffix is parsed by the bare build URLs
+	task := &BuildTask{BuildVersion: 87, Target: "es2022", NodeEnv: "test", DevMode: true}
+	pkg := Pkg{Name: "react", Version: "18.2.0"}
+	if importPath := task.getImportPath(pkg, ""); importPath != "/v87/react@18.2.0/es2022/react.ne-test.development.js" {
+		t.Fatalf("invalid import path: %s", importPath)
+	}
+	task.Pkg = pkg
+	if task.ID() != "v87/react@18.2.0/es2022/react.ne-test.development.js" {
+		t.Fatalf("invalid build id: %s", task.ID())
+	}
+}
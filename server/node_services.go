@@ -223,11 +223,14 @@ type cjsExportsResult struct {
 	Error         string   `json:"error"`
 }
 
-func parseCJSModuleExports(buildDir string, importPath string, nodeEnv string) (ret cjsExportsResult, err error) {
+// parseCJSModuleExports parses the exports of the cjs module, the `requireMode` requires the module
+// to get the enumerable keys of the `module.exports` that can't be detected by the lexer.
+func parseCJSModuleExports(buildDir string, importPath string, nodeEnv string, requireMode bool) (ret cjsExportsResult, err error) {
 	data := invokeNodeService("parseCjsExports", map[string]interface{}{
-		"buildDir":   buildDir,
-		"importPath": importPath,
-		"nodeEnv":    nodeEnv,
+		"buildDir":    buildDir,
+		"importPath":  importPath,
+		"nodeEnv":     nodeEnv,
+		"requireMode": requireMode,
 	})
 
 	err = json.Unmarshal(data, &ret)
@@ -176,15 +176,31 @@ type NpmPackage struct {
 	Type             string            `json:"type,omitempty"`
 	Types            string            `json:"types,omitempty"`
 	Typings          string            `json:"typings,omitempty"`
+	Unpkg            string            `json:"unpkg,omitempty"`
+	Jsdelivr         string            `json:"jsdelivr,omitempty"`
+	TypesVersions    TypesVersions     `json:"typesVersions,omitempty"`
 	Dependencies     map[string]string `json:"dependencies,omitempty"`
 	PeerDependencies map[string]string `json:"peerDependencies,omitempty"`
 	DefinedExports   interface{}       `json:"exports,omitempty"`
+
+	OptionalDependencies map[string]string       `json:"optionalDependencies,omitempty"`
+	PeerDependenciesMeta map[string]PeerDepsMeta `json:"peerDependenciesMeta,omitempty"`
+	Engines              PackageEngines          `json:"engines,omitempty"`
+
+	// the original `workspace:`, `file:` and `link:` versions of the dependencies
+	protocolDeps map[string]string
+}
+
+// PeerDepsMeta defines the `peerDependenciesMeta` of package.json
+type PeerDepsMeta struct {
+	Optional bool `json:"optional"`
 }
 
 // Node defines the nodejs info
 type Node struct {
 	version     string
 	npmRegistry string
+	npmToken    string
 	yarn        string
 }
 
@@ -221,6 +237,7 @@ CheckNodejs:
 	node = &Node{
 		version:     version,
 		npmRegistry: "https://registry.npmjs.org/",
+		npmToken:    npmToken,
 	}
 	var output []byte
 	if npmRegistry == "" {
@@ -254,6 +271,11 @@ CheckYarn:
 }
 
 func getPackageInfo(wd string, name string, version string) (info NpmPackage, submodule string, fromPackageJSON bool, err error) {
+	return getPackageInfoFrom("", wd, name, version)
+}
+
+// getPackageInfoFrom is the `getPackageInfo` that fetches the metadata from the registry, empty means the default registry
+func getPackageInfoFrom(registry string, wd string, name string, version string) (info NpmPackage, submodule string, fromPackageJSON bool, err error) {
 	slice := strings.Split(name, "/")
 	if l := len(slice); strings.HasPrefix(name, "@") && l > 1 {
 		name = strings.Join(slice[:2], "/")
@@ -281,23 +303,57 @@ func getPackageInfo(wd string, name string, version string) (info NpmPackage, su
 		if fileExists(pkgJsonPath) {
 			err = utils.ParseJSONFile(pkgJsonPath, &info)
 			if err == nil {
+				info.fixProtocolVersions()
 				fromPackageJSON = true
 				return
 			}
 		}
 	}
 
-	info, err = fetchPackageInfo(name, version)
+	info, err = fetchPackageInfoFrom(registry, name, version)
 	return
 }
 
 var lock sync.Map
 
 func fetchPackageInfo(name string, version string) (info NpmPackage, err error) {
+	return fetchPackageInfoFrom("", name, version)
+}
+
+// packageInfoID returns the cache id of the package metadata, the metadata of the registries picked
+// by the `X-Esm-Registry` header are cached apart from the default registry.
+func packageInfoID(registry string, name string, version string) string {
+	if registry == "" || registry == node.npmRegistry {
+		return fmt.Sprintf("npm:%s@%s", name, version)
+	}
+	return fmt.Sprintf("npm:%s%s@%s", registry, name, version)
+}
+
+// fetchPackageInfoFrom fetches the package metadata from the registry, empty means the default registry
+func fetchPackageInfoFrom(registry string, name string, version string) (info NpmPackage, err error) {
+	return lookupPackageInfo(registry, name, version, false)
+}
+
+// refetchPackageInfo fetches the package metadata from the registry bypassing the caches, the cached
+// metadata is kept until the fetch succeeds and is still served while the registry is unavailable.
+func refetchPackageInfo(registry string, name string, version string) (info NpmPackage, err error) {
+	return lookupPackageInfo(registry, name, version, true)
+}
+
+func lookupPackageInfo(registry string, name string, version string, fresh bool) (info NpmPackage, err error) {
+	if registry == "" {
+		registry = node.npmRegistry
+	}
 	if version == "" {
 		version = "latest"
 	}
-	id := fmt.Sprintf("npm:%s@%s", name, version)
+	// the raw metadata is cached, the protocol versions are fixed for every lookup
+	defer func() {
+		if err == nil {
+			info.fixProtocolVersions()
+		}
+	}()
+	id := packageInfoID(registry, name, version)
 
 	// wait lock release
 	for {
@@ -308,20 +364,45 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 		time.Sleep(10 * time.Millisecond)
 	}
 
-	data, err := cache.Get(id)
-	if err == nil && json.Unmarshal(data, &info) == nil {
-		return
-	}
-	if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
-		log.Error("cache:", err)
+	var data []byte
+	if !fresh {
+		data, err = cache.Get(id)
+		if err == nil && json.Unmarshal(data, &info) == nil {
+			return
+		}
+		if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
+			log.Error("cache:", err)
+		}
 	}
 
 	lock.Store(id, struct{}{})
 	defer lock.Delete(id)
 
+	// the memory cache will be expired in 10 minutes for tags and semver ranges
+	isFullVersion := regFullVersion.MatchString(version)
+	var ttl time.Duration = 0
+	if !isFullVersion {
+		ttl = 10 * time.Minute
+	}
+
+	// the metadata cached in the db, tags and semver ranges are cached in a short ttl
+	store, modtime, err := db.Get(id)
+	if err == nil && !fresh && (isFullVersion || time.Since(modtime) < registryCacheTTL) && json.Unmarshal([]byte(store["info"]), &info) == nil {
+		cache.Set(id, []byte(store["info"]), ttl)
+		return
+	}
+
 	start := time.Now()
-	resp, err := httpClient.Get(node.npmRegistry + name)
+	req, err := http.NewRequest("GET", registry+name, nil)
+	if err != nil {
+		return
+	}
+	resp, err := fetchRegistry(req)
 	if err != nil {
+		// serve the stale metadata in the db while the registry is unavailable
+		if err == errRegistryUnavailable && store != nil && json.Unmarshal([]byte(store["info"]), &info) == nil {
+			err = nil
+		}
 		return
 	}
 	defer resp.Body.Close()
@@ -350,7 +431,6 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 		return
 	}
 
-	isFullVersion := regFullVersion.MatchString(version)
 	if isFullVersion {
 		info = h.Versions[version]
 	} else {
@@ -361,7 +441,12 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 			var c *semver.Constraints
 			c, err = semver.NewConstraint(version)
 			if err != nil && version != "latest" {
-				return fetchPackageInfo(name, "latest")
+				// the unknown dist-tag, other specifiers(like `github:user/repo`) fall back to the latest version
+				if regexpDistTag.MatchString(version) {
+					err = newUnknownTagError(name, version, h.DistTags)
+					return
+				}
+				return fetchPackageInfoFrom(registry, name, "latest")
 			}
 			vs := make([]*semver.Version, len(h.Versions))
 			i := 0
@@ -398,11 +483,14 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 	log.Debugf("lookup package(%s@%s) in %v", name, info.Version, time.Since(start))
 
 	// cache data
-	var ttl time.Duration = 0
-	if !isFullVersion {
-		ttl = 10 * time.Minute
+	data = utils.MustEncodeJSON(info)
+	cache.Set(id, data, ttl)
+	if isFullVersion || registryCacheTTL > 0 {
+		dbErr := db.Put(id, "npm", storage.Store{"info": string(data)})
+		if dbErr != nil {
+			log.Errorf("db: %v", dbErr)
+		}
 	}
-	cache.Set(id, utils.MustEncodeJSON(info), ttl)
 	return
 }
 
@@ -570,6 +658,11 @@ func installNodejs(dir string, version string) (err error) {
 }
 
 func yarnAdd(wd string, packages ...string) (err error) {
+	return yarnAddFrom(node.npmRegistry, wd, packages...)
+}
+
+// yarnAddFrom installs the packages from the registry
+func yarnAddFrom(registry string, wd string, packages ...string) (err error) {
 	if len(packages) > 0 {
 		start := time.Now()
 		args := []string{
@@ -586,7 +679,7 @@ func yarnAdd(wd string, packages ...string) (err error) {
 			"--no-progress",
 			"--non-interactive",
 			"--silent",
-			"--registry=" + node.npmRegistry,
+			"--registry=" + registry,
 		}
 		yarnCacheDir := os.Getenv("YARN_CACHE_DIR")
 		if yarnCacheDir != "" {
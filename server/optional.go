@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// the behaviors of the unresolved optional dependencies with the `?optional` query:
+//   - stub:     the dependency is stubbed to `undefined`
+//   - external: the dependency is kept as a bare import, resolved by the import map
+//   - error:    the `require` of the dependency is a call that throws a catchable error, the
+//     `import` of it resolves to a module throwing on evaluation
+var optionalModes = map[string]bool{
+	"stub":     true,
+	"external": true,
+	"error":    true,
+}
+
+// isOptionalDependency checks whether the specifier is declared in the `optionalDependencies`
+// or is a peer dependency marked optional by the `peerDependenciesMeta`.
+func (npm *NpmPackage) isOptionalDependency(specifier string) bool {
+	name := specifierPkgName(specifier)
+	if _, ok := npm.OptionalDependencies[name]; ok {
+		return true
+	}
+	if _, ok := npm.PeerDependencies[name]; ok {
+		return npm.PeerDependenciesMeta[name].Optional
+	}
+	return false
+}
+
+// the identifiers of the named exports of the optional dependency stub
+var regIdentifier = regexp.MustCompile(`^[A-Za-z_$][\w$]*$`)
+
+// importedNames returns the names imported or re-exported from the external module by the
+// `import { a, b as c } from` and `export { a } from` statements of the esbuild output.
+func importedNames(code []byte, name string) []string {
+	reg := regexp.MustCompile(`(?:import|export)\s*(?:[\w$]+\s*,\s*)?\{([^}]*)\}\s*from\s*"__ESM_SH_EXTERNAL:` + regexp.QuoteMeta(name) + `"`)
+	names := newStringSet()
+	for _, m := range reg.FindAllSubmatch(code, -1) {
+		for _, spec := range strings.Split(string(m[1]), ",") {
+			imported := strings.TrimSpace(strings.SplitN(strings.TrimSpace(spec), " as ", 2)[0])
+			if imported != "" && imported != "default" && regIdentifier.MatchString(imported) {
+				names.Add(imported)
+			}
+		}
+	}
+	values := names.Values()
+	sort.Strings(values)
+	return values
+}
+
+// optionalImportPath returns the import path of the optional dependency for the `import` statements,
+// the imported names are declared by the stub module so the imports can be linked.
+func (task *BuildTask) optionalImportPath(name string, exports []string) string {
+	if task.Optional == "external" {
+		return name
+	}
+	importPath := fmt.Sprintf(
+		"%s/optional.js?mode=%s&name=%s&importer=%s",
+		basePath,
+		task.Optional,
+		url.QueryEscape(name),
+		url.QueryEscape(task.Pkg.Name),
+	)
+	if len(exports) > 0 {
+		importPath += "&exports=" + url.QueryEscape(strings.Join(exports, ","))
+	}
+	return importPath
+}
+
+// optionalModule returns the stub module of the optional dependency for the `import` statements,
+// with the `error` mode it throws on evaluation, the response is still `200` so the error is
+// thrown as it is, and a dynamic `import()` of it can be caught.
+func optionalModule(mode string, name string, importer string, exports []string) string {
+	buf := strings.Builder{}
+	buf.WriteString("/* esm.sh - optional dependency stub */\n")
+	if mode == "error" {
+		fmt.Fprintf(
+			&buf,
+			"throw new Error(\"[esm.sh] \" + %s);\n",
+			strings.TrimSpace(string(utils.MustEncodeJSON(fmt.Sprintf(`Optional dependency "%s" is not resolved (Imported by "%s")`, name, importer)))),
+		)
+	}
+	buf.WriteString("export default undefined;\n")
+	for _, name := range exports {
+		if regIdentifier.MatchString(name) {
+			fmt.Fprintf(&buf, "export const %s = undefined;\n", name)
+		}
+	}
+	return buf.String()
+}
+
+// optionalRequireStub returns the declaration of the optional dependency for the `require` calls,
+// with the `error` mode the `require` call is replaced by a function call that throws, so it can
+// be caught by the `try...catch` of the package.
+func optionalRequireStub(identifier string, name string, importer string, mode string) string {
+	if mode == "error" {
+		return fmt.Sprintf(
+			`const __%s$ = () => { throw new Error("[esm.sh] " + %s) };`,
+			identifier,
+			strings.TrimSpace(string(utils.MustEncodeJSON(fmt.Sprintf(`Optional dependency "%s" is not resolved (Imported by "%s")`, name, importer)))),
+		)
+	}
+	return fmt.Sprintf(`const __%s$ = undefined;`, identifier)
+}
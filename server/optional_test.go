@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+	logx "github.com/ije/gox/log"
+)
+
+func TestIsOptionalDependency(t *testing.T) {
+	npm := &NpmPackage{
+		Name:                 "foo",
+		Dependencies:         map[string]string{"bar": "^1.0.0"},
+		OptionalDependencies: map[string]string{"fsevents": "^2.0.0"},
+		PeerDependencies:     map[string]string{"react": "^18.0.0", "@types/react": "^18.0.0"},
+		PeerDependenciesMeta: map[string]PeerDepsMeta{"@types/react": {Optional: true}},
+	}
+	for name, optional := range map[string]bool{
+		"bar":                 false,
+		"fsevents":            true,
+		"fsevents/fsevents":   true,
+		"react":               false,
+		"@types/react":        true,
+		"@types/react/global": true,
+	} {
+		if npm.isOptionalDependency(name) != optional {
+			t.Fatalf("isOptionalDependency(%s) should be %v", name, optional)
+		}
+	}
+}
+
+func TestOptionalRequire(t *testing.T) {
+	var err error
+	defer func(l *logx.Logger) { log = l }(log)
+	log = &logx.Logger{}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(f storage.FS) { fs = f }(fs)
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the package probes the optional dependency in `try...catch`, and re-exports another one
+	wd := t.TempDir()
+	writeFixture(t, wd, "watcher", map[string]string{
+		"package.json": `{"name":"watcher","version":"1.0.0","module":"index.js","types":"index.d.ts","optionalDependencies":{"fsevents":"^2.0.0","native-watch":"^1.0.0"}}`,
+		"index.d.ts":   `export declare const watch: any;`,
+		"index.js":     `let fsevents; try { fsevents = require("fsevents"); } catch (e) { fsevents = null; } export { watch } from "native-watch"; export default fsevents;`,
+	})
+	build := func(mode string) string {
+		task := &BuildTask{
+			wd:           wd,
+			BuildVersion: VERSION,
+			Pkg:          Pkg{Name: "watcher", Version: "1.0.0"},
+			Target:       "es2022",
+			DevMode:      true,
+			Optional:     mode,
+			External:     newStringSet(),
+			noStore:      true,
+		}
+		_, err := task.build(newStringSet())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(task.output)
+	}
+
+	// the `require` call throws in the `try` block with the `error` mode
+	code := build("error")
+	for _, s := range []string{
+		`const __fsevents$ = () => { throw new Error(`,
+		`from "/optional.js?mode=error&name=native-watch&importer=watcher&exports=watch"`,
+	} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("'%s' not found in the code: %s", s, code)
+		}
+	}
+	i := strings.Index(code, "try")
+	j := strings.Index(code, "__fsevents$()")
+	if i < 0 || j < i || strings.Contains(code, "import __fsevents$") {
+		t.Fatalf("the require call should be caught: %s", code)
+	}
+
+	// the `require` of the `stub` mode is `undefined`
+	code = build("stub")
+	for _, s := range []string{
+		`const __fsevents$ = undefined;`,
+		`from "/optional.js?mode=stub&name=native-watch&importer=watcher&exports=watch"`,
+	} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("'%s' not found in the code: %s", s, code)
+		}
+	}
+
+	// the stub modules declare the imported names, the `error` one throws on evaluation
+	for _, mode := range []string{"stub", "error"} {
+		module := optionalModule(mode, "native-watch", "watcher", []string{"watch", "bad-name"})
+		ret := api.Transform(module, api.TransformOptions{Format: api.FormatESModule})
+		if len(ret.Errors) > 0 {
+			t.Fatalf("invalid %s module: %s", mode, ret.Errors[0].Text)
+		}
+		if !strings.Contains(module, "export const watch = undefined;") || strings.Contains(module, "bad-name") {
+			t.Fatalf("invalid exports of the %s module: %s", mode, module)
+		}
+		if strings.Contains(module, "throw") != (mode == "error") {
+			t.Fatalf("invalid %s module: %s", mode, module)
+		}
+	}
+
+	task := &BuildTask{Pkg: Pkg{Name: "foo"}, Optional: "external"}
+	if task.optionalImportPath("fsevents", nil) != "fsevents" {
+		t.Fatal("the external optional dependency should be a bare import")
+	}
+	task.Optional = "stub"
+	if p := task.optionalImportPath("@foo/bar", nil); p != basePath+"/optional.js?mode=stub&name=%40foo%2Fbar&importer=foo" {
+		t.Fatalf("invalid import path: %s", p)
+	}
+}
+
+func TestImportedNames(t *testing.T) {
+	code := []byte(`import { a, b as c } from "__ESM_SH_EXTERNAL:foo";import d, { e } from "__ESM_SH_EXTERNAL:foo";export { default as f, g } from "__ESM_SH_EXTERNAL:foo";import { h } from "__ESM_SH_EXTERNAL:bar";`)
+	if names := strings.Join(importedNames(code, "foo"), ","); names != "a,b,e,g" {
+		t.Fatalf("invalid imported names: %s", names)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// the artifacts of a build that can be selected by the `?output` query, `js` is the default
+var outputTypes = map[string]bool{
+	"js":    true,
+	"dts":   true,
+	"css":   true,
+	"meta":  true,
+	"map":   true,
+	"graph": true, // the import graph in the Graphviz DOT format
+}
+
+// the prefix of the inline source map of the builds
+const inlineSourceMapPrefix = "//# sourceMappingURL=data:application/json;base64,"
+
+// readSourceMap returns the inline source map of the build, the `ok` is false if the build has no source map
+func readSourceMap(id string) (sourcemap []byte, ok bool, err error) {
+	savePath := path.Join("builds", id)
+	exists, size, _, err := fs.Exists(savePath)
+	if err != nil || !exists {
+		return
+	}
+	r, err := fs.ReadFile(savePath, size)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	i := bytes.LastIndex(data, []byte(inlineSourceMapPrefix))
+	if i < 0 {
+		return
+	}
+	encoded := data[i+len(inlineSourceMapPrefix):]
+	if j := bytes.IndexAny(encoded, "\r\n"); j >= 0 {
+		encoded = encoded[:j]
+	}
+	sourcemap, err = base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		err = fmt.Errorf("bad source map of %s: %v", id, err)
+		return
+	}
+	ok = true
+	return
+}
+
+// outputMeta returns the metadata of the build for the `?output=meta` query
+func outputMeta(esm *ModuleMeta, id string, pkg Pkg, target string, dts string, cdnOrigin string) map[string]interface{} {
+	meta := map[string]interface{}{
+		"id":            id,
+		"url":           fmt.Sprintf("%s%s/%s", cdnOrigin, basePath, id),
+		"pkg":           pkg.String(),
+		"target":        target,
+		"cjs":           esm.CJS,
+		"exportDefault": esm.ExportDefault,
+		"typesOnly":     esm.TypesOnly,
+		"packageCSS":    esm.PackageCSS,
+	}
+	if dts != "" {
+		meta["dts"] = fmt.Sprintf("%s%s/%s", cdnOrigin, basePath, strings.TrimPrefix(dts, "/"))
+	}
+	if esm.PackageCSS {
+		meta["css"] = fmt.Sprintf("%s%s/%s.css", cdnOrigin, basePath, strings.TrimSuffix(id, ".js"))
+	}
+	if esm.Entry != "" {
+		meta["entry"] = esm.Entry
+	}
+	if esm.EngineWarning != "" {
+		meta["engineWarning"] = esm.EngineWarning
+	}
+	if esm.AssetWarning != "" {
+		meta["assetWarning"] = esm.AssetWarning
+	}
+	if len(esm.PeerDeps) > 0 {
+		meta["peerDeps"] = esm.PeerDeps
+	}
+	return meta
+}
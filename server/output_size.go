@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// the maximum size of the build output, set by the `-max-output-size` flag, 0 means no limit
+var maxOutputSize int64
+
+// checkOutputSize returns an error if the total size of the esbuild output files exceeds the `-max-output-size`
+func (task *BuildTask) checkOutputSize(files []api.OutputFile) error {
+	if maxOutputSize <= 0 {
+		return nil
+	}
+	var size int64
+	for _, file := range files {
+		size += int64(len(file.Contents))
+	}
+	if size <= maxOutputSize {
+		return nil
+	}
+	return &BuildError{ErrOutputTooLarge, fmt.Sprintf(
+		"the output of %s (%s) is %s, exceeds the max output size %s",
+		task.Pkg,
+		task.describeOptions(),
+		formatBytes(size),
+		formatBytes(maxOutputSize),
+	)}
+}
+
+// describeOptions returns the build options that affect the output size
+func (task *BuildTask) describeOptions() string {
+	options := []string{"target=" + task.Target}
+	if task.BundleMode {
+		options = append(options, "bundle")
+	}
+	if task.DevMode {
+		options = append(options, "dev")
+	}
+	if task.Sourcemap {
+		options = append(options, "sourcemap")
+	}
+	if task.KeepNames {
+		options = append(options, "keep-names")
+	}
+	if task.IgnoreAnnotations {
+		options = append(options, "ignore-annotations")
+	}
+	if task.Minify != "" {
+		options = append(options, "minify="+task.minifyHeader())
+	}
+	if task.LegalComments != "" {
+		options = append(options, "legal-comments="+task.LegalComments)
+	}
+	if len(task.Deps) > 0 {
+		options = append(options, "deps="+task.Deps.String())
+	}
+	if task.External.Size() > 0 {
+		options = append(options, "external="+strings.Join(task.External.Values(), ","))
+	}
+	return strings.Join(options, ", ")
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
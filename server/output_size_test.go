@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestCheckOutputSize(t *testing.T) {
+	task := &BuildTask{
+		Pkg:        Pkg{Name: "foo", Version: "1.0.0"},
+		External:   newStringSet(),
+		Target:     "es2022",
+		BundleMode: true,
+	}
+	files := []api.OutputFile{
+		{Path: "/esbuild/stdin.js", Contents: bytes.Repeat([]byte{'a'}, 3<<20)},
+		{Path: "/esbuild/stdin.css", Contents: bytes.Repeat([]byte{'a'}, 1<<19)},
+	}
+
+	defer func() { maxOutputSize = 0 }()
+	maxOutputSize = 0
+	if err := task.checkOutputSize(files); err != nil {
+		t.Fatal("no limit if the max output size is 0")
+	}
+	maxOutputSize = 4 << 20
+	if err := task.checkOutputSize(files); err != nil {
+		t.Fatal(err)
+	}
+
+	maxOutputSize = 2 << 20
+	err := task.checkOutputSize(files)
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) || buildErr.Code != ErrOutputTooLarge {
+		t.Fatalf("expected the %s error, got %v", ErrOutputTooLarge, err)
+	}
+	for _, s := range []string{"foo@1.0.0", "target=es2022, bundle", "3.5MB", "2.0MB"} {
+		if !strings.Contains(buildErr.Message, s) {
+			t.Fatalf("the error message should contain '%s': %s", s, buildErr.Message)
+		}
+	}
+}
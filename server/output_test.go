@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestReadSourceMap(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourcemap := `{"version":3,"sources":["index.js"],"mappings":"AAAA"}`
+	id := "v87/foo@1.0.0/es2022/foo.sm.js"
+	err = fs.WriteData("builds/"+id, []byte("export const foo = 1;\n"+inlineSourceMapPrefix+base64.StdEncoding.EncodeToString([]byte(sourcemap))+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok, err := readSourceMap(id)
+	if err != nil || !ok || string(data) != sourcemap {
+		t.Fatalf("unexpected source map %s %v %v", data, ok, err)
+	}
+
+	id = "v87/foo@1.0.0/es2022/foo.js"
+	err = fs.WriteData("builds/"+id, []byte("export const foo = 1;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err = readSourceMap(id); ok || err != nil {
+		t.Fatalf("the build without source map should not be ok, got %v %v", ok, err)
+	}
+	if _, ok, err = readSourceMap("v87/bar@1.0.0/es2022/bar.js"); ok || err != nil {
+		t.Fatalf("the missing build should not be ok, got %v %v", ok, err)
+	}
+}
+
+func TestOutputMeta(t *testing.T) {
+	esm := &ModuleMeta{ExportDefault: true, PackageCSS: true, Dts: "/v87/foo@1.0.0/index.d.ts"}
+	meta := outputMeta(esm, "v87/foo@1.0.0/es2022/foo.js", Pkg{Name: "foo", Version: "1.0.0"}, "es2022", esm.Dts, "https://esm.sh")
+	for key, value := range map[string]interface{}{
+		"url":           "https://esm.sh/v87/foo@1.0.0/es2022/foo.js",
+		"pkg":           "foo@1.0.0",
+		"target":        "es2022",
+		"exportDefault": true,
+		"dts":           "https://esm.sh/v87/foo@1.0.0/index.d.ts",
+		"css":           "https://esm.sh/v87/foo@1.0.0/es2022/foo.css",
+	} {
+		if meta[key] != value {
+			t.Fatalf("meta.%s should be %v, got %v", key, value, meta[key])
+		}
+	}
+	if _, ok := meta["entry"]; ok {
+		t.Fatal("the empty entry should be omitted")
+	}
+}
+
+func TestSourceMapOutput(t *testing.T) {
+	var err error
+	defer func(l *logx.Logger) { log = l }(log)
+	log = &logx.Logger{}
+	defer func(e EmbedFS) { embedFS = e }(embedFS)
+	embedFS = testEmbedFS{}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(f storage.FS) { fs = f }(fs)
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourcemap := `{"version":3,"sources":["index.js"],"mappings":"AAAA"}`
+	for id, code := range map[string]string{
+		fmt.Sprintf("v%d/foo@1.0.0/es2022/foo.sm.js", VERSION): "export const foo = 1;\n" + inlineSourceMapPrefix + base64.StdEncoding.EncodeToString([]byte(sourcemap)) + "\n",
+		fmt.Sprintf("v%d/bar@1.0.0/es2022/bar.sm.js", VERSION): "export const bar = 1;\n",
+	} {
+		if err = fs.WriteData("builds/"+id, []byte(code)); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Put(id, "build", storage.Store{"meta": `{}`}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(url string) (*http.Response, string) {
+		res, err := client.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res, string(data)
+	}
+
+	// the build without the source map redirects to the map of the `?sourcemap` build
+	res, _ := get(fmt.Sprintf("/v%d/foo@1.0.0/es2022/foo.js?output=map", VERSION))
+	if location := res.Header.Get("Location"); res.StatusCode != 307 || !strings.HasSuffix(location, fmt.Sprintf("/v%d/foo@1.0.0/es2022/foo.sm.js?output=map", VERSION)) {
+		t.Fatalf("the map output should be redirected to the sourcemap build, got %d %s", res.StatusCode, location)
+	}
+	res, body := get(fmt.Sprintf("/v%d/foo@1.0.0/es2022/foo.sm.js?output=map", VERSION))
+	if res.StatusCode != 200 || body != sourcemap {
+		t.Fatalf("the map of the build should be served, got %d %s", res.StatusCode, body)
+	}
+	if res, _ := get(fmt.Sprintf("/v%d/bar@1.0.0/es2022/bar.sm.js?output=map", VERSION)); res.StatusCode != 404 {
+		t.Fatalf("the missing map should be not found, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the `package.json` fields that can be overridden
+var overridableFields = map[string]bool{
+	"browser":     true,
+	"exports":     true,
+	"main":        true,
+	"module":      true,
+	"sideEffects": true,
+	"type":        true,
+	"types":       true,
+	"typings":     true,
+}
+
+// A PackageOverride overrides the `package.json` fields of the packages matched the version range,
+// a `null` field removes the field.
+type PackageOverride struct {
+	Name       string
+	Range      string
+	constraint *semver.Constraints
+	Fields     map[string]json.RawMessage
+}
+
+// PackageOverrides is loaded from the `[etc-dir]/overrides.json`, keyed by `name@versionRange`:
+//
+//	{
+//	  "foo@<1.2.0": { "module": "./esm/index.js", "sideEffects": false }
+//	}
+type PackageOverrides []*PackageOverride
+
+var pkgOverrides PackageOverrides
+
+func loadPackageOverrides(filename string) (overrides PackageOverrides, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var m map[string]map[string]json.RawMessage
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return
+	}
+	return parsePackageOverrides(m)
+}
+
+func parsePackageOverrides(m map[string]map[string]json.RawMessage) (overrides PackageOverrides, err error) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, versionRange := key, "*"
+		if i := strings.LastIndexByte(key, '@'); i > 0 {
+			name, versionRange = key[:i], key[i+1:]
+		}
+		var c *semver.Constraints
+		c, err = semver.NewConstraint(versionRange)
+		if err != nil {
+			err = fmt.Errorf("invalid override '%s': %v", key, err)
+			return
+		}
+		for field := range m[key] {
+			if !overridableFields[field] {
+				err = fmt.Errorf("invalid override '%s': field '%s' can't be overridden", key, field)
+				return
+			}
+		}
+		overrides = append(overrides, &PackageOverride{
+			Name:       name,
+			Range:      versionRange,
+			constraint: c,
+			Fields:     m[key],
+		})
+	}
+	return
+}
+
+// Apply applies the matched overrides to the raw `package.json`, returns the keys of the applied overrides.
+func (overrides PackageOverrides) Apply(raw map[string]json.RawMessage) (applied []string) {
+	var name, version string
+	json.Unmarshal(raw["name"], &name)
+	json.Unmarshal(raw["version"], &version)
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return
+	}
+	for _, o := range overrides {
+		if o.Name != name || !o.constraint.Check(v) {
+			continue
+		}
+		for field, value := range o.Fields {
+			if string(value) == "null" {
+				delete(raw, field)
+			} else {
+				raw[field] = value
+			}
+		}
+		applied = append(applied, fmt.Sprintf("%s@%s", o.Name, o.Range))
+	}
+	return
+}
+
+// ApplyInfo returns the package info with the matched overrides applied, the same fields the build gets
+// from the overridden `package.json`.
+func (overrides PackageOverrides) ApplyInfo(info NpmPackage) NpmPackage {
+	if len(overrides) == 0 {
+		return info
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return info
+	}
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(data, &raw) != nil || len(overrides.Apply(raw)) == 0 {
+		return info
+	}
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return info
+	}
+	var overridden NpmPackage
+	if json.Unmarshal(data, &overridden) != nil {
+		return info
+	}
+	overridden.protocolDeps = info.protocolDeps
+	return overridden
+}
+
+// Hash returns the hash of the overrides that match the package, it's a part of the build id so the
+// builds are rebuilt when the matched overrides change. It returns an empty string if no override matches.
+func (overrides PackageOverrides) Hash(pkg Pkg) string {
+	if len(overrides) == 0 {
+		return ""
+	}
+	v, err := semver.NewVersion(pkg.Version)
+	if err != nil {
+		return ""
+	}
+	h := sha1.New()
+	matched := false
+	for _, o := range overrides {
+		if o.Name != pkg.Name || !o.constraint.Check(v) {
+			continue
+		}
+		// the raw values are compacted by the encoder, the keys are sorted
+		fields, _ := json.Marshal(o.Fields)
+		fmt.Fprintf(h, "%s@%s\n%s\n", o.Name, o.Range, fields)
+		matched = true
+	}
+	if !matched {
+		return ""
+	}
+	return strings.ToLower(hex.EncodeToString(h.Sum(nil))[:10])
+}
+
+// overridePackageJSON rewrites the `package.json` file with the matched overrides,
+// the file in the build directory is rewritten so the esbuild resolver gets the fixed fields too.
+func overridePackageJSON(packageFile string) (applied []string, err error) {
+	if len(pkgOverrides) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(packageFile)
+	if err != nil {
+		return
+	}
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return
+	}
+	applied = pkgOverrides.Apply(raw)
+	if len(applied) == 0 {
+		return
+	}
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(packageFile, data, 0644)
+	return
+}
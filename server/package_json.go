@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A PackageJSONShim is the synthesized package.json served at `/pkg@version/package.json`, the
+// entries and the exports point to the CDN module URLs instead of the unbuilt files of the tarball.
+type PackageJSONShim struct {
+	Name    string                 `json:"name"`
+	Version string                 `json:"version"`
+	Type    string                 `json:"type"`
+	Main    string                 `json:"main"`
+	Module  string                 `json:"module"`
+	Types   string                 `json:"types,omitempty"`
+	Exports map[string]interface{} `json:"exports"`
+}
+
+// newPackageJSONShim returns the package.json shim of the package, the subpaths exported by the
+// `exports` of the package are rewritten to the CDN URLs, the `null` exclusions are kept. All the
+// subpaths are exported if the package has no `exports`, like node.
+func newPackageJSONShim(info NpmPackage, cdnOrigin string) *PackageJSONShim {
+	pkgURL := fmt.Sprintf("%s%s/%s@%s", cdnOrigin, basePath, info.Name, info.Version)
+	shim := &PackageJSONShim{
+		Name:    info.Name,
+		Version: info.Version,
+		Type:    "module",
+		Main:    pkgURL,
+		Module:  pkgURL,
+		Exports: map[string]interface{}{
+			".":              pkgURL,
+			"./package.json": "./package.json",
+		},
+	}
+
+	types := info.Types
+	if types == "" {
+		types = info.Typings
+	}
+	if types != "" {
+		types = strings.TrimPrefix(path.Clean("/"+types), "/")
+		if path.Ext(types) == "" {
+			types += ".d.ts"
+		}
+		if strings.HasSuffix(types, ".d.ts") {
+			// the types are transformed on the first request like the `X-TypeScript-Types`
+			shim.Types = fmt.Sprintf("%s%s/v%d/%s@%s/%s", cdnOrigin, basePath, VERSION, info.Name, info.Version, types)
+		}
+	}
+
+	m, ok := info.DefinedExports.(map[string]interface{})
+	if info.DefinedExports == nil {
+		shim.Exports["./*"] = pkgURL + "/*"
+	} else if ok {
+		if _, ok := m["."]; !ok && !isConditionsExports(m) {
+			// the subpath exports without `.` don't export the main
+			delete(shim.Exports, ".")
+		}
+		for key, value := range m {
+			if !strings.HasPrefix(key, "./") || key == "./package.json" {
+				continue
+			}
+			if value == nil {
+				shim.Exports[key] = nil
+			} else {
+				shim.Exports[key] = pkgURL + key[1:]
+			}
+		}
+	}
+	return shim
+}
+
+// isConditionsExports reports whether the `exports` is the conditions sugar of the main like
+// `{"import": "./index.mjs", "require": "./index.js"}`
+func isConditionsExports(m map[string]interface{}) bool {
+	for key := range m {
+		if strings.HasPrefix(key, ".") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestPackageJSONShim(t *testing.T) {
+	// like the package.json of react
+	var react NpmPackage
+	err := json.Unmarshal([]byte(`{
+		"name": "react",
+		"version": "18.2.0",
+		"main": "index.js",
+		"exports": {
+			".": {"react-server": "./react.shared-subset.js", "default": "./index.js"},
+			"./package.json": "./package.json",
+			"./jsx-runtime": "./jsx-runtime.js",
+			"./jsx-dev-runtime": "./jsx-dev-runtime.js",
+			"./cjs/*": null
+		}
+	}`), &react)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shim := newPackageJSONShim(react, "https://esm.sh")
+	if shim.Name != react.Name || shim.Version != react.Version || shim.Type != "module" {
+		t.Fatalf("invalid package.json shim: %+v", shim)
+	}
+	if shim.Main != "https://esm.sh/react@18.2.0" || shim.Module != shim.Main || shim.Types != "" {
+		t.Fatalf("invalid entries of the package.json shim: %+v", shim)
+	}
+	for key, expected := range map[string]interface{}{
+		".":                 "https://esm.sh/react@18.2.0",
+		"./package.json":    "./package.json",
+		"./jsx-runtime":     "https://esm.sh/react@18.2.0/jsx-runtime",
+		"./jsx-dev-runtime": "https://esm.sh/react@18.2.0/jsx-dev-runtime",
+		"./cjs/*":           nil,
+	} {
+		value, ok := shim.Exports[key]
+		if !ok || value != expected {
+			t.Fatalf("the export '%s' of the shim should be %v, got %v", key, expected, value)
+		}
+	}
+	if len(shim.Exports) != len(react.DefinedExports.(map[string]interface{})) {
+		t.Fatalf("the exports of the shim should mirror the source: %v", shim.Exports)
+	}
+
+	// like the package.json of dayjs, no `exports`
+	dayjs := NpmPackage{Name: "dayjs", Version: "1.11.0", Main: "dayjs.min.js", Types: "index"}
+	shim = newPackageJSONShim(dayjs, "https://esm.sh")
+	if shim.Types != fmt.Sprintf("https://esm.sh/v%d/dayjs@1.11.0/index.d.ts", VERSION) {
+		t.Fatalf("invalid types of the shim: %s", shim.Types)
+	}
+	if shim.Exports["./*"] != "https://esm.sh/dayjs@1.11.0/*" || shim.Exports["."] != "https://esm.sh/dayjs@1.11.0" {
+		t.Fatalf("all the subpaths should be exported without the exports: %v", shim.Exports)
+	}
+
+	// the subpath exports without `.` don't export the main
+	shim = newPackageJSONShim(NpmPackage{Name: "foo", Version: "1.0.0", DefinedExports: map[string]interface{}{"./utils": "./utils.js"}}, "https://esm.sh")
+	if _, ok := shim.Exports["."]; ok || shim.Exports["./utils"] != "https://esm.sh/foo@1.0.0/utils" {
+		t.Fatalf("invalid exports of the shim: %v", shim.Exports)
+	}
+
+	// the conditions sugar exports the main only
+	shim = newPackageJSONShim(NpmPackage{Name: "bar", Version: "1.0.0", DefinedExports: map[string]interface{}{"import": "./index.mjs"}}, "https://esm.sh")
+	if len(shim.Exports) != 2 || shim.Exports["."] != "https://esm.sh/bar@1.0.0" {
+		t.Fatalf("invalid exports of the shim: %v", shim.Exports)
+	}
+}
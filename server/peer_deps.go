@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the modes of the `?peer-deps` query: `external`(default) imports the peer dependencies from the
+// CDN URLs like the host provides them, `bundle` bundles them into the build.
+var peerDepsModes = map[string]bool{
+	"external": true,
+	"bundle":   true,
+}
+
+// specifierPkgName returns the package name of the bare specifier, like `react` of `react/jsx-runtime`
+func specifierPkgName(specifier string) string {
+	a := strings.Split(specifier, "/")
+	if strings.HasPrefix(specifier, "@") && len(a) > 1 {
+		return a[0] + "/" + a[1]
+	}
+	return a[0]
+}
+
+// isPeerDependency checks whether the specifier is declared in the `peerDependencies`
+func (npm *NpmPackage) isPeerDependency(specifier string) bool {
+	name := specifierPkgName(specifier)
+	if name == npm.Name {
+		return false
+	}
+	_, ok := npm.PeerDependencies[name]
+	return ok
+}
+
+// peerDepsToInstall returns the peer dependencies to install with the `?peer-deps=bundle` query,
+// yarn doesn't install the peer dependencies.
+func (task *BuildTask) peerDepsToInstall(info NpmPackage) []string {
+	if task.PeerDeps != "bundle" {
+		return nil
+	}
+	specs := make([]string, 0, len(info.PeerDependencies))
+	for name, version := range info.PeerDependencies {
+		if info.PeerDependenciesMeta[name].Optional || builtInNodeModules[name] || strings.Contains(version, ":") {
+			continue
+		}
+		specs = append(specs, fmt.Sprintf("%s@%s", name, version))
+	}
+	sort.Strings(specs)
+	return specs
+}
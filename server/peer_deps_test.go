@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+)
+
+func TestPeerDepsBuild(t *testing.T) {
+	defer func(l *logx.Logger, d storage.DB, f storage.FS, q *BuildQueue) {
+		log, db, fs, buildQueue = l, d, f, q
+	}(log, db, fs, buildQueue)
+	var err error
+	log = &logx.Logger{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the queue without slots keeps the dependency builds waiting
+	buildQueue = newBuildQueue(0)
+
+	wd := t.TempDir()
+	// a plugin package that peer-depends on react
+	writeFixture(t, wd, "react-plugin", map[string]string{
+		"package.json": `{"name":"react-plugin","version":"1.0.0","module":"index.js","types":"index.d.ts","peerDependencies":{"react":"^18.0.0","@scope/theme":"^1.0.0"},"dependencies":{"tiny":"^1.0.0"}}`,
+		"index.d.ts":   `export declare const Plugin: () => any;`,
+		"index.js":     `import { createElement } from "react"; import { jsx } from "react/jsx-runtime"; import theme from "@scope/theme"; import tiny from "tiny"; export const Plugin = () => createElement("div", { theme, tiny }, jsx("span", {}));`,
+	})
+	writeFixture(t, wd, "react", map[string]string{
+		"package.json":   `{"name":"react","version":"18.2.0","module":"index.js","exports":{".":"./index.js","./jsx-runtime":"./jsx-runtime.js"}}`,
+		"index.js":       `export function createElement() { return "__REACT_SOURCE__" }`,
+		"jsx-runtime.js": `export function jsx() { return "__REACT_JSX_SOURCE__" }`,
+	})
+	writeFixture(t, wd, "@scope/theme", map[string]string{
+		"package.json": `{"name":"@scope/theme","version":"1.2.0","module":"index.js"}`,
+		"index.js":     `export default "__THEME_SOURCE__"`,
+	})
+	writeFixture(t, wd, "tiny", map[string]string{
+		"package.json": `{"name":"tiny","version":"1.0.0","module":"index.js"}`,
+		"index.js":     `export default "__TINY_SOURCE__"`,
+	})
+
+	build := func(bundleMode bool, peerDeps string) (*ModuleMeta, string) {
+		task := &BuildTask{
+			wd:           wd,
+			BuildVersion: VERSION,
+			Pkg:          Pkg{Name: "react-plugin", Version: "1.0.0"},
+			Target:       "es2022",
+			BundleMode:   bundleMode,
+			PeerDeps:     peerDeps,
+			External:     newStringSet(),
+			noStore:      true,
+		}
+		esm, err := task.build(newStringSet())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return esm, string(task.output)
+	}
+
+	// the peer dependencies are not bundled in the bundle mode, the scoped ones included
+	esm, code := build(true, "")
+	if strings.Contains(code, "__REACT_SOURCE__") || strings.Contains(code, "__REACT_JSX_SOURCE__") || strings.Contains(code, "__THEME_SOURCE__") {
+		t.Fatalf("the peer dependencies should not be bundled: %s", code)
+	}
+	for _, s := range []string{"/react@18.2.0/es2022/react.js", "/react@18.2.0/es2022/jsx-runtime.js", "/@scope/theme@1.2.0/es2022/theme.js", "__TINY_SOURCE__"} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("'%s' not found in the code: %s", s, code)
+		}
+	}
+	if strings.Join(esm.PeerDeps, ",") != "@scope/theme,react" {
+		t.Fatalf("invalid externalized peer dependencies: %v", esm.PeerDeps)
+	}
+
+	// the peer dependencies are externalized in the default mode too
+	esm, _ = build(false, "")
+	if strings.Join(esm.PeerDeps, ",") != "@scope/theme,react" {
+		t.Fatalf("invalid externalized peer dependencies: %v", esm.PeerDeps)
+	}
+
+	// the `?peer-deps=bundle` query forces bundling
+	esm, code = build(true, "bundle")
+	for _, s := range []string{"__REACT_SOURCE__", "__REACT_JSX_SOURCE__", "__THEME_SOURCE__"} {
+		if !strings.Contains(code, s) {
+			t.Fatalf("the peer dependency '%s' should be bundled: %s", s, code)
+		}
+	}
+	if len(esm.PeerDeps) != 0 {
+		t.Fatalf("no peer dependencies should be externalized: %v", esm.PeerDeps)
+	}
+}
+
+func TestPeerDepsToInstall(t *testing.T) {
+	info := NpmPackage{
+		Name:                 "react-plugin",
+		Version:              "1.0.0",
+		PeerDependencies:     map[string]string{"react": "^18.0.0", "react-dom": "^18.0.0", "@types/react": "*", "local": "workspace:*"},
+		PeerDependenciesMeta: map[string]PeerDepsMeta{"@types/react": {Optional: true}},
+	}
+	if specs := (&BuildTask{}).peerDepsToInstall(info); specs != nil {
+		t.Fatalf("the peer dependencies should not be installed by default: %v", specs)
+	}
+	specs := (&BuildTask{PeerDeps: "bundle"}).peerDepsToInstall(info)
+	if strings.Join(specs, ",") != "react-dom@^18.0.0,react@^18.0.0" {
+		t.Fatalf("invalid peer dependencies to install: %v", specs)
+	}
+
+	for specifier, expected := range map[string]bool{
+		"react":             true,
+		"react/jsx-runtime": true,
+		"@types/react":      true,
+		"react-is":          false,
+		"react-plugin":      false,
+		"react-plugin/sub":  false,
+	} {
+		if info.isPeerDependency(specifier) != expected {
+			t.Fatalf("the peer dependency of '%s' should be %v", specifier, expected)
+		}
+	}
+}
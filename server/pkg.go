@@ -14,6 +14,11 @@ type Pkg struct {
 }
 
 func parsePkg(pathname string) (*Pkg, bool, error) {
+	return parsePkgFrom("", pathname)
+}
+
+// parsePkgFrom is the `parsePkg` that resolves the version from the registry, empty means the default registry
+func parsePkgFrom(registry string, pathname string) (*Pkg, bool, error) {
 	a := strings.Split(strings.Trim(pathname, "/"), "/")
 	for i, s := range a {
 		a[i] = strings.TrimSpace(s)
@@ -49,7 +54,7 @@ func parsePkg(pathname string) (*Pkg, bool, error) {
 		}, true, nil
 	}
 
-	info, _, _, err := getPackageInfo("", name, version)
+	info, _, _, err := getPackageInfoFrom(registry, "", name, version)
 	if err != nil {
 		return nil, false, err
 	}
@@ -61,6 +66,70 @@ func parsePkg(pathname string) (*Pkg, bool, error) {
 	}, false, nil
 }
 
+// canonicalPkgPath returns the canonical form of the raw request path: the redundant `.` and empty
+// segments are removed, the `..` segments are resolved within the package, and the package name is
+// lowercased since the npm registry doesn't accept the uppercase names. The first `skip` segments
+// (like the base path and the build version prefix) are dropped.
+func canonicalPkgPath(raw string, skip int) (string, error) {
+	trailing := len(raw) > 1 && strings.HasSuffix(raw, "/")
+	segments := []string{}
+	for _, s := range strings.Split(raw, "/") {
+		if s != "" && s != "." {
+			segments = append(segments, s)
+		}
+	}
+	if len(segments) <= skip {
+		return "", fmt.Errorf("invalid path")
+	}
+	for _, s := range segments[:skip] {
+		if s == ".." {
+			return "", fmt.Errorf("invalid path")
+		}
+	}
+	segments = segments[skip:]
+
+	// the scope and name segments
+	n := 1
+	if strings.HasPrefix(segments[0], "@") && len(segments) > 1 {
+		n = 2
+	}
+	parts := make([]string, 0, len(segments))
+	for i, s := range segments {
+		if i < n {
+			if s == ".." {
+				return "", fmt.Errorf("path escapes the package root")
+			}
+			if i == n-1 {
+				name, version := utils.SplitByLastByte(s, '@')
+				if strings.HasPrefix(s, "@") && n == 1 {
+					name, version = s, ""
+				}
+				if name != "" {
+					s = strings.ToLower(name)
+					if version != "" {
+						s += "@" + version
+					}
+				}
+			} else {
+				s = strings.ToLower(s)
+			}
+			parts = append(parts, s)
+		} else if s == ".." {
+			if len(parts) <= n {
+				return "", fmt.Errorf("path escapes the package root")
+			}
+			parts = parts[:len(parts)-1]
+		} else {
+			parts = append(parts, s)
+		}
+	}
+	canonical := "/" + strings.Join(parts, "/")
+	if trailing {
+		canonical += "/"
+	}
+	return canonical, nil
+}
+
 func (m Pkg) Equels(other Pkg) bool {
 	return m.Name == other.Name && m.Version == other.Version && m.Submodule == other.Submodule
 }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestCanonicalPkgPath(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"/react@18.2.0":                        "/react@18.2.0",
+		"/React@18.2.0":                        "/react@18.2.0",
+		"/React":                               "/react",
+		"/@EMOTION/React@11.0.0/jsx-runtime":   "/@emotion/react@11.0.0/jsx-runtime",
+		"/react@18.2.0-RC.1/Index.js":          "/react@18.2.0-RC.1/Index.js",
+		"/react@Next":                          "/react@Next",
+		"/react@18.2.0/./lib/index.js":         "/react@18.2.0/lib/index.js",
+		"/react@18.2.0//lib/./index.js":        "/react@18.2.0/lib/index.js",
+		"/react@18.2.0/lib/../cjs/index.js":    "/react@18.2.0/cjs/index.js",
+		"/./react@18.2.0/lib/":                 "/react@18.2.0/lib/",
+		"/react@18.2.0/lib/..":                 "/react@18.2.0",
+		"/@scope/foo@1.0.0/a/b/../../index.js": "/@scope/foo@1.0.0/index.js",
+	} {
+		canonical, err := canonicalPkgPath(raw, 0)
+		if err != nil {
+			t.Fatalf("canonicalPkgPath(%s): %v", raw, err)
+		}
+		if canonical != expected {
+			t.Fatalf("canonicalPkgPath(%s) should be '%s', got '%s'", raw, expected, canonical)
+		}
+	}
+
+	// the base path and the build version prefix are skipped
+	canonical, err := canonicalPkgPath("/cdn/v87/React@18.2.0/./es2022/react.js", 2)
+	if err != nil || canonical != "/react@18.2.0/es2022/react.js" {
+		t.Fatalf("unexpected canonical path with the prefix: %s %v", canonical, err)
+	}
+
+	for _, raw := range []string{
+		"/react@18.2.0/../../etc/passwd",
+		"/react@18.2.0/lib/../../foo",
+		"/@scope/../etc/passwd",
+		"/../react@18.2.0",
+		"/v87/../react@18.2.0",
+	} {
+		skip := 0
+		if raw == "/v87/../react@18.2.0" {
+			skip = 1
+		}
+		if _, err := canonicalPkgPath(raw, skip); err == nil {
+			t.Fatalf("'%s' escapes the package root, should be rejected", raw)
+		}
+	}
+}
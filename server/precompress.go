@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"esm.sh/server/storage"
+	"github.com/andybalholm/brotli"
+	"github.com/ije/gox/utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+// the encodings of the precompressed variants in the preference order
+var allPrecompressEncodings = []string{"zstd", "br", "gzip"}
+
+// the file extensions of the precompressed variants, stored next to the builds
+var precompressExts = map[string]string{
+	"zstd": ".zst",
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// the enabled encodings of the precompressed variants, set by the `-precompress` flag
+var precompressEncodings = allPrecompressEncodings
+
+// parsePrecompressEncodings parses the `-precompress` flag, `none` disables the precompression
+func parsePrecompressEncodings(value string) (encodings []string, err error) {
+	set := newStringSet()
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+		if _, ok := precompressExts[name]; !ok {
+			err = fmt.Errorf("unsupported encoding '%s'", name)
+			return
+		}
+		set.Add(name)
+	}
+	for _, name := range allPrecompressEncodings {
+		if set.Has(name) {
+			encodings = append(encodings, name)
+		}
+	}
+	return
+}
+
+func compressData(encoding string, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	var w io.WriteCloser
+	switch encoding {
+	case "zstd":
+		zw, err := zstd.NewWriter(buf, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	case "br":
+		w = brotli.NewWriterLevel(buf, brotli.BestCompression)
+	case "gzip":
+		w, _ = gzip.NewWriterLevel(buf, gzip.BestCompression)
+	default:
+		return nil, fmt.Errorf("unsupported encoding '%s'", encoding)
+	}
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// the number of the workers of the precompression and the capacity of the pending jobs, the
+// precompression runs out of the build slots, the variants of the dropped jobs are generated
+// on request by `servePrecompressed`.
+const (
+	precompressWorkers   = 2
+	precompressQueueSize = 256
+)
+
+type precompressJob struct {
+	fs        storage.FS // the storage of the build, the global one may be replaced when the job runs
+	savePath  string
+	data      []byte // nil means reading the build file
+	encodings []string
+}
+
+var (
+	precompressQueue   chan precompressJob
+	precompressOnce    sync.Once
+	precompressPending sync.WaitGroup
+)
+
+// queuePrecompress queues the precompression of the build file, the build doesn't wait for it.
+func queuePrecompress(savePath string, data []byte, encodings []string) {
+	precompressOnce.Do(func() {
+		precompressQueue = make(chan precompressJob, precompressQueueSize)
+		for i := 0; i < precompressWorkers; i++ {
+			go func() {
+				for job := range precompressQueue {
+					job.run()
+				}
+			}()
+		}
+	})
+	precompressPending.Add(1)
+	select {
+	case precompressQueue <- precompressJob{fs, savePath, data, encodings}:
+	default:
+		precompressPending.Done()
+		log.Warnf("precompress %s: the queue is full", savePath)
+	}
+}
+
+// waitPrecompress waits for the queued precompressions to be done
+func waitPrecompress() {
+	precompressPending.Wait()
+}
+
+func (job precompressJob) run() {
+	defer precompressPending.Done()
+	data := job.data
+	if data == nil {
+		_, size, _, err := job.fs.Exists(job.savePath)
+		if err != nil {
+			log.Warnf("precompress %s: %v", job.savePath, err)
+			return
+		}
+		f, err := job.fs.ReadFile(job.savePath, size)
+		if err != nil {
+			log.Warnf("precompress %s: %v", job.savePath, err)
+			return
+		}
+		data, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			log.Warnf("precompress %s: %v", job.savePath, err)
+			return
+		}
+	}
+	precompressVariants(job.fs, job.savePath, data, job.encodings)
+}
+
+// precompressBuild writes the precompressed variants of the build file
+func precompressBuild(savePath string, data []byte) {
+	precompressVariants(fs, savePath, data, precompressEncodings)
+}
+
+// precompressVariants writes the compressed variants of the build file, the concurrent calls of the
+// same file and encodings share one call.
+func precompressVariants(fs storage.FS, savePath string, data []byte, encodings []string) {
+	sidecarFlight.Do(savePath+"#"+strings.Join(encodings, ","), func() error {
+		for _, encoding := range encodings {
+			variantPath := savePath + precompressExts[encoding]
+			compressed, err := compressData(encoding, data)
+			if err == nil {
+				err = fs.WriteData(variantPath, compressed)
+			}
+			if err != nil {
+				log.Warnf("precompress %s: %v", variantPath, err)
+			}
+		}
+		return nil
+	})
+}
+
+// negotiateEncoding returns the enabled precompressed encoding accepted by the `Accept-Encoding` header
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, p := range strings.Split(acceptEncoding, ",") {
+		name, params := utils.SplitByFirstByte(p, ';')
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if k, v := utils.SplitByFirstByte(strings.TrimSpace(params), '='); strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		accepted[name] = q > 0
+	}
+	for _, encoding := range precompressEncodings {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// precompressContentType returns the content type of the files that have precompressed variants
+func precompressContentType(pathname string) string {
+	switch {
+	case strings.HasSuffix(pathname, ".d.ts"):
+		return "application/typescript; charset=utf-8"
+	case strings.HasSuffix(pathname, ".js"):
+		return "application/javascript; charset=utf-8"
+	case strings.HasSuffix(pathname, ".css"):
+		return "text/css; charset=utf-8"
+	}
+	return ""
+}
+
+// servePrecompressed serves the precompressed variant of the build file if it's accepted by the client,
+// the missing or outdated variants are queued to be generated and the build is served as usual.
+func servePrecompressed(r *http.Request, savePath string, modtime time.Time) http.Handler {
+	contentType := precompressContentType(savePath)
+	if contentType == "" {
+		return nil
+	}
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil
+	}
+	variantPath := savePath + precompressExts[encoding]
+	exists, size, variantModtime, err := fs.Exists(variantPath)
+	if err != nil {
+		return nil
+	}
+	if !exists || variantModtime.Before(modtime) {
+		queuePrecompress(savePath, nil, []string{encoding})
+		return nil
+	}
+	f, err := fs.ReadFile(variantPath, size)
+	if err != nil {
+		return nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer f.Close()
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Encoding", encoding)
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		h.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+		if !strings.Contains(h.Get("Vary"), "Accept-Encoding") {
+			h.Add("Vary", "Accept-Encoding")
+		}
+		w.WriteHeader(200)
+		if r.Method != http.MethodHead {
+			io.Copy(w, f)
+		}
+	})
+}
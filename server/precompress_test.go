@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	defer func() { precompressEncodings = allPrecompressEncodings }()
+
+	encodings, err := parsePrecompressEncodings("gzip, zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(encodings, ",") != "zstd,gzip" {
+		t.Fatalf("unexpected encodings %v", encodings)
+	}
+	if _, err := parsePrecompressEncodings("deflate"); err == nil {
+		t.Fatal("deflate should be unsupported")
+	}
+	if encodings, _ := parsePrecompressEncodings("none"); len(encodings) != 0 {
+		t.Fatal("'none' should disable the precompression")
+	}
+
+	precompressEncodings = allPrecompressEncodings
+	for acceptEncoding, expected := range map[string]string{
+		"gzip, deflate, br, zstd": "zstd",
+		"gzip, deflate, br":       "br",
+		"gzip":                    "gzip",
+		"zstd;q=0, gzip;q=0.5":    "gzip",
+		"identity":                "",
+		"":                        "",
+	} {
+		if encoding := negotiateEncoding(acceptEncoding); encoding != expected {
+			t.Fatalf("negotiateEncoding(%s) should be '%s', got '%s'", acceptEncoding, expected, encoding)
+		}
+	}
+	precompressEncodings = []string{"br", "gzip"}
+	if encoding := negotiateEncoding("zstd, gzip"); encoding != "gzip" {
+		t.Fatalf("the disabled zstd should fall back to gzip, got '%s'", encoding)
+	}
+}
+
+func TestServePrecompressed(t *testing.T) {
+	defer func(f storage.FS) { fs = f }(fs)
+	// the queued jobs write into the storage of the test
+	defer waitPrecompress()
+	var err error
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	precompressEncodings = allPrecompressEncodings
+
+	savePath := "builds/v87/foo@1.0.0/es2022/foo.js"
+	data := []byte(strings.Repeat("export const foo = 'bar';\n", 100))
+	err = fs.WriteData(savePath, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	precompressBuild(savePath, data)
+
+	req := httptest.NewRequest("GET", "/v87/foo@1.0.0/es2022/foo.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br, zstd")
+	h := servePrecompressed(req, savePath, time.Now().Add(-time.Minute))
+	if h == nil {
+		t.Fatal("the zstd variant should be served")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "zstd" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	zr, err := zstd.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	decoded, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatal("the zstd variant doesn't match the build")
+	}
+
+	// the build is served as usual without the accepted encodings
+	req = httptest.NewRequest("GET", "/v87/foo@1.0.0/es2022/foo.js", nil)
+	if servePrecompressed(req, savePath, time.Now()) != nil {
+		t.Fatal("the identity should be served")
+	}
+	req.Header.Set("Accept-Encoding", "br")
+	req.Method = http.MethodHead
+	if servePrecompressed(req, "builds/v87/foo@1.0.0/es2022/foo.LEGAL.txt", time.Now()) != nil {
+		t.Fatal("only js, css and types have the precompressed variants")
+	}
+
+	// the queued precompression runs out of the build, and the missing variant is queued on request
+	queued := "builds/v87/bar@1.0.0/es2022/bar.js"
+	err = fs.WriteData(queued, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuePrecompress(queued, data, []string{"br"})
+	req = httptest.NewRequest("GET", "/v87/bar@1.0.0/es2022/bar.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if servePrecompressed(req, queued, time.Now().Add(-time.Minute)) != nil {
+		t.Fatal("the missing gzip variant should not be served")
+	}
+	for _, ext := range []string{".br", ".gz"} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if exists, _, _, _ := fs.Exists(queued + ext); exists {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the %s variant should be generated by the queue", ext)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
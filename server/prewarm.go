@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+// the db id of the persisted access stats of the storage files
+const accessStatsID = "stats:access"
+
+// the number of the most-requested builds that are pre-warmed on startup, set by the `-prewarm-top` flag, 0 disables it
+var prewarmTop int
+
+// persistAccessStats persists the access stats that the gc maintains, so the popular builds are
+// still recently used after the restart.
+func persistAccessStats() {
+	recorder, ok := fs.(storage.AccessStatsRecorder)
+	if !ok {
+		return
+	}
+	stats := recorder.AccessStats()
+	if len(stats) == 0 {
+		return
+	}
+	err := db.Put(accessStatsID, "stats", storage.Store{"stats": string(utils.MustEncodeJSON(stats))})
+	if err != nil {
+		log.Warnf("persist access stats: %v", err)
+	}
+}
+
+func loadAccessStats() (stats map[string]storage.AccessStat, err error) {
+	store, _, err := db.Get(accessStatsID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal([]byte(store["stats"]), &stats)
+	return
+}
+
+// restoreAccessStats restores the persisted access stats into the fs, and returns the top N
+// most-requested builds to pre-warm.
+func restoreAccessStats(top int) (builds []string) {
+	recorder, ok := fs.(storage.AccessStatsRecorder)
+	if !ok {
+		return
+	}
+	stats, err := loadAccessStats()
+	if err != nil {
+		log.Warnf("load access stats: %v", err)
+		return
+	}
+	recorder.RestoreAccessStats(stats)
+	if top > 0 {
+		builds = topBuilds(stats, top)
+	}
+	return
+}
+
+// topBuilds returns the build files sorted by the access count, then the recency
+func topBuilds(stats map[string]storage.AccessStat, n int) []string {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		if strings.HasPrefix(name, "builds/") {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := stats[names[i]], stats[names[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if !a.LastAccess.Equal(b.LastAccess) {
+			return a.LastAccess.After(b.LastAccess)
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// prewarmBuilds re-verifies the presence of the builds on disk and reads them to warm the page cache,
+// the module meta of the missing builds are removed by `findModule` so they are rebuilt on request.
+func prewarmBuilds(names []string) (warmed int, missing []string) {
+	for _, name := range names {
+		exists, size, _, err := fs.Exists(name)
+		if err != nil {
+			log.Warnf("prewarm %s: %v", name, err)
+			continue
+		}
+		if !exists {
+			missing = append(missing, name)
+			if strings.HasSuffix(name, ".js") {
+				findModule(strings.TrimPrefix(name, "builds/"))
+			}
+			continue
+		}
+		r, err := fs.ReadFile(name, size)
+		if err != nil {
+			log.Warnf("prewarm %s: %v", name, err)
+			continue
+		}
+		_, err = io.Copy(ioutil.Discard, r)
+		r.Close()
+		if err == nil {
+			warmed++
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+)
+
+func TestPrewarmBuilds(t *testing.T) {
+	defer func(l *logx.Logger, d storage.DB, f storage.FS) {
+		log, db, fs = l, d, f
+	}(log, db, fs)
+	var err error
+	log = &logx.Logger{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	root := t.TempDir()
+	fs, err = storage.OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builds := map[string]int{"a": 3, "b": 5, "c": 1, "d": 4}
+	for name, n := range builds {
+		task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: name, Version: "1.0.0"}, Target: "es2022", External: newStringSet()}
+		savePath := path.Join("builds", task.ID())
+		fs.WriteData(savePath, []byte("export default null;\n"))
+		task.storeToDB(&ModuleMeta{})
+		for i := 0; i < n; i++ {
+			r, err := fs.ReadFile(savePath, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+		}
+	}
+	persistAccessStats()
+
+	// restart with a new fs, the build `d` is lost
+	fs, err = storage.OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := fmt.Sprintf("v%d/d@1.0.0/es2022/d.js", VERSION)
+	os.Remove(path.Join(root, "builds", lost))
+
+	top := restoreAccessStats(3)
+	expected := []string{"b", "d", "a"}
+	if len(top) != 3 {
+		t.Fatalf("invalid top builds: %v", top)
+	}
+	for i, name := range expected {
+		if top[i] != fmt.Sprintf("builds/v%d/%s@1.0.0/es2022/%s.js", VERSION, name, name) {
+			t.Fatalf("invalid top builds: %v", top)
+		}
+	}
+	if stats := fs.(storage.AccessStatsRecorder).AccessStats(); len(stats) != 4 {
+		t.Fatalf("the access stats should be restored: %v", stats)
+	}
+
+	warmed, missing := prewarmBuilds(top)
+	if warmed != 2 || len(missing) != 1 || missing[0] != path.Join("builds", lost) {
+		t.Fatalf("invalid prewarm result: %d warmed, missing %v", warmed, missing)
+	}
+	if _, _, err := db.Get(lost); err != storage.ErrNotFound {
+		t.Fatalf("the meta of the missing build should be removed: %v", err)
+	}
+
+	// disabled
+	if top := restoreAccessStats(0); len(top) != 0 {
+		t.Fatalf("the prewarm should be disabled: %v", top)
+	}
+}
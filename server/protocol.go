@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the version protocols of the local packages that are leaked by the monorepo-published packages
+var versionProtocols = []string{"workspace:", "file:", "link:"}
+
+// fixProtocolVersion returns the version range to resolve the protocol version, the `workspace:^1.2.0`
+// is resolved by the range, others are resolved to the latest published version.
+func fixProtocolVersion(version string) (fixed string, ok bool) {
+	for _, protocol := range versionProtocols {
+		if strings.HasPrefix(version, protocol) {
+			fixed = "latest"
+			if protocol == "workspace:" {
+				v := strings.TrimPrefix(version, protocol)
+				if v != "*" && v != "^" && v != "~" && v != "" {
+					if _, err := semver.NewConstraint(v); err == nil {
+						fixed = v
+					}
+				}
+			}
+			return fixed, true
+		}
+	}
+	return version, false
+}
+
+// fixProtocolVersions replaces the protocol versions of the dependencies with the resolvable ranges
+func (info *NpmPackage) fixProtocolVersions() {
+	for _, deps := range []map[string]string{info.Dependencies, info.PeerDependencies, info.OptionalDependencies} {
+		for name, version := range deps {
+			if fixed, ok := fixProtocolVersion(version); ok {
+				if info.protocolDeps == nil {
+					info.protocolDeps = map[string]string{}
+				}
+				info.protocolDeps[name] = version
+				deps[name] = fixed
+				log.Warnf("dependency '%s' of '%s@%s' uses the '%s' version, resolved by '%s'", name, info.Name, info.Version, version, fixed)
+			}
+		}
+	}
+}
+
+// writeYarnResolutions writes the `resolutions` of the protocol versions to the `package.json`
+// of the build directory, so yarn can install the package.
+func writeYarnResolutions(wd string, info NpmPackage) error {
+	if len(info.protocolDeps) == 0 {
+		return nil
+	}
+	resolutions := map[string]string{}
+	for name := range info.protocolDeps {
+		for _, deps := range []map[string]string{info.Dependencies, info.PeerDependencies, info.OptionalDependencies} {
+			if v, ok := deps[name]; ok {
+				resolutions[name] = v
+				break
+			}
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"resolutions": resolutions})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(wd, "package.json"), data, 0644)
+}
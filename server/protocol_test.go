@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFixProtocolVersion(t *testing.T) {
+	for version, expected := range map[string]string{
+		"workspace:*":      "latest",
+		"workspace:^":      "latest",
+		"workspace:^1.2.0": "^1.2.0",
+		"file:../bar":      "latest",
+		"link:../bar":      "latest",
+	} {
+		fixed, ok := fixProtocolVersion(version)
+		if !ok || fixed != expected {
+			t.Fatalf("fixProtocolVersion(%s) should be '%s', got '%s'", version, expected, fixed)
+		}
+	}
+	if _, ok := fixProtocolVersion("^1.0.0"); ok {
+		t.Fatal("the semver range should not be fixed")
+	}
+}
+
+func TestWorkspaceDependencies(t *testing.T) {
+	wd := t.TempDir()
+	pkgDir := path.Join(wd, "node_modules", "foo")
+	err := os.MkdirAll(pkgDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(pkgDir, "package.json"), []byte(`{
+		"name": "foo",
+		"version": "1.0.0",
+		"main": "index.js",
+		"dependencies": { "bar": "workspace:*", "baz": "workspace:^2.0.0", "qux": "^3.0.0" },
+		"peerDependencies": { "local": "file:../local" }
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, _, fromPackageJSON, err := getPackageInfo(wd, "foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromPackageJSON {
+		t.Fatal("the package info should be read from the package.json")
+	}
+	if info.Dependencies["bar"] != "latest" || info.Dependencies["baz"] != "^2.0.0" || info.Dependencies["qux"] != "^3.0.0" || info.PeerDependencies["local"] != "latest" {
+		t.Fatalf("unexpected dependencies %v %v", info.Dependencies, info.PeerDependencies)
+	}
+	if info.protocolDeps["bar"] != "workspace:*" || info.protocolDeps["local"] != "file:../local" || len(info.protocolDeps) != 3 {
+		t.Fatalf("unexpected protocol dependencies %v", info.protocolDeps)
+	}
+
+	err = writeYarnResolutions(wd, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(wd, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkgJSON struct {
+		Resolutions map[string]string `json:"resolutions"`
+	}
+	err = json.Unmarshal(data, &pkgJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgJSON.Resolutions) != 3 || pkgJSON.Resolutions["bar"] != "latest" || pkgJSON.Resolutions["baz"] != "^2.0.0" {
+		t.Fatalf("unexpected resolutions %v", pkgJSON.Resolutions)
+	}
+}
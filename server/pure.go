@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+// identifiers or member expressions like `React.createElement`
+var regexpPureName = regexp.MustCompile(`^[a-zA-Z_$][\w$]*(\.[a-zA-Z_$][\w$]*)*$`)
+
+// the hash of the pure names in the `.pr-` suffix of the bare build urls
+var regexpPureHash = regexp.MustCompile(`^[0-9a-f]{10}$`)
+
+// the maximum number of the `?pure` names
+const maxPureNames = 32
+
+// parsePureQuery parses the `?pure` query to the sorted names
+func parsePureQuery(value string) (names []string, err error) {
+	set := newStringSet()
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !regexpPureName.MatchString(name) {
+			err = fmt.Errorf("invalid pure name '%s'", name)
+			return
+		}
+		set.Add(name)
+	}
+	if set.Size() > maxPureNames {
+		err = fmt.Errorf("too many pure names, the maximum is %d", maxPureNames)
+		return
+	}
+	names = set.Values()
+	sort.Strings(names)
+	return
+}
+
+// hashPure returns the hash of the pure names that is a part of the build id
+func hashPure(names []string) string {
+	h := sha1.New()
+	for _, name := range names {
+		h.Write([]byte(name + "\n"))
+	}
+	return strings.ToLower(hex.EncodeToString(h.Sum(nil))[:10])
+}
+
+// storePure stores the pure names in the db by the hash, the bare build urls only have the hash.
+func storePure(names []string) (hash string, err error) {
+	hash = hashPure(names)
+	_, _, err = db.Get("pure:" + hash)
+	if err == storage.ErrNotFound {
+		err = db.Put("pure:"+hash, "pure", storage.Store{"names": string(utils.MustEncodeJSON(names))})
+	}
+	return
+}
+
+func loadPure(hash string) (names []string, err error) {
+	store, _, err := db.Get("pure:" + hash)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(store["names"]), &names)
+	return
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestPureQuery(t *testing.T) {
+	defer func(d storage.DB) { db = d }(db)
+	names, err := parsePureQuery("styled, React.createElement,styled,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "React.createElement,styled" {
+		t.Fatalf("unexpected pure names %v", names)
+	}
+	for _, value := range []string{"alert(1)", "React..createElement", "1foo", "a-b"} {
+		if _, err := parsePureQuery(value); err == nil {
+			t.Fatalf("'%s' should be invalid", value)
+		}
+	}
+	many := make([]string, maxPureNames+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("fn%d", i)
+	}
+	if _, err := parsePureQuery(strings.Join(many, ",")); err == nil {
+		t.Fatal("too many pure names should be invalid")
+	}
+
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hash, err := storePure(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &BuildTask{Pure: hash}
+	if strings.Join(task.getPureNames(), ",") != "React.createElement,styled" {
+		t.Fatalf("unexpected pure names of the hash %s: %v", hash, task.getPureNames())
+	}
+
+	// the unused results of the pure calls are dropped, esbuild only matches the global references
+	code := `const el = React.createElement("div"); styled("div"); export const x = 1;`
+	for _, pure := range [][]string{nil, names} {
+		ret := api.Build(api.BuildOptions{
+			Stdin:        &api.StdinOptions{Contents: code},
+			Bundle:       true,
+			Format:       api.FormatESModule,
+			MinifySyntax: true,
+			Pure:         pure,
+		})
+		if len(ret.Errors) > 0 {
+			t.Fatal(ret.Errors[0].Text)
+		}
+		output := string(ret.OutputFiles[0].Contents)
+		if (strings.Contains(output, "createElement") || strings.Contains(output, "styled")) == (pure != nil) {
+			t.Fatalf("unexpected output with pure %v: %s", pure, output)
+		}
+	}
+}
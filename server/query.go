@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -10,6 +12,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"esm.sh/server/storage"
@@ -21,6 +24,58 @@ var banList = map[string]bool{
 	"/@withfig/autocomplete": true,
 }
 
+// query keys that affect the build output or the response, see the "Cache busting" section in README.md
+var buildQueryKeys = map[string]bool{
+	"alias":              true,
+	"analyze":            true,
+	"assets":             true,
+	"binary":             true,
+	"bundle":             true,
+	"cache":              true,
+	"css":                true,
+	"css-bundle-assets":  true,
+	"deps":               true,
+	"deps-policy":        true,
+	"deep-import":        true,
+	"dev":                true,
+	"download":           true,
+	"dts-bundle":         true,
+	"entry-field":        true,
+	"entry-points":       true,
+	"exp":                true,
+	"external":           true,
+	"ignore-annotations": true,
+	"keep-names":         true,
+	"legal-comments":     true,
+	"minify":             true,
+	"minify-identifiers": true,
+	"minify-syntax":      true,
+	"minify-whitespace":  true,
+	"namespace":          true,
+	"node-env":           true,
+	"no-check":           true,
+	"no-dts":             true,
+	"no-require":         true,
+	"optional":           true,
+	"output":             true,
+	"path":               true,
+	"peer-deps":          true,
+	"pure":               true,
+	"raw":                true,
+	"sig":                true,
+	"pin":                true,
+	"sourcemap":          true,
+	"strip-directives":   true,
+	"tag":                true,
+	"target":             true,
+	"ts-version":         true,
+	"worker":             true,
+}
+
+// cosmetic query keys(like `?v=3`) that are stripped before computing the build id,
+// set by the `-ignore-query` flag
+var ignoredQueryKeys = map[string]bool{}
+
 var httpClient = &http.Client{
 	Transport: &http.Transport{
 		Dial: func(network, addr string) (conn net.Conn, err error) {
@@ -116,36 +171,26 @@ func query(devMode bool) rex.Handle {
 			return rex.Content("index.html", startTime, bytes.NewReader(html))
 
 		case "/status.json":
-			buildQueue.lock.RLock()
-			q := make([]map[string]interface{}, buildQueue.list.Len())
-			i := 0
-			for el := buildQueue.list.Front(); el != nil; el = el.Next() {
-				t, ok := el.Value.(*queueTask)
-				if ok {
-					m := map[string]interface{}{
-						"stage":      t.stage,
-						"createTime": t.createTime.Format(http.TimeFormat),
-						"consumers":  t.consumers,
-						"pkg":        t.Pkg.String(),
-						"target":     t.Target,
-						"inProcess":  t.inProcess,
-						"devMode":    t.DevMode,
-						"bundleMode": t.BundleMode,
-					}
-					if !t.startTime.IsZero() {
-						m["startTime"] = t.startTime.Format(http.TimeFormat)
-					}
-					if len(t.Deps) > 0 {
-						m["deps"] = t.Deps.String()
-					}
-					q[i] = m
-					i++
-				}
-			}
-			buildQueue.lock.RUnlock()
+			buildProcessing, buildWaiting := buildQueue.Depth()
+			processing, waiting := dtsQueue.Depth()
 			return map[string]interface{}{
 				"uptime": time.Since(startTime).String(),
-				"queue":  q[:i],
+				"queue":  buildQueue.JSON(),
+				"queueDepth": map[string]interface{}{
+					"concurrency": buildQueue.maxProcesses,
+					"processing":  buildProcessing,
+					"waiting":     buildWaiting,
+					"highWater":   queueHighWater,
+				},
+				"dtsQueue": map[string]interface{}{
+					"concurrency": dtsQueue.maxProcesses,
+					"processing":  processing,
+					"waiting":     waiting,
+					"tasks":       dtsQueue.JSON(),
+				},
+				"registry":       registryStats.JSON(),
+				"breaker":        registryBreaker.JSON(),
+				"dtsTransformed": atomic.LoadInt64(&dtsTransformedFiles),
 			}
 
 		case "/error.js":
@@ -166,6 +211,128 @@ func query(devMode bool) rex.Handle {
 				return throwErrorJS(ctx, fmt.Errorf("Unknown error"))
 			}
 
+		case "/optional.js":
+			var exports []string
+			if v := ctx.Form.Value("exports"); v != "" {
+				exports = strings.Split(v, ",")
+			}
+			ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+			return optionalModule(ctx.Form.Value("mode"), ctx.Form.Value("name"), ctx.Form.Value("importer"), exports)
+
+		case "/-/search":
+			if !registryLimiter.Allow(ctx.RemoteIP()) {
+				return rex.Status(429, "Too Many Requests")
+			}
+			text := strings.TrimSpace(ctx.Form.Value("q"))
+			if text == "" {
+				return rex.Status(400, "missing query")
+			}
+			size := 20
+			if i, err := ctx.Form.Int("size"); err == nil && i > 0 && i <= 250 {
+				size = int(i)
+			}
+			ret, err := searchPackages(text, size)
+			if err == errRegistryUnavailable {
+				return registryUnavailable(ctx)
+			}
+			if err != nil {
+				return rex.Status(http.StatusBadGateway, err.Error())
+			}
+			ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 5*60))
+			return ret
+
+		case "/-/manifest":
+			if ctx.R.Method != http.MethodPost {
+				return rex.Status(http.StatusMethodNotAllowed, "Method Not Allowed")
+			}
+			// the manifest triggers the builds of the whole graph, it's for the admins if the builds require the signed URLs
+			if (adminToken != "" || buildSigningKey != "") && !isAdmin(ctx) {
+				return rex.Status(401, "Unauthorized")
+			}
+			if !registryLimiter.Allow(ctx.RemoteIP()) {
+				return rex.Status(429, "Too Many Requests")
+			}
+			var opts ManifestOptions
+			err := json.NewDecoder(io.LimitReader(ctx.R.Body, 1<<20)).Decode(&opts)
+			if err != nil || opts.Pkg == "" {
+				return rex.Status(400, "Bad Request")
+			}
+			if ok, reason := pkgAccess.Check(pkgNameOf(opts.Pkg)); !ok {
+				return rex.Status(403, reason)
+			}
+			root, _, err := parsePkg(opts.Pkg)
+			if err != nil {
+				return rex.Status(400, err.Error())
+			}
+			target := strings.ToLower(opts.Target)
+			if _, ok := targets[target]; !ok {
+				target = "es2015"
+			}
+			manifest, err := buildManifest(*root, target, opts.Dev, getOrigin(ctx.R), ctx.RemoteIP())
+			if err == errDepsGraphTruncated {
+				return rex.Status(http.StatusUnprocessableEntity, err.Error())
+			}
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return manifest
+
+		case "/-/gc":
+			if ctx.R.Method != http.MethodPost {
+				return rex.Status(http.StatusMethodNotAllowed, "Method Not Allowed")
+			}
+			if !isAdmin(ctx) {
+				return rex.Status(401, "Unauthorized")
+			}
+			targetSize, err := utils.ParseBytes(ctx.Form.Value("target"))
+			if err != nil || targetSize < 0 {
+				return rex.Status(400, "Invalid target size")
+			}
+			gc, ok := fs.(storage.GarbageCollector)
+			if !ok {
+				return rex.Status(501, "The fs doesn't support gc")
+			}
+			ret, err := gc.GC(targetSize)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			for i, name := range ret.Removed {
+				if strings.HasPrefix(name, "builds/") {
+					id := strings.TrimPrefix(name, "builds/")
+					if strings.HasSuffix(id, ".js") {
+						db.Delete(id)
+					}
+					ret.Removed[i] = id
+				}
+			}
+			log.Infof("gc by %s: %d bytes freed, %d files removed", ctx.RemoteIP(), ret.Freed, len(ret.Removed))
+			ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return ret
+
+		case "/-/importmap":
+			if !registryLimiter.Allow(ctx.RemoteIP()) {
+				return rex.Status(429, "Too Many Requests")
+			}
+			if ok, reason := pkgAccess.Check(pkgNameOf(ctx.Form.Value("pkg"))); !ok {
+				return rex.Status(403, reason)
+			}
+			root, _, err := parsePkg(ctx.Form.Value("pkg"))
+			if err != nil {
+				return rex.Status(400, err.Error())
+			}
+			target := strings.ToLower(ctx.Form.Value("target"))
+			if _, ok := targets[target]; !ok {
+				target = getTargetByUA(ctx.R.UserAgent())
+			}
+			importMap, err := buildImportMap(Pkg{Name: root.Name, Version: root.Version}, target, ctx.Form.Has("dev"), getOrigin(ctx.R))
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60)) // the graph may be changed by new releases
+			return importMap
+
 		case "/favicon.ico":
 			return rex.Status(404, "not found")
 		}
@@ -198,23 +365,105 @@ func query(devMode bool) rex.Handle {
 			}
 		}
 
+		// redirect the non-canonical specifiers(like `/React@18.2.0` or `/react@18.2.0/./index.js`) to the canonical URL
+		rawPath := ctx.R.URL.Path
+		if strings.ContainsRune(rawPath, ':') {
+			rawPath = regLocPath.ReplaceAllString(rawPath, "$1")
+		}
+		skip := 0
+		if basePath != "" {
+			skip = strings.Count(basePath, "/")
+		}
+		if hasBuildVerPrefix {
+			skip++
+		}
+		canonicalPath, err := canonicalPkgPath(rawPath, skip)
+		if err != nil {
+			return rex.Status(400, err.Error())
+		}
+		if canonicalPath != pathname {
+			prefix := basePath
+			if hasBuildVerPrefix {
+				if outdatedBuildVer != "" {
+					prefix += "/" + outdatedBuildVer
+				} else {
+					prefix += fmt.Sprintf("/v%d", VERSION)
+				}
+			}
+			url := getOrigin(ctx.R) + prefix + canonicalPath
+			if ctx.R.URL.RawQuery != "" {
+				url += "?" + ctx.R.URL.RawQuery
+			}
+			ctx.SetHeader("X-Esm-Path", canonicalPath)
+			return rex.Redirect(url, http.StatusMovedPermanently)
+		}
+
+		// check the access rules before any fetch of the registry, the dependencies are checked by
+		// their build URLs and the resolver of the build too
+		if ok, reason := pkgAccess.Check(pkgNameOf(pathname)); !ok {
+			return rex.Status(403, reason)
+		}
+
+		// the registry picked by the `X-Esm-Registry` header, used by the metadata fetches and the build
+		registry, hasRegistry := requestRegistry(ctx.R.Header.Get("X-Esm-Registry"))
+
+		// resolve the `?tag` query of the path without explicit version, and redirect to the pinned URL
+		if tag := ctx.Form.Value("tag"); tag != "" && !hasBuildVerPrefix {
+			name, version, rest := splitPkgPath(pathname)
+			if version == "" {
+				if !regexpDistTag.MatchString(tag) {
+					return rex.Status(400, fmt.Sprintf("Invalid tag query: %s", tag))
+				}
+				version, err := resolveDistTag(registry, name, tag)
+				if err == errRegistryUnavailable {
+					return registryUnavailable(ctx)
+				}
+				if err != nil {
+					status := 500
+					var tagErr *UnknownTagError
+					if errors.As(err, &tagErr) || strings.HasSuffix(err.Error(), "not found") {
+						status = 404
+					}
+					return rex.Status(status, err.Error())
+				}
+				url := fmt.Sprintf("%s%s/%s@%s%s", getOrigin(ctx.R), basePath, name, version, rest)
+				if query := removeRawQuery(ctx.R.URL.RawQuery, "tag"); query != "" {
+					url += "?" + query
+				}
+				return rex.Redirect(url, http.StatusTemporaryRedirect)
+			}
+		}
+
 		// get package info
-		reqPkg, _, err := parsePkg(pathname)
+		reqPkg, isFullVersion, err := parsePkgFrom(registry, pathname)
+		if err == errRegistryUnavailable {
+			return registryUnavailable(ctx)
+		}
 		if err != nil {
 			status := 500
 			message := err.Error()
+			var tagErr *UnknownTagError
 			if message == "invalid path" {
 				status = 400
-			} else if strings.HasSuffix(message, "not found") {
+			} else if strings.HasSuffix(message, "not found") || errors.As(err, &tagErr) {
 				status = 404
 			}
 			return rex.Status(status, message)
 		}
 
-		origin := getOrigin(ctx.R.Host)
+		origin := getOrigin(ctx.R)
+
+		// serve tag(or semver range) URLs in place with the pinned version of the tag refresher
+		var pkgTag string
+		if tagRefresher != nil && !isFullVersion && !hasBuildVerPrefix && !strings.HasSuffix(pathname, ".d.ts") {
+			pkgTag = getPkgTag(pathname, reqPkg.Name)
+			if version := tagRefresher.Get(reqPkg.Name, pkgTag); version != "" {
+				reqPkg.Version = version
+			}
+		}
 
 		// redirect to the url with full package version
-		if (!hasBuildVerPrefix || strings.HasSuffix(pathname, ".d.ts")) && !strings.HasPrefix(pathname, fmt.Sprintf("/%s@%s", reqPkg.Name, reqPkg.Version)) {
+		if pkgTag == "" && (!hasBuildVerPrefix || strings.HasSuffix(pathname, ".d.ts")) && !strings.HasPrefix(pathname, fmt.Sprintf("/%s@%s", reqPkg.Name, reqPkg.Version)) {
 			prefix := ""
 			if hasBuildVerPrefix {
 				if outdatedBuildVer != "" {
@@ -238,37 +487,36 @@ func query(devMode bool) rex.Handle {
 			reqPkg.Submodule = "jsx-runtime"
 		}
 
+		// strip cosmetic queries, the raw query is still kept for redirects
+		stripIgnoredQuery(ctx.R)
+
+		// apply the build defaults of the package, the build URLs have the options in the path already
+		if !hasBuildVerPrefix {
+			if applied := buildDefaults.Apply(ctx.R, *reqPkg); len(applied) > 0 {
+				ctx.SetHeader("X-Esm-Build-Defaults", strings.Join(applied, ", "))
+				ctx.SetHeader("X-Esm-Build-Options", effectiveBuildQuery(ctx.R))
+			}
+		}
+
 		if v := ctx.Form.Value("path"); v != "" {
 			reqPkg.Submodule = utils.CleanPath(v)[1:]
 		}
 
-		var storageType string
-		if reqPkg.Submodule != "" {
-			switch path.Ext(pathname) {
-			case ".js":
-				if hasBuildVerPrefix {
-					storageType = "builds"
-				}
-
-			// todo: transform ts/jsx/tsx for browser
-			case ".ts", ".jsx", ".tsx":
-				if hasBuildVerPrefix {
-					if strings.HasSuffix(pathname, ".d.ts") {
-						storageType = "types"
-					}
-				} else if len(strings.Split(pathname, "/")) > 2 {
-					storageType = "raw"
-				}
+		isRaw := ctx.Form.Has("raw")
+		storageType := getStorageType(reqPkg, pathname, hasBuildVerPrefix, isRaw)
 
-			case ".json", ".css", ".pcss", ".postcss", ".less", ".sass", ".scss", ".stylus", ".styl", ".wasm", ".xml", ".yaml", ".md", ".svg", ".png", ".jpg", ".webp", ".gif", ".eot", ".ttf", ".otf", ".woff", ".woff2":
-				if hasBuildVerPrefix {
-					if strings.HasSuffix(pathname, ".css") {
-						storageType = "builds"
-					}
-				} else if len(strings.Split(pathname, "/")) > 2 {
-					storageType = "raw"
-				}
+		// serve the package.json shim of the module, the raw package.json is served with the `?raw` query
+		if !hasBuildVerPrefix && reqPkg.Submodule == "package.json" && !isRaw {
+			info, err := fetchPackageInfoFrom(registry, reqPkg.Name, reqPkg.Version)
+			if err != nil {
+				return throwErrorJS(ctx, err)
 			}
+			if pkgTag != "" {
+				ctx.SetHeader("Cache-Control", tagRefresher.CacheControl())
+			} else {
+				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			}
+			return newPackageJSONShim(info, origin)
 		}
 
 		// serve raw dist files like CSS that is fetching from unpkg.com
@@ -276,6 +524,9 @@ func query(devMode bool) rex.Handle {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if !regFullVersionPath.MatchString(pathname) {
 					url := fmt.Sprintf("%s/%s", origin, reqPkg.String())
+					if isRaw {
+						url += "?raw"
+					}
 					http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 					return
 				}
@@ -294,8 +545,8 @@ func query(devMode bool) rex.Handle {
 						return
 					}
 					defer f.Close()
-					if strings.HasSuffix(pathname, ".ts") {
-						w.Header().Set("Content-Type", "application/typescript")
+					if contentType := getRawContentType(pathname); contentType != "" {
+						w.Header().Set("Content-Type", contentType)
 					}
 					w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 					http.ServeContent(w, r, savePath, modtime, f)
@@ -348,8 +599,16 @@ func query(devMode bool) rex.Handle {
 			})
 		}
 
+		// check `output` query, the build files are served as they are for the default `js` output
+		output := ctx.Form.Value("output")
+		if output == "" {
+			output = "js"
+		} else if !outputTypes[output] {
+			return rex.Status(400, fmt.Sprintf("Invalid output query: %s", output))
+		}
+
 		// serve build files
-		if hasBuildVerPrefix && (storageType == "builds" || storageType == "types") {
+		if hasBuildVerPrefix && (storageType == "builds" || storageType == "types") && ((output == "js" && !ctx.Form.Has("analyze")) || storageType == "types") {
 			var savePath string
 			if outdatedBuildVer != "" {
 				savePath = path.Join(storageType, outdatedBuildVer, pathname)
@@ -371,6 +630,16 @@ func query(devMode bool) rex.Handle {
 					ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
 				}
 				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+				if ctx.Form.Has("download") {
+					return serveDownload(pathname, modtime, r)
+				}
+				if len(precompressEncodings) > 0 {
+					ctx.SetHeader("Vary", "Accept-Encoding")
+					if h := servePrecompressed(ctx.R, savePath, modtime); h != nil {
+						r.Close()
+						return h
+					}
+				}
 				return rex.Content(savePath, modtime, r)
 			}
 		}
@@ -384,6 +653,10 @@ func query(devMode bool) rex.Handle {
 				name = strings.TrimSpace(name)
 				to = strings.TrimSpace(to)
 				if name != "" && to != "" {
+					// the alias targets are built into the module, they are checked like the dependencies
+					if err := checkDependencyAccess(to); err != nil {
+						return rex.Status(403, strings.TrimPrefix(err.Error(), accessDeniedErrorPrefix))
+					}
 					alias[name] = to
 				}
 			}
@@ -394,7 +667,10 @@ func query(devMode bool) rex.Handle {
 		for _, p := range strings.Split(ctx.Form.Value("deps"), ",") {
 			p = strings.TrimSpace(p)
 			if p != "" {
-				m, _, err := parsePkg(p)
+				if ok, reason := pkgAccess.Check(pkgNameOf(p)); !ok {
+					return rex.Status(403, reason)
+				}
+				m, _, err := parsePkgFrom(registry, p)
 				if err != nil {
 					if strings.HasSuffix(err.Error(), "not found") {
 						continue
@@ -433,7 +709,7 @@ func query(devMode bool) rex.Handle {
 		}
 
 		isBare := false
-		isPkgCss := ctx.Form.Has("css")
+		isPkgCss := ctx.Form.Has("css") || output == "css"
 		isBundleMode := ctx.Form.Has("bundle")
 		isDev := ctx.Form.Has("dev")
 		isPined := ctx.Form.Has("pin")
@@ -443,6 +719,138 @@ func query(devMode bool) rex.Handle {
 		keepNames := ctx.Form.Has("keep-names")
 		ignoreAnnotations := ctx.Form.Has("ignore-annotations")
 		sourcemap := ctx.Form.Has("sourcemap")
+		namespace := ctx.Form.Has("namespace")
+		stripDirectives := ctx.Form.Has("strip-directives")
+		minify := ""
+		if ctx.Form.Has("minify") {
+			minify = minifyAll
+		} else {
+			if ctx.Form.Has("minify-syntax") {
+				minify += "s"
+			}
+			if ctx.Form.Has("minify-whitespace") {
+				minify += "w"
+			}
+			if ctx.Form.Has("minify-identifiers") {
+				minify += "i"
+			}
+		}
+		legalComments := ctx.Form.Value("legal-comments")
+		if _, ok := legalCommentsModes[legalComments]; !ok && legalComments != "eof" {
+			return rex.Status(400, fmt.Sprintf("Invalid legal-comments query: %s", legalComments))
+		}
+		if legalComments == "eof" {
+			legalComments = ""
+		}
+		var pureNames []string
+		if ctx.Form.Has("pure") {
+			pureNames, err = parsePureQuery(ctx.Form.Value("pure"))
+			if err != nil {
+				return rex.Status(400, fmt.Sprintf("Invalid pure query: %v", err))
+			}
+		}
+		pure := ""
+		optional := ctx.Form.Value("optional")
+		if optional != "" && !optionalModes[optional] {
+			return rex.Status(400, fmt.Sprintf("Invalid optional query: %s", optional))
+		}
+		tsVersion, err := parseTSVersion(ctx.Form.Value("ts-version"))
+		if err != nil {
+			return rex.Status(400, fmt.Sprintf("Invalid ts-version query: %s", ctx.Form.Value("ts-version")))
+		}
+		assets := ctx.Form.Value("assets")
+		if assets != "" && !assetsModes[assets] {
+			return rex.Status(400, fmt.Sprintf("Invalid assets query: %s", assets))
+		}
+		if assets == "rewrite" {
+			assets = ""
+		}
+		cssBundleAssets := ctx.Form.Value("css-bundle-assets")
+		if cssBundleAssets != "" && !cssBundleAssetsModes[cssBundleAssets] {
+			return rex.Status(400, fmt.Sprintf("Invalid css-bundle-assets query: %s", cssBundleAssets))
+		}
+		nodeEnv := ctx.Form.Value("node-env")
+		if nodeEnv != "" && !isValidNodeEnv(nodeEnv) {
+			return rex.Status(400, fmt.Sprintf("Invalid node-env query: %s", nodeEnv))
+		}
+		peerDeps := ctx.Form.Value("peer-deps")
+		if peerDeps != "" && !peerDepsModes[peerDeps] {
+			return rex.Status(400, fmt.Sprintf("Invalid peer-deps query: %s", peerDeps))
+		}
+		if peerDeps == "external" {
+			peerDeps = ""
+		}
+		binary := ctx.Form.Value("binary")
+		if binary != "" && !binaryLoaderModes[binary] {
+			return rex.Status(400, fmt.Sprintf("Invalid binary query: %s", binary))
+		}
+		entryField := ctx.Form.Value("entry-field")
+		if entryField != "" && !entryFields[entryField] {
+			return rex.Status(400, fmt.Sprintf("Invalid entry-field query: %s", entryField))
+		}
+		depsPolicy := defaultDepsPolicy
+		depsGraph := ""
+		if ctx.Form.Has("deps-policy") {
+			depsPolicy = ctx.Form.Value("deps-policy")
+			if !isValidDepsPolicy(depsPolicy) {
+				return rex.Status(400, fmt.Sprintf("Invalid deps-policy query: %s", depsPolicy))
+			}
+		}
+
+		// build the entry points with code splitting, returns the manifest of the outputs
+		if ctx.Form.Has("entry-points") && !hasBuildVerPrefix {
+			entries, err := parseEntryPoints(ctx.Form.Value("entry-points"))
+			if err != nil {
+				return rex.Status(400, fmt.Sprintf("Invalid entry-points query: %v", err))
+			}
+			// the split build bundles all the dependencies, the resolve args are not supported
+			if len(alias) > 0 || len(deps) > 0 || external.Size() > 0 {
+				return rex.Status(400, "The entry-points query can't be used with the alias, deps or external query")
+			}
+			if !registryLimiter.Allow(ctx.RemoteIP()) {
+				return rex.Status(429, "Too Many Requests")
+			}
+			task := &SplitTask{
+				BuildVersion: buildVersion,
+				Pkg:          Pkg{Name: reqPkg.Name, Version: reqPkg.Version},
+				Entries:      entries,
+				Target:       target,
+				DevMode:      isDev,
+			}
+			manifest, err := task.findManifest()
+			if err == storage.ErrNotFound {
+				if err := canTriggerBuild(ctx, task.ID()); err != nil {
+					return unsignedBuild(ctx, task.ID(), err)
+				}
+				buildTask := newSplitBuildTask(task)
+				if retryAfter, saturated := buildQueue.Saturated(buildTask, queueHighWater); saturated {
+					return queueSaturated(ctx, retryAfter)
+				}
+				c := buildQueue.Add(buildTask, ctx.RemoteIP())
+				select {
+				case output := <-c.C:
+					err = output.err
+					if err == nil {
+						manifest, err = task.findManifest()
+					}
+				case <-time.After(time.Minute):
+					buildQueue.RemoveConsumer(buildTask, c)
+					return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try again later!")
+				}
+			}
+			if err != nil {
+				if e, ok := err.(*BuildError); ok && e.Code == ErrNoEntry {
+					return rex.Status(404, e.Message)
+				}
+				return rex.Status(500, err.Error())
+			}
+			if pkgTag != "" {
+				ctx.SetHeader("Cache-Control", tagRefresher.CacheControl())
+			} else {
+				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			}
+			return manifest.WithOrigin(origin)
+		}
 
 		// force react/jsx-dev-runtime and react-refresh into `dev` mode
 		if !isDev {
@@ -491,6 +899,101 @@ func query(devMode bool) rex.Handle {
 						submodule = strings.TrimSuffix(submodule, ".development")
 						isDev = true
 					}
+					if endsWith(submodule, ".sd") {
+						submodule = strings.TrimSuffix(submodule, ".sd")
+						stripDirectives = true
+					}
+					peerDeps = ""
+					if endsWith(submodule, ".pd-bundle") {
+						submodule = strings.TrimSuffix(submodule, ".pd-bundle")
+						peerDeps = "bundle"
+					}
+					binary = ""
+					if i := strings.LastIndex(submodule, ".bi-"); i > 0 && binaryLoaderModes[submodule[i+4:]] {
+						binary = submodule[i+4:]
+						submodule = submodule[:i]
+					}
+					nodeEnv = ""
+					if i := strings.LastIndex(submodule, ".ne-"); i > 0 && isValidNodeEnv(submodule[i+4:]) {
+						nodeEnv = submodule[i+4:]
+						submodule = submodule[:i]
+					}
+					cssBundleAssets = ""
+					if i := strings.LastIndex(submodule, ".ca-"); i > 0 && cssBundleAssetsModes[submodule[i+4:]] {
+						cssBundleAssets = submodule[i+4:]
+						submodule = submodule[:i]
+					}
+					assets = ""
+					if i := strings.LastIndex(submodule, ".as-"); i > 0 && assetsModes[submodule[i+4:]] {
+						assets = submodule[i+4:]
+						submodule = submodule[:i]
+					}
+					entryField = ""
+					if i := strings.LastIndex(submodule, ".ef-"); i > 0 && entryFields[submodule[i+4:]] {
+						entryField = submodule[i+4:]
+						submodule = submodule[:i]
+					}
+					// the registry of the build is picked by the hash, the header is ignored
+					registry, hasRegistry = "", false
+					if i := strings.LastIndex(submodule, ".rg-"); i > 0 {
+						registry, hasRegistry = lookupHashRegistry(submodule[i+4:])
+						if !hasRegistry {
+							return rex.Status(404, "Unknown registry")
+						}
+						submodule = submodule[:i]
+					}
+					// the hash of the package overrides must match the current overrides
+					if i := strings.LastIndex(submodule, ".ov-"); i > 0 {
+						if submodule[i+4:] != pkgOverrides.Hash(Pkg{Name: reqPkg.Name, Version: reqPkg.Version}) {
+							return rex.Status(404, "Unknown package overrides")
+						}
+						submodule = submodule[:i]
+					}
+					pure = ""
+					pureNames = nil
+					if i := strings.LastIndex(submodule, ".pr-"); i > 0 {
+						pure = submodule[i+4:]
+						if !regexpPureHash.MatchString(pure) {
+							return rex.Status(400, fmt.Sprintf("Invalid pure hash: %s", pure))
+						}
+						submodule = submodule[:i]
+					}
+					optional = ""
+					if i := strings.LastIndex(submodule, ".op-"); i > 0 && optionalModes[submodule[i+4:]] {
+						optional = submodule[i+4:]
+						submodule = submodule[:i]
+					}
+					legalComments = ""
+					if i := strings.LastIndex(submodule, ".lc-"); i > 0 {
+						if _, ok := legalCommentsModes[submodule[i+4:]]; ok {
+							legalComments = submodule[i+4:]
+							submodule = submodule[:i]
+						}
+					}
+					minify = ""
+					if i := strings.LastIndex(submodule, ".min-"); i > 0 && strings.Trim(submodule[i+5:], minifyAll) == "" {
+						minify = submodule[i+5:]
+						submodule = submodule[:i]
+					}
+					depsGraph = ""
+					if endsWith(submodule, ".dr") {
+						submodule = strings.TrimSuffix(submodule, ".dr")
+						depsPolicy = "range"
+					} else if i := strings.LastIndex(submodule, ".dg-"); i > 0 {
+						depsGraph = submodule[i+4:]
+						submodule = submodule[:i]
+						depsPolicy = "graph"
+					} else {
+						depsPolicy = "exact"
+					}
+					if endsWith(submodule, ".ns") {
+						submodule = strings.TrimSuffix(submodule, ".ns")
+						namespace = true
+					}
+					if endsWith(submodule, ".sm") {
+						submodule = strings.TrimSuffix(submodule, ".sm")
+						sourcemap = true
+					}
 					if endsWith(submodule, ".ia") {
 						submodule = strings.TrimSuffix(submodule, ".ia")
 						ignoreAnnotations = true
@@ -499,10 +1002,6 @@ func query(devMode bool) rex.Handle {
 						submodule = strings.TrimSuffix(submodule, ".kn")
 						keepNames = true
 					}
-					if endsWith(submodule, ".sm") {
-						submodule = strings.TrimSuffix(submodule, ".sm")
-						sourcemap = true
-					}
 					if endsWith(submodule, ".nr") {
 						submodule = strings.TrimSuffix(submodule, ".nr")
 						noRequire = true
@@ -529,45 +1028,70 @@ func query(devMode bool) rex.Handle {
 				Target:       "types",
 				stage:        "-",
 			}
-			var savePath string
-			findTypesFile := func() (bool, int64, time.Time, error) {
-				savePath = path.Join(fmt.Sprintf(
-					"types/v%d/%s@%s/%s",
-					buildVersion,
-					reqPkg.Name,
-					reqPkg.Version,
-					encodeResolveArgsPrefix(alias, deps, external),
-				), reqPkg.Submodule)
-				if strings.HasSuffix(savePath, "~.d.ts") {
-					savePath = strings.TrimSuffix(savePath, "~.d.ts")
-					ok, _, _, err := fs.Exists(path.Join(savePath, "index.d.ts"))
-					if err != nil {
-						return false, 0, time.Time{}, err
-					}
-					if ok {
-						savePath = path.Join(savePath, "index.d.ts")
-					} else {
-						savePath += ".d.ts"
-					}
-				}
-				return fs.Exists(savePath)
-			}
-			exists, size, modtime, err := findTypesFile()
+			savePath, exists, size, modtime, err := findTypesFile(*reqPkg, buildVersion, encodeResolveArgsPrefix(alias, deps, external))
 			if err == nil && !exists {
-				c := buildQueue.Add(task, ctx.RemoteIP())
+				// the types are transformed in the dts queue, so they don't contend with the js builds
+				c := dtsQueue.Add(task, ctx.RemoteIP())
 				select {
 				case output := <-c.C:
 					if output.err != nil {
 						return rex.Status(500, "types: "+output.err.Error())
 					}
 				case <-time.After(time.Minute):
-					buildQueue.RemoveConsumer(task, c)
+					dtsQueue.RemoveConsumer(task, c)
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are transforming the types hardly, please try again later!")
 				}
 			}
 			if err != nil {
 				return rex.Status(500, err.Error())
 			}
+			// the `?dts-bundle` query rolls the types into one `.d.ts`, it's heavier than the types so
+			// it's cached separately and rolled in the dts queue too
+			if ctx.Form.Has("dts-bundle") {
+				typesPath, exists, _, _, err := findTypesFile(*reqPkg, buildVersion, encodeResolveArgsPrefix(alias, deps, external))
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				if !exists {
+					return rex.Status(404, "Types not found")
+				}
+				savePath = dtsBundlePath(typesPath)
+				exists, size, modtime, err = fs.Exists(savePath)
+				if err == nil && !exists {
+					bundleTask := &BuildTask{
+						CdnOrigin:    origin,
+						BuildVersion: buildVersion,
+						Pkg:          *reqPkg,
+						Alias:        alias,
+						Deps:         deps,
+						External:     external,
+						Target:       "types",
+						DtsBundle:    true,
+						stage:        "-",
+					}
+					c := dtsQueue.Add(bundleTask, ctx.RemoteIP())
+					select {
+					case output := <-c.C:
+						var buildErr *BuildError
+						if errors.As(output.err, &buildErr) && buildErr.Code == ErrDtsBundleUnsupported {
+							return rex.Status(http.StatusUnprocessableEntity, buildErr.Message)
+						}
+						if output.err != nil {
+							return rex.Status(500, "types: "+output.err.Error())
+						}
+					case <-time.After(time.Minute):
+						dtsQueue.RemoveConsumer(bundleTask, c)
+						return rex.Status(http.StatusRequestTimeout, "timeout, we are transforming the types hardly, please try again later!")
+					}
+					exists, size, modtime, err = fs.Exists(savePath)
+				}
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				if !exists {
+					return rex.Status(404, "Types not found")
+				}
+			}
 			var r io.ReadSeeker
 			r, err = fs.ReadFile(savePath, size)
 			if err != nil {
@@ -578,9 +1102,51 @@ func query(devMode bool) rex.Handle {
 			}
 			ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
 			ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			if ctx.Form.Has("download") {
+				return serveDownload(savePath, modtime, r)
+			}
 			return rex.Content(savePath, modtime, r) // auto close
 		}
 
+		// the `graph` deps policy pins all the dependencies by the dependency graph of the requested package
+		if depsPolicy == "graph" && depsGraph == "" {
+			depsGraph, _, _, err = resolveGraphPins(Pkg{Name: reqPkg.Name, Version: reqPkg.Version})
+			if err != nil {
+				return throwErrorJS(ctx, err)
+			}
+		}
+
+		// the entry field only applies to the main entry of the package
+		if reqPkg.Submodule != "" {
+			entryField = ""
+		}
+
+		// check the subpath against the `exports` of package.json, the build URLs are the imports
+		// resolved by esm.sh that are not checked
+		if !hasBuildVerPrefix && reqPkg.Submodule != "" && storageType == "" {
+			info, err := fetchPackageInfoFrom(registry, reqPkg.Name, reqPkg.Version)
+			if err != nil {
+				return throwErrorJS(ctx, err)
+			}
+			// the `exports` fixed by the package overrides are checked, as the build sees them
+			warning, err := checkSubpathExport(pkgOverrides.ApplyInfo(info), reqPkg.Submodule, ctx.Form.Has("deep-import"))
+			if err != nil {
+				return throwErrorJS(ctx, err)
+			}
+			if warning != "" {
+				log.Warnf("%s (%s)", warning, ctx.R.URL.Path)
+				ctx.SetHeader("X-Esm-Export-Warning", warning)
+			}
+		}
+
+		// the `?pure` names are stored in the db by the hash that is a part of the build id
+		if len(pureNames) > 0 {
+			pure, err = storePure(pureNames)
+			if err != nil {
+				return throwErrorJS(ctx, err)
+			}
+		}
+
 		task := &BuildTask{
 			CdnOrigin:         origin,
 			BuildVersion:      buildVersion,
@@ -595,9 +1161,79 @@ func query(devMode bool) rex.Handle {
 			KeepNames:         keepNames,
 			IgnoreAnnotations: ignoreAnnotations,
 			Sourcemap:         sourcemap,
+			Namespace:         namespace,
+			DepsPolicy:        depsPolicy,
+			DepsGraph:         depsGraph,
+			Minify:            normalizeMinify(minify, isDev),
+			LegalComments:     legalComments,
+			Optional:          optional,
+			Pure:              pure,
+			EntryField:        entryField,
+			Assets:            assets,
+			CSSBundleAssets:   cssBundleAssets,
+			NodeEnv:           nodeEnv,
+			Binary:            binary,
+			PeerDeps:          peerDeps,
+			StripDirectives:   stripDirectives,
+			pureNames:         pureNames,
 			stage:             "init",
 		}
+		ctx.SetHeader("X-Esm-Minify", task.minifyHeader())
+		ctx.SetHeader("X-Esm-Node-Env", task.getNodeEnv())
+		if optional != "" {
+			ctx.SetHeader("X-Esm-Optional", optional)
+		}
+		if hasRegistry {
+			task.registry = registry
+			ctx.SetHeader("X-Esm-Registry", registry)
+		}
+		if pkgTag != "" {
+			tagRefresher.Track(pkgTag, task)
+		}
 		taskID := task.ID()
+
+		// the build without the source map redirects to the map of the `?sourcemap` build
+		if output == "map" && !task.Sourcemap {
+			smTask := *task
+			smTask.id = ""
+			smTask.Sourcemap = true
+			url := fmt.Sprintf("%s%s/%s?output=map", origin, basePath, smTask.ID())
+			return rex.Redirect(url, http.StatusTemporaryRedirect)
+		}
+
+		// bypass the build cache for debugging, `no-store` doesn't overwrite the cached build
+		if mode := ctx.Form.Value("cache"); mode == "no-store" || mode == "reload" {
+			if !isAdmin(ctx) {
+				return rex.Status(403, "forbidden")
+			}
+			// the forced builds are out of the build queue, so the concurrency is limited apart
+			select {
+			case forcedBuildSlots <- struct{}{}:
+			default:
+				ctx.SetHeader("Retry-After", "30")
+				return rex.Status(429, "Too Many Requests")
+			}
+			log.Infof("bypass build cache(%s) of '%s' by %s", mode, taskID, ctx.RemoteIP())
+			task.noCache = true
+			task.noStore = mode == "no-store"
+			esm, err := task.Build()
+			<-forcedBuildSlots
+			if err != nil {
+				return throwErrorJS(ctx, err)
+			}
+			if !task.noStore {
+				db.Delete(buildErrorID(taskID))
+			}
+			if task.noStore {
+				if esm.TypesOnly || task.output == nil {
+					return rex.Status(404, "File not found")
+				}
+				ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+				ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+				return task.output
+			}
+		}
+
 		esm, err := findModule(taskID)
 		if err != nil && err != storage.ErrNotFound {
 			return rex.Status(500, err.Error())
@@ -618,12 +1254,32 @@ func query(devMode bool) rex.Handle {
 				}
 			}
 
+			// fail fast if the build failed recently
+			if esm == nil {
+				buildErr, err := findBuildError(task.ID())
+				if err != nil && err != storage.ErrNotFound {
+					return rex.Status(500, err.Error())
+				}
+				if buildErr != nil {
+					return throwErrorJS(ctx, buildErr)
+				}
+			}
+
 			// if the previous build exists and is not pin/bare mode, then build current module in backgound,
 			// or wait the current build task for 30 seconds
 			if esm != nil {
 				// todo: maybe don't build?
-				buildQueue.Add(task, "")
+				// the previous build is served without the rebuild if the queue is saturated or the request is not signed
+				if _, saturated := buildQueue.Saturated(task, queueHighWater); !saturated && canTriggerBuild(ctx, task.ID()) == nil {
+					buildQueue.Add(task, "")
+				}
 			} else {
+				if err := canTriggerBuild(ctx, task.ID()); err != nil {
+					return unsignedBuild(ctx, task.ID(), err)
+				}
+				if retryAfter, saturated := buildQueue.Saturated(task, queueHighWater); saturated {
+					return queueSaturated(ctx, retryAfter)
+				}
 				c := buildQueue.Add(task, ctx.RemoteIP())
 				select {
 				case output := <-c.C:
@@ -638,15 +1294,151 @@ func query(devMode bool) rex.Handle {
 			}
 		}
 
+		if esm.Entry != "" {
+			ctx.SetHeader("X-Esm-Entry", esm.Entry)
+		}
+		if esm.EngineWarning != "" {
+			ctx.SetHeader("X-Esm-Engine-Warning", esm.EngineWarning)
+		}
+		if esm.AssetWarning != "" {
+			ctx.SetHeader("X-Esm-Asset-Warning", esm.AssetWarning)
+		}
+		if len(esm.PeerDeps) > 0 {
+			ctx.SetHeader("X-Esm-Peer-Deps", strings.Join(esm.PeerDeps, ","))
+		}
+
+		// redirect the directory-style request(`/pkg@1.0.0/lib/`) to the canonical file URL of its index entry
+		if dirRedirect && !hasBuildVerPrefix && strings.HasSuffix(ctx.R.URL.Path, "/") && reqPkg.Submodule != "" && esm.Entry != "" {
+			url := fmt.Sprintf("%s%s/%s@%s/%s", origin, basePath, reqPkg.Name, reqPkg.Version, esm.Entry)
+			if ctx.R.URL.RawQuery != "" {
+				url += "?" + ctx.R.URL.RawQuery
+			}
+			return rex.Redirect(url, http.StatusMovedPermanently)
+		}
+
+		setCacheControl := func() {
+			if hasBuildVerPrefix && isFullVersion {
+				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			} else if hasBuildVerPrefix {
+				// the version range of the `range` deps policy resolves to the new releases
+				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
+			} else if regFullVersionPath.MatchString(pathname) {
+				if isPined {
+					if targeted {
+						ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+					} else {
+						ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+						ctx.SetHeader("Vary", "User-Agent")
+					}
+				} else {
+					ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 24*3600)) // cache for 24 hours
+					ctx.SetHeader("Vary", "User-Agent")
+				}
+			} else if pkgTag != "" {
+				ctx.SetHeader("Cache-Control", tagRefresher.CacheControl())
+				ctx.SetHeader("Vary", "User-Agent")
+			} else {
+				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60)) // cache for 10 minutes
+				ctx.SetHeader("Vary", "User-Agent")
+			}
+		}
+
+		// the metafile-derived outputs(the `?analyze` and `?output=graph`) are stored alongside the build
+		// on the first request, the build is rebuilt with the metafile
+		metafileOutput := func(read func(id string) ([]byte, bool, error), contentType string, notFound string) interface{} {
+			data, ok, err := read(taskID)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			if !ok && !esm.TypesOnly {
+				task.noCache = true
+				task.metafile = true
+				if err := canTriggerBuild(ctx, task.ID()); err != nil {
+					return unsignedBuild(ctx, task.ID(), err)
+				}
+				if retryAfter, saturated := buildQueue.Saturated(task, queueHighWater); saturated {
+					return queueSaturated(ctx, retryAfter)
+				}
+				c := buildQueue.Add(task, ctx.RemoteIP())
+				select {
+				case output := <-c.C:
+					if output.err != nil {
+						return throwErrorText(ctx, output.err)
+					}
+				case <-time.After(time.Minute):
+					buildQueue.RemoveConsumer(task, c)
+					return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try again later!")
+				}
+				data, ok, err = read(task.ID())
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+			}
+			if !ok {
+				return rex.Status(404, notFound)
+			}
+			setCacheControl()
+			ctx.SetHeader("Content-Type", contentType)
+			return data
+		}
+		if ctx.Form.Has("analyze") {
+			return metafileOutput(readBuildAnalysis, "application/json; charset=utf-8", "Analysis not found")
+		}
+
+		// serve the other artifacts of the build by the `output` query
+		switch output {
+		case "dts":
+			dts := esm.getDts(tsVersion)
+			if dts == "" {
+				return rex.Status(404, "Types not found")
+			}
+			savePath := path.Join("types", dts)
+			exists, size, modtime, err := fs.Exists(savePath)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			if !exists {
+				// the types are transformed on the first request of the types file
+				url := fmt.Sprintf("%s%s/%s", origin, basePath, strings.TrimPrefix(dts, "/"))
+				return rex.Redirect(url, http.StatusTemporaryRedirect)
+			}
+			r, err := fs.ReadFile(savePath, size)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			setCacheControl()
+			ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
+			return rex.Content(savePath, modtime, r) // auto close
+		case "meta":
+			setCacheControl()
+			return outputMeta(esm, taskID, task.Pkg, target, esm.getDts(tsVersion), origin)
+		case "map":
+			sourcemap, ok, err := readSourceMap(taskID)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			if !ok {
+				return rex.Status(404, "Source map not found")
+			}
+			setCacheControl()
+			ctx.SetHeader("Content-Type", "application/json; charset=utf-8")
+			return sourcemap
+		case "graph":
+			return metafileOutput(readBuildGraph, "text/vnd.graphviz; charset=utf-8", "Graph not found")
+		}
+
+		// the `X-TypeScript-Types` of the module, the `?dts-bundle` query advertises the types bundle
+		typesURL := func() string {
+			url := fmt.Sprintf("%s%s/%s", origin, basePath, strings.TrimPrefix(esm.getDts(tsVersion), "/"))
+			if ctx.Form.Has("dts-bundle") {
+				url += "?dts-bundle"
+			}
+			return url
+		}
+
 		if esm.TypesOnly {
 			if esm.Dts != "" && !noCheck {
-				value := fmt.Sprintf(
-					"%s%s/%s",
-					origin,
-					basePath,
-					strings.TrimPrefix(esm.Dts, "/"),
-				)
-				ctx.SetHeader("X-TypeScript-Types", value)
+				ctx.SetHeader("X-TypeScript-Types", typesURL())
 			}
 			ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
 			ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
@@ -684,68 +1476,83 @@ func query(devMode bool) rex.Handle {
 				return rex.Status(500, err.Error())
 			}
 			if !hasBuildVerPrefix && esm.Dts != "" && !noCheck && !isWorker {
-				value := fmt.Sprintf(
-					"%s%s/%s",
-					origin,
-					basePath,
-					strings.TrimPrefix(esm.Dts, "/"),
-				)
-				ctx.SetHeader("X-TypeScript-Types", value)
+				ctx.SetHeader("X-TypeScript-Types", typesURL())
+			}
+			if isFullVersion {
+				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				// the version range of the `range` deps policy resolves to the new releases
+				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
+			}
+			if ctx.Form.Has("download") {
+				return serveDownload(taskID, modtime, r)
 			}
-			ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
 			return rex.Content(savePath, modtime, r)
 		}
 
+		// download the build instead of the stub module of the package URL
+		if ctx.Form.Has("download") && !isWorker {
+			url := fmt.Sprintf("%s%s/%s?download", origin, basePath, taskID)
+			return rex.Redirect(url, http.StatusTemporaryRedirect)
+		}
+
 		buf := bytes.NewBuffer(nil)
+		importURL := fmt.Sprintf("%s%s/%s", origin, basePath, taskID)
+		if importBase != "" {
+			importURL = toImportURL(importBase, basePath+pathname, fmt.Sprintf("%s/%s", basePath, taskID))
+		}
 
 		fmt.Fprintf(buf, `/* esm.sh - %v */%s`, reqPkg, "\n")
 		if isWorker {
 			fmt.Fprintf(buf, `export default function workerFactory() {%s  return new Worker('%s/%s', { type: 'module' })%s}`, "\n", origin, taskID, "\n")
 		} else {
-			fmt.Fprintf(buf, `export * from "%s%s/%s";%s`, origin, basePath, taskID, "\n")
+			fmt.Fprintf(buf, `export * from "%s";%s`, importURL, "\n")
 			if esm.CJS || esm.ExportDefault {
-				fmt.Fprintf(
-					buf,
-					`export { default } from "%s%s/%s";%s`,
-					origin,
-					basePath,
-					taskID,
-					"\n",
-				)
+				fmt.Fprintf(buf, `export { default } from "%s";%s`, importURL, "\n")
 			}
 		}
 
 		if esm.Dts != "" && !noCheck && !isWorker {
-			value := fmt.Sprintf(
-				"%s%s/%s",
-				origin,
-				basePath,
-				strings.TrimPrefix(esm.Dts, "/"),
-			)
-			ctx.SetHeader("X-TypeScript-Types", value)
+			ctx.SetHeader("X-TypeScript-Types", typesURL())
 		}
 
-		if regFullVersionPath.MatchString(pathname) {
-			if isPined {
-				if targeted {
-					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-				} else {
-					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-					ctx.SetHeader("Vary", "User-Agent")
-				}
-			} else {
-				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 24*3600)) // cache for 24 hours
-				ctx.SetHeader("Vary", "User-Agent")
-			}
-		} else {
-			ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60)) // cache for 10 minutes
-			ctx.SetHeader("Vary", "User-Agent")
-		}
+		setCacheControl()
 		ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+		if ctx.Form.Has("download") {
+			setContentDisposition(ctx.W.Header(), taskID)
+		}
 		return buf
 	}
 }
 
+func stripIgnoredQuery(r *http.Request) {
+	if len(ignoredQueryKeys) == 0 {
+		return
+	}
+	if r.Form == nil {
+		r.ParseForm()
+	}
+	for key := range ignoredQueryKeys {
+		delete(r.Form, key)
+	}
+}
+
+// registryUnavailable returns the 503 error while the circuit of the npm registry is open
+func registryUnavailable(ctx *rex.Context) interface{} {
+	ctx.SetHeader("Retry-After", strconv.Itoa(int(registryBreaker.RetryAfter().Seconds())))
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	return rex.Status(http.StatusServiceUnavailable, errRegistryUnavailable.Error())
+}
+
+// queueSaturated sheds the build-triggering request when the build queue reached the high-water mark
+func queueSaturated(ctx *rex.Context, retryAfter time.Duration) interface{} {
+	_, waiting := buildQueue.Depth()
+	ctx.SetHeader("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	ctx.SetHeader("X-Esm-Queue-Depth", strconv.Itoa(waiting))
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	return rex.Status(http.StatusServiceUnavailable, "the build queue is saturated, please try again later")
+}
+
 func throwErrorJS(ctx *rex.Context, err error) interface{} {
 	buf := bytes.NewBuffer(nil)
 	fmt.Fprintf(buf, "/* esm.sh - error */\n")
@@ -756,7 +1563,119 @@ func throwErrorJS(ctx *rex.Context, err error) interface{} {
 		"\n",
 	)
 	fmt.Fprintf(buf, "export default null;\n")
+	status := errorStatus(ctx, err)
 	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
 	ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
-	return rex.Status(500, buf)
+	return rex.Status(status, buf)
+}
+
+// throwErrorText returns the plain text error for the outputs that are not JS modules, like the `?analyze` JSON
+func throwErrorText(ctx *rex.Context, err error) interface{} {
+	status := errorStatus(ctx, err)
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	return rex.Status(status, err.Error())
+}
+
+// errorStatus returns the status code of the error, and sets the `X-Esm-Error-Code` header of the build error
+func errorStatus(ctx *rex.Context, err error) int {
+	status := 500
+	var buildErr *BuildError
+	if errors.As(err, &buildErr) {
+		ctx.SetHeader("X-Esm-Error-Code", buildErr.Code)
+		if buildErr.Code == ErrNoEntry || buildErr.Code == ErrNotExported {
+			status = 404
+		} else if buildErr.Code == ErrOutputTooLarge {
+			status = 413
+		} else if buildErr.Code == ErrPackageDenied {
+			status = 403
+		}
+	} else if errors.Is(err, errRegistryUnavailable) {
+		ctx.SetHeader("Retry-After", strconv.Itoa(int(registryBreaker.RetryAfter().Seconds())))
+		status = http.StatusServiceUnavailable
+	}
+	return status
+}
+
+// findTypesFile returns the save path of the transformed types file of the package, the dynamic
+// types path like `lib~.d.ts` is resolved to `lib/index.d.ts` or `lib.d.ts`.
+func findTypesFile(pkg Pkg, buildVersion int, resolveArgsPrefix string) (savePath string, exists bool, size int64, modtime time.Time, err error) {
+	savePath = path.Join(fmt.Sprintf("types/v%d/%s@%s/%s", buildVersion, pkg.Name, pkg.Version, resolveArgsPrefix), pkg.Submodule)
+	if strings.HasSuffix(savePath, "~.d.ts") {
+		savePath = strings.TrimSuffix(savePath, "~.d.ts")
+		var ok bool
+		ok, _, _, err = fs.Exists(path.Join(savePath, "index.d.ts"))
+		if err != nil {
+			return
+		}
+		if ok {
+			savePath = path.Join(savePath, "index.d.ts")
+		} else {
+			savePath += ".d.ts"
+		}
+	}
+	exists, size, modtime, err = fs.Exists(savePath)
+	return
+}
+
+// getStorageType returns the storage type of the request, the `raw` files are the files in the package
+// fetching from unpkg.com, like CSS and the source maps shipped with the pre-built bundles.
+func getStorageType(reqPkg *Pkg, pathname string, hasBuildVerPrefix bool, isRaw bool) string {
+	if reqPkg.Submodule == "" {
+		return ""
+	}
+	isPackageFile := len(strings.Split(pathname, "/")) > 2
+	if isRaw && !hasBuildVerPrefix && isPackageFile {
+		return "raw"
+	}
+	switch path.Ext(pathname) {
+	case ".js":
+		if hasBuildVerPrefix {
+			return "builds"
+		}
+
+	// todo: transform ts/jsx/tsx for browser
+	case ".ts", ".jsx", ".tsx":
+		if hasBuildVerPrefix {
+			if strings.HasSuffix(pathname, ".d.ts") {
+				return "types"
+			}
+		} else if isPackageFile {
+			return "raw"
+		}
+
+	case ".txt":
+		if hasBuildVerPrefix && strings.HasSuffix(pathname, ".LEGAL.txt") {
+			return "builds"
+		}
+
+	// the source maps referenced by the `//# sourceMappingURL=` of the package files
+	case ".map":
+		if !hasBuildVerPrefix && isPackageFile {
+			return "raw"
+		}
+
+	default:
+		if rawAssetExts[path.Ext(pathname)] {
+			if hasBuildVerPrefix {
+				if strings.HasSuffix(pathname, ".css") {
+					return "builds"
+				}
+			} else if isPackageFile {
+				return "raw"
+			}
+		}
+	}
+	return ""
+}
+
+func getRawContentType(pathname string) string {
+	switch path.Ext(pathname) {
+	case ".ts":
+		return "application/typescript"
+	case ".js", ".mjs", ".cjs":
+		return "application/javascript; charset=utf-8"
+	case ".map":
+		return "application/json; charset=utf-8"
+	}
+	return ""
 }
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestPackageSourceMaps(t *testing.T) {
+	// the package ships the minified code with the source map
+	pkg := &Pkg{Name: "foo", Version: "1.0.0", Submodule: "dist/foo.min.js"}
+	code := "var foo=1;export default foo;\n//# sourceMappingURL=foo.min.js.map"
+
+	if storageType := getStorageType(pkg, "/foo@1.0.0/dist/foo.min.js", false, false); storageType != "" {
+		t.Fatalf("the submodule should be built without the raw query, got '%s'", storageType)
+	}
+	if storageType := getStorageType(pkg, "/foo@1.0.0/dist/foo.min.js", false, true); storageType != "raw" {
+		t.Fatalf("the package file should be served with the raw query, got '%s'", storageType)
+	}
+
+	// the map referenced by the raw file is resolved next to it
+	base, _ := url.Parse("https://esm.sh/foo@1.0.0/dist/foo.min.js?raw")
+	ref, _ := url.Parse(code[len("var foo=1;export default foo;\n//# sourceMappingURL="):])
+	mapURL := base.ResolveReference(ref)
+	mapPkg := &Pkg{Name: "foo", Version: "1.0.0", Submodule: "dist/foo.min.js.map"}
+	if storageType := getStorageType(mapPkg, mapURL.Path, false, false); storageType != "raw" {
+		t.Fatalf("the source map of the package should be served, got '%s'", storageType)
+	}
+	if contentType := getRawContentType(mapURL.Path); contentType != "application/json; charset=utf-8" {
+		t.Fatalf("invalid content type of the source map: %s", contentType)
+	}
+
+	// builds are not affected
+	if storageType := getStorageType(pkg, "/v87/foo@1.0.0/es2022/dist/foo.min.js", true, true); storageType != "builds" {
+		t.Fatalf("the build should not be served raw, got '%s'", storageType)
+	}
+}
+
+func TestCosmeticQuery(t *testing.T) {
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS, q *BuildQueue) {
+		log, embedFS, db, fs, buildQueue = l, e, d, f, q
+	}(log, embedFS, db, fs, buildQueue)
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	defer func(m map[string]bool) { ignoredQueryKeys = m }(ignoredQueryKeys)
+	var err error
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryLimiter = newRateLimiter(0, time.Minute)
+	// the queue without slots keeps the triggered builds waiting
+	buildQueue = newBuildQueue(0)
+	ignoredQueryKeys = map[string]bool{"v": true, "_": true}
+
+	task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022"}
+	err = fs.WriteData(path.Join("builds", task.ID()), []byte("export default 1;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put(task.ID(), "build", storage.Store{"meta": "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(url string) (int, string) {
+		res, err := client.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(data)
+	}
+
+	// the cosmetic and unknown queries get the cached build, no redirect and no new build
+	_, expected := get("/foo@1.0.0?target=es2022")
+	for _, url := range []string{
+		"/foo@1.0.0?target=es2022&v=3",
+		"/foo@1.0.0?target=es2022&_=1653068816",
+		"/foo@1.0.0?target=es2022&unknown=1",
+	} {
+		if status, code := get(url); status != 200 || code != expected {
+			t.Fatalf("%s should get the cached build, got %d: %s", url, status, code)
+		}
+	}
+	if status, _ := get("/" + task.ID() + "?v=3&unknown=1"); status != 200 {
+		t.Fatalf("the build URL with the cosmetic queries should be served, got %d", status)
+	}
+	if processing, waiting := buildQueue.Depth(); processing != 0 || waiting != 0 {
+		t.Fatalf("the cosmetic queries should not trigger the builds, got %d processing and %d waiting", processing, waiting)
+	}
+}
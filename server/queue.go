@@ -3,6 +3,7 @@ package server
 import (
 	"container/list"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -52,7 +53,10 @@ func (t *queueTask) run() BuildOutput {
 		}
 	case <-time.After(5 * time.Minute):
 		log.Errorf("build %s: timeout(%v)", t.ID(), time.Since(t.startTime))
-		output = BuildOutput{err: fmt.Errorf("build ")}
+		output = BuildOutput{err: &BuildError{ErrTimeout, fmt.Sprintf("build %s timeout", t.Pkg)}}
+	}
+	if output.err != nil && !t.noStore {
+		storeBuildError(t.ID(), output.err)
 	}
 
 	return output
@@ -107,6 +111,77 @@ func (q *BuildQueue) Add(task *BuildTask, consumerIp string) *BuildQueueConsumer
 	return c
 }
 
+// Depth returns the number of the tasks in process and the tasks waiting for a slot.
+func (q *BuildQueue) Depth() (processing int, waiting int) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	processing = len(q.processes)
+	waiting = q.list.Len() - processing
+	return
+}
+
+// Saturated reports whether the new task should be shed since the waiting tasks reached the
+// high-water mark, 0 means no limit. The task that is already in the queue is not shed since it
+// doesn't add load. The `retryAfter` is estimated by the waiting tasks per slot.
+func (q *BuildQueue) Saturated(task *BuildTask, highWater int) (retryAfter time.Duration, saturated bool) {
+	if highWater <= 0 {
+		return
+	}
+
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if _, ok := q.tasks[task.ID()]; ok {
+		return
+	}
+	waiting := q.list.Len() - len(q.processes)
+	if waiting < highWater {
+		return
+	}
+	slots := q.maxProcesses
+	if slots < 1 {
+		slots = 1
+	}
+	// about 10 seconds per build, no longer than 5 minutes
+	retryAfter = time.Duration(waiting/slots+1) * 10 * time.Second
+	if retryAfter > 5*time.Minute {
+		retryAfter = 5 * time.Minute
+	}
+	return retryAfter, true
+}
+
+// JSON returns the tasks of the queue for the `/status.json`
+func (q *BuildQueue) JSON() []map[string]interface{} {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	a := make([]map[string]interface{}, 0, q.list.Len())
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if ok {
+			m := map[string]interface{}{
+				"stage":      t.stage,
+				"createTime": t.createTime.Format(http.TimeFormat),
+				"consumers":  t.consumers,
+				"pkg":        t.Pkg.String(),
+				"target":     t.Target,
+				"inProcess":  t.inProcess,
+				"devMode":    t.DevMode,
+				"bundleMode": t.BundleMode,
+			}
+			if !t.startTime.IsZero() {
+				m["startTime"] = t.startTime.Format(http.TimeFormat)
+			}
+			if len(t.Deps) > 0 {
+				m["deps"] = t.Deps.String()
+			}
+			a = append(a, m)
+		}
+	}
+	return a
+}
+
 func (q *BuildQueue) RemoveConsumer(task *BuildTask, c *BuildQueueConsumer) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
@@ -127,6 +202,7 @@ func (q *BuildQueue) RemoveConsumer(task *BuildTask, c *BuildQueueConsumer) {
 
 func (q *BuildQueue) next() {
 	var nextTask *queueTask
+	// pick the task and take the slot in one lock, the concurrent calls can't exceed the max processes
 	q.lock.Lock()
 	if len(q.processes) < q.maxProcesses {
 		for el := q.list.Front(); el != nil; el = el.Next() {
@@ -137,17 +213,16 @@ func (q *BuildQueue) next() {
 			}
 		}
 	}
+	if nextTask != nil {
+		nextTask.inProcess = true
+		q.processes = append(q.processes, nextTask)
+	}
 	q.lock.Unlock()
 
 	if nextTask == nil {
 		return
 	}
 
-	q.lock.Lock()
-	nextTask.inProcess = true
-	q.processes = append(q.processes, nextTask)
-	q.lock.Unlock()
-
 	go q.wait(nextTask)
 }
 
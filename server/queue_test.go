@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestBuildQueueConcurrency(t *testing.T) {
+	defer func(d storage.DB, f storage.FS) {
+		db, fs = d, f
+	}(db, fs)
+	var err error
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the built types tasks, they are found in the db without installing
+	tasks := make([]*BuildTask, 20)
+	for i := range tasks {
+		task := &BuildTask{
+			BuildVersion: VERSION,
+			Pkg:          Pkg{Name: fmt.Sprintf("foo-%d", i), Version: "1.0.0"},
+			External:     newStringSet(),
+			Target:       "types",
+			stage:        "-",
+		}
+		err = fs.WriteData(path.Join("builds", task.ID()), []byte("export default null;\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.storeToDB(&ModuleMeta{TypesOnly: true})
+		tasks[i] = task
+	}
+
+	q := newBuildQueue(2)
+	var exceeded int32
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if processing, _ := q.Depth(); processing > 2 {
+					atomic.StoreInt32(&exceeded, 1)
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task *BuildTask) {
+			defer wg.Done()
+			output := <-q.Add(task, "127.0.0.1").C
+			if output.err != nil {
+				t.Error(output.err)
+			}
+		}(task)
+	}
+	wg.Wait()
+	close(done)
+
+	if atomic.LoadInt32(&exceeded) == 1 {
+		t.Fatal("the queue should not process more than 2 tasks at the same time")
+	}
+	if processing, waiting := q.Depth(); processing != 0 || waiting != 0 {
+		t.Fatalf("the queue should be empty, got %d processing and %d waiting", processing, waiting)
+	}
+}
+
+type testEmbedFS struct{}
+
+func (testEmbedFS) ReadFile(name string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+func TestBuildQueueSaturated(t *testing.T) {
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS, q *BuildQueue) {
+		log, embedFS, db, fs, buildQueue = l, e, d, f, q
+	}(log, embedFS, db, fs, buildQueue)
+	var err error
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	registryLimiter = newRateLimiter(0, time.Minute)
+	// the queue without slots keeps all the tasks waiting
+	buildQueue = newBuildQueue(0)
+	defer func(n int) { queueHighWater = n }(queueHighWater)
+	queueHighWater = 2
+	for i := 0; i < 2; i++ {
+		buildQueue.Add(&BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: fmt.Sprintf("foo-%d", i), Version: "1.0.0"}, Target: "es2022"}, "")
+	}
+	waiting := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "foo-0", Version: "1.0.0"}, Target: "es2022"}
+	if _, saturated := buildQueue.Saturated(waiting, queueHighWater); saturated {
+		t.Fatal("the task in the queue should not be shed")
+	}
+	if _, saturated := buildQueue.Saturated(waiting, 0); saturated {
+		t.Fatal("the queue without the high-water mark should not be saturated")
+	}
+
+	// the cached build
+	err = fs.WriteData(fmt.Sprintf("builds/v%d/hit@1.0.0/es2022/hit.js", VERSION), []byte("export default 1;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/v%d/hit@1.0.0/es2022/hit.js", server.URL, VERSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("the cached build should be served, got %d", res.StatusCode)
+	}
+
+	res, err = http.Get(fmt.Sprintf("%s/v%d/miss@1.0.0/es2022/miss.js", server.URL, VERSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("the build-triggering request should be shed, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Retry-After") != "30" || res.Header.Get("X-Esm-Queue-Depth") != "2" {
+		t.Fatalf("invalid headers of the shed request: %v", res.Header)
+	}
+	if processing, waiting := buildQueue.Depth(); processing != 0 || waiting != 2 {
+		t.Fatalf("the shed request should not be queued, got %d processing and %d waiting", processing, waiting)
+	}
+
+	// the split builds go through the build queue too, and the resolve args are refused
+	for url, status := range map[string]int{
+		"/foo@1.0.0?entry-points=a.js,b.js":               http.StatusServiceUnavailable,
+		"/foo@1.0.0?entry-points=a.js&alias=react:preact": http.StatusBadRequest,
+		"/foo@1.0.0?entry-points=a.js&deps=react@18.2.0":  http.StatusBadRequest,
+		"/foo@1.0.0?entry-points=a.js&external=react":     http.StatusBadRequest,
+	} {
+		res, err = http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s: expected %d, got %d", url, status, res.StatusCode)
+		}
+	}
+	if processing, waiting := buildQueue.Depth(); processing != 0 || waiting != 2 {
+		t.Fatalf("the shed split build should not be queued, got %d processing and %d waiting", processing, waiting)
+	}
+}
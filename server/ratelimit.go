@@ -0,0 +1,58 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// A fixed-window rate limiter keyed by client IP
+type rateLimiter struct {
+	lock    sync.Mutex
+	limit   int
+	window  time.Duration
+	buckets map[string]*rateLimitBucket
+}
+
+type rateLimitBucket struct {
+	count   int
+	resetAt time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: map[string]*rateLimitBucket{},
+	}
+}
+
+// Allow reports whether the key can make one more request in current window,
+// a limiter with zero limit allows all requests.
+func (l *rateLimiter) Allow(key string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok || now.After(b.resetAt) {
+		// drop expired buckets to avoid the map growing forever
+		if len(l.buckets) > 10000 {
+			for k, v := range l.buckets {
+				if now.After(v.resetAt) {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &rateLimitBucket{resetAt: now.Add(l.window)}
+		l.buckets[key] = b
+	}
+	if b.count >= l.limit {
+		return false
+	}
+	b.count++
+	return true
+}
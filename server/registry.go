@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// http client for the npm registry metadata calls, the tarball downloads are not using it.
+// it's replaced by the `-registry-pool-size` and the `-registry-timeout` flags.
+var registryClient = newRegistryClient(16, 30*time.Second)
+
+// latency and errors of the npm registry calls, reported in the `/status.json`
+var registryStats = &RegistryStats{}
+
+func newRegistryClient(poolSize int, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{Timeout: 15 * time.Second}).Dial,
+			// a slow registry can't hold more connections than the pool size
+			MaxConnsPerHost:     poolSize,
+			MaxIdleConnsPerHost: poolSize,
+			IdleConnTimeout:     90 * time.Second,
+			Proxy:               http.ProxyFromEnvironment,
+		},
+		Timeout: timeout,
+	}
+}
+
+type RegistryStats struct {
+	calls   int64
+	errors  int64
+	latency int64 // total nanoseconds
+}
+
+func (s *RegistryStats) record(start time.Time, resp *http.Response, err error) {
+	atomic.AddInt64(&s.calls, 1)
+	atomic.AddInt64(&s.latency, int64(time.Since(start)))
+	if err != nil || resp.StatusCode >= 500 {
+		atomic.AddInt64(&s.errors, 1)
+	}
+}
+
+// JSON returns the stats for the `/status.json`
+func (s *RegistryStats) JSON() map[string]interface{} {
+	calls := atomic.LoadInt64(&s.calls)
+	m := map[string]interface{}{
+		"calls":  calls,
+		"errors": atomic.LoadInt64(&s.errors),
+	}
+	if calls > 0 {
+		m["avgLatency"] = time.Duration(atomic.LoadInt64(&s.latency) / calls).String()
+	}
+	return m
+}
+
+// fetchRegistry sends the request to the npm registry with the registry client,
+// it fails fast with `errRegistryUnavailable` while the circuit is open.
+func fetchRegistry(req *http.Request) (resp *http.Response, err error) {
+	if !registryBreaker.Allow() {
+		return nil, errRegistryUnavailable
+	}
+	start := time.Now()
+	resp, err = registryClient.Do(req)
+	registryStats.record(start, resp, err)
+	registryBreaker.Record(err == nil && resp.StatusCode < 500)
+	return
+}
+
+// the registries can be picked by the `X-Esm-Registry` request header, set by the `-registry-header` flag.
+// the builds of the picked registry are stored with the `.rg-` hash of the registry in the build id.
+var headerRegistries = map[string]bool{}
+
+// normalizeRegistryURL validates the registry URL and appends the tailing slash
+func normalizeRegistryURL(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid registry url '%s'", rawURL)
+	}
+	return strings.TrimRight(u.String(), "/") + "/", nil
+}
+
+// requestRegistry returns the registry of the `X-Esm-Registry` request header if it's allowed
+func requestRegistry(header string) (registry string, ok bool) {
+	if header == "" || len(headerRegistries) == 0 {
+		return
+	}
+	registry, err := normalizeRegistryURL(header)
+	if err != nil || !headerRegistries[registry] {
+		return "", false
+	}
+	return registry, true
+}
+
+// registryHash returns the hash of the registry in the build id, empty for the default registry
+func registryHash(registry string) string {
+	if registry == "" || (node != nil && registry == node.npmRegistry) {
+		return ""
+	}
+	h := sha1.Sum([]byte(registry))
+	return hex.EncodeToString(h[:])[:10]
+}
+
+// lookupHashRegistry returns the allowed registry of the hash in the build id
+func lookupHashRegistry(hash string) (string, bool) {
+	for registry := range headerRegistries {
+		if registryHash(registry) == hash {
+			return registry, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestRequestRegistry(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"https://registry.npmmirror.com":    "https://registry.npmmirror.com/",
+		"http://localhost:4873/":            "http://localhost:4873/",
+		"https://npm.example.com/verdaccio": "https://npm.example.com/verdaccio/",
+		"registry.npmjs.org":                "",
+		"ftp://registry.npmjs.org":          "",
+	} {
+		registry, err := normalizeRegistryURL(rawURL)
+		if expected == "" {
+			if err == nil {
+				t.Fatalf("'%s' should be an invalid registry", rawURL)
+			}
+			continue
+		}
+		if err != nil || registry != expected {
+			t.Fatalf("normalizeRegistryURL(%s) should be '%s', got '%s' (%v)", rawURL, expected, registry, err)
+		}
+	}
+
+	if _, ok := requestRegistry("http://localhost:4873"); ok {
+		t.Fatal("the header should be ignored without the allowed registries")
+	}
+	headerRegistries = map[string]bool{"http://localhost:4873/": true}
+	defer func() { headerRegistries = map[string]bool{} }()
+	if registry, ok := requestRegistry("http://localhost:4873"); !ok || registry != "http://localhost:4873/" {
+		t.Fatalf("the allowed registry should be picked, got '%s'", registry)
+	}
+	if _, ok := requestRegistry("https://evil.example.com/"); ok {
+		t.Fatal("the registry is not allowed")
+	}
+}
+
+func TestRegistryMetadata(t *testing.T) {
+	newRegistry := func(version string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.EscapedPath() {
+			case "/-/package/foo/dist-tags":
+				fmt.Fprintf(w, `{"latest":"%s"}`, version)
+			case "/foo":
+				fmt.Fprintf(w, `{"dist-tags":{"latest":"%s"},"versions":{"%s":{"name":"foo","version":"%s"}}}`, version, version, version)
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	}
+	defaultRegistry := newRegistry("1.0.0")
+	defer defaultRegistry.Close()
+	mirror := newRegistry("1.0.1")
+	defer mirror.Close()
+
+	var err error
+	defer func(c storage.Cache) { cache = c }(cache)
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(n *Node) { node = n }(node)
+	node = &Node{npmRegistry: defaultRegistry.URL + "/"}
+
+	// the metadata of the picked registry is fetched from the registry and cached apart
+	for i := 0; i < 2; i++ {
+		for registry, expected := range map[string]string{"": "1.0.0", mirror.URL + "/": "1.0.1"} {
+			pkg, _, err := parsePkgFrom(registry, "foo")
+			if err != nil || pkg.Version != expected {
+				t.Fatalf("the version of the registry '%s' should be %s, got %v (%v)", registry, expected, pkg, err)
+			}
+			version, err := resolveDistTag(registry, "foo", "latest")
+			if err != nil || version != expected {
+				t.Fatalf("the dist tag of the registry '%s' should be %s, got %s (%v)", registry, expected, version, err)
+			}
+		}
+	}
+	if packageInfoID("", "foo", "latest") != "npm:foo@latest" || packageInfoID(node.npmRegistry, "foo", "latest") != "npm:foo@latest" {
+		t.Fatal("the cache id of the default registry should not be changed")
+	}
+	if id := packageInfoID(mirror.URL+"/", "foo", "latest"); id != "npm:"+mirror.URL+"/foo@latest" {
+		t.Fatalf("the cache id should have the registry: %s", id)
+	}
+}
+
+func TestRegistryBuildID(t *testing.T) {
+	defer func(n *Node) { node = n }(node)
+	node = &Node{npmRegistry: "https://registry.npmjs.org/"}
+	defer func(m map[string]bool) { headerRegistries = m }(headerRegistries)
+	headerRegistries = map[string]bool{"https://npm.example.com/": true}
+
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	id := computeBuildID(pkg, newTestBuildOptions())
+	o := newTestBuildOptions()
+	o.registry = node.npmRegistry
+	if computeBuildID(pkg, o) != id {
+		t.Fatal("the default registry should not be in the build id")
+	}
+
+	// the builds of the picked registry are not shared with the default registry
+	o.registry = "https://npm.example.com/"
+	rg := registryHash(o.registry)
+	if rgID := computeBuildID(pkg, o); rgID == id || !strings.Contains(rgID, ".rg-"+rg) {
+		t.Fatalf("the build id should have the hash of the registry, got %s", rgID)
+	}
+	if registry, ok := lookupHashRegistry(rg); !ok || registry != o.registry {
+		t.Fatalf("the registry of the hash should be found, got '%s'", registry)
+	}
+	if _, ok := lookupHashRegistry(registryHash("https://evil.example.com/")); ok {
+		t.Fatal("the registry not allowed should not be found")
+	}
+
+	// the bare build URL of an unknown registry hash is refused
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS) {
+		log, embedFS, db, fs = l, e, d, f
+	}(log, embedFS, db, fs)
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	var err error
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryLimiter = newRateLimiter(0, time.Minute)
+	o = &BuildTask{BuildVersion: VERSION, Pkg: pkg, Target: "es2022", registry: "https://npm.example.com/"}
+	err = fs.WriteData(path.Join("builds", o.ID()), []byte("export default 1;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+	for url, status := range map[string]int{
+		"/" + o.ID(): 200,
+		"/" + strings.Replace(o.ID(), ".rg-"+rg, ".rg-"+registryHash("https://evil.example.com/"), 1): 404,
+	} {
+		res, err := http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s: expected %d, got %d", url, status, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+// SearchResult defines the compact result of the `/-/search` endpoint
+type SearchResult struct {
+	Total    int             `json:"total"`
+	Packages []SearchPackage `json:"packages"`
+}
+
+// SearchPackage defines a package in the search result
+type SearchPackage struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Description string   `json:"description,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+	Date        string   `json:"date,omitempty"`
+	Homepage    string   `json:"homepage,omitempty"`
+	Repository  string   `json:"repository,omitempty"`
+	Score       float64  `json:"score"`
+}
+
+// the response of `GET /-/v1/search` of npm registry
+type npmSearchResult struct {
+	Total   int `json:"total"`
+	Objects []struct {
+		Package struct {
+			Name        string            `json:"name"`
+			Version     string            `json:"version"`
+			Description string            `json:"description"`
+			Keywords    []string          `json:"keywords"`
+			Date        string            `json:"date"`
+			Links       map[string]string `json:"links"`
+		} `json:"package"`
+		Score struct {
+			Final float64 `json:"final"`
+		} `json:"score"`
+	} `json:"objects"`
+}
+
+func searchPackages(text string, size int) (ret *SearchResult, err error) {
+	id := fmt.Sprintf("search:%s?size=%d", text, size)
+	data, err := cache.Get(id)
+	if err == nil && json.Unmarshal(data, &ret) == nil {
+		return
+	}
+	if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
+		log.Error("cache:", err)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s-/v1/search?text=%s&size=%d", node.npmRegistry, url.QueryEscape(text), size), nil)
+	if err != nil {
+		return
+	}
+	// scoped packages may be private, use the auth token of the registry
+	if node.npmToken != "" && strings.HasPrefix(text, "@") {
+		req.Header.Set("Authorization", "Bearer "+node.npmToken)
+	}
+
+	start := time.Now()
+	resp, err := fetchRegistry(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("npm: search '%s' failed (%s)", text, resp.Status)
+		return
+	}
+
+	var h npmSearchResult
+	err = json.NewDecoder(resp.Body).Decode(&h)
+	if err != nil {
+		return
+	}
+
+	ret = &SearchResult{
+		Total:    h.Total,
+		Packages: make([]SearchPackage, len(h.Objects)),
+	}
+	for i, o := range h.Objects {
+		ret.Packages[i] = SearchPackage{
+			Name:        o.Package.Name,
+			Version:     o.Package.Version,
+			Description: o.Package.Description,
+			Keywords:    o.Package.Keywords,
+			Date:        o.Package.Date,
+			Homepage:    o.Package.Links["homepage"],
+			Repository:  o.Package.Links["repository"],
+			Score:       o.Score.Final,
+		}
+	}
+
+	log.Debugf("search packages(%s) in %v", text, time.Since(start))
+
+	cache.Set(id, utils.MustEncodeJSON(ret), 5*time.Minute)
+	return
+}
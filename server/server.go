@@ -11,12 +11,14 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"esm.sh/server/storage"
 
 	logx "github.com/ije/gox/log"
+	"github.com/ije/gox/utils"
 	"github.com/ije/rex"
 )
 
@@ -25,6 +27,7 @@ var (
 	db         storage.DB
 	fs         storage.FS
 	buildQueue *BuildQueue
+	dtsQueue   *BuildQueue // the queue of the types transforms, separated from the build queue
 	log        *logx.Logger
 	node       *Node
 	embedFS    EmbedFS
@@ -39,10 +42,30 @@ var (
 	denoStdVersion string
 	// npm registry
 	npmRegistry string
+	// auth token for the npm registry
+	npmToken string
 	// server origin
 	origin string
+	// base of the rewritten import URLs, empty means the server-absolute path
+	importBase string
 	// unpkg.com origin
 	unpkgOrigin string
+	// token for the admin endpoints
+	adminToken string
+	// the default policy of rewriting dependency versions: `exact` or `range`
+	defaultDepsPolicy string
+	// the high-water mark of the waiting build tasks, the build-triggering requests are shed over it, 0 means no limit
+	queueHighWater int
+	// rate limiter for endpoints that touch the npm registry
+	registryLimiter *rateLimiter
+	// serve tag URLs in place instead of redirecting, nil if it's disabled
+	tagRefresher *TagRefresher
+	// redirect the directory-style requests to the canonical file URLs
+	dirRedirect bool
+	// how long the failed builds are cached, 0 means never
+	buildErrorTTL time.Duration
+	// how long the registry metadata of tags and semver ranges are cached in the db
+	registryCacheTTL time.Duration
 )
 
 type EmbedFS interface {
@@ -50,11 +73,33 @@ type EmbedFS interface {
 }
 
 // Serve serves ESM server
+// the response headers that the cross-origin clients can read
+var corsExposedHeaders = []string{
+	"Retry-After",
+	"X-Esm-Asset-Warning",
+	"X-Esm-Build-Defaults",
+	"X-Esm-Build-Id",
+	"X-Esm-Build-Options",
+	"X-Esm-Engine-Warning",
+	"X-Esm-Entry",
+	"X-Esm-Error-Code",
+	"X-Esm-Export-Warning",
+	"X-Esm-Minify",
+	"X-Esm-Node-Env",
+	"X-Esm-Optional",
+	"X-Esm-Path",
+	"X-Esm-Peer-Deps",
+	"X-Esm-Queue-Depth",
+	"X-Esm-Registry",
+	"X-TypeScript-Types",
+}
+
 func Serve(efs EmbedFS) {
 	var (
 		port             int
 		httpsPort        int
 		buildConcurrency int
+		dtsConcurrency   int
 		etcDir           string
 		cacheUrl         string
 		dbUrl            string
@@ -63,6 +108,21 @@ func Serve(efs EmbedFS) {
 		logDir           string
 		noCompress       bool
 		isDev            bool
+		registryRate     int
+		ignoreQuery      string
+		tagInPlace       bool
+		tagRefresh       time.Duration
+		tagSWR           time.Duration
+		registryPoolSize int
+		registryTimeout  time.Duration
+		breakerThreshold int
+		breakerWindow    time.Duration
+		breakerCooldown  time.Duration
+		registryHeader   string
+		maxOutputSizeStr string
+		inlineLimitStr   string
+		precompress      string
+		trustedProxyStr  string
 	)
 	flag.IntVar(&port, "port", 80, "http server port")
 	flag.IntVar(&httpsPort, "https-port", 0, "https(autotls) server port, default is disabled")
@@ -73,13 +133,45 @@ func Serve(efs EmbedFS) {
 	flag.StringVar(&dbUrl, "db", "", "database config, default is 'postdb:[etc-dir]/esm.db'")
 	flag.StringVar(&fsUrl, "fs", "", "filesystem config, default is 'local:[etc-dir]/storage'")
 	flag.IntVar(&buildConcurrency, "build-concurrency", runtime.NumCPU(), "maximum number of concurrent build task")
+	flag.IntVar(&dtsConcurrency, "dts-concurrency", runtime.NumCPU(), "maximum number of concurrent types(.d.ts) transform task, separated from the build tasks")
+	flag.IntVar(&prewarmTop, "prewarm-top", 0, "number of the most-requested builds that are re-verified on disk and pre-warmed on startup by the persisted access stats, 0 disables it")
+	flag.IntVar(&queueHighWater, "queue-high-water", 0, "maximum number of the waiting build tasks, the requests that trigger new builds get the 503 error with the 'Retry-After' header over it while the cached builds are still served, 0 means no limit")
+	flag.IntVar(&depsGraphMaxDepth, "deps-graph-max-depth", 32, "maximum depth of walking the dependency graph for the import map, the manifest and the 'graph' deps policy, 0 means no limit")
+	flag.IntVar(&depsGraphMaxNodes, "deps-graph-max-nodes", 1000, "maximum number of the packages of the dependency graph, the graph over the limits is truncated, 0 means no limit")
+	flag.DurationVar(&buildErrorTTL, "build-error-ttl", time.Hour, "how long the known build errors(native addon, no entry, unresolvable dependency, timeout) are cached, 0 means never")
+	flag.StringVar(&maxOutputSizeStr, "max-output-size", "50MB", "maximum size of the build output, the larger builds are not stored and get the 413 error, 0 means no limit")
+	flag.StringVar(&inlineLimitStr, "css-inline-limit", "8KB", "maximum size of the fonts and images of the package CSS that are inlined as data URLs in the '?css-bundle-assets=url' mode")
+	flag.StringVar(&precompress, "precompress", "zstd,br,gzip", "encodings of the precompressed variants of the builds, separated by commas, 'none' disables the precompression")
+	flag.StringVar(&enginesPolicy, "engines", "warn", "policy of the packages that the 'engines.node' is not satisfied by the node version: 'warn' returns the mismatch in the 'X-Esm-Engine-Warning' header, 'error' refuses to build them, 'ignore' skips the check")
 	flag.StringVar(&logDir, "log-dir", "", "log dir")
 	flag.StringVar(&logLevel, "log-level", "info", "log level")
 	flag.BoolVar(&noCompress, "no-compress", false, "disable compression for text content")
 	flag.BoolVar(&isDev, "dev", false, "run server in development mode")
-	flag.StringVar(&npmRegistry, "npm-registry", "", "npm registry")
+	flag.StringVar(&npmRegistry, "registry", "", "the default npm registry url for all fetches, default is the 'npm config get registry'")
+	flag.StringVar(&npmRegistry, "npm-registry", "", "alias of the '-registry' flag")
+	flag.StringVar(&registryHeader, "registry-header", "", "registry urls that can be picked by the 'X-Esm-Registry' request header, separated by commas, the header is ignored if it's empty")
+	flag.StringVar(&npmToken, "npm-token", os.Getenv("NPM_TOKEN"), "auth token for the npm registry")
+	flag.IntVar(&registryPoolSize, "registry-pool-size", 16, "maximum number of connections to the npm registry for the metadata calls")
+	flag.DurationVar(&registryTimeout, "registry-timeout", 30*time.Second, "timeout of a npm registry metadata call")
+	flag.IntVar(&breakerThreshold, "registry-breaker-threshold", 20, "number of the npm registry failures within the window to open the circuit, 0 disables the circuit breaker")
+	flag.DurationVar(&breakerWindow, "registry-breaker-window", time.Minute, "window of counting the npm registry failures")
+	flag.DurationVar(&breakerCooldown, "registry-breaker-cooldown", 30*time.Second, "cooldown of the open circuit before probing the npm registry")
+	flag.DurationVar(&registryCacheTTL, "registry-cache-ttl", 5*time.Minute, "how long the registry metadata of tags and semver ranges are cached in the db, 0 means no db cache")
+	flag.IntVar(&registryRate, "registry-rate-limit", 60, "maximum requests per minute per client for endpoints that touch the npm registry, 0 means no limit")
 	flag.StringVar(&origin, "origin", "", "the server origin, default is the request host")
+	flag.StringVar(&trustedProxyStr, "trusted-proxies", "", "IPs or CIDRs of the proxies that the 'X-Forwarded-Host' and 'X-Forwarded-Proto' headers are trusted from for the origin of the rewritten URLs, separated by commas")
+	flag.StringVar(&importBase, "import-base", "", "base of the rewritten import URLs: a path prefix('/esm'), a full URL('https://cdn.example.com/esm') or './' for relative imports, default is the server-absolute path")
 	flag.StringVar(&unpkgOrigin, "unpkg-origin", "https://unpkg.com/", "unpkg.com origin")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ESM_ADMIN_TOKEN"), "token for the admin endpoints, the admin endpoints are disabled if it's empty")
+	flag.StringVar(&buildSigningKey, "build-signing-key", os.Getenv("ESM_BUILD_SIGNING_KEY"), "secret key of the signed URLs that are required to trigger new builds, the cache hits are always public, disabled if it's empty")
+	flag.BoolVar(&tagInPlace, "tag-in-place", false, "serve tag URLs(like '/react@next') in place instead of redirecting to the pinned version")
+	flag.DurationVar(&tagRefresh, "tag-refresh-interval", 10*time.Minute, "interval to re-check the dist tags are served in place, 0 means never")
+	flag.DurationVar(&tagSWR, "tag-swr", time.Hour, "stale-while-revalidate window of the tags are served in place, 0 disables the revalidation on requests")
+	flag.StringVar(&exportsEnforcement, "exports-enforcement", "loose", "enforcement of the 'exports' of package.json for the subpaths that are not exported: 'strict' follows node that they are not found unless the '?deep-import' query is set, 'loose' serves the physical files with a deprecation warning")
+	flag.StringVar(&binaryLoader, "binary-loader", "error", "default loader policy of the '.node' native addons and the binary imports: 'empty' stubs them, 'file' serves them by the raw passthrough, 'error' fails the build")
+	flag.StringVar(&defaultDepsPolicy, "deps-policy", "exact", "default policy of rewriting dependency versions: 'exact' pins the resolved versions at build time, 'range' keeps the declared ranges, 'graph' pins the versions collapsed by the dependency graph of the requested package")
+	flag.BoolVar(&dirRedirect, "dir-redirect", false, "redirect the directory-style requests(like '/pkg@1.0.0/lib/') to the canonical file URLs of the index entries")
+	flag.StringVar(&ignoreQuery, "ignore-query", "v,_", "cosmetic query keys that don't affect the build, separated by commas")
 
 	flag.Parse()
 
@@ -103,6 +195,79 @@ func Serve(efs EmbedFS) {
 		logDir = path.Join(etcDir, "log")
 	}
 
+	maxOutputSize, err = utils.ParseBytes(maxOutputSizeStr)
+	if err != nil {
+		fmt.Printf("bad max output size '%s'\n", maxOutputSizeStr)
+		os.Exit(1)
+	}
+
+	cssInlineLimit, err = utils.ParseBytes(inlineLimitStr)
+	if err != nil {
+		fmt.Printf("bad css inline limit '%s'\n", inlineLimitStr)
+		os.Exit(1)
+	}
+
+	precompressEncodings, err = parsePrecompressEncodings(precompress)
+	if err != nil {
+		fmt.Printf("bad precompress: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !isValidEnginesPolicy(enginesPolicy) {
+		fmt.Printf("invalid engines policy '%s'\n", enginesPolicy)
+		os.Exit(1)
+	}
+
+	if !isValidDepsPolicy(defaultDepsPolicy) {
+		fmt.Printf("invalid deps policy '%s'\n", defaultDepsPolicy)
+		os.Exit(1)
+	}
+
+	trustedProxies, err = parseTrustedProxies(trustedProxyStr)
+	if err != nil {
+		fmt.Printf("bad trusted proxies: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !binaryLoaderModes[binaryLoader] {
+		fmt.Printf("invalid binary loader '%s'\n", binaryLoader)
+		os.Exit(1)
+	}
+
+	if !exportsEnforcementModes[exportsEnforcement] {
+		fmt.Printf("invalid exports enforcement '%s'\n", exportsEnforcement)
+		os.Exit(1)
+	}
+
+	if npmRegistry != "" {
+		npmRegistry, err = normalizeRegistryURL(npmRegistry)
+		if err != nil {
+			fmt.Printf("bad registry: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	for _, v := range strings.Split(registryHeader, ",") {
+		if strings.TrimSpace(v) != "" {
+			registry, err := normalizeRegistryURL(v)
+			if err != nil {
+				fmt.Printf("bad registry header: %v\n", err)
+				os.Exit(1)
+			}
+			headerRegistries[registry] = true
+		}
+	}
+
+	for _, key := range strings.Split(ignoreQuery, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			if buildQueryKeys[key] {
+				fmt.Printf("can't ignore the build query '%s'\n", key)
+				os.Exit(1)
+			}
+			ignoredQueryKeys[key] = true
+		}
+	}
+
 	if isDev {
 		logLevel = "debug"
 		cwd, err := os.Getwd()
@@ -157,7 +322,42 @@ func Serve(efs EmbedFS) {
 		log.Fatalf("init storage(fs,%s): %v", fsUrl, err)
 	}
 
+	// the access stats are restored before serving, the top builds are pre-warmed in background
+	if builds := restoreAccessStats(prewarmTop); len(builds) > 0 {
+		go func() {
+			warmed, missing := prewarmBuilds(builds)
+			log.Infof("prewarm %d builds, %d missing", warmed, len(missing))
+		}()
+	}
+	go cron(5*time.Minute, persistAccessStats)
+
+	pkgOverrides, err = loadPackageOverrides(path.Join(etcDir, "overrides.json"))
+	if err != nil {
+		log.Fatalf("load package overrides: %v", err)
+	}
+
+	buildDefaults, err = loadBuildDefaults(path.Join(etcDir, "build-defaults.json"))
+	if err != nil {
+		log.Fatalf("load build defaults: %v", err)
+	}
+
+	pkgAccess, err = loadPackageAccess(path.Join(etcDir, "access.json"))
+	if err != nil {
+		log.Fatalf("load package access: %v", err)
+	}
+
 	buildQueue = newBuildQueue(buildConcurrency)
+	dtsQueue = newBuildQueue(dtsConcurrency)
+	registryLimiter = newRateLimiter(registryRate, time.Minute)
+	registryClient = newRegistryClient(registryPoolSize, registryTimeout)
+	registryBreaker = newCircuitBreaker(breakerThreshold, breakerWindow, breakerCooldown)
+
+	if tagInPlace {
+		tagRefresher = newTagRefresher(tagRefresh, tagSWR, buildConcurrency)
+		if tagRefresh > 0 {
+			go cron(tagRefresh, tagRefresher.refresh)
+		}
+	}
 
 	var accessLogger *logx.Logger
 	if logDir == "" {
@@ -200,9 +400,10 @@ func Serve(efs EmbedFS) {
 			AllowedOrigins: []string{"*"},
 			AllowedMethods: []string{
 				http.MethodGet,
+				http.MethodPost,
 			},
 			AllowedHeaders:   []string{"*"},
-			ExposedHeaders:   []string{"X-TypeScript-Types"},
+			ExposedHeaders:   corsExposedHeaders,
 			AllowCredentials: false,
 		}),
 		query(isDev),
@@ -233,6 +434,7 @@ func Serve(efs EmbedFS) {
 	}
 
 	// release resources
+	persistAccessStats()
 	db.Close()
 	log.FlushBuffer()
 	accessLogger.FlushBuffer()
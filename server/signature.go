@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+var (
+	errMissingSignature = errors.New("the build requires a signed URL")
+	errInvalidSignature = errors.New("invalid signature")
+	errExpiredSignature = errors.New("the signature is expired")
+)
+
+// the secret key of the build signatures, set by the `-build-signing-key` flag, the requests that
+// trigger new builds require the `?sig` signed by it, the cache hits are always public.
+var buildSigningKey string
+
+// signBuildID returns the hex-encoded HMAC-SHA256 signature of the build id, the `exp` is the unix
+// time in seconds that the signature expires, empty means it never expires.
+func signBuildID(key string, id string, exp string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(id + "\n" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyBuildSignature verifies the `?sig` and the `?exp` of the build-triggering request
+func verifyBuildSignature(key string, id string, sig string, exp string, now time.Time) error {
+	if sig == "" {
+		return errMissingSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(signBuildID(key, id, exp))) {
+		return errInvalidSignature
+	}
+	if exp != "" {
+		t, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return errInvalidSignature
+		}
+		if now.Unix() > t {
+			return errExpiredSignature
+		}
+	}
+	return nil
+}
+
+// canTriggerBuild checks whether the request can trigger the new build of the id, the admins
+// bypass the signature check.
+func canTriggerBuild(ctx *rex.Context, id string) error {
+	if buildSigningKey == "" || isAdmin(ctx) {
+		return nil
+	}
+	return verifyBuildSignature(buildSigningKey, id, ctx.Form.Value("sig"), ctx.Form.Value("exp"), time.Now())
+}
+
+// unsignedBuild refuses the build-triggering request that is not signed
+func unsignedBuild(ctx *rex.Context, id string, err error) interface{} {
+	ctx.SetHeader("X-Esm-Build-Id", id)
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	return rex.Status(403, err.Error())
+}
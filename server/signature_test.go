@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+	"github.com/ije/rex"
+)
+
+func TestVerifyBuildSignature(t *testing.T) {
+	id := fmt.Sprintf("v%d/react@18.2.0/es2022/react.js", VERSION)
+	now := time.Now()
+	exp := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+
+	// the valid signatures
+	if err := verifyBuildSignature("secret", id, signBuildID("secret", id, ""), "", now); err != nil {
+		t.Fatalf("the signature without expiration should be valid: %v", err)
+	}
+	if err := verifyBuildSignature("secret", id, signBuildID("secret", id, exp), exp, now); err != nil {
+		t.Fatalf("the signature before the expiration should be valid: %v", err)
+	}
+
+	// the invalid signatures
+	for name, sig := range map[string]string{
+		"wrong key":    signBuildID("other", id, exp),
+		"wrong id":     signBuildID("secret", id+".map", exp),
+		"without exp":  signBuildID("secret", id, ""),
+		"malformed":    "not-a-signature",
+		"wrong format": signBuildID("secret", id, exp)[1:],
+	} {
+		if err := verifyBuildSignature("secret", id, sig, exp, now); err != errInvalidSignature {
+			t.Fatalf("the signature of %s should be invalid, got %v", name, err)
+		}
+	}
+	if err := verifyBuildSignature("secret", id, signBuildID("secret", id, "soon"), "soon", now); err != errInvalidSignature {
+		t.Fatalf("the malformed expiration should be invalid, got %v", err)
+	}
+	if err := verifyBuildSignature("secret", id, "", "", now); err != errMissingSignature {
+		t.Fatalf("the unsigned request should be refused, got %v", err)
+	}
+
+	// the expired signature
+	if err := verifyBuildSignature("secret", id, signBuildID("secret", id, exp), exp, now.Add(2*time.Hour)); err != errExpiredSignature {
+		t.Fatalf("the signature should be expired, got %v", err)
+	}
+}
+
+func TestSignedBuildURL(t *testing.T) {
+	defer func(l *logx.Logger, e EmbedFS, d storage.DB, f storage.FS, q *BuildQueue) {
+		log, embedFS, db, fs, buildQueue = l, e, d, f, q
+	}(log, embedFS, db, fs, buildQueue)
+	var err error
+	log = &logx.Logger{}
+	embedFS = testEmbedFS{}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(l *rateLimiter) { registryLimiter = l }(registryLimiter)
+	registryLimiter = newRateLimiter(0, time.Minute)
+	defer func(k string) { buildSigningKey = k }(buildSigningKey)
+	buildSigningKey = "secret"
+	// the saturated queue sheds the signed miss instead of building it
+	buildQueue = newBuildQueue(0)
+	defer func(n int) { queueHighWater = n }(queueHighWater)
+	queueHighWater = 1
+	buildQueue.Add(&BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022"}, "")
+
+	err = fs.WriteData(fmt.Sprintf("builds/v%d/hit@1.0.0/es2022/hit.js", VERSION), []byte("export default 1;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &rex.Handler{}
+	h.Use(query(false))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	get := func(url string) *http.Response {
+		res, err := http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// the cache hits are public
+	if res := get(fmt.Sprintf("/v%d/hit@1.0.0/es2022/hit.js", VERSION)); res.StatusCode != 200 {
+		t.Fatalf("the cached build should be served, got %d", res.StatusCode)
+	}
+
+	id := fmt.Sprintf("v%d/miss@1.0.0/es2022/miss.js", VERSION)
+	res := get("/" + id)
+	if res.StatusCode != 403 || res.Header.Get("X-Esm-Build-Id") != id {
+		t.Fatalf("the unsigned miss should be refused with the build id, got %d %v", res.StatusCode, res.Header)
+	}
+	exp := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	if res := get(fmt.Sprintf("/%s?sig=%s&exp=%s", id, signBuildID("secret", id, exp), exp)); res.StatusCode != 403 {
+		t.Fatalf("the expired signature should be refused, got %d", res.StatusCode)
+	}
+	if res := get(fmt.Sprintf("/%s?sig=%s", id, signBuildID("other", id, ""))); res.StatusCode != 403 {
+		t.Fatalf("the invalid signature should be refused, got %d", res.StatusCode)
+	}
+	if res := get(fmt.Sprintf("/%s?sig=%s", id, signBuildID("secret", id, ""))); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("the signed miss should trigger the build, got %d", res.StatusCode)
+	}
+
+	// the unsigned miss of the split manifest is refused with the split id
+	res = get("/foo@1.0.0?entry-points=a.js,b.js&target=es2022")
+	if res.StatusCode != 403 || !strings.HasPrefix(res.Header.Get("X-Esm-Build-Id"), fmt.Sprintf("split:v%d/foo@1.0.0/es2022/_split-", VERSION)) {
+		t.Fatalf("the unsigned split build should be refused with the split id, got %d %v", res.StatusCode, res.Header)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/gox/utils"
+)
+
+// the maximum number of the `?entry-points`
+const maxSplitEntries = 16
+
+// A SplitManifest maps the entry points of a multi-entry build to their output URLs,
+// the shared chunks are emitted once.
+type SplitManifest struct {
+	Entries map[string]string `json:"entries"`
+	Chunks  []string          `json:"chunks"`
+}
+
+// A SplitTask builds the entry points of the package together with the code splitting,
+// all the dependencies are bundled so they are shared by the chunks.
+type SplitTask struct {
+	BuildVersion int
+	Pkg          Pkg
+	Entries      []string // sorted
+	Target       string
+	DevMode      bool
+}
+
+// parseEntryPoints parses the `?entry-points` query to the sorted relative paths of the package
+func parseEntryPoints(value string) (entries []string, err error) {
+	set := newStringSet()
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cleaned := strings.TrimPrefix(utils.CleanPath(entry), "/")
+		if cleaned == "" || strings.Contains(entry, "..") {
+			err = fmt.Errorf("invalid entry point '%s'", entry)
+			return
+		}
+		set.Add(cleaned)
+	}
+	if set.Size() == 0 {
+		err = fmt.Errorf("missing entry points")
+		return
+	}
+	if set.Size() > maxSplitEntries {
+		err = fmt.Errorf("too many entry points, the maximum is %d", maxSplitEntries)
+		return
+	}
+	entries = set.Values()
+	sort.Strings(entries)
+	return
+}
+
+// Hash returns the key derived from the sorted entry set and the build options
+func (task *SplitTask) Hash() string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%v\n", task.Pkg, task.Target, task.DevMode)
+	for _, entry := range task.Entries {
+		h.Write([]byte(entry + "\n"))
+	}
+	return strings.ToLower(hex.EncodeToString(h.Sum(nil))[:10])
+}
+
+// BaseDir returns the directory of the outputs, like `v87/foo@1.0.0/es2022/_split-{hash}`
+func (task *SplitTask) BaseDir() string {
+	return fmt.Sprintf("v%d/%s@%s/%s/_split-%s", task.BuildVersion, task.Pkg.Name, task.Pkg.Version, task.Target, task.Hash())
+}
+
+// ID returns the db id of the manifest, it's the key of the signed builds too
+func (task *SplitTask) ID() string {
+	return "split:" + task.BaseDir()
+}
+
+// findManifest returns the stored manifest of the task, or `storage.ErrNotFound`
+func (task *SplitTask) findManifest() (manifest *SplitManifest, err error) {
+	store, _, err := db.Get(task.ID())
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(store["manifest"]), &manifest)
+	return
+}
+
+// newSplitBuildTask wraps the split task into the build task of the build queue, so the split
+// builds are limited by the build concurrency and the high-water mark too.
+func newSplitBuildTask(split *SplitTask) *BuildTask {
+	return &BuildTask{
+		BuildVersion: split.BuildVersion,
+		Pkg:          split.Pkg,
+		Target:       split.Target,
+		DevMode:      split.DevMode,
+		BundleMode:   true,
+		id:           split.ID(),
+		split:        split,
+		stage:        "init",
+	}
+}
+
+// WithOrigin returns the manifest with the full URLs
+func (m *SplitManifest) WithOrigin(origin string) *SplitManifest {
+	ret := &SplitManifest{Entries: map[string]string{}, Chunks: make([]string, len(m.Chunks))}
+	for entry, url := range m.Entries {
+		ret.Entries[entry] = origin + url
+	}
+	for i, url := range m.Chunks {
+		ret.Chunks[i] = origin + url
+	}
+	return ret
+}
+
+// Build installs the package and builds the entry points, the outputs are stored in the `builds` storage.
+func (task *SplitTask) Build() (manifest *SplitManifest, err error) {
+	id := task.ID()
+	manifest, err = task.findManifest()
+	if err == nil {
+		return
+	}
+	if err != storage.ErrNotFound {
+		log.Warnf("db: %v", err)
+	}
+
+	err = sidecarFlight.Do(id, func() error {
+		wd, err := os.MkdirTemp("", "esm-split-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(wd)
+		err = yarnAdd(wd, fmt.Sprintf("%s@%s", task.Pkg.Name, task.Pkg.Version))
+		if err != nil {
+			return err
+		}
+		outputs, m, err := task.build(wd)
+		if err != nil {
+			return err
+		}
+		for name, data := range outputs {
+			err = fs.WriteData(path.Join("builds", task.BaseDir(), name), data)
+			if err != nil {
+				return err
+			}
+		}
+		return db.Put(id, "split", storage.Store{"manifest": string(utils.MustEncodeJSON(m))})
+	})
+	if err != nil {
+		return
+	}
+	return task.findManifest()
+}
+
+// build runs the esbuild with the entry points in the wd that the package is installed,
+// the URLs of the manifest are server-absolute.
+func (task *SplitTask) build(wd string) (outputs map[string][]byte, manifest *SplitManifest, err error) {
+	pkgDir := path.Join(wd, "node_modules", task.Pkg.Name)
+	entryPoints := make([]api.EntryPoint, len(task.Entries))
+	for i, entry := range task.Entries {
+		if !fileExists(path.Join(pkgDir, entry)) {
+			err = &BuildError{ErrNoEntry, fmt.Sprintf("entry point '%s' not found in %s", entry, task.Pkg)}
+			return
+		}
+		entryPoints[i] = api.EntryPoint{
+			InputPath:  path.Join(pkgDir, entry),
+			OutputPath: strings.TrimSuffix(entry, path.Ext(entry)),
+		}
+	}
+
+	nodeEnv := "production"
+	if task.DevMode {
+		nodeEnv = "development"
+	}
+	builtinsPlugin := api.Plugin{
+		Name: "esm.sh-split-builtins",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(
+				api.OnResolveOptions{Filter: ".*"},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					name := strings.TrimPrefix(args.Path, "node:")
+					if !builtInNodeModules[name] {
+						return api.OnResolveResult{}, nil
+					}
+					if task.Target == "node" {
+						return api.OnResolveResult{Path: name, External: true}, nil
+					}
+					if embedFS != nil {
+						if _, err := embedFS.ReadFile(fmt.Sprintf("server/embed/polyfills/node_%s.js", name)); err == nil {
+							return api.OnResolveResult{Path: fmt.Sprintf("%s/v%d/node_%s.js", basePath, task.BuildVersion, name), External: true}, nil
+						}
+					}
+					return api.OnResolveResult{
+						Path:     fmt.Sprintf("%s/error.js?type=unsupported-nodejs-builtin-module&name=%s&importer=%s", basePath, name, task.Pkg.Name),
+						External: true,
+					}, nil
+				},
+			)
+		},
+	}
+	minify := !task.DevMode
+	result := api.Build(api.BuildOptions{
+		EntryPointsAdvanced: entryPoints,
+		AbsWorkingDir:       wd,
+		Outdir:              "/esbuild",
+		Write:               false,
+		Bundle:              true,
+		Splitting:           true,
+		Format:              api.FormatESModule,
+		Target:              targets[task.Target],
+		Platform:            api.PlatformBrowser,
+		MinifyWhitespace:    minify,
+		MinifyIdentifiers:   minify,
+		MinifySyntax:        minify,
+		ChunkNames:          "chunk-[hash]",
+		Define: map[string]string{
+			"process.env.NODE_ENV": fmt.Sprintf(`"%s"`, nodeEnv),
+			"global":               "globalThis",
+		},
+		Plugins: []api.Plugin{builtinsPlugin},
+	})
+	if len(result.Errors) > 0 {
+		err = fmt.Errorf("esbuild: %s", result.Errors[0].Text)
+		return
+	}
+
+	baseURL := fmt.Sprintf("%s/%s", basePath, task.BaseDir())
+	outputs = map[string][]byte{}
+	manifest = &SplitManifest{Entries: map[string]string{}, Chunks: []string{}}
+	entryNames := map[string]string{}
+	for _, entry := range task.Entries {
+		entryNames[strings.TrimSuffix(entry, path.Ext(entry))+".js"] = entry
+	}
+	for _, file := range result.OutputFiles {
+		name := strings.TrimPrefix(file.Path, "/esbuild/")
+		outputs[name] = file.Contents
+		if entry, ok := entryNames[name]; ok {
+			manifest.Entries[entry] = baseURL + "/" + name
+		} else if strings.HasSuffix(name, ".js") {
+			manifest.Chunks = append(manifest.Chunks, baseURL+"/"+name)
+		}
+	}
+	sort.Strings(manifest.Chunks)
+	return
+}
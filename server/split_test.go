@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseEntryPoints(t *testing.T) {
+	entries, err := parseEntryPoints("./b.js, a.js,/a.js,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(entries, ",") != "a.js,b.js" {
+		t.Fatalf("unexpected entry points %v", entries)
+	}
+	for _, value := range []string{"", ",", "../foo.js", "lib/../../foo.js"} {
+		if _, err := parseEntryPoints(value); err == nil {
+			t.Fatalf("'%s' should be invalid", value)
+		}
+	}
+	many := make([]string, maxSplitEntries+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("entry%d.js", i)
+	}
+	if _, err := parseEntryPoints(strings.Join(many, ",")); err == nil {
+		t.Fatal("too many entry points should be invalid")
+	}
+}
+
+func TestSplitBuild(t *testing.T) {
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0"}`,
+		"a.js":         `import { shared } from "./shared.js"; export const a = shared("a");`,
+		"lib/b.js":     `import { shared } from "../shared.js"; export const b = shared("b");`,
+		"shared.js":    `import bar from "bar"; export function shared(s) { return bar + s; }`,
+	})
+	writeFixture(t, wd, "bar", map[string]string{
+		"package.json": `{"name":"bar","version":"1.0.0","main":"index.js"}`,
+		"index.js":     `export default "bar:";`,
+	})
+
+	task := &SplitTask{
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "foo", Version: "1.0.0"},
+		Entries:      []string{"a.js", "lib/b.js"},
+		Target:       "es2022",
+	}
+	outputs, manifest, err := task.build(wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL := fmt.Sprintf("%s/v%d/foo@1.0.0/es2022/_split-%s/", basePath, VERSION, task.Hash())
+	if manifest.Entries["a.js"] != baseURL+"a.js" || manifest.Entries["lib/b.js"] != baseURL+"lib/b.js" {
+		t.Fatalf("unexpected entries %v", manifest.Entries)
+	}
+	if len(manifest.Chunks) != 1 || !strings.HasPrefix(manifest.Chunks[0], baseURL+"chunk-") {
+		t.Fatalf("the shared module should be emitted once, got chunks %v", manifest.Chunks)
+	}
+	chunk := string(outputs[strings.TrimPrefix(manifest.Chunks[0], baseURL)])
+	if !strings.Contains(chunk, "bar:") {
+		t.Fatalf("the dependency should be bundled in the shared chunk: %s", chunk)
+	}
+	if strings.Contains(string(outputs["a.js"]), "bar:") {
+		t.Fatal("the entry should import the shared chunk")
+	}
+
+	task.Entries = []string{"a.js", "missing.js"}
+	if _, _, err := task.build(wd); err == nil {
+		t.Fatal("the missing entry point should be rejected")
+	}
+	if hash := task.Hash(); hash == (&SplitTask{Pkg: task.Pkg, Entries: []string{"a.js", "lib/b.js"}, Target: "es2022"}).Hash() {
+		t.Fatal("the hash should be derived from the entry set")
+	}
+}
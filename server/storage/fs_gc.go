@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A GarbageCollector is a FS that can remove the least recently used files on demand.
+type GarbageCollector interface {
+	GC(targetSize int64) (ret GCResult, err error)
+}
+
+// An AccessStatsRecorder is a FS that records the access stats of the files for the gc, the stats
+// can be persisted and restored after the restart.
+type AccessStatsRecorder interface {
+	AccessStats() map[string]AccessStat
+	RestoreAccessStats(stats map[string]AccessStat)
+}
+
+// An AccessStat is the access frequency and recency of a file
+type AccessStat struct {
+	Count      int64     `json:"count"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+type GCResult struct {
+	Size    int64    `json:"size"`
+	Freed   int64    `json:"freed"`
+	Removed []string `json:"removed"`
+}
+
+// accessTracker tracks the last access time and the in-flight reads of the files,
+// the removal of a file is postponed until the in-flight reads are closed.
+type accessTracker struct {
+	lock       sync.Mutex
+	lastAccess map[string]time.Time
+	counts     map[string]int64
+	inflight   map[string]int
+	pending    map[string]func()
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{
+		lastAccess: map[string]time.Time{},
+		counts:     map[string]int64{},
+		inflight:   map[string]int{},
+		pending:    map[string]func(){},
+	}
+}
+
+func (t *accessTracker) open(name string, file io.ReadSeekCloser) io.ReadSeekCloser {
+	t.lock.Lock()
+	t.lastAccess[name] = time.Now()
+	t.counts[name]++
+	t.inflight[name]++
+	t.lock.Unlock()
+	return &trackedFile{ReadSeekCloser: file, name: name, tracker: t}
+}
+
+func (t *accessTracker) close(name string) {
+	t.lock.Lock()
+	t.inflight[name]--
+	var remove func()
+	if t.inflight[name] <= 0 {
+		delete(t.inflight, name)
+		remove = t.pending[name]
+		delete(t.pending, name)
+	}
+	t.lock.Unlock()
+	if remove != nil {
+		remove()
+	}
+}
+
+func (t *accessTracker) isInflight(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.inflight[name] > 0
+}
+
+// remove calls the fn after the in-flight reads of the file are closed
+func (t *accessTracker) remove(name string, fn func()) {
+	t.lock.Lock()
+	delete(t.lastAccess, name)
+	delete(t.counts, name)
+	if t.inflight[name] > 0 {
+		t.pending[name] = fn
+		t.lock.Unlock()
+		return
+	}
+	t.lock.Unlock()
+	fn()
+}
+
+func (t *accessTracker) stats() map[string]AccessStat {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stats := make(map[string]AccessStat, len(t.lastAccess))
+	for name, lastAccess := range t.lastAccess {
+		stats[name] = AccessStat{t.counts[name], lastAccess}
+	}
+	return stats
+}
+
+// restore merges the persisted stats, the counts are added and the later access time wins
+func (t *accessTracker) restore(stats map[string]AccessStat) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for name, stat := range stats {
+		t.counts[name] += stat.Count
+		if a, ok := t.lastAccess[name]; !ok || stat.LastAccess.After(a) {
+			t.lastAccess[name] = stat.LastAccess
+		}
+	}
+}
+
+// gc removes the least recently used files under the root until the total size is not greater than
+// the target size, the files that are being read are skipped.
+func (t *accessTracker) gc(root string, targetSize int64, remove func(name string)) (ret GCResult, err error) {
+	type fileEntry struct {
+		name       string
+		size       int64
+		lastAccess time.Time
+	}
+	var files []fileEntry
+	err = filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		lastAccess := info.ModTime()
+		t.lock.Lock()
+		if a, ok := t.lastAccess[name]; ok {
+			lastAccess = a
+		}
+		t.lock.Unlock()
+		files = append(files, fileEntry{name, info.Size(), lastAccess})
+		ret.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].lastAccess.Before(files[j].lastAccess)
+	})
+	for _, f := range files {
+		if ret.Size <= targetSize {
+			break
+		}
+		if t.isInflight(f.name) {
+			continue
+		}
+		remove(f.name)
+		ret.Size -= f.size
+		ret.Freed += f.size
+		ret.Removed = append(ret.Removed, f.name)
+	}
+	return
+}
+
+type trackedFile struct {
+	io.ReadSeekCloser
+	name    string
+	tracker *accessTracker
+	once    sync.Once
+}
+
+func (f *trackedFile) Close() error {
+	err := f.ReadSeekCloser.Close()
+	f.once.Do(func() { f.tracker.close(f.name) })
+	return err
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLocalFSGC(t *testing.T) {
+	root := t.TempDir()
+	fs, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"builds/a.js", "builds/b.js", "builds/c.js"} {
+		err = fs.WriteData(name, make([]byte, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		modtime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(path.Join(root, name), modtime, modtime)
+	}
+
+	// `a.js` is being read
+	file, err := fs.ReadFile("builds/a.js", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := fs.(GarbageCollector).GC(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Freed != 200 || len(ret.Removed) != 2 || ret.Removed[0] != "builds/b.js" || ret.Removed[1] != "builds/c.js" {
+		t.Fatalf("invalid gc result: %+v", ret)
+	}
+	if found, _, _, _ := fs.Exists("builds/b.js"); found {
+		t.Fatal("b.js should be removed")
+	}
+
+	// the in-flight file is removed after it's closed
+	fs.(*localFSLayer).remove("builds/a.js")
+	if found, _, _, _ := fs.Exists("builds/a.js"); !found {
+		t.Fatal("a.js should not be removed before it's closed")
+	}
+	file.Close()
+	if found, _, _, _ := fs.Exists("builds/a.js"); found {
+		t.Fatal("a.js should be removed after it's closed")
+	}
+}
+
+func TestLocalFSAccessStats(t *testing.T) {
+	fs, err := OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.WriteData("builds/a.js", make([]byte, 100))
+	for i := 0; i < 3; i++ {
+		file, err := fs.ReadFile("builds/a.js", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	stats := fs.(AccessStatsRecorder).AccessStats()
+	if stats["builds/a.js"].Count != 3 || stats["builds/a.js"].LastAccess.IsZero() {
+		t.Fatalf("invalid access stats: %+v", stats)
+	}
+
+	// the persisted stats are merged into the stats after the restart
+	lastAccess := time.Now().Add(time.Hour)
+	fs.(AccessStatsRecorder).RestoreAccessStats(map[string]AccessStat{
+		"builds/a.js": {Count: 10, LastAccess: lastAccess},
+		"builds/b.js": {Count: 1, LastAccess: lastAccess},
+	})
+	stats = fs.(AccessStatsRecorder).AccessStats()
+	if stats["builds/a.js"].Count != 13 || !stats["builds/a.js"].LastAccess.Equal(lastAccess) || stats["builds/b.js"].Count != 1 {
+		t.Fatalf("invalid restored access stats: %+v", stats)
+	}
+
+	// the removed file has no stats
+	fs.(*localFSLayer).remove("builds/a.js")
+	if _, ok := fs.(AccessStatsRecorder).AccessStats()["builds/a.js"]; ok {
+		t.Fatal("the removed file should have no stats")
+	}
+}
@@ -17,11 +17,12 @@ func (driver *localFSDriver) Open(root string, options url.Values) (FS, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &localFSLayer{root}, nil
+	return &localFSLayer{root, newAccessTracker()}, nil
 }
 
 type localFSLayer struct {
-	root string
+	root    string
+	tracker *accessTracker
 }
 
 func (fs *localFSLayer) Exists(name string) (bool, int64, time.Time, error) {
@@ -39,7 +40,11 @@ func (fs *localFSLayer) Exists(name string) (bool, int64, time.Time, error) {
 
 func (fs *localFSLayer) ReadFile(name string, size int64) (file io.ReadSeekCloser, err error) {
 	fullPath := path.Join(fs.root, name)
-	return os.Open(fullPath)
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return
+	}
+	return fs.tracker.open(name, f), nil
 }
 
 func (fs *localFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
@@ -70,6 +75,25 @@ func (fs *localFSLayer) WriteData(name string, data []byte) error {
 	return os.WriteFile(fullPath, data, 0666)
 }
 
+// remove removes the file after the in-flight reads are closed
+func (fs *localFSLayer) remove(name string) {
+	fs.tracker.remove(name, func() {
+		os.Remove(path.Join(fs.root, name))
+	})
+}
+
+func (fs *localFSLayer) GC(targetSize int64) (GCResult, error) {
+	return fs.tracker.gc(fs.root, targetSize, fs.remove)
+}
+
+func (fs *localFSLayer) AccessStats() map[string]AccessStat {
+	return fs.tracker.stats()
+}
+
+func (fs *localFSLayer) RestoreAccessStats(stats map[string]AccessStat) {
+	fs.tracker.restore(stats)
+}
+
 func ensureDir(dir string) (err error) {
 	_, err = os.Stat(dir)
 	if err != nil && os.IsNotExist(err) {
@@ -6,7 +6,6 @@ import (
 	"io"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"time"
 
@@ -25,8 +24,9 @@ func (fs *LocalLRUFS) Open(root string, options url.Values) (FS, error) {
 		return nil, err
 	}
 
+	// the removal is postponed until the in-flight reads are closed
 	remove := func(name string) {
-		go os.Remove(path.Join(root, name))
+		go backingFS.(*localFSLayer).remove(name)
 	}
 
 	cache, err := ristretto.NewCache(&ristretto.Config{
@@ -185,6 +185,22 @@ func (fs *localLRUFSLayer) WriteData(name string, data []byte) (err error) {
 	return
 }
 
+func (fs *localLRUFSLayer) GC(targetSize int64) (GCResult, error) {
+	backingFS := fs.backingFS.(*localFSLayer)
+	return backingFS.tracker.gc(backingFS.root, targetSize, func(name string) {
+		fs.cache.Del(name)
+		backingFS.remove(name)
+	})
+}
+
+func (fs *localLRUFSLayer) AccessStats() map[string]AccessStat {
+	return fs.backingFS.(*localFSLayer).tracker.stats()
+}
+
+func (fs *localLRUFSLayer) RestoreAccessStats(stats map[string]AccessStat) {
+	fs.backingFS.(*localFSLayer).tracker.restore(stats)
+}
+
 func init() {
 	RegisterFS("localLRU", &LocalLRUFS{})
 }
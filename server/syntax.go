@@ -0,0 +1,143 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/esbuild-internal/config"
+	"github.com/ije/esbuild-internal/js_ast"
+	"github.com/ije/esbuild-internal/js_parser"
+	"github.com/ije/esbuild-internal/logger"
+	"github.com/ije/esbuild-internal/test"
+	"github.com/ije/gox/utils"
+)
+
+// the module types of the package files
+const (
+	moduleTypeESM = "esm"
+	moduleTypeCJS = "cjs"
+)
+
+// the namespace of the mislabeled CommonJS files, the paths of the namespace don't end with `.mjs`,
+// so esbuild detects the module type by the syntax instead of the extension or the `type` field.
+const mislabeledCJSNamespace = "esm.sh-cjs"
+
+// probeModuleSyntax returns the module type by the syntax of the file: the `import`/`export`
+// statements mean `esm` and the `require`/`module.exports` mean `cjs`, it returns an empty
+// string if the file has neither or fails to be parsed.
+func probeModuleSyntax(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug)
+	// the `module` and `exports` are tracked in the bundle mode only
+	options := js_parser.OptionsFromConfig(&config.Options{Mode: config.ModeBundle})
+	ast, pass := js_parser.Parse(log, test.SourceForTest(string(data)), options)
+	if !pass {
+		return ""
+	}
+	switch ast.ExportsKind {
+	case js_ast.ExportsESM, js_ast.ExportsESMWithDynamicFallback:
+		return moduleTypeESM
+	case js_ast.ExportsCommonJS:
+		return moduleTypeCJS
+	}
+	return ""
+}
+
+// declaredModuleType returns the module type declared by the extension of the file or
+// the `type` field of the nearest package.json, like node does.
+func declaredModuleType(filename string) string {
+	switch path.Ext(filename) {
+	case ".mjs":
+		return moduleTypeESM
+	case ".cjs":
+		return moduleTypeCJS
+	}
+	for dir := path.Dir(filename); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		packageFile := path.Join(dir, "package.json")
+		if fileExists(packageFile) {
+			var p NpmPackage
+			if utils.ParseJSONFile(packageFile, &p) == nil && p.Type == "module" {
+				return moduleTypeESM
+			}
+			return moduleTypeCJS
+		}
+	}
+	return moduleTypeCJS
+}
+
+// checkModuleSyntax returns the actual module type of the file if it mismatches the declared one
+func checkModuleSyntax(filename string) (actual string, mismatch bool) {
+	actual = probeModuleSyntax(filename)
+	mismatch = actual != "" && actual != declaredModuleType(filename)
+	return
+}
+
+// resolveModuleFile resolves the file of the module path in node's way
+func resolveModuleFile(modulePath string) (filename string, ok bool) {
+	for _, f := range []string{modulePath, modulePath + ".js", modulePath + ".mjs", modulePath + ".cjs", path.Join(modulePath, "index.js")} {
+		if fileExists(f) {
+			return f, true
+		}
+	}
+	return
+}
+
+// syntaxPlugin loads the CommonJS files that are labeled as ES modules(like CJS in `.mjs`) by the
+// syntax, the ES modules in `.js` of a CommonJS package are handled by esbuild already.
+// It runs after the resolver plugin, so only the bundled modules are checked.
+func (task *BuildTask) syntaxPlugin(cjsEntry string, assetWarnings *stringSet) api.Plugin {
+	return api.Plugin{
+		Name: "esm.sh-syntax",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(
+				api.OnResolveOptions{Filter: ".*"},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					var modulePath string
+					if args.Kind == api.ResolveEntryPoint || strings.HasPrefix(args.Path, "/") {
+						modulePath = args.Path
+					} else if strings.HasPrefix(args.Path, "./") || strings.HasPrefix(args.Path, "../") {
+						modulePath = path.Join(args.ResolveDir, args.Path)
+					} else if cjsEntry != "" && args.Path == task.Pkg.ImportPath() {
+						modulePath = cjsEntry
+					} else {
+						return api.OnResolveResult{}, nil
+					}
+					filename, ok := resolveModuleFile(modulePath)
+					if !ok {
+						return api.OnResolveResult{}, nil
+					}
+					// probe the syntax of the declared ES modules only, to avoid parsing every file twice
+					if declaredModuleType(filename) == moduleTypeESM && probeModuleSyntax(filename) == moduleTypeCJS {
+						log.Warnf("'%s' of %s is labeled as an ES module but uses the CommonJS syntax", strings.TrimPrefix(filename, task.wd+"/node_modules/"), task.Pkg)
+						return api.OnResolveResult{Path: filename + "?cjs", Namespace: mislabeledCJSNamespace}, nil
+					}
+					return api.OnResolveResult{}, nil
+				},
+			)
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: mislabeledCJSNamespace},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					filename := strings.TrimSuffix(args.Path, "?cjs")
+					data, err := ioutil.ReadFile(filename)
+					if err != nil {
+						return api.OnLoadResult{}, err
+					}
+					code := string(data)
+					if task.Assets != "keep" && strings.Contains(code, "import.meta.url") {
+						code = task.rewriteAssetURLs(code, filename, assetWarnings)
+					}
+					loader := api.LoaderJS
+					if strings.HasSuffix(filename, ".jsx") {
+						loader = api.LoaderJSX
+					}
+					return api.OnLoadResult{Contents: &code, Loader: loader, ResolveDir: path.Dir(filename)}, nil
+				},
+			)
+		},
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/evanw/esbuild/pkg/api"
+	logx "github.com/ije/gox/log"
+)
+
+func TestCheckModuleSyntax(t *testing.T) {
+	wd := t.TempDir()
+	writeFixture(t, wd, "mislabeled", map[string]string{
+		"package.json":        `{"name":"mislabeled","version":"1.0.0"}`,
+		"esm.js":              `export const foo = "bar"`,
+		"cjs.mjs":             `module.exports = { foo: "bar" }`,
+		"cjs.js":              `exports.foo = "bar"`,
+		"empty.js":            `console.log("foo")`,
+		"module/package.json": `{"type":"module"}`,
+		"module/cjs.js":       `module.exports = { foo: "bar" }`,
+		"module/legacy.cjs":   `export default "bar"`,
+	})
+	dir := path.Join(wd, "node_modules/mislabeled")
+	for name, expected := range map[string][2]string{
+		"esm.js":            {moduleTypeESM, "mismatch"},
+		"cjs.mjs":           {moduleTypeCJS, "mismatch"},
+		"cjs.js":            {moduleTypeCJS, ""},
+		"empty.js":          {"", ""},
+		"module/cjs.js":     {moduleTypeCJS, "mismatch"},
+		"module/legacy.cjs": {moduleTypeESM, "mismatch"},
+	} {
+		actual, mismatch := checkModuleSyntax(path.Join(dir, name))
+		if actual != expected[0] || mismatch != (expected[1] == "mismatch") {
+			t.Fatalf("checkModuleSyntax(%s) should be (%s, %v), got (%s, %v)", name, expected[0], expected[1] == "mismatch", actual, mismatch)
+		}
+	}
+}
+
+func TestInitMislabeledModule(t *testing.T) {
+	if log == nil {
+		log = &logx.Logger{}
+	}
+	wd := t.TempDir()
+
+	// the ES module syntax in `.js` without the `type: module`
+	writeFixture(t, wd, "esm-in-js", map[string]string{
+		"package.json": `{"name":"esm-in-js","version":"1.0.0","main":"index.js"}`,
+		"index.js":     `export default function foo() {}`,
+	})
+	esm, npm, err := initModule(wd, Pkg{Name: "esm-in-js", Version: "1.0.0"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esm.CJS || npm.Module != "index.js" || !esm.ExportDefault {
+		t.Fatalf("the main should be treated as an ES module, got module '%s'", npm.Module)
+	}
+}
+
+func TestSyntaxPlugin(t *testing.T) {
+	if log == nil {
+		log = &logx.Logger{}
+	}
+	wd := t.TempDir()
+
+	// the CommonJS syntax in `.mjs` and in `.js` of a `type: module` package
+	writeFixture(t, wd, "cjs-in-mjs", map[string]string{
+		"package.json": `{"name":"cjs-in-mjs","version":"1.0.0","type":"module","main":"index.mjs"}`,
+		"index.mjs":    `const util = require("./util.js"); module.exports = { foo: util.foo };`,
+		"util.js":      `exports.foo = "bar";`,
+	})
+	task := &BuildTask{wd: wd, Pkg: Pkg{Name: "cjs-in-mjs", Version: "1.0.0"}, Assets: "keep", External: newStringSet()}
+	result := api.Build(api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents:   `import $default from "cjs-in-mjs"; export default $default;`,
+			ResolveDir: wd,
+			Sourcefile: "mod.js",
+		},
+		Bundle:  true,
+		Format:  api.FormatESModule,
+		Target:  api.ESNext,
+		Write:   false,
+		Plugins: []api.Plugin{task.syntaxPlugin(path.Join(wd, "node_modules/cjs-in-mjs/index.mjs"), newStringSet())},
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors[0].Text)
+	}
+	code := string(result.OutputFiles[0].Contents)
+	if strings.Count(code, "__commonJS(") < 1 || !strings.Contains(code, "module.exports = { foo: util.foo }") || !strings.Contains(code, `exports.foo = "bar"`) {
+		t.Fatalf("the mislabeled files should be wrapped as CommonJS: %s", code)
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// A TagRefresher keeps the resolved versions of the tag (or semver range) URLs that are served in
+// place, and re-checks the npm registry periodically for the tags that are actively requested.
+//
+// A tag is fresh within the interval since its last check. The stale tags within the
+// stale-while-revalidate window are served immediately and revalidated in background, the
+// tags beyond the window are revalidated before serving. The failed revalidations are retried
+// with the exponential backoff, the pinned version is kept in the meantime.
+type TagRefresher struct {
+	lock     sync.RWMutex
+	interval time.Duration
+	swr      time.Duration
+	entries  map[string]*tagEntry
+	flight   *FlightGroup
+	slots    chan struct{}
+}
+
+// the max templates of a tag, the other builds of the tag are built on demand after the tag moves
+const maxTagTemplates = 16
+
+// the max backoff of the failed revalidations
+const maxTagBackoff = time.Hour
+
+type tagEntry struct {
+	name       string
+	tag        string
+	version    string
+	lastAccess time.Time
+	checked    time.Time
+	failures   int
+	retryAt    time.Time
+	tasks      map[string]*BuildTask // the templates of the tag builds, keyed by the build id
+}
+
+func newTagRefresher(interval time.Duration, swr time.Duration, concurrency int) *TagRefresher {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &TagRefresher{
+		interval: interval,
+		swr:      swr,
+		entries:  map[string]*tagEntry{},
+		flight:   newFlightGroup(),
+		slots:    make(chan struct{}, concurrency),
+	}
+}
+
+// Get returns the pinned version of the tag, or an empty string if the tag is not tracked.
+func (r *TagRefresher) Get(name string, tag string) string {
+	r.lock.Lock()
+	e, ok := r.entries[name+"@"+tag]
+	if !ok {
+		r.lock.Unlock()
+		return ""
+	}
+	e.lastAccess = time.Now()
+	age := time.Since(e.checked)
+	version := e.version
+	r.lock.Unlock()
+
+	if r.interval <= 0 || r.swr <= 0 || age <= r.interval {
+		return version
+	}
+	if age <= r.interval+r.swr {
+		go r.revalidate(e)
+		return version
+	}
+
+	// too stale to be served, wait for the revalidation
+	r.revalidate(e)
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return e.version
+}
+
+// CacheControl returns the `Cache-Control` header of the tag URLs that are served in place
+func (r *TagRefresher) CacheControl() string {
+	maxAge := 10 * 60
+	if r.interval > 0 {
+		maxAge = int(r.interval.Seconds())
+	}
+	if r.swr > 0 {
+		return fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", maxAge, int(r.swr.Seconds()))
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAge)
+}
+
+// Track records the build task of a tag request, the tasks of the tag are used as the templates to
+// rebuild the artifacts when the tag moves.
+func (r *TagRefresher) Track(tag string, task *BuildTask) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := task.Pkg.Name + "@" + tag
+	e, ok := r.entries[key]
+	if !ok {
+		e = &tagEntry{
+			name:    task.Pkg.Name,
+			tag:     tag,
+			version: task.Pkg.Version,
+			checked: time.Now(),
+			tasks:   map[string]*BuildTask{},
+		}
+		r.entries[key] = e
+	}
+	e.lastAccess = time.Now()
+	if id := task.ID(); e.tasks[id] != nil || len(e.tasks) < maxTagTemplates {
+		e.tasks[id] = task
+	}
+}
+
+func (r *TagRefresher) refresh() {
+	r.lock.Lock()
+	entries := []*tagEntry{}
+	for key, e := range r.entries {
+		// only refresh the tags that are actively requested
+		if time.Since(e.lastAccess) > 2*r.interval {
+			delete(r.entries, key)
+			continue
+		}
+		if len(e.tasks) > 0 {
+			entries = append(entries, e)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, e := range entries {
+		go r.revalidate(e)
+	}
+}
+
+// revalidate re-checks the tag against the npm registry and rebuilds the artifact if the tag moved,
+// the concurrent revalidations of the same tag are collapsed and bounded by the worker slots.
+func (r *TagRefresher) revalidate(e *tagEntry) {
+	r.flight.Do(e.name+"@"+e.tag, func() error {
+		r.slots <- struct{}{}
+		defer func() { <-r.slots }()
+		r.refreshEntry(e)
+		return nil
+	})
+}
+
+func (r *TagRefresher) refreshEntry(e *tagEntry) {
+	r.lock.RLock()
+	checked := e.checked
+	retryAt := e.retryAt
+	templates := make([]*BuildTask, 0, len(e.tasks))
+	for _, task := range e.tasks {
+		templates = append(templates, task)
+	}
+	r.lock.RUnlock()
+	// the tag is just revalidated by the collapsed call, or backing off from the failures
+	if len(templates) == 0 || (r.interval > 0 && time.Since(checked) < r.interval/2) || time.Now().Before(retryAt) {
+		return
+	}
+
+	// the cached package info is kept until the latest dist tag is fetched
+	registry := templates[0].registry
+	info, err := refetchPackageInfo(registry, e.name, e.tag)
+	if err != nil {
+		r.backoff(e, err)
+		return
+	}
+
+	r.lock.Lock()
+	version := e.version
+	if info.Version == version {
+		e.checked = time.Now()
+		e.failures = 0
+	}
+	r.lock.Unlock()
+	if info.Version == version {
+		return
+	}
+
+	tasks := map[string]*BuildTask{}
+	for _, template := range templates {
+		task := *template
+		task.id = ""
+		task.wd = ""
+		task.stage = "init"
+		task.Pkg.Version = info.Version
+		c := buildQueue.Add(&task, "tag-refresher")
+		output := <-c.C
+		if output.err != nil {
+			log.Warnf("refresh tag %s@%s: %v", e.name, e.tag, output.err)
+			continue
+		}
+		tasks[task.ID()] = &task
+	}
+	if len(tasks) == 0 {
+		r.backoff(e, fmt.Errorf("no build of %s@%s", e.name, info.Version))
+		return
+	}
+
+	// swap the version after the new artifacts are built, the failed builds are built on demand
+	r.lock.Lock()
+	e.version = info.Version
+	e.checked = time.Now()
+	e.failures = 0
+	e.tasks = tasks
+	r.lock.Unlock()
+	log.Infof("tag %s@%s moved: %s -> %s", e.name, e.tag, version, info.Version)
+}
+
+// backoff delays the next revalidation of the failed tag exponentially
+func (r *TagRefresher) backoff(e *tagEntry, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e.failures++
+	delay := r.interval
+	if delay <= 0 {
+		delay = time.Minute
+	}
+	for i := 1; i < e.failures && delay < maxTagBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxTagBackoff {
+		delay = maxTagBackoff
+	}
+	e.retryAt = time.Now().Add(delay)
+	log.Warnf("refresh tag %s@%s: %v, retry in %v", e.name, e.tag, err, delay)
+}
+
+// getPkgTag returns the tag(or semver range) of the package path, like `/react@next/jsx-runtime` -> `next`,
+// the `latest` tag is returned if the path has no version.
+func getPkgTag(pathname string, pkgName string) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(pathname, "/"), pkgName)
+	if strings.HasPrefix(rest, "@") {
+		tag, _ := utils.SplitByFirstByte(rest[1:], '/')
+		if tag != "" {
+			return tag
+		}
+	}
+	return "latest"
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+func TestTagStaleWhileRevalidate(t *testing.T) {
+	r := newTagRefresher(10*time.Minute, time.Hour, 2)
+	if cc := r.CacheControl(); cc != "public, max-age=600, stale-while-revalidate=3600" {
+		t.Fatalf("unexpected cache-control: %s", cc)
+	}
+	e := &tagEntry{name: "foo", tag: "latest", version: "1.0.0", checked: time.Now()}
+	r.entries["foo@latest"] = e
+
+	// the fresh tag is served without revalidation
+	if v := r.Get("foo", "latest"); v != "1.0.0" || r.flight.Executed() != 0 {
+		t.Fatalf("unexpected fresh tag: %s, %d revalidations", v, r.flight.Executed())
+	}
+
+	// the stale tag is served immediately and revalidated in background
+	r.lock.Lock()
+	e.checked = time.Now().Add(-20 * time.Minute)
+	r.lock.Unlock()
+	if v := r.Get("foo", "latest"); v != "1.0.0" {
+		t.Fatalf("the stale version should be served, got %s", v)
+	}
+	for i := 0; i < 100 && r.flight.Executed() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.flight.Executed() != 1 {
+		t.Fatalf("the stale tag should be revalidated once, got %d", r.flight.Executed())
+	}
+
+	// the tag beyond the window is revalidated before serving
+	r.lock.Lock()
+	e.checked = time.Now().Add(-2 * time.Hour)
+	r.lock.Unlock()
+	r.Get("foo", "latest")
+	if r.flight.Executed() != 2 {
+		t.Fatalf("the expired tag should be revalidated synchronously, got %d", r.flight.Executed())
+	}
+
+	if cc := newTagRefresher(5*time.Minute, 0, 1).CacheControl(); cc != "public, max-age=300" {
+		t.Fatalf("unexpected cache-control without swr: %s", cc)
+	}
+}
+
+func TestTagRevalidateBackoff(t *testing.T) {
+	var calls int
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(502)
+	}))
+	defer registry.Close()
+
+	var err error
+	defer func(c storage.Cache) { cache = c }(cache)
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d storage.DB) { db = d }(db)
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(n *Node) { node = n }(node)
+	node = &Node{npmRegistry: registry.URL + "/"}
+	err = db.Put("npm:foo@latest", "npm", storage.Store{"info": `{"name":"foo","version":"1.0.0"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTagRefresher(10*time.Minute, time.Hour, 1)
+	for _, target := range []string{"es2020", "es2022"} {
+		r.Track("latest", &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: target, External: newStringSet()})
+	}
+	e := r.entries["foo@latest"]
+	if len(e.tasks) != 2 {
+		t.Fatalf("the templates of the tag should be tracked, got %d", len(e.tasks))
+	}
+	e.checked = time.Now().Add(-2 * time.Hour)
+
+	// the failed revalidation keeps the version and the db record, and backs off
+	r.refreshEntry(e)
+	if calls != 1 || e.failures != 1 || !e.retryAt.After(time.Now()) || e.version != "1.0.0" {
+		t.Fatalf("the failed revalidation should back off, got %d calls, %d failures", calls, e.failures)
+	}
+	if _, _, err := db.Get("npm:foo@latest"); err != nil {
+		t.Fatalf("the db record should be kept: %v", err)
+	}
+	r.refreshEntry(e)
+	if calls != 1 {
+		t.Fatalf("the revalidation should not be retried before the backoff, got %d calls", calls)
+	}
+
+	e.retryAt = time.Time{}
+	r.refreshEntry(e)
+	if calls != 2 || e.failures != 2 || time.Until(e.retryAt) < 15*time.Minute {
+		t.Fatalf("the backoff should grow, got %d calls, %d failures, retry in %v", calls, e.failures, time.Until(e.retryAt))
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// the dist-tags lookups of the `?tag` query are cached briefly since the tags move
+const distTagsTTL = time.Minute
+
+// dist-tag names like `next`, `canary` or `beta-2`
+var regexpDistTag = regexp.MustCompile(`^[a-zA-Z][\w.\-]*$`)
+
+// An UnknownTagError is returned when the dist-tag is not defined by the package
+type UnknownTagError struct {
+	Name string
+	Tag  string
+	Tags []string // the available tags
+}
+
+func (e *UnknownTagError) Error() string {
+	return fmt.Sprintf("npm: tag '%s' of package '%s' not found, available tags: %s", e.Tag, e.Name, strings.Join(e.Tags, ", "))
+}
+
+func newUnknownTagError(name string, tag string, distTags map[string]string) *UnknownTagError {
+	tags := make([]string, 0, len(distTags))
+	for t := range distTags {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return &UnknownTagError{name, tag, tags}
+}
+
+// getDistTags returns the dist-tags of the package from the registry, empty means the default registry
+func getDistTags(registry string, name string) (distTags map[string]string, err error) {
+	if registry == "" {
+		registry = node.npmRegistry
+	}
+	id := "dist-tags:" + name
+	if registry != node.npmRegistry {
+		id = "dist-tags:" + registry + name
+	}
+	data, err := cache.Get(id)
+	if err == nil && json.Unmarshal(data, &distTags) == nil {
+		return
+	}
+
+	// the scoped package name is escaped like `@scope%2fname`
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s-/package/%s/dist-tags", registry, strings.Replace(name, "/", "%2f", 1)), nil)
+	if err != nil {
+		return
+	}
+	resp, err := fetchRegistry(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 || resp.StatusCode == 401 {
+		err = fmt.Errorf("npm: package '%s' not found", name)
+		return
+	}
+	if resp.StatusCode != 200 {
+		ret, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("npm: can't get dist-tags of package '%s' (%s: %s)", name, resp.Status, string(ret))
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&distTags)
+	if err != nil {
+		return
+	}
+	cache.Set(id, utils.MustEncodeJSON(distTags), distTagsTTL)
+	return
+}
+
+// resolveDistTag returns the exact version of the dist-tag
+func resolveDistTag(registry string, name string, tag string) (version string, err error) {
+	distTags, err := getDistTags(registry, name)
+	if err != nil {
+		return
+	}
+	version, ok := distTags[tag]
+	if !ok {
+		err = newUnknownTagError(name, tag, distTags)
+	}
+	return
+}
+
+// splitPkgPath splits the package path like `/@scope/name@version/submodule` to the package
+// name, the version(empty if the path has no explicit version) and the rest path.
+func splitPkgPath(pathname string) (name string, version string, rest string) {
+	a := strings.SplitN(strings.TrimPrefix(pathname, "/"), "/", 3)
+	n := 1
+	if strings.HasPrefix(a[0], "@") && len(a) > 1 {
+		n = 2
+	}
+	name, version = utils.SplitByLastByte(a[n-1], '@')
+	if name == "" {
+		name, version = a[n-1], ""
+	}
+	if n == 2 {
+		name = a[0] + "/" + name
+	}
+	if len(a) > n {
+		rest = "/" + strings.Join(a[n:], "/")
+	}
+	return
+}
+
+// removeRawQuery removes the key from the raw query, the order of other queries is kept
+func removeRawQuery(rawQuery string, key string) string {
+	parts := []string{}
+	for _, p := range strings.Split(rawQuery, "&") {
+		k, _ := utils.SplitByFirstByte(p, '=')
+		if p != "" && k != key {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"esm.sh/server/storage"
+)
+
+func TestSplitPkgPath(t *testing.T) {
+	for pathname, expected := range map[string][3]string{
+		"/react":                      {"react", "", ""},
+		"/react/jsx-runtime":          {"react", "", "/jsx-runtime"},
+		"/react@18.2.0/jsx-runtime":   {"react", "18.2.0", "/jsx-runtime"},
+		"/@emotion/react":             {"@emotion/react", "", ""},
+		"/@emotion/react@next/a/b.js": {"@emotion/react", "next", "/a/b.js"},
+	} {
+		name, version, rest := splitPkgPath(pathname)
+		if name != expected[0] || version != expected[1] || rest != expected[2] {
+			t.Fatalf("splitPkgPath(%s) should be %v, got [%s %s %s]", pathname, expected, name, version, rest)
+		}
+	}
+	if q := removeRawQuery("bundle&tag=next&target=es2020", "tag"); q != "bundle&target=es2020" {
+		t.Fatalf("unexpected query %s", q)
+	}
+}
+
+func TestDistTags(t *testing.T) {
+	defer func(d storage.DB, c storage.Cache) {
+		db, cache = d, c
+	}(db, cache)
+	var calls int
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.EscapedPath() {
+		case "/-/package/@scope%2ffoo/dist-tags":
+			fmt.Fprint(w, `{"latest":"1.0.0","next":"2.0.0-beta.1","canary":"2.0.0-canary.3"}`)
+		case "/@scope/foo", "/@scope%2ffoo":
+			fmt.Fprint(w, `{"dist-tags":{"latest":"1.0.0","next":"2.0.0-beta.1"},"versions":{"1.0.0":{"name":"@scope/foo","version":"1.0.0"},"2.0.0-beta.1":{"name":"@scope/foo","version":"2.0.0-beta.1"}}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer registry.Close()
+
+	var err error
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	prevNode := node
+	defer func() { node = prevNode }()
+	node = &Node{npmRegistry: registry.URL + "/"}
+
+	version, err := resolveDistTag("", "@scope/foo", "canary")
+	if err != nil || version != "2.0.0-canary.3" {
+		t.Fatalf("unexpected version of the canary tag: %s %v", version, err)
+	}
+	// the dist-tags are cached
+	version, err = resolveDistTag("", "@scope/foo", "next")
+	if err != nil || version != "2.0.0-beta.1" || calls != 1 {
+		t.Fatalf("unexpected version of the next tag: %s %v, %d calls", version, err, calls)
+	}
+	_, err = resolveDistTag("", "@scope/foo", "rc")
+	var tagErr *UnknownTagError
+	if !errors.As(err, &tagErr) || err.Error() != "npm: tag 'rc' of package '@scope/foo' not found, available tags: canary, latest, next" {
+		t.Fatalf("unexpected error of the unknown tag: %v", err)
+	}
+
+	// the path form
+	info, err := fetchPackageInfo("@scope/foo", "next")
+	if err != nil || info.Version != "2.0.0-beta.1" {
+		t.Fatalf("unexpected version of the next tag: %s %v", info.Version, err)
+	}
+	_, err = fetchPackageInfo("@scope/foo", "rc")
+	if !errors.As(err, &tagErr) || len(tagErr.Tags) != 2 {
+		t.Fatalf("unexpected error of the unknown tag: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the `typesVersions` ranges are matched for the latest TypeScript if the `?ts-version` query is not specified,
+// only the ranges without the upper bound(like `>=4.7` or `*`) match it.
+var latestTypeScript = semver.MustParse("999.0.0")
+
+// TypesVersions defines the `typesVersions` of package.json in the declared order, the first
+// range that matches the TypeScript version is used.
+type TypesVersions []TypesVersionsEntry
+
+// TypesVersionsEntry maps the path patterns to the substitutions for a TypeScript version range
+type TypesVersionsEntry struct {
+	Range string
+	Paths map[string][]string
+}
+
+// DtsVersion is the types path of a `typesVersions` range
+type DtsVersion struct {
+	Range string `json:"r"`
+	Dts   string `json:"t"`
+}
+
+// UnmarshalJSON keeps the order of the ranges since the object keys are ordered in `typesVersions`
+func (tv *TypesVersions) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		// ignore the invalid `typesVersions`
+		*tv = nil
+		return nil
+	}
+	entries := TypesVersions{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := t.(string)
+		var paths map[string][]string
+		if dec.Decode(&paths) != nil {
+			continue
+		}
+		entries = append(entries, TypesVersionsEntry{Range: key, Paths: paths})
+	}
+	*tv = entries
+	return nil
+}
+
+// MarshalJSON encodes the ranges as an ordered object
+func (tv TypesVersions) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBufferString("{")
+	for i, e := range tv {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.Range)
+		paths, err := json.Marshal(e.Paths)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(paths)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// resolve maps the types path by the path patterns, the exact pattern or the wildcard pattern
+// with the longest prefix wins.
+func (e *TypesVersionsEntry) resolve(types string) (string, bool) {
+	types = strings.TrimPrefix(path.Clean(types), "./")
+	substitution := ""
+	wildcard := ""
+	prefixLen := -1
+	for pattern, substitutions := range e.Paths {
+		if len(substitutions) == 0 {
+			continue
+		}
+		pattern = strings.TrimPrefix(pattern, "./")
+		if pattern == types {
+			substitution = substitutions[0]
+			wildcard = ""
+			break
+		}
+		prefix, suffix, ok := cutWildcard(pattern)
+		if ok && len(prefix) > prefixLen && len(types) >= len(prefix)+len(suffix) && strings.HasPrefix(types, prefix) && strings.HasSuffix(types, suffix) {
+			substitution = substitutions[0]
+			wildcard = types[len(prefix) : len(types)-len(suffix)]
+			prefixLen = len(prefix)
+		}
+	}
+	if substitution == "" {
+		return "", false
+	}
+	resolved := strings.Replace(substitution, "*", wildcard, 1)
+	return strings.TrimPrefix(path.Clean(resolved), "./"), true
+}
+
+func cutWildcard(pattern string) (prefix string, suffix string, ok bool) {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return
+	}
+	return pattern[:i], pattern[i+1:], true
+}
+
+// parseTSVersion parses the `?ts-version` query like `5.0` or `4.7.4`
+func parseTSVersion(value string) (*semver.Version, error) {
+	if value == "" {
+		return nil, nil
+	}
+	v, err := semver.NewVersion(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ts-version '%s'", value)
+	}
+	return v, nil
+}
+
+// matchTypesVersion returns the first range of the dts versions that matches the TypeScript version
+func matchTypesVersion(ranges []string, tsVersion *semver.Version) int {
+	if tsVersion == nil {
+		tsVersion = latestTypeScript
+	}
+	for i, r := range ranges {
+		c, err := semver.NewConstraint(r)
+		if err == nil && c.Check(tsVersion) {
+			return i
+		}
+	}
+	return -1
+}
+
+// getDts returns the types path for the TypeScript version, falls back to the default types
+// if there is no matching `typesVersions` range.
+func (esm *ModuleMeta) getDts(tsVersion *semver.Version) string {
+	if len(esm.DtsVersions) > 0 {
+		ranges := make([]string, len(esm.DtsVersions))
+		for i, v := range esm.DtsVersions {
+			ranges[i] = v.Range
+		}
+		if i := matchTypesVersion(ranges, tsVersion); i >= 0 {
+			if dts := esm.DtsVersions[i].Dts; dts != "" {
+				return dts
+			}
+			return esm.Dts
+		}
+	}
+	return esm.Dts
+}
+
+// toDtsVersions maps the types path(like `foo@1.0.0/index.d.ts`) of the package by the `typesVersions`,
+// the ranges that don't map the types path keep the default types.
+func toDtsVersions(wd string, p *NpmPackage, dts string, head string) []DtsVersion {
+	if len(p.TypesVersions) == 0 || !strings.HasPrefix(dts, head) {
+		return nil
+	}
+	types := strings.TrimPrefix(dts, head)
+	pkgDir := path.Join(wd, "node_modules", p.Name)
+	versions := make([]DtsVersion, len(p.TypesVersions))
+	for i, e := range p.TypesVersions {
+		versions[i].Range = e.Range
+		resolved, ok := e.resolve(types)
+		if !ok || resolved == types {
+			continue
+		}
+		if dirExists(pkgDir) && !fileExists(path.Join(pkgDir, resolved)) {
+			// the mapping like `"*": ["ts3.4/*"]` may point to a directory index
+			if fileExists(path.Join(pkgDir, strings.TrimSuffix(resolved, ".d.ts"), "index.d.ts")) {
+				resolved = path.Join(strings.TrimSuffix(resolved, ".d.ts"), "index.d.ts")
+			} else {
+				continue
+			}
+		}
+		versions[i].Dts = head + resolved
+	}
+	return versions
+}
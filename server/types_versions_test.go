@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTypesVersions(t *testing.T) {
+	wd := t.TempDir()
+	writeFixture(t, wd, "foo", map[string]string{
+		"package.json": `{
+			"name": "foo",
+			"version": "1.0.0",
+			"types": "index.d.ts",
+			"typesVersions": {
+				">=5.0": { "*": ["ts5.0/*"] },
+				">=4.7": { "index.d.ts": ["ts4.7/index.d.ts"], "lib/*": ["ts4.7/lib/*"] },
+				">=3.1 <4.0": { "*": ["ts3.1/*"] },
+				"<3.1": { "*": ["missing/*"] }
+			}
+		}`,
+		"index.d.ts":       `export declare const foo: string;`,
+		"ts5.0/index.d.ts": `export declare const foo: "5.0";`,
+		"ts4.7/index.d.ts": `export declare const foo: "4.7";`,
+		"ts3.1/index.d.ts": `export declare const foo: "3.1";`,
+	})
+
+	_, npm, err := initModule(wd, Pkg{Name: "foo", Version: "1.0.0"}, "es2022", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(npm.TypesVersions) != 4 || npm.TypesVersions[0].Range != ">=5.0" || npm.TypesVersions[3].Range != "<3.1" {
+		t.Fatalf("the order of the typesVersions should be kept, got %v", npm.TypesVersions)
+	}
+	data, err := json.Marshal(npm.TypesVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tv TypesVersions
+	if json.Unmarshal(data, &tv) != nil || len(tv) != 4 || tv[1].Range != ">=4.7" {
+		t.Fatalf("unexpected typesVersions round trip: %s", data)
+	}
+
+	dts := toTypesPath(wd, npm, "", "", "")
+	esm := &ModuleMeta{Dts: "/v87/" + dts}
+	for _, v := range toDtsVersions(wd, npm, dts, "foo@1.0.0/") {
+		if v.Dts != "" {
+			v.Dts = "/v87/" + v.Dts
+		}
+		esm.DtsVersions = append(esm.DtsVersions, v)
+	}
+
+	for tsVersion, expected := range map[string]string{
+		"":      "/v87/foo@1.0.0/ts5.0/index.d.ts",
+		"5.1":   "/v87/foo@1.0.0/ts5.0/index.d.ts",
+		"4.9.5": "/v87/foo@1.0.0/ts4.7/index.d.ts",
+		"3.4":   "/v87/foo@1.0.0/ts3.1/index.d.ts",
+		"4.2":   "/v87/foo@1.0.0/index.d.ts", // no matching range
+		"3.0":   "/v87/foo@1.0.0/index.d.ts", // the mapped types don't exist
+	} {
+		v, err := parseTSVersion(tsVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dts := esm.getDts(v); dts != expected {
+			t.Fatalf("the types of ts-version '%s' should be '%s', got '%s'", tsVersion, expected, dts)
+		}
+	}
+
+	if _, err := parseTSVersion("next"); err == nil {
+		t.Fatal("'next' should be an invalid ts-version")
+	}
+}
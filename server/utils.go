@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"regexp"
@@ -268,13 +269,23 @@ func encodeResolveArgsPrefix(alias map[string]string, deps PkgSlice, external *s
 	return ""
 }
 
-func getOrigin(host string) string {
+// getOrigin returns the origin of the rewritten URLs, the forwarded origin of the trusted proxies
+// takes precedence over the `-origin` flag, then the request host.
+func getOrigin(r *http.Request) string {
+	if forwarded, ok := forwardedOrigin(r); ok {
+		return forwarded
+	}
 	if origin != "" {
 		return strings.TrimSuffix(origin, "/")
 	}
+	host := r.Host
 	proto := "https"
 	if host == "localhost" || strings.HasPrefix(host, "localhost:") {
 		proto = "http"
 	}
 	return fmt.Sprintf("%s://%s", proto, host)
 }
+
+func isValidDepsPolicy(policy string) bool {
+	return policy == "exact" || policy == "range" || policy == "graph"
+}